@@ -0,0 +1,86 @@
+package main
+
+import (
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Alert modes for incoming messages
+const (
+    alertOff    = "off"
+    alertBell   = "bell"   // terminal bell
+    alertVisual = "visual" // flash the screen instead of beeping
+)
+
+var alertModes = []string{alertOff, alertBell, alertVisual}
+
+var (
+    alertMode         = alertOff
+    alertMentionsOnly bool
+)
+
+// alertFor rings the bell for an incoming message if alerts are on and, with
+// alertMentionsOnly, the message mentions us.
+func alertFor(text string) {
+    if alertMode == alertOff {
+        return
+    }
+    if alertMentionsOnly && len(findMentions(text, ownName())) == 0 {
+        return
+    }
+    display.Alert(alertMode == alertVisual)
+}
+
+// findMentions returns the byte ranges in text where name appears as a
+// whole word, ignoring case.
+func findMentions(text, name string) [][2]int {
+    if name == "" {
+        return nil
+    }
+    var found [][2]int
+    length := utf8.RuneCountInString(name)
+    for start := 0; start < len(text); {
+        end := start
+        for n := 0; n < length && end < len(text); n++ {
+            _, size := utf8.DecodeRuneInString(text[end:])
+            end += size
+        }
+        if strings.EqualFold(text[start:end], name) && wordBoundaryBefore(text, start) && wordBoundaryAfter(text, end) {
+            found = append(found, [2]int{start, end})
+            start = end
+            continue
+        }
+        _, size := utf8.DecodeRuneInString(text[start:])
+        start += size
+    }
+    return found
+}
+
+func wordBoundaryBefore(text string, i int) bool {
+    r, _ := utf8.DecodeLastRuneInString(text[:i])
+    return i == 0 || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func wordBoundaryAfter(text string, i int) bool {
+    r, _ := utf8.DecodeRuneInString(text[i:])
+    return i == len(text) || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// highlightMentions wraps each mention of ownName in on and off, after
+// passing the rest of the text through escape.
+func highlightMentions(text, on, off string, escape func(string) string) string {
+    mentions := findMentions(text, ownName())
+    if len(mentions) == 0 {
+        return escape(text)
+    }
+    var b strings.Builder
+    last := 0
+    for _, m := range mentions {
+        b.WriteString(escape(text[last:m[0]]))
+        b.WriteString(on + escape(text[m[0]:m[1]]) + off)
+        last = m[1]
+    }
+    b.WriteString(escape(text[last:]))
+    return b.String()
+}
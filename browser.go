@@ -0,0 +1,82 @@
+package main
+
+import (
+    "encoding/json"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// browserCompat sends offers, answers and candidates the way browsers
+// exchange them: the full RTCSessionDescriptionInit ({"type","sdp"}) and
+// RTCIceCandidateInit ({"candidate","sdpMid","sdpMLineIndex"}) objects
+// rather than bare strings. A browser's addIceCandidate rejects a candidate
+// without sdpMid or sdpMLineIndex. Either form is accepted when receiving,
+// but older clients only understand the strings, so it's off by default.
+var browserCompat bool
+
+// descriptionField is an offer or answer SDP, sent as either the bare SDP or
+// an RTCSessionDescriptionInit.
+type descriptionField string
+
+func (d *descriptionField) UnmarshalJSON(data []byte) error {
+    if len(data) > 0 && data[0] == '{' {
+        var desc webrtc.SessionDescription
+        if err := json.Unmarshal(data, &desc); err != nil {
+            return err
+        }
+        *d = descriptionField(desc.SDP)
+        return nil
+    }
+    var sdp string
+    if err := json.Unmarshal(data, &sdp); err != nil {
+        return err
+    }
+    *d = descriptionField(sdp)
+    return nil
+}
+
+// candidateField is an ICE candidate, sent as either the bare candidate line
+// or an RTCIceCandidateInit. A browser signals the end of its candidates with
+// an empty candidate, which is left empty here.
+type candidateField webrtc.ICECandidateInit
+
+func (c *candidateField) UnmarshalJSON(data []byte) error {
+    if len(data) > 0 && data[0] == '{' {
+        var init webrtc.ICECandidateInit
+        if err := json.Unmarshal(data, &init); err != nil {
+            return err
+        }
+        *c = candidateField(init)
+        return nil
+    }
+    var candidate string
+    if err := json.Unmarshal(data, &candidate); err != nil {
+        return err
+    }
+    *c = candidateField{Candidate: candidate}
+    return nil
+}
+
+// MarshalJSON keeps the string form, so requests built from a
+// SignalingMessage look the same to the server as before.
+func (c candidateField) MarshalJSON() ([]byte, error) {
+    return json.Marshal(c.Candidate)
+}
+
+// descriptionPayload is what goes in an offer or answer message.
+func descriptionPayload(desc webrtc.SessionDescription) interface{} {
+    if browserCompat {
+        return desc
+    }
+    return desc.SDP
+}
+
+// candidatePayload is what goes in a candidate message.
+func candidatePayload(candidate *webrtc.ICECandidate) interface{} {
+    init := candidate.ToJSON()
+    init.Candidate = rankCandidate(init.Candidate)
+    if browserCompat {
+        return init
+    }
+    return init.Candidate
+}
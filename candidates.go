@@ -0,0 +1,100 @@
+package main
+
+import (
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// preferIPv6 ranks IPv6 candidate pairs above IPv4 ones (ice.ipv6 "prefer").
+var preferIPv6 bool
+
+// preferIPv6HostWait is how long host pairs wait to be nominated when
+// preferring IPv6, so a slightly slower IPv6 pair still wins.
+const preferIPv6HostWait = 500 * time.Millisecond
+
+// ipv4Demotion lowers an IPv4 candidate's local preference by one step,
+// enough to lose ties with IPv6 candidates of the same type without
+// overtaking candidates of a better type.
+const ipv4Demotion = 1 << 8
+
+// rankCandidate applies the address family preference to a candidate line
+// ("candidate:<foundation> <component> <protocol> <priority> <address> ..."),
+// both for our candidates before they are sent and for the peer's when they
+// arrive, so pairs rank the same whichever side is controlling. pion has no
+// address family preference of its own.
+func rankCandidate(candidate string) string {
+    if !preferIPv6 {
+        return candidate
+    }
+    fields := strings.Fields(candidate)
+    if len(fields) < 5 {
+        return candidate
+    }
+    ip := net.ParseIP(fields[4])
+    if ip == nil || ip.To4() == nil {
+        return candidate
+    }
+    priority, err := strconv.ParseUint(fields[3], 10, 32)
+    if err != nil || priority < ipv4Demotion {
+        return candidate
+    }
+    fields[3] = strconv.FormatUint(priority-ipv4Demotion, 10)
+    return strings.Join(fields, " ")
+}
+
+// candidateQueue holds our ICE candidates until the offer or answer they
+// belong to has gone out, so the peer never gets a candidate before the
+// description. Gathering starts inside SetLocalDescription, before the
+// description is sent, so LocalDescription() being set isn't enough. An ICE
+// restart gathers afresh, so each new description holds them again.
+type candidateQueue struct {
+    conn     Signaler
+    clientID string
+
+    mu       sync.Mutex
+    targetID string // empty while candidates are held
+    pending  []*webrtc.ICECandidate
+}
+
+func newCandidateQueue(conn Signaler, clientID string) *candidateQueue {
+    return &candidateQueue{conn: conn, clientID: clientID}
+}
+
+// Add sends candidate now if a description has been sent, otherwise queues
+// it for Flush.
+func (q *candidateQueue) Add(candidate *webrtc.ICECandidate) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.targetID == "" {
+        log.Println("ICE candidate 追加")
+        q.pending = append(q.pending, candidate)
+        return
+    }
+    sendICECandidate(q.conn, candidate, q.targetID, q.clientID)
+}
+
+// Hold queues candidates again until the next Flush, for a description
+// about to be made.
+func (q *candidateQueue) Hold() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.targetID = ""
+}
+
+// Flush is called once a description has been sent to targetID: queued
+// candidates follow it in gathering order, and later ones go out directly.
+func (q *candidateQueue) Flush(targetID string) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.targetID = targetID
+    for _, candidate := range q.pending {
+        sendICECandidate(q.conn, candidate, q.targetID, q.clientID)
+    }
+    q.pending = nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "sync"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// Data channels the peer opens are routed by label. Chat registers its own
+// "chat", "file" and "control" channels; anything built on this client can
+// open purpose-specific channels of its own and register a handler for the
+// peer's side with Chat.HandleChannel, without touching OnDataChannel.
+// Channels with a label nobody registered are logged and ignored.
+
+// ChannelHandler sets up a data channel the peer opened, usually by
+// installing its OnMessage handler. It runs before the channel opens, after
+// the default OnOpen and OnClose handlers, which only log, are installed.
+type ChannelHandler func(dc *webrtc.DataChannel)
+
+// channelRegistry maps data channel labels to their handlers.
+type channelRegistry struct {
+    mu       sync.RWMutex
+    handlers map[string]ChannelHandler
+}
+
+// Handle routes channels labelled label to handler, replacing any handler
+// registered for it before.
+func (r *channelRegistry) Handle(label string, handler ChannelHandler) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.handlers == nil {
+        r.handlers = map[string]ChannelHandler{}
+    }
+    r.handlers[label] = handler
+}
+
+// lookup returns the handler for label, or nil if there is none.
+func (r *channelRegistry) lookup(label string) ChannelHandler {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.handlers[label]
+}
+
+// messageHandler is a ChannelHandler for channels that only need their
+// messages handled.
+func messageHandler(onMessage func(webrtc.DataChannelMessage)) ChannelHandler {
+    return func(dc *webrtc.DataChannel) {
+        dc.OnMessage(onMessage)
+    }
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+    "unicode/utf8"
+
+    "github.com/pion/webrtc/v3"
+)
+
+const (
+    // Sends block while more than maxBufferedAmount bytes are queued on the
+    // data channel, so large transfers don't balloon memory.
+    maxBufferedAmount          = 1024 * 1024
+    bufferedAmountLowThreshold = 256 * 1024
+
+    // How long the outbox waits for the peer's join, which says how to
+    // encode for them, before going out anyway
+    outboxJoinWait = 5 * time.Second
+)
+
+// Transport is a message channel to the peer as Chat uses it. A
+// *webrtc.DataChannel is the real thing; tests use in-memory fakes.
+type Transport interface {
+    Send(data []byte) error
+    ReadyState() webrtc.DataChannelState
+    BufferedAmount() uint64
+    SetBufferedAmountLowThreshold(threshold uint64)
+    OnBufferedAmountLow(f func())
+    // MaxRetransmits and MaxPacketLifeTime are nil unless the channel may
+    // drop messages
+    MaxRetransmits() *uint16
+    MaxPacketLifeTime() *uint16
+    Close() error
+}
+
+// Chat owns the user-facing side of the data channel: it wraps what the user
+// typed in envelopes, routes the peer's envelopes by type and applies E2E
+// encryption when enabled.
+type Chat struct {
+    dataChannel    Transport
+    fileChannel    Transport   // carries file envelopes only
+    controlChannel Transport   // carries control messages only
+    e2e            *E2ESession // nil when E2E is disabled
+    files          *FileTransfers
+    history        *History // nil when history is disabled
+    clientID       string
+    name           string
+    // where the conversation is shown; the global display unless main
+    // gives each conversation its own
+    display Display
+
+    mu       sync.Mutex
+    peerID   string
+    peerName string
+    peerLeft bool
+    // features both joins listed; empty for older peers
+    peerFeatures []string
+    // the peer protocol version agreed on in the joins
+    peerVersion int
+    // the client and platform the peer said it runs
+    peerClient   string
+    peerPlatform string
+    lastRecv     []byte
+    recent       recentMessages
+    // opened is set once the chat channel is open and the outbox sent;
+    // until then messages wait in the outbox
+    opened   bool
+    ready    chan struct{} // closed when opened is set
+    outbox   [][]byte
+    joined   chan struct{} // closed on the peer's first join
+    joinOnce sync.Once
+
+    bufferLow     chan struct{}
+    fileBufferLow chan struct{}
+
+    sendLimit *tokenBucket // nil when sends aren't rate limited
+    pipe      *pipeStream  // non-nil in -pipe mode
+
+    middleware pipeline
+    channels   channelRegistry
+
+    fragmentID atomic.Uint32
+    reassembly *reassembler
+
+    sendSeq    atomic.Uint64
+    reorder    *reorderBuffer
+    retransmit *retransmitter
+    // whether the peer's chat channel may drop messages, so they resend
+    // what we don't acknowledge
+    peerUnreliable atomic.Bool
+
+    pinger       *Pinger
+    pingInterval time.Duration
+    controlDone  chan struct{} // closed when the control channel closes
+
+    keepaliveInterval time.Duration
+    lastSentAt        atomic.Int64 // Unix nanoseconds
+    lastRecvAt        atomic.Int64
+    onPeerDead        func() // called when the peer stops sending keepalives
+    onPeerBack        func() // and when it starts again
+    onPeerJoined      func(id, name string)
+    onPeerRenamed     func(name string)
+    // called when the peer speaks no protocol version we do
+    onIncompatible func(err error)
+    incompatible   atomic.Bool
+}
+
+func newChat(dataChannel, fileChannel, controlChannel Transport, e2e *E2ESession, history *History, clientID string, config Config) *Chat {
+    c := &Chat{
+        dataChannel:    dataChannel,
+        fileChannel:    fileChannel,
+        controlChannel: controlChannel,
+        e2e:            e2e,
+        history:        history,
+        clientID:       clientID,
+        name:           config.Name,
+        display:        display,
+        bufferLow:      watchBufferedAmount(dataChannel),
+        fileBufferLow:  watchBufferedAmount(fileChannel),
+        reassembly:     newReassembler(),
+        pingInterval:   time.Duration(config.PingInterval),
+        controlDone:    make(chan struct{}),
+        joined:         make(chan struct{}),
+        ready:          make(chan struct{}),
+
+        keepaliveInterval: time.Duration(config.KeepaliveInterval),
+    }
+    if config.MaxSendRate > 0 {
+        c.sendLimit = newTokenBucket(config.MaxSendRate)
+    }
+    c.reorder = newReorderBuffer(c.routeEnvelope, func(count uint64) {
+        c.display.Printf("[chat] %d message(s) from %s were lost in transit\n", count, displayName(c.PeerName()))
+    }, c.gapTimeout)
+    c.retransmit = newRetransmitter(func(frame []byte) error {
+        return c.sendData(c.dataChannel, c.bufferLow, frame)
+    })
+    c.middleware.Use(compressionMiddleware{peerSupports: c.peerSupports})
+    // "chat" and "file" both carry envelopes and share a handler; "control"
+    // carries control messages
+    c.channels.Handle("chat", func(dc *webrtc.DataChannel) {
+        c.peerUnreliable.Store(isUnreliable(dc))
+        dc.OnMessage(c.handleMessage)
+    })
+    c.channels.Handle("file", messageHandler(c.handleMessage))
+    c.channels.Handle("control", messageHandler(c.handleControlMessage))
+    c.pinger = newPinger(clientID, c.sendControl)
+    c.files = newFileTransfers(config.DownloadDir, func(frame []byte) error {
+        return c.sendEnvelope(newEnvelope(envelopeFile, c.clientID, frame))
+    })
+    return c
+}
+
+// watchBufferedAmount returns a channel that is signalled whenever dc's send
+// buffer drains below bufferedAmountLowThreshold.
+func watchBufferedAmount(dc Transport) chan struct{} {
+    low := make(chan struct{}, 1)
+    dc.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+    dc.OnBufferedAmountLow(func() {
+        select {
+        case low <- struct{}{}:
+        default:
+        }
+    })
+    return low
+}
+
+func (c *Chat) Send(data []byte) error {
+    c.mu.Lock()
+    if !c.opened {
+        c.outbox = append(c.outbox, data)
+        c.mu.Unlock()
+        c.display.Printf("[outbox] not connected yet, the message will be sent once the peer is\n")
+        return nil
+    }
+    c.mu.Unlock()
+    return c.send(data)
+}
+
+// Queue puts data in the outbox without a notice, for messages restored
+// from an earlier run.
+func (c *Chat) Queue(data []byte) {
+    c.mu.Lock()
+    c.outbox = append(c.outbox, data)
+    c.mu.Unlock()
+}
+
+// Connected reports whether the data channel is open, so Send goes out
+// straight away rather than to the outbox.
+func (c *Chat) Connected() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.opened
+}
+
+// Unsent returns the messages still in the outbox.
+func (c *Chat) Unsent() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    unsent := make([]string, len(c.outbox))
+    for i, data := range c.outbox {
+        unsent[i] = string(data)
+    }
+    return unsent
+}
+
+// flushOutbox sends the outbox in order once the peer has joined, then
+// lets Send go straight out. Messages typed meanwhile join the end of the
+// outbox.
+func (c *Chat) flushOutbox() {
+    select {
+    case <-c.joined:
+    case <-time.After(outboxJoinWait):
+        log.Println("No join from peer, sending the outbox anyway")
+    }
+    if c.incompatible.Load() {
+        return
+    }
+    for {
+        c.mu.Lock()
+        if len(c.outbox) == 0 {
+            if !c.opened {
+                close(c.ready)
+            }
+            c.opened = true
+            c.mu.Unlock()
+            return
+        }
+        data := c.outbox[0]
+        c.outbox = c.outbox[1:]
+        c.mu.Unlock()
+
+        if err := c.send(data); err != nil {
+            log.Println("メッセージ送信エラー: ", err)
+        }
+    }
+}
+
+func (c *Chat) send(data []byte) error {
+    typ := envelopeText
+    if isBinaryData(data) {
+        typ = envelopeBinary
+    }
+    env := newEnvelope(typ, c.clientID, data)
+    if err := c.sendEnvelope(env); err != nil {
+        return err
+    }
+    c.display.PrintSent(env.ID, data, env.Time())
+    c.recent.add(env.ID, true, data)
+    c.record(env, directionOut)
+    return nil
+}
+
+// record saves a chat message to the history store, if there is one.
+func (c *Chat) record(env *Envelope, direction string) {
+    if c.history == nil {
+        return
+    }
+
+    c.mu.Lock()
+    entry := HistoryEntry{
+        ID:         env.ID,
+        PeerID:     c.peerID,
+        SenderID:   env.Sender,
+        SenderName: c.name,
+        Direction:  direction,
+        Type:       env.Type,
+        Body:       env.Payload,
+        SentAt:     env.Time(),
+    }
+    if direction == directionIn {
+        entry.SenderName = c.peerName
+    }
+    c.mu.Unlock()
+
+    if err := c.history.Record(entry); err != nil {
+        log.Println("履歴保存エラー: ", err)
+    }
+}
+
+func (c *Chat) SendFile(path string) error {
+    if err := c.requireFeature(featureFiles, "file transfer"); err != nil {
+        return err
+    }
+    return c.files.SendFile(path)
+}
+
+// UnpackDirectory extracts the oldest directory the peer sent.
+func (c *Chat) UnpackDirectory() error {
+    return c.files.Unpack()
+}
+
+// DiscardDirectory deletes the oldest directory the peer sent unopened.
+func (c *Chat) DiscardDirectory() error {
+    return c.files.Discard()
+}
+
+func (c *Chat) SendVoice(path string) error {
+    if err := c.requireFeature(featureFiles, "voice messages"); err != nil {
+        return err
+    }
+    return c.files.SendVoice(path)
+}
+
+// LastVoice returns the path of the peer's latest voice message, or "".
+func (c *Chat) LastVoice() string {
+    return c.files.LastVoice()
+}
+
+// sendControl sends m on the control channel. Control messages are small,
+// so they skip fragmentation and backpressure.
+func (c *Chat) sendControl(m *ControlMessage) error {
+    data, err := encodeControl(m)
+    if err != nil {
+        return err
+    }
+    if c.e2e != nil {
+        <-c.e2e.Ready()
+        data, err = c.e2e.Seal(data)
+        if err != nil {
+            return err
+        }
+    }
+    c.markSent()
+    return c.controlChannel.Send(data)
+}
+
+func (c *Chat) sendEnvelope(env *Envelope) error {
+    if env.Type != envelopeFile && env.Seq == 0 {
+        env.Seq = c.sendSeq.Add(1)
+    }
+    env, err := c.middleware.outbound(env)
+    if env == nil || err != nil {
+        return err
+    }
+    data, err := c.encodeEnvelope(env)
+    if err != nil {
+        return err
+    }
+
+    dc, bufferLow := c.dataChannel, c.bufferLow
+    if env.Type == envelopeFile {
+        // Bulk transfers get their own channel so they don't hold up chat
+        dc, bufferLow = c.fileChannel, c.fileBufferLow
+    } else if c.resending() {
+        c.retransmit.track(env.Seq, data)
+    }
+    return c.sendData(dc, bufferLow, data)
+}
+
+// sendData seals an encoded envelope if E2E is on and sends it on dc in
+// fragments.
+func (c *Chat) sendData(dc Transport, bufferLow chan struct{}, data []byte) error {
+    var err error
+    if c.e2e != nil {
+        <-c.e2e.Ready()
+        data, err = c.e2e.Seal(data)
+        if err != nil {
+            return err
+        }
+    }
+
+    fragments, err := fragmentFrame(c.fragmentID.Add(1), data)
+    if err != nil {
+        return err
+    }
+    for _, fragment := range fragments {
+        if err := c.sendFrame(dc, bufferLow, fragment); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// sendRaw sends data on the chat channel as is, for -pipe mode.
+func (c *Chat) sendRaw(data []byte) error {
+    return c.sendFrame(c.dataChannel, c.bufferLow, data)
+}
+
+// sendFrame sends one data channel message, waiting for the send buffer to
+// drain and for the rate limit first.
+func (c *Chat) sendFrame(dc Transport, bufferLow chan struct{}, frame []byte) error {
+    for dc.BufferedAmount() > maxBufferedAmount {
+        select {
+        case <-bufferLow:
+        case <-time.After(100 * time.Millisecond):
+        }
+    }
+    if c.sendLimit != nil {
+        c.sendLimit.Wait(len(frame))
+    }
+    c.markSent()
+    return dc.Send(frame)
+}
+
+func (c *Chat) handleOpen() {
+    log.Println("DataChannel opened")
+    if c.pipe != nil {
+        go c.pipe.run(c.sendRaw)
+        return
+    }
+    if c.e2e != nil {
+        if err := c.dataChannel.Send(c.e2e.KeyFrame()); err != nil {
+            log.Println("E2E鍵送信エラー: ", err)
+        }
+    }
+    // With E2E the outbox has to wait for the key exchange
+    go c.flushOutbox()
+}
+
+func (c *Chat) handleControlOpen() {
+    log.Println("Control channel opened")
+
+    // With E2E the join has to wait for the key exchange, so don't hold up
+    // the data channel's event goroutine
+    go func() {
+        join := newControlMessage(controlJoin, c.clientID)
+        c.mu.Lock()
+        join.Name = c.name
+        c.mu.Unlock()
+        join.Version = peerProtocolVersion
+        join.MinVersion = minPeerProtocolVersion
+        join.Features = c.localFeatures()
+        join.Client = clientVersion()
+        join.Platform = clientPlatform()
+        if err := c.sendControl(join); err != nil {
+            log.Println("参加通知送信エラー: ", err)
+        }
+    }()
+
+    if c.pingInterval > 0 {
+        go c.pinger.Run(c.pingInterval, c.controlDone)
+    }
+    if c.keepaliveInterval > 0 {
+        go c.runKeepalive(c.keepaliveInterval, c.controlDone)
+    }
+}
+
+func (c *Chat) handleControlClose() {
+    log.Println("Control channel closed")
+    close(c.controlDone)
+}
+
+// Ping measures the round-trip time to the peer over the control channel.
+func (c *Chat) Ping() (time.Duration, error) {
+    return c.pinger.Ping()
+}
+
+// Leave tells the peer we are going away, so they see a leave notice even
+// though the connection is torn down right after.
+func (c *Chat) Leave() {
+    if c.controlChannel.ReadyState() != webrtc.DataChannelStateOpen {
+        return
+    }
+    if err := c.sendControl(newControlMessage(controlLeave, c.clientID)); err != nil {
+        log.Println("退出通知送信エラー: ", err)
+    }
+}
+
+// handlePeerGone announces that the peer left if they didn't say so already.
+func (c *Chat) handlePeerGone() {
+    if c.pipe != nil {
+        c.pipe.finish()
+    }
+    c.mu.Lock()
+    announced := c.peerLeft
+    c.peerLeft = true
+    c.mu.Unlock()
+
+    c.retransmit.stop()
+
+    if !announced {
+        c.display.Printf("* %s left\n", displayName(c.PeerName()))
+    }
+}
+
+// restorePeer names the peer before they join, when resuming a session.
+func (c *Chat) restorePeer(id, name string) {
+    c.mu.Lock()
+    c.peerID = id
+    c.peerName = name
+    c.mu.Unlock()
+}
+
+// PeerLeft reports whether the peer said goodbye or was given up on.
+func (c *Chat) PeerLeft() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.peerLeft
+}
+
+// resending reports whether our chat envelopes need acknowledging: the
+// chat channel may drop them and the peer acknowledges.
+func (c *Chat) resending() bool {
+    return isUnreliable(c.dataChannel) && c.peerSupports(featureAck)
+}
+
+// acking reports whether the peer resends chat envelopes we don't
+// acknowledge.
+func (c *Chat) acking() bool {
+    return c.peerUnreliable.Load() && c.peerSupports(featureAck)
+}
+
+// gapTimeout is how long the reorder buffer waits for a missing envelope.
+func (c *Chat) gapTimeout() time.Duration {
+    if c.acking() {
+        return retransmitGiveUp
+    }
+    return reorderTimeout
+}
+
+func (c *Chat) sendAck(seq uint64) {
+    ack := newControlMessage(controlAck, c.clientID)
+    ack.Seq = seq
+    if err := c.sendControl(ack); err != nil {
+        log.Println("ACK送信エラー: ", err)
+    }
+}
+
+// handleControlMessage handles a frame from the peer's control channel.
+func (c *Chat) handleControlMessage(msg webrtc.DataChannelMessage) {
+    c.markReceived()
+    data := msg.Data
+    if c.e2e != nil {
+        if msg.IsString {
+            log.Println("Dropping unencrypted message received in E2E mode")
+            return
+        }
+        select {
+        case <-c.e2e.Ready():
+        case <-time.After(controlKeyTimeout):
+            log.Println("Dropping control message: no E2E key from peer")
+            return
+        }
+        var err error
+        data, err = c.e2e.Open(data)
+        if err != nil {
+            log.Println("E2E復号エラー: ", err)
+            return
+        }
+    }
+
+    m, err := decodeControl(data)
+    if err != nil {
+        log.Println("制御メッセージ解析エラー: ", err)
+        return
+    }
+    c.handleControl(m)
+}
+
+func (c *Chat) handleControl(m *ControlMessage) {
+    switch m.Type {
+    case controlJoin:
+        version, err := negotiateVersion(m)
+        if err != nil {
+            c.refuseIncompatible(m, err)
+            return
+        }
+        name := m.Name
+        c.mu.Lock()
+        c.peerID = m.From
+        c.peerName = name
+        theirs := m.Features
+        if m.Version == 0 {
+            theirs = append(append([]string(nil), theirs...), legacyFeatures...)
+        }
+        c.peerFeatures = sharedFeatures(c.localFeatures(), theirs)
+        c.peerVersion = version
+        c.peerClient = m.Client
+        c.peerPlatform = m.Platform
+        c.peerLeft = false
+        c.mu.Unlock()
+        c.joinOnce.Do(func() { close(c.joined) })
+        name = c.PeerName()
+        c.display.Printf("* %s joined\n", displayName(name))
+        c.display.SetStatus("peer name", displayName(name))
+        if c.onPeerJoined != nil {
+            c.onPeerJoined(m.From, m.Name)
+        }
+        go c.SyncHistory()
+    case controlLeave:
+        c.handlePeerGone()
+    case controlPing:
+        c.pinger.handlePing(m)
+    case controlPong:
+        c.pinger.handlePong(m)
+    case controlAck:
+        c.retransmit.ack(m.Seq)
+    case controlKeepalive:
+        // Arriving was all it had to do
+    case controlSync:
+        go c.handleSync(m)
+    case controlNick:
+        c.handleNick(m)
+    default:
+        log.Printf("Unknown control message: %s\n", m.Type)
+    }
+}
+
+// refuseIncompatible ends the conversation with a peer whose join says it
+// speaks no protocol version we do. Nothing is sent to them but a leave.
+func (c *Chat) refuseIncompatible(join *ControlMessage, err error) {
+    c.incompatible.Store(true)
+    c.joinOnce.Do(func() { close(c.joined) })
+    c.display.Printf("[chat] can't talk to %s: %v. One of you needs to update\n", displayName(join.Name), err)
+    c.Leave()
+    if c.onIncompatible != nil {
+        c.onIncompatible(err)
+    }
+}
+
+// ProtocolVersion is the peer protocol version agreed on with the peer, or
+// 0 before their join.
+func (c *Chat) ProtocolVersion() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.peerVersion
+}
+
+// Use adds m to the envelope pipeline, closer to the wire than the
+// middleware already registered.
+func (c *Chat) Use(m Middleware) {
+    c.middleware.Use(m)
+}
+
+// HandleChannel routes the data channels the peer opens with label to
+// handler. Register before connecting, or a channel the peer opens first is
+// ignored.
+func (c *Chat) HandleChannel(label string, handler ChannelHandler) {
+    c.channels.Handle(label, handler)
+}
+
+// encodeEnvelope encodes env in the preferred wire format if the peer
+// supports it, and as JSON otherwise.
+func (c *Chat) encodeEnvelope(env *Envelope) ([]byte, error) {
+    switch {
+    case wireFormat == wireFormatProtobuf && c.peerSupports(featureProtobuf):
+        return encodeEnvelopeProto(env), nil
+    case wireFormat == wireFormatMsgpack && c.peerSupports(featureMsgpack):
+        return encodeEnvelopeMsgpack(env)
+    }
+    return encodeEnvelope(env)
+}
+
+// peerSupports reports whether feature can be used with the peer: both
+// joins listed it.
+func (c *Chat) peerSupports(feature string) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return containsString(c.peerFeatures, feature)
+}
+
+// PeerInfo returns what the peer said about itself in its join.
+func (c *Chat) PeerInfo() PeerInfo {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return PeerInfo{
+        ID:       c.peerID,
+        Name:     c.peerName,
+        Client:   c.peerClient,
+        Platform: c.peerPlatform,
+        Version:  c.peerVersion,
+        Features: append([]string(nil), c.peerFeatures...),
+    }
+}
+
+// Features returns the features in use with the peer.
+func (c *Chat) Features() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return append([]string(nil), c.peerFeatures...)
+}
+
+// localFeatures are the features this side advertises in its join.
+func (c *Chat) localFeatures() []string {
+    features := append([]string(nil), localFeatures...)
+    if c.e2e != nil {
+        features = append(features, featureE2E)
+    }
+    return features
+}
+
+// requireFeature returns an error if the peer has joined without listing
+// feature, which is called what in the error.
+func (c *Chat) requireFeature(feature, what string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.peerVersion == 0 || containsString(c.peerFeatures, feature) {
+        return nil
+    }
+    return fmt.Errorf("%s doesn't support %s", displayName(c.peerName), what)
+}
+
+// LastReceived returns the peer's most recent chat message, or nil.
+func (c *Chat) LastReceived() []byte {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.lastRecv
+}
+
+func (c *Chat) setLastReceived(data []byte) {
+    c.mu.Lock()
+    c.lastRecv = data
+    c.mu.Unlock()
+}
+
+// PeerID is the ID the peer joined with, "" until they join.
+func (c *Chat) PeerID() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.peerID
+}
+
+// PeerName is the peer's alias from the address book if there is one,
+// otherwise the name they gave.
+func (c *Chat) PeerName() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if alias := contacts.Alias(c.peerID); alias != "" {
+        return alias
+    }
+    return c.peerName
+}
+
+func displayName(name string) string {
+    if name == "" {
+        return "peer"
+    }
+    return name
+}
+
+func (c *Chat) handleMessage(msg webrtc.DataChannelMessage) {
+    c.markReceived()
+    if c.pipe != nil {
+        c.pipe.receive(msg.Data)
+        return
+    }
+    data := msg.Data
+    if !msg.IsString && isFragment(data) {
+        whole, err := c.reassembly.add(data)
+        if err != nil {
+            log.Println("メッセージ再構成エラー: ", err)
+            return
+        }
+        if whole == nil {
+            return
+        }
+        data = whole
+    }
+
+    if c.e2e != nil {
+        if msg.IsString {
+            log.Println("Dropping unencrypted message received in E2E mode")
+            return
+        }
+
+        established := isE2EKeyFrame(data) && c.e2e.Fingerprint() == ""
+        var err error
+        data, err = c.e2e.Open(data)
+        if err != nil {
+            log.Println("E2E復号エラー: ", err)
+            return
+        }
+        if established {
+            c.display.Printf("[e2e] Encrypted session established. Compare this code with your peer: %s\n", c.e2e.Fingerprint())
+            c.display.SetStatus("e2e", c.e2e.Fingerprint())
+        }
+        if data == nil {
+            return
+        }
+    } else if msg.IsString {
+        // Clients predating envelopes send bare text
+        c.display.PrintMessage(c.PeerName(), c.PeerInfo().ID, "", data, true, time.Now())
+        alertFor(string(data))
+        c.setLastReceived(data)
+        return
+    }
+
+    env, err := decodeEnvelope(data)
+    if err != nil {
+        log.Println("メッセージ解析エラー: ", err)
+        c.display.PrintMessage(c.PeerName(), c.PeerInfo().ID, "", data, false, time.Now())
+        return
+    }
+    env, err = c.middleware.inbound(env)
+    if err != nil {
+        log.Println("メッセージ処理エラー: ", err)
+        return
+    }
+    if env == nil {
+        return
+    }
+    if env.Seq != 0 && c.acking() {
+        // Duplicates are acknowledged too: the first ack may still be on
+        // its way, or the peer resent because it was slow
+        c.sendAck(env.Seq)
+    }
+    c.reorder.Receive(env)
+}
+
+func (c *Chat) routeEnvelope(env *Envelope) {
+    if (env.Type == envelopeText || env.Type == envelopeBinary) && c.alreadySeen(env.ID) {
+        log.Printf("Dropping message %s: already seen\n", env.ID)
+        return
+    }
+    switch env.Type {
+    case envelopeText:
+        sender := c.PeerName()
+        if env.Private {
+            sender = privateSender(sender)
+        }
+        c.display.PrintMessage(sender, env.Sender, env.ID, env.Payload, true, env.Time())
+        alertFor(string(env.Payload))
+        c.setLastReceived(env.Payload)
+        c.recent.add(env.ID, false, env.Payload)
+        c.record(env, directionIn)
+    case envelopeBinary:
+        c.display.PrintMessage(c.PeerName(), env.Sender, env.ID, env.Payload, false, env.Time())
+        alertFor("")
+        c.setLastReceived(env.Payload)
+        c.recent.add(env.ID, false, env.Payload)
+        c.record(env, directionIn)
+    case envelopeFile:
+        c.files.handleFrame(env.Payload)
+    case envelopeReaction:
+        c.handleReaction(env)
+    case envelopeControl:
+        c.handleControl(controlFromEnvelope(env))
+    default:
+        log.Printf("Unknown envelope type: %s\n", env.Type)
+    }
+}
+
+func isE2EKeyFrame(data []byte) bool {
+    return len(data) > 0 && data[0] == e2eKeyFrame
+}
+
+func isBinaryData(data []byte) bool {
+    return !utf8.Valid(data)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+type testChat struct {
+    *Chat
+    data, file, control *fakeTransport
+}
+
+// newChatPair connects two Chats, alice and bob, over fake transports.
+// Neither is open yet; see open.
+func newChatPair(t *testing.T) (alice, bob *testChat) {
+    newSide := func(id, name string) *testChat {
+        side := &testChat{data: newFakeTransport(), file: newFakeTransport(), control: newFakeTransport()}
+        config := Config{Name: name, DownloadDir: t.TempDir()}
+        side.Chat = newChat(side.data, side.file, side.control, nil, nil, id, config)
+        return side
+    }
+    alice = newSide("alice-id", "alice")
+    bob = newSide("bob-id", "bob")
+    for _, pair := range [][2]*testChat{{alice, bob}, {bob, alice}} {
+        from, to := pair[0], pair[1]
+        from.data.connect(to.handleMessage)
+        from.file.connect(to.handleMessage)
+        from.control.connect(to.handleControlMessage)
+    }
+    return alice, bob
+}
+
+// open does what the data channels opening would. The control channels go
+// first and the joins are waited for, so each side knows the other's name
+// before any chat arrives.
+func open(t *testing.T, shown *fakeDisplay, sides ...*testChat) {
+    for _, side := range sides {
+        side.handleControlOpen()
+    }
+    eventually(t, "joins", func() bool {
+        return shown.HasNotice("* alice joined") && shown.HasNotice("* bob joined")
+    })
+    for _, side := range sides {
+        side.handleOpen()
+    }
+    for _, side := range sides {
+        eventually(t, "the outbox", side.isOpen)
+    }
+}
+
+func (side *testChat) isOpen() bool {
+    side.mu.Lock()
+    defer side.mu.Unlock()
+    return side.opened
+}
+
+func TestChatSendsText(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+
+    if err := alice.Send([]byte("hello\n")); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the message", func() bool { return len(shown.Messages()) == 1 })
+    if got := shown.Messages()[0]; got != "alice: hello\n" {
+        t.Errorf("bob saw %q", got)
+    }
+    if !bob.peerSupports(featureProtobuf) {
+        t.Error("alice's join didn't list protobuf")
+    }
+}
+
+func TestChatMarksPrivateMessages(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    if err := alice.SendPrivate([]byte("psst\n")); err != errNotConnected {
+        t.Errorf("a whisper before connecting gave %v", err)
+    }
+    open(t, shown, alice, bob)
+
+    if err := alice.SendPrivate([]byte("psst\n")); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the message", func() bool { return len(shown.Messages()) == 1 })
+    if got := shown.Messages()[0]; got != "alice (private): psst\n" {
+        t.Errorf("bob saw %q", got)
+    }
+}
+
+func TestChatRenamesPeer(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+
+    if err := alice.SetName("alicia"); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the rename", func() bool { return shown.HasNotice("* alice is now known as alicia") })
+    if err := alice.Send([]byte("hi\n")); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the message", func() bool { return len(shown.Messages()) == 1 })
+    if got := shown.Messages()[0]; got != "alicia: hi\n" {
+        t.Errorf("bob saw %q", got)
+    }
+}
+
+func TestChatCompressesAndFragmentsLargeMessages(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+
+    text := strings.Repeat("a fairly repetitive line of text\n", 10000)
+    if err := alice.Send([]byte(text)); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the message", func() bool { return len(shown.Messages()) == 1 })
+    if shown.Messages()[0] != "alice: "+text {
+        t.Error("the message arrived changed")
+    }
+}
+
+func TestChatOutboxWaitsForOpen(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+
+    for _, text := range []string{"one\n", "two\n"} {
+        if err := alice.Send([]byte(text)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if !reflect.DeepEqual(alice.Unsent(), []string{"one\n", "two\n"}) {
+        t.Fatalf("outbox is %q", alice.Unsent())
+    }
+
+    open(t, shown, alice, bob)
+    eventually(t, "the messages", func() bool { return len(shown.Messages()) == 2 })
+    want := []string{"alice: one\n", "alice: two\n"}
+    if got := shown.Messages(); !reflect.DeepEqual(got, want) {
+        t.Errorf("bob saw %q, want %q", got, want)
+    }
+    if len(alice.Unsent()) != 0 {
+        t.Errorf("outbox still has %q", alice.Unsent())
+    }
+}
+
+func TestChatDropsDuplicates(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+
+    alice.data.setDuplicate(true)
+    for _, text := range []string{"one\n", "two\n", "three\n"} {
+        if err := alice.Send([]byte(text)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // The channel is ordered, so once the marker is shown every copy
+    // before it has been handled
+    alice.data.setDuplicate(false)
+    if err := alice.Send([]byte("end\n")); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the end marker", func() bool {
+        messages := shown.Messages()
+        return len(messages) > 0 && messages[len(messages)-1] == "alice: end\n"
+    })
+
+    var fromAlice []string
+    for _, message := range shown.Messages() {
+        if strings.HasPrefix(message, "alice: ") {
+            fromAlice = append(fromAlice, message)
+        }
+    }
+    want := []string{"alice: one\n", "alice: two\n", "alice: three\n", "alice: end\n"}
+    if !reflect.DeepEqual(fromAlice, want) {
+        t.Errorf("bob saw %q, want %q", fromAlice, want)
+    }
+}
+
+func TestChatRefusesIncompatiblePeer(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+    if v := bob.ProtocolVersion(); v != peerProtocolVersion {
+        t.Errorf("agreed on v%d", v)
+    }
+
+    refused := make(chan error, 1)
+    bob.onIncompatible = func(err error) { refused <- err }
+    join := newControlMessage(controlJoin, "carol-id")
+    join.Name = "carol"
+    join.Version = peerProtocolVersion + 2
+    join.MinVersion = peerProtocolVersion + 1
+    bob.handleControl(join)
+    select {
+    case err := <-refused:
+        if !strings.Contains(err.Error(), "protocol") {
+            t.Errorf("got %v", err)
+        }
+    default:
+        t.Fatal("a peer with no version in common was accepted")
+    }
+    eventually(t, "the leave", func() bool { return shown.HasNotice("* bob left") })
+}
+
+func TestNegotiateVersion(t *testing.T) {
+    tests := []struct {
+        version, min int
+        want         int
+        ok           bool
+    }{
+        {0, 0, 1, true}, // older than versioning
+        {peerProtocolVersion, minPeerProtocolVersion, peerProtocolVersion, true},
+        {peerProtocolVersion + 1, 1, peerProtocolVersion, true},
+        {peerProtocolVersion + 2, peerProtocolVersion + 1, 0, false},
+    }
+    for _, test := range tests {
+        got, err := negotiateVersion(&ControlMessage{Version: test.version, MinVersion: test.min})
+        if got != test.want || (err == nil) != test.ok {
+            t.Errorf("v%d-v%d: got v%d, %v", test.min, test.version, got, err)
+        }
+    }
+}
+
+func TestChatUsesSharedFeatures(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+    if !reflect.DeepEqual(bob.Features(), localFeatures) {
+        t.Errorf("bob uses %v", bob.Features())
+    }
+
+    // A newer peer without file transfer, and with a feature we lack
+    join := newControlMessage(controlJoin, "alice-id")
+    join.Name = "alice"
+    join.Version = peerProtocolVersion
+    join.Features = []string{featureZstd, "teleport"}
+    bob.handleControl(join)
+    if got := bob.Features(); !reflect.DeepEqual(got, []string{featureZstd}) {
+        t.Errorf("bob uses %v", got)
+    }
+    if err := bob.SendFile("chat_test.go"); err == nil || !strings.Contains(err.Error(), "file transfer") {
+        t.Errorf("sending a file gave %v", err)
+    }
+
+    // Peers older than versioning could always take files
+    join.Version = 0
+    bob.handleControl(join)
+    if !bob.peerSupports(featureFiles) {
+        t.Error("a legacy peer can't take files")
+    }
+}
+
+func TestChatPeerInfo(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+
+    info := bob.PeerInfo()
+    if info.ID != "alice-id" || info.Name != "alice" || info.Client != clientVersion() || info.Platform != clientPlatform() {
+        t.Errorf("got %+v", info)
+    }
+    whois := formatPeerInfo(info, "")
+    for _, want := range []string{"alice-id", clientPlatform(), "protocol  v1\n"} {
+        if !strings.Contains(whois, want) {
+            t.Errorf("/whois doesn't show %q:\n%s", want, whois)
+        }
+    }
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "hash/fnv"
+    "os"
+)
+
+// Each peer's name is shown in a colour picked from their client ID, so it
+// stays the same from one session to the next and tells people apart when
+// several are talking. -no-color, no_color in the config or a NO_COLOR
+// environment variable (https://no-color.org) turn colour off.
+
+// colorOutput is whether peers' names, and code in their messages, are
+// coloured.
+var colorOutput = true
+
+// noColorEnv reports whether NO_COLOR asks for no colour: any value but
+// the empty string does.
+func noColorEnv() bool {
+    return os.Getenv("NO_COLOR") != ""
+}
+
+// The palettes leave out black and white, which vanish on one background
+// or the other. The two line up, so a peer has the same colour in both
+// interfaces.
+var (
+    ansiPeerColors = []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"}
+    tuiPeerColors  = []string{"maroon", "green", "olive", "navy", "purple", "teal", "red", "lime", "yellow", "blue", "fuchsia", "aqua"}
+)
+
+// peerColor picks the palette entry for peerID.
+func peerColor(peerID string, palette []string) string {
+    h := fnv.New32a()
+    h.Write([]byte(peerID))
+    return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// ansiPeerName colours name for the terminal, or leaves it alone when
+// colour is off or the peer isn't known yet.
+func ansiPeerName(peerID, name string) string {
+    if !colorOutput || peerID == "" {
+        return name
+    }
+    return "\x1b[" + peerColor(peerID, ansiPeerColors) + "m" + name + "\x1b[39m"
+}
+
+// tuiPeerName is ansiPeerName for the TUI, where the name is bold as well.
+func tuiPeerName(peerID, name string) string {
+    if !colorOutput || peerID == "" {
+        return "[::b]" + name + "[::-]"
+    }
+    return "[" + peerColor(peerID, tuiPeerColors) + "::b]" + name + "[-::-]"
+}
+
+// ansiMessageStyle is ansiMarkdown, less the colour of code when colour is
+// off.
+func ansiMessageStyle() markdownStyle {
+    style := ansiMarkdown
+    if !colorOutput {
+        style.code = [2]string{}
+    }
+    return style
+}
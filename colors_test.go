@@ -0,0 +1,28 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestPeerNameColors(t *testing.T) {
+    bob := ansiPeerName("bob-id", "bob")
+    if bob != ansiPeerName("bob-id", "bob") || !strings.Contains(bob, "bob") {
+        t.Fatalf("bob's name came out as %q", bob)
+    }
+    if got := ansiPeerName("", "bob"); got != "bob" {
+        t.Errorf("a peer without an ID got %q", got)
+    }
+    if len(ansiPeerColors) != len(tuiPeerColors) {
+        t.Error("the terminal and TUI palettes don't line up")
+    }
+
+    colorOutput = false
+    t.Cleanup(func() { colorOutput = true })
+    if got := ansiPeerName("bob-id", "bob"); got != "bob" {
+        t.Errorf("with colour off got %q", got)
+    }
+    if got := tuiPeerName("bob-id", "bob"); got != "[::b]bob[::-]" {
+        t.Errorf("with colour off the TUI got %q", got)
+    }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// CommandFunc runs a slash command. arg is the rest of the input line after
+// the command name, with surrounding whitespace removed.
+type CommandFunc func(arg string) error
+
+type command struct {
+    usage string
+    help  string
+    run   CommandFunc
+}
+
+// Commands dispatches "/name arg" input lines. A line starting with "//" is
+// not a command; it is sent as text with the first slash removed.
+type Commands struct {
+    commands map[string]command
+}
+
+func newCommands() *Commands {
+    c := &Commands{commands: map[string]command{}}
+    c.Register("help", "", "Show available commands", func(string) error {
+        c.printHelp()
+        return nil
+    })
+    return c
+}
+
+func (c *Commands) Register(name, usage, help string, run CommandFunc) {
+    c.commands[name] = command{usage: usage, help: help, run: run}
+}
+
+// Dispatch runs line if it is a command. It reports whether the line was
+// consumed; otherwise line (with a "//" escape undone) should be sent as chat.
+func (c *Commands) Dispatch(line []byte) ([]byte, bool) {
+    text := strings.TrimRight(string(line), "\r\n")
+    if !strings.HasPrefix(text, "/") {
+        return line, false
+    }
+    if strings.HasPrefix(text, "//") {
+        return line[1:], false
+    }
+
+    name, arg, _ := strings.Cut(text[1:], " ")
+    cmd, ok := c.commands[name]
+    if !ok {
+        display.Error(fmt.Sprintf("Unknown command: /%s (try /help)", name))
+        return nil, true
+    }
+    if err := cmd.run(strings.TrimSpace(arg)); err != nil {
+        display.Error(fmt.Sprintf("/%s: %v", name, err))
+    }
+    return nil, true
+}
+
+func (c *Commands) printHelp() {
+    names := make([]string, 0, len(c.commands))
+    for name := range c.commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        cmd := c.commands[name]
+        display.Printf("  /%-20s %s\n", strings.TrimSpace(name+" "+cmd.usage), cmd.help)
+    }
+}
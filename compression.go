@@ -0,0 +1,80 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/klauspost/compress/zstd"
+)
+
+// Envelope payloads of compressMinSize bytes or more are zstd-compressed
+// when the peer listed featureZstd in its join message. Older peers don't
+// send the list, so they keep getting uncompressed payloads. The envelope
+// header stays uncompressed and names the compression in "comp".
+//
+// Compression happens before E2E encryption, so the ciphertext's length
+// says something about how repetitive the plaintext was.
+const (
+    featureZstd = "zstd"
+
+    compressMinSize     = 1024
+    maxDecompressedSize = 64 * 1024 * 1024
+)
+
+var (
+    zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+    zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize), zstd.WithDecoderConcurrency(0))
+)
+
+// compressionMiddleware compresses outgoing envelopes for peers that
+// support it and decompresses incoming ones. Every Chat has it, since every
+// join advertises featureZstd.
+type compressionMiddleware struct {
+    peerSupports func(feature string) bool
+}
+
+func (m compressionMiddleware) Outbound(env *Envelope) (*Envelope, error) {
+    if !m.peerSupports(featureZstd) {
+        return env, nil
+    }
+    // Compress a copy: the sender keeps using the original payload
+    compressed := *env
+    compressEnvelope(&compressed)
+    return &compressed, nil
+}
+
+func (m compressionMiddleware) Inbound(env *Envelope) (*Envelope, error) {
+    return env, decompressEnvelope(env)
+}
+
+// compressEnvelope compresses env's payload in place if that makes it
+// smaller.
+func compressEnvelope(env *Envelope) {
+    if len(env.Payload) < compressMinSize {
+        return
+    }
+    compressed := zstdEncoder.EncodeAll(env.Payload, nil)
+    if len(compressed) >= len(env.Payload) {
+        // Already compressed data such as images and archives
+        return
+    }
+    env.Payload = compressed
+    env.Compression = featureZstd
+}
+
+// decompressEnvelope undoes compressEnvelope.
+func decompressEnvelope(env *Envelope) error {
+    switch env.Compression {
+    case "":
+        return nil
+    case featureZstd:
+        payload, err := zstdDecoder.DecodeAll(env.Payload, nil)
+        if err != nil {
+            return err
+        }
+        env.Payload = payload
+        env.Compression = ""
+        return nil
+    default:
+        return fmt.Errorf("unsupported compression %q", env.Compression)
+    }
+}
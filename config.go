@@ -0,0 +1,642 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/url"
+    "os"
+    "reflect"
+    "strings"
+    "time"
+)
+
+const defaultConfigPath = "config.json"
+
+// ICEServer is a STUN or TURN server offered to the ICE agent, shaped like
+// a browser's RTCIceServer. URLs use the stun:, stuns:, turn: or turns:
+// schemes. CredentialType is "password", the default, with Credential as
+// the password, or "oauth" for RFC 7635 token authentication with MACKey
+// and AccessToken instead.
+type ICEServer struct {
+    URLs           stringList `json:"urls"`
+    Username       string     `json:"username,omitempty"`
+    Credential     string     `json:"credential,omitempty"`
+    CredentialType string     `json:"credential_type,omitempty"`
+    MACKey         string     `json:"mac_key,omitempty"`
+    AccessToken    string     `json:"access_token,omitempty"`
+}
+
+var iceCredentialTypes = []string{"password", "oauth"}
+
+// stringList is a list of strings that can also be given as a single
+// string, as RTCIceServer's urls can.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+    var single string
+    if err := json.Unmarshal(data, &single); err == nil {
+        *l = stringList{single}
+        return nil
+    }
+    var list []string
+    if err := json.Unmarshal(data, &list); err != nil {
+        return err
+    }
+    *l = list
+    return nil
+}
+
+type TURNServer struct {
+    URL        string `json:"url"`
+    Username   string `json:"username"`
+    Credential string `json:"credential"`
+}
+
+type TLSConfig struct {
+    CACert             string `json:"ca_cert,omitempty"`
+    ClientCert         string `json:"client_cert,omitempty"`
+    ClientKey          string `json:"client_key,omitempty"`
+    InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// DataChannelConfig controls the reliability of the "chat" channel. At most
+// one of MaxRetransmits and MaxPacketLifeTime may be set; leaving both unset
+// gives a fully reliable channel.
+type DataChannelConfig struct {
+    Ordered           *bool   `json:"ordered,omitempty"`
+    MaxRetransmits    *uint16 `json:"max_retransmits,omitempty"`
+    MaxPacketLifeTime *uint16 `json:"max_packet_life_time,omitempty"` // milliseconds
+}
+
+// ICEConfig controls which local addresses are offered to the peer.
+// Candidates is "all" (the default), "no-host" to keep LAN addresses private
+// or "relay" to offer only TURN relay addresses, which hides the public
+// address as well. MDNS replaces host addresses with random .local names,
+// which only peers on the same network can resolve.
+//
+// UDPPortMin and UDPPortMax, set together, keep ICE to that range of local
+// UDP ports for firewalls that only allow a few.
+//
+// NetworkTypes limits gathering to some of udp4, udp6, tcp4 and tcp6 (pion
+// gathers udp4 and udp6 by default). IPv6 is "disable" to drop IPv6
+// entirely, which helps on networks where broken IPv6 stalls ICE, or
+// "prefer" to rank IPv6 pairs above IPv4 ones.
+type ICEConfig struct {
+    Candidates   string   `json:"candidates,omitempty"`
+    MDNS         bool     `json:"mdns,omitempty"`
+    UDPPortMin   uint16   `json:"udp_port_min,omitempty"`
+    UDPPortMax   uint16   `json:"udp_port_max,omitempty"`
+    NetworkTypes []string `json:"network_types,omitempty"`
+    IPv6         string   `json:"ipv6,omitempty"`
+}
+
+var iceCandidatePolicies = []string{"all", "no-host", "relay"}
+var iceNetworkTypes = []string{"udp4", "udp6", "tcp4", "tcp6"}
+var ipv6Policies = []string{"prefer", "disable"}
+
+// GatherNetworkTypes returns the network types to gather candidates on, or
+// nil for pion's default.
+func (c ICEConfig) GatherNetworkTypes() []string {
+    types := c.NetworkTypes
+    if c.IPv6 != "disable" {
+        return types
+    }
+    if len(types) == 0 {
+        return []string{"udp4"}
+    }
+    var ipv4 []string
+    for _, t := range types {
+        if strings.HasSuffix(t, "4") {
+            ipv4 = append(ipv4, t)
+        }
+    }
+    return ipv4
+}
+
+// ReconnectConfig controls how a dropped signaling connection is redialed.
+// Delays grow exponentially from InitialDelay up to MaxDelay; MaxAttempts of
+// zero retries forever.
+type ReconnectConfig struct {
+    Enabled      *bool    `json:"enabled,omitempty"`
+    InitialDelay Duration `json:"initial_delay,omitempty"`
+    MaxDelay     Duration `json:"max_delay,omitempty"`
+    MaxAttempts  int      `json:"max_attempts,omitempty"`
+}
+
+func (r ReconnectConfig) IsEnabled() bool {
+    return r.Enabled == nil || *r.Enabled
+}
+
+type Config struct {
+    ServerIP    string       `json:"server_ip"`
+    AuthToken   string       `json:"auth_token,omitempty"`
+    Proxy       string       `json:"proxy,omitempty"`
+    ICEServers  []ICEServer  `json:"ice_servers,omitempty"`
+    TURNServers []TURNServer `json:"turn_servers,omitempty"`
+    // STUNServers are stun: or stuns: URLs used to find our public
+    // address. NoSTUN uses none at all, for networks where every STUN
+    // server is blocked; otherwise, with neither these nor ice_servers
+    // set, a public default is used.
+    STUNServers []string `json:"stun_servers,omitempty"`
+    NoSTUN      bool     `json:"no_stun,omitempty"`
+    // TURNCredentials fetches short-lived TURN credentials at startup
+    // and again before they expire.
+    TURNCredentials TURNCredentialsConfig `json:"turn_credentials,omitempty"`
+
+    TLS         TLSConfig `json:"tls,omitempty"`
+    DownloadDir string    `json:"download_dir,omitempty"`
+    Name        string    `json:"name,omitempty"`
+    HistoryPath string    `json:"history_path,omitempty"`
+    NoHistory   bool      `json:"no_history,omitempty"`
+    // HistoryEncryption encrypts the history with a key derived from a
+    // passphrase ("passphrase") or kept in the OS keyring ("keyring").
+    HistoryEncryption string `json:"history_encryption,omitempty"`
+    // IdentityPath is where the long-lived identity key and certificate
+    // are kept; empty means the user's config directory.
+    IdentityPath string `json:"identity_path,omitempty"`
+    // ContactsPath is the address book file; empty means the user's
+    // config directory.
+    ContactsPath string `json:"contacts_path,omitempty"`
+    // SessionPath is where the last conversation is remembered for
+    // -resume; empty means the user's config directory.
+    SessionPath string `json:"session_path,omitempty"`
+
+    // LogLevel is one of off, error, warn, info, debug or trace. This
+    // client's own log is shown from info up; the level is also passed on to
+    // pion's WebRTC internals. Left empty, pion keeps its default of
+    // printing errors to stderr.
+    LogLevel string `json:"log_level,omitempty"`
+
+    // TimestampFormat is a Go time layout such as "15:04" shown before
+    // each message, taken from the sender's clock; empty shows none.
+    TimestampFormat string `json:"timestamp_format,omitempty"`
+
+    // ShowMessageIDs shows each message's short ID, which /react takes to
+    // pick the message to react to.
+    ShowMessageIDs bool `json:"show_message_ids,omitempty"`
+
+    // Plain shows the peer's messages exactly as sent instead of rendering
+    // their Markdown.
+    Plain bool `json:"plain,omitempty"`
+
+    // NoColor shows every peer's name in the terminal's default colour
+    // rather than one picked from their ID.
+    NoColor bool `json:"no_color,omitempty"`
+
+    // NoReadline reads typed lines as the terminal delivers them instead
+    // of with the line editor's arrow keys and history.
+    NoReadline bool `json:"no_readline,omitempty"`
+
+    // NoTitle leaves the terminal window's title alone instead of showing
+    // the peer and how many messages are new in it.
+    NoTitle bool `json:"no_title,omitempty"`
+
+    // ScrollbackSize is how many messages /more can page back through;
+    // 0 keeps the last 1000.
+    ScrollbackSize int `json:"scrollback_size,omitempty"`
+
+    // Alert is how an incoming message gets attention: bell, visual or
+    // off (the default). With AlertMentionsOnly only messages mentioning
+    // Name alert; mentions are highlighted either way.
+    Alert             string `json:"alert,omitempty"`
+    AlertMentionsOnly bool   `json:"alert_mentions_only,omitempty"`
+
+    // Encoding is the terminal's character encoding, such as cp932 or
+    // euc-jp; empty detects it from the console or locale.
+    Encoding string `json:"encoding,omitempty"`
+
+    // MaxSendRate caps how fast data is written to the data channels, such
+    // as "1MBps"; zero means no limit.
+    MaxSendRate ByteRate `json:"max_send_rate,omitempty"`
+
+    // WireFormat is how envelopes are encoded for peers that support it:
+    // protobuf (the default), msgpack or json. msgpack also asks the
+    // signaling server for MessagePack.
+    WireFormat string `json:"wire_format,omitempty"`
+
+    // BrowserCompat sends offers, answers and candidates as the JSON
+    // objects browsers use instead of bare strings, for peers running in a
+    // browser.
+    BrowserCompat bool `json:"browser_compat,omitempty"`
+
+    // PingInterval, when set, pings the peer this often over the control
+    // channel and shows the round-trip time in the status.
+    PingInterval Duration `json:"ping_interval,omitempty"`
+
+    // KeepaliveInterval is how long the data channels may sit idle before
+    // a keepalive is sent; "0s" turns keepalives off.
+    KeepaliveInterval Duration `json:"keepalive_interval,omitempty"`
+
+    ICE         ICEConfig         `json:"ice,omitempty"`
+    DataChannel DataChannelConfig `json:"data_channel,omitempty"`
+    Reconnect   ReconnectConfig   `json:"reconnect,omitempty"`
+    Media       MediaConfig       `json:"media,omitempty"`
+    Matrix      MatrixConfig      `json:"matrix,omitempty"`
+}
+
+var logLevels = []string{"off", "error", "warn", "info", "debug", "trace"}
+
+// Duration is a time.Duration written as a string such as "500ms" or "30s"
+// in config.json.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("expected a duration string such as \"500ms\" or \"30s\", got %s", data)
+    }
+    value, err := time.ParseDuration(s)
+    if err != nil {
+        return fmt.Errorf("invalid duration %q (use a value such as \"500ms\" or \"30s\")", s)
+    }
+    *d = Duration(value)
+    return nil
+}
+
+func defaultConfig() Config {
+    return Config{
+        ServerIP:    "ws://localhost:8080",
+        DownloadDir: "downloads",
+        HistoryPath: "history.db",
+
+        KeepaliveInterval: Duration(defaultKeepaliveInterval),
+        Reconnect: ReconnectConfig{
+            InitialDelay: Duration(500 * time.Millisecond),
+            MaxDelay:     Duration(30 * time.Second),
+        },
+    }
+}
+
+// loadConfig reads the config file at path. A missing file at the default
+// path is created with default values; a missing file that was asked for
+// explicitly is an error. The caller validates the config once the flags
+// that add to it are in.
+func loadConfig(path string, explicit bool) (Config, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) && !explicit {
+        // If config file doesn't exist, create it with default values
+        config := defaultConfig()
+
+        file, err := os.Create(path)
+        if err != nil {
+            return config, fmt.Errorf("config file create error: %w", err)
+        }
+        defer file.Close()
+
+        err = json.NewEncoder(file).Encode(config)
+        if err != nil {
+            return config, fmt.Errorf("config file encode error: %w", err)
+        }
+
+        fmt.Fprintf(os.Stderr, "Created default config file: %s\n", path)
+        return config, nil
+    }
+    if err != nil {
+        return Config{}, err
+    }
+
+    config := defaultConfig()
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&config); err != nil {
+        return config, fmt.Errorf("%s: %s", path, describeDecodeError(data, err))
+    }
+    return config, nil
+}
+
+// Validate reports every problem with the config at once, one per line.
+func (c Config) Validate() error {
+    var errs []error
+    addf := func(format string, args ...interface{}) {
+        errs = append(errs, fmt.Errorf(format, args...))
+    }
+
+    if c.ServerIP == "" {
+        addf("server_ip is required (e.g. \"ws://localhost:8080\")")
+    } else if u, err := url.Parse(c.ServerIP); err != nil || (u.Scheme != "ws" && u.Scheme != "wss" && u.Scheme != "grpc" && u.Scheme != "grpcs") {
+        addf("server_ip %q must be a ws://, wss://, grpc:// or grpcs:// URL", c.ServerIP)
+    }
+
+    if c.HistoryEncryption != "" && !containsString(historyEncryptionModes, c.HistoryEncryption) {
+        addf("history_encryption must be one of %s", strings.Join(historyEncryptionModes, ", "))
+    }
+
+    if c.Proxy != "" {
+        if u, err := url.Parse(c.Proxy); err != nil || (u.Scheme != "http" && u.Scheme != "socks5") {
+            addf("proxy %q must be an http:// or socks5:// URL", c.Proxy)
+        }
+    }
+
+    for i, server := range c.ICEServers {
+        if len(server.URLs) == 0 {
+            addf("ice_servers[%d].urls is required", i)
+        }
+        for _, u := range server.URLs {
+            if !isICEServerURL(u) {
+                addf("ice_servers[%d].urls: %q must start with stun:, stuns:, turn: or turns:", i, u)
+            }
+        }
+        if server.CredentialType != "" && !containsString(iceCredentialTypes, server.CredentialType) {
+            addf("ice_servers[%d].credential_type must be one of %s", i, strings.Join(iceCredentialTypes, ", "))
+        }
+        switch {
+        case !isTURNServer(server.URLs):
+        case server.CredentialType == "oauth":
+            if server.Username == "" || server.MACKey == "" || server.AccessToken == "" {
+                addf("ice_servers[%d]: OAuth TURN servers need username (the key ID), mac_key and access_token", i)
+            }
+        case server.Username == "" || server.Credential == "":
+            addf("ice_servers[%d]: TURN servers need both username and credential", i)
+        }
+    }
+
+    for i, u := range c.STUNServers {
+        if !isSTUNURL(u) {
+            addf("stun_servers[%d]: %q must start with stun: or stuns:", i, u)
+        }
+    }
+    if c.NoSTUN && len(c.STUNServers) > 0 {
+        addf("no_stun and stun_servers cannot be used together")
+    }
+
+    if c.TURNCredentials.URL != "" && len(c.TURNCredentials.Command) > 0 {
+        addf("turn_credentials.url and turn_credentials.command cannot be used together")
+    }
+    if c.TURNCredentials.URL != "" {
+        if u, err := url.Parse(c.TURNCredentials.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            addf("turn_credentials.url %q must be an http:// or https:// URL", c.TURNCredentials.URL)
+        }
+    }
+    if m := c.TURNCredentials.Method; m != "" && m != "GET" && m != "POST" {
+        addf("turn_credentials.method must be GET or POST")
+    }
+
+    for i, server := range c.TURNServers {
+        if server.URL == "" {
+            addf("turn_servers[%d].url is required", i)
+        } else if !isTURNURL(server.URL) {
+            addf("turn_servers[%d].url: %q must start with turn: or turns:", i, server.URL)
+        } else if server.Username == "" || server.Credential == "" {
+            addf("turn_servers[%d]: TURN servers need both username and credential", i)
+        }
+    }
+
+    if c.ICE.Candidates != "" && !containsString(iceCandidatePolicies, c.ICE.Candidates) {
+        addf("ice.candidates %q must be one of %s", c.ICE.Candidates, strings.Join(iceCandidatePolicies, ", "))
+    }
+    if (c.ICE.UDPPortMin == 0) != (c.ICE.UDPPortMax == 0) {
+        addf("ice.udp_port_min and ice.udp_port_max must be set together")
+    } else if c.ICE.UDPPortMin > c.ICE.UDPPortMax {
+        addf("ice.udp_port_min must not be greater than ice.udp_port_max")
+    }
+    for _, t := range c.ICE.NetworkTypes {
+        if !containsString(iceNetworkTypes, t) {
+            addf("ice.network_types: %q must be one of %s", t, strings.Join(iceNetworkTypes, ", "))
+        }
+    }
+    if c.ICE.IPv6 != "" && !containsString(ipv6Policies, c.ICE.IPv6) {
+        addf("ice.ipv6 %q must be prefer or disable", c.ICE.IPv6)
+    } else if len(c.ICE.NetworkTypes) > 0 && len(c.ICE.GatherNetworkTypes()) == 0 {
+        addf("ice.ipv6 is disable but ice.network_types has only IPv6 types")
+    }
+
+    if (c.TLS.ClientCert == "") != (c.TLS.ClientKey == "") {
+        addf("tls.client_cert and tls.client_key must be set together")
+    }
+
+    if c.LogLevel != "" && !containsString(logLevels, c.LogLevel) {
+        addf("log_level %q must be one of %s", c.LogLevel, strings.Join(logLevels, ", "))
+    }
+
+    if c.DataChannel.MaxRetransmits != nil && c.DataChannel.MaxPacketLifeTime != nil {
+        addf("data_channel.max_retransmits and data_channel.max_packet_life_time cannot be used together")
+    }
+
+    if c.Media.VideoCodec != "" && !strings.EqualFold(c.Media.VideoCodec, "vp8") && !strings.EqualFold(c.Media.VideoCodec, "h264") {
+        addf("media.video_codec %q must be vp8 or h264", c.Media.VideoCodec)
+    }
+
+    if _, err := lookupEncoding(c.Encoding); err != nil {
+        addf("encoding: %v", err)
+    }
+
+    if c.Alert != "" && !containsString(alertModes, c.Alert) {
+        addf("alert %q must be one of %s", c.Alert, strings.Join(alertModes, ", "))
+    }
+
+    if c.WireFormat != "" && !containsString(wireFormats, c.WireFormat) {
+        addf("wire_format %q must be one of %s", c.WireFormat, strings.Join(wireFormats, ", "))
+    }
+
+    if c.MaxSendRate < 0 {
+        addf("max_send_rate must not be negative")
+    }
+
+    if c.PingInterval < 0 {
+        addf("ping_interval must not be negative")
+    }
+
+    if c.KeepaliveInterval < 0 {
+        addf("keepalive_interval must not be negative")
+    }
+
+    if c.Matrix != (MatrixConfig{}) {
+        if u, err := url.Parse(c.Matrix.Homeserver); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            addf("matrix.homeserver %q must be an http:// or https:// URL", c.Matrix.Homeserver)
+        }
+        if c.Matrix.AccessToken == "" {
+            addf("matrix.access_token is required")
+        }
+        if c.Matrix.Room != "" && !strings.HasPrefix(c.Matrix.Room, "!") && !strings.HasPrefix(c.Matrix.Room, "#") {
+            addf("matrix.room %q must be a room ID (!...) or alias (#...)", c.Matrix.Room)
+        }
+    }
+
+    if c.Reconnect.InitialDelay <= 0 {
+        addf("reconnect.initial_delay must be positive")
+    }
+    if c.Reconnect.MaxDelay < c.Reconnect.InitialDelay {
+        addf("reconnect.max_delay must not be shorter than reconnect.initial_delay")
+    }
+    if c.Reconnect.MaxAttempts < 0 {
+        addf("reconnect.max_attempts must be 0 (unlimited) or more")
+    }
+
+    return errors.Join(errs...)
+}
+
+func isICEServerURL(u string) bool {
+    for _, scheme := range []string{"stun:", "stuns:", "turn:", "turns:"} {
+        if strings.HasPrefix(u, scheme) {
+            return true
+        }
+    }
+    return false
+}
+
+func isSTUNURL(u string) bool {
+    return strings.HasPrefix(u, "stun:") || strings.HasPrefix(u, "stuns:")
+}
+
+// defaultSTUNServers are used when no STUN server is configured.
+var defaultSTUNServers = []string{"stun:stun.l.google.com:19302"}
+
+// STUNURLs returns the STUN servers to offer the ICE agent besides those in
+// ice_servers.
+func (c Config) STUNURLs() []string {
+    switch {
+    case c.NoSTUN:
+        return nil
+    case len(c.STUNServers) > 0:
+        return c.STUNServers
+    case len(c.ICEServers) == 0:
+        return defaultSTUNServers
+    }
+    return nil
+}
+
+// applySTUNFlag sets the STUN servers from -stun: a comma-separated list of
+// URLs, or "none".
+func applySTUNFlag(c *Config, value string) error {
+    if value == "none" {
+        c.NoSTUN = true
+        c.STUNServers = nil
+        return nil
+    }
+    var urls []string
+    for _, u := range strings.Split(value, ",") {
+        u = strings.TrimSpace(u)
+        if !isSTUNURL(u) {
+            return fmt.Errorf("%q must start with stun: or stuns:", u)
+        }
+        urls = append(urls, u)
+    }
+    c.NoSTUN = false
+    c.STUNServers = urls
+    return nil
+}
+
+// HasTURNServer reports whether any relay server is configured.
+func (c Config) HasTURNServer() bool {
+    if len(c.TURNServers) > 0 || c.TURNCredentials.URL != "" || len(c.TURNCredentials.Command) > 0 {
+        return true
+    }
+    for _, server := range c.ICEServers {
+        if isTURNServer(server.URLs) {
+            return true
+        }
+    }
+    return false
+}
+
+func isTURNServer(urls []string) bool {
+    for _, u := range urls {
+        if isTURNURL(u) {
+            return true
+        }
+    }
+    return false
+}
+
+func isTURNURL(u string) bool {
+    return strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:")
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// describeDecodeError turns encoding/json errors into messages that point at
+// the offending line or field.
+func describeDecodeError(data []byte, err error) string {
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.As(err, &syntaxErr):
+        line, column := lineAndColumn(data, syntaxErr.Offset)
+        return fmt.Sprintf("line %d, column %d: %v", line, column, err)
+    case errors.As(err, &typeErr):
+        line, _ := lineAndColumn(data, typeErr.Offset)
+        return fmt.Sprintf("line %d: %s must be %s, not %s", line, typeErr.Field, typeErr.Type, typeErr.Value)
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+        msg := fmt.Sprintf("unknown field %q", field)
+        if suggestion := closestField(field); suggestion != "" {
+            msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+        }
+        return msg
+    }
+    return err.Error()
+}
+
+func lineAndColumn(data []byte, offset int64) (int, int) {
+    if offset > int64(len(data)) {
+        offset = int64(len(data))
+    }
+    before := data[:offset]
+    line := bytes.Count(before, []byte("\n")) + 1
+    column := len(before) - bytes.LastIndexByte(before, '\n')
+    return line, column
+}
+
+// closestField suggests the known config key nearest to a misspelled one.
+func closestField(field string) string {
+    best, bestDistance := "", 3
+    for _, name := range configFieldNames(reflect.TypeOf(Config{})) {
+        if d := editDistance(strings.ToLower(field), name); d < bestDistance {
+            best, bestDistance = name, d
+        }
+    }
+    return best
+}
+
+func configFieldNames(t reflect.Type) []string {
+    for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+        t = t.Elem()
+    }
+    if t.Kind() != reflect.Struct {
+        return nil
+    }
+    var names []string
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name := strings.Split(field.Tag.Get("json"), ",")[0]
+        if name == "" || name == "-" {
+            continue
+        }
+        names = append(names, name)
+        names = append(names, configFieldNames(field.Type)...)
+    }
+    return names
+}
+
+func editDistance(a, b string) int {
+    prev := make([]int, len(b)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        cur := make([]int, len(b)+1)
+        cur[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+        }
+        prev = cur
+    }
+    return prev[len(b)]
+}
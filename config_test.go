@@ -0,0 +1,104 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/pion/webrtc/v3"
+)
+
+func TestSTUNURLs(t *testing.T) {
+    custom := []string{"stun:a.example:3478", "stuns:b.example"}
+    tests := []struct {
+        name   string
+        config Config
+        want   []string
+    }{
+        {"default", Config{}, defaultSTUNServers},
+        {"configured", Config{STUNServers: custom}, custom},
+        {"none", Config{NoSTUN: true}, nil},
+        {"ice_servers only", Config{ICEServers: []ICEServer{{URLs: []string{"stun:c.example"}}}}, nil},
+    }
+    for _, test := range tests {
+        if got := test.config.STUNURLs(); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestApplySTUNFlag(t *testing.T) {
+    config := Config{NoSTUN: true}
+    if err := applySTUNFlag(&config, "stun:a.example, stun:b.example:3478"); err != nil {
+        t.Fatal(err)
+    }
+    if config.NoSTUN || len(config.STUNServers) != 2 || config.STUNServers[1] != "stun:b.example:3478" {
+        t.Errorf("got %+v", config)
+    }
+    if err := applySTUNFlag(&config, "none"); err != nil || !config.NoSTUN || config.STUNServers != nil {
+        t.Errorf("none gave %+v, %v", config, err)
+    }
+    if err := applySTUNFlag(&config, "turn:relay.example"); err == nil {
+        t.Error("a TURN URL was accepted")
+    }
+}
+
+func TestICEServersConfig(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "config.json")
+    data := `{
+  "server_ip": "ws://localhost:8080",
+  "ice_servers": [
+    {"urls": "stun:stun.example.com"},
+    {"urls": ["turn:turn.example.com:3478", "turns:turn.example.com:5349"], "username": "u", "credential": "p", "credential_type": "password"}
+  ]
+}`
+    if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    config, err := loadConfig(path, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(config.ICEServers) != 2 || len(config.ICEServers[0].URLs) != 1 || len(config.ICEServers[1].URLs) != 2 {
+        t.Errorf("got %+v", config.ICEServers)
+    }
+
+    config.ICEServers[1].CredentialType = "token"
+    if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "credential_type") {
+        t.Errorf("an unknown credential type gave %v", err)
+    }
+
+    config.ICEServers[1] = ICEServer{URLs: []string{"turn:turn.example.com"}, Username: "kid", CredentialType: "oauth", MACKey: "mac"}
+    if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "access_token") {
+        t.Errorf("an OAuth server without an access token gave %v", err)
+    }
+    config.ICEServers[1].AccessToken = "token"
+    if err := config.Validate(); err != nil {
+        t.Errorf("an OAuth server: %v", err)
+    }
+    servers := iceServersFor(config, nil)
+    if servers[1].CredentialType != webrtc.ICECredentialTypeOauth {
+        t.Errorf("got %+v", servers[1])
+    }
+
+    config.TURNCredentials = TURNCredentialsConfig{URL: "https://example.com/turn", Command: []string{"turn-creds"}}
+    if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "cannot be used together") {
+        t.Errorf("both url and command gave %v", err)
+    }
+    config.TURNCredentials = TURNCredentialsConfig{}
+
+    config.TURNServers = []TURNServer{{URL: "stun:stun.example.com"}}
+    if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "must start with turn:") {
+        t.Errorf("a STUN URL in turn_servers gave %v", err)
+    }
+    config.TURNServers[0].URL = "turn:turn.example.com"
+    if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "username and credential") {
+        t.Errorf("a TURN server without credentials gave %v", err)
+    }
+    config.TURNServers[0].Username, config.TURNServers[0].Credential = "user", "secret"
+    if err := config.Validate(); err != nil {
+        t.Errorf("a TURN server: %v", err)
+    }
+}
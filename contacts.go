@@ -0,0 +1,153 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+)
+
+// Contact is a known peer saved in the address book.
+type Contact struct {
+    ID    string `json:"id"`
+    Alias string `json:"alias"`
+}
+
+// Contacts is the local address book mapping peer IDs to aliases. A nil
+// *Contacts behaves as an empty book.
+type Contacts struct {
+    path string
+
+    mu   sync.Mutex
+    byID map[string]string
+}
+
+// contacts is the address book loaded at startup, used wherever a peer ID is
+// shown to the user.
+var contacts *Contacts
+
+func defaultContactsPath() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return "contacts.json"
+    }
+    return filepath.Join(dir, "webrtc-chat", "contacts.json")
+}
+
+func loadContacts(path string) (*Contacts, error) {
+    c := &Contacts{path: path, byID: map[string]string{}}
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return c, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var list []Contact
+    if err := json.Unmarshal(data, &list); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    for _, contact := range list {
+        c.byID[contact.ID] = contact.Alias
+    }
+    return c, nil
+}
+
+// Add saves id under alias, replacing any previous alias for either.
+func (c *Contacts) Add(id, alias string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for existing, a := range c.byID {
+        if a == alias && existing != id {
+            return fmt.Errorf("alias %q is already used for %s", alias, existing)
+        }
+    }
+    c.byID[id] = alias
+    return c.save()
+}
+
+// Remove deletes the contact with the given alias or ID.
+func (c *Contacts) Remove(aliasOrID string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    id, ok := c.lookup(aliasOrID)
+    if !ok {
+        return fmt.Errorf("no contact %q", aliasOrID)
+    }
+    delete(c.byID, id)
+    return c.save()
+}
+
+// Resolve turns an alias into a peer ID; anything else is returned as is.
+func (c *Contacts) Resolve(aliasOrID string) string {
+    if c == nil {
+        return aliasOrID
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if id, ok := c.lookup(aliasOrID); ok {
+        return id
+    }
+    return aliasOrID
+}
+
+// Alias returns the alias saved for id, or "".
+func (c *Contacts) Alias(id string) string {
+    if c == nil {
+        return ""
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.byID[id]
+}
+
+// Label is how a peer ID is shown: its alias when there is one.
+func (c *Contacts) Label(id string) string {
+    if alias := c.Alias(id); alias != "" {
+        return alias
+    }
+    return id
+}
+
+// List returns the contacts sorted by alias.
+func (c *Contacts) List() []Contact {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.sorted()
+}
+
+func (c *Contacts) sorted() []Contact {
+    list := make([]Contact, 0, len(c.byID))
+    for id, alias := range c.byID {
+        list = append(list, Contact{ID: id, Alias: alias})
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Alias < list[j].Alias })
+    return list
+}
+
+func (c *Contacts) lookup(aliasOrID string) (string, bool) {
+    if _, ok := c.byID[aliasOrID]; ok {
+        return aliasOrID, true
+    }
+    for id, alias := range c.byID {
+        if alias == aliasOrID {
+            return id, true
+        }
+    }
+    return "", false
+}
+
+func (c *Contacts) save() error {
+    data, err := json.MarshalIndent(c.sorted(), "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+        return err
+    }
+    return os.WriteFile(c.path, data, 0o600)
+}
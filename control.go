@@ -0,0 +1,138 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// Protocol metadata travels on its own "control" data channel so the "chat"
+// channel carries nothing but what the user typed. Each frame is one JSON
+// object, sealed like any other frame when E2E is on:
+//
+//	{"type":"join","from":<id>,"ts":<unix ms>,"name":<display name>,"version":<n>,"min_version":<n>,"features":[...],"client":<build>,"platform":<os/arch>}
+//	{"type":"leave","from":<id>,"ts":<unix ms>}
+//	{"type":"ping","from":<id>,"ts":<unix ms>,"id":<ping id>}
+//	{"type":"pong","from":<id>,"ts":<unix ms>,"id":<ping id>}
+//	{"type":"ack","from":<id>,"ts":<unix ms>,"seq":<envelope seq>}
+//	{"type":"keepalive","from":<id>,"ts":<unix ms>}
+//	{"type":"sync","from":<id>,"ts":<unix ms>,"ref":<message id>}
+//	{"type":"nick","from":<id>,"ts":<unix ms>,"name":<new display name>}
+//
+// Peers that predate the control channel send the same actions as control
+// envelopes on "chat"; those are still understood.
+//
+// The join is the hello each side sends when the control channel opens.
+// Its version and min_version are the newest and oldest peer protocol
+// versions the sender speaks, and both sides then speak the newest version
+// they have in common. If there is none the conversation is refused rather
+// than carried on in a format one side would misread. A join without a
+// version comes from a build older than versioning, which spoke version 1.
+const (
+    peerProtocolVersion    = 1
+    minPeerProtocolVersion = 1
+)
+
+// Control message types
+const (
+    controlJoin  = "join"  // Name is the sender's display name, Features what it supports
+    controlLeave = "leave" // no fields
+    controlPing  = "ping"  // ID identifies the ping
+    controlPong  = "pong"  // ID is the ping being answered
+    controlAck   = "ack"   // Seq is the envelope acknowledged; see retransmitter
+
+    controlKeepalive = "keepalive" // no fields; see runKeepalive
+    controlSync      = "sync"      // Ref is the last message seen from the peer; see SyncHistory
+    controlNick      = "nick"      // Name is the sender's new display name; see SetName
+)
+
+// How long a control frame waits for the E2E key, which arrives on the chat
+// channel and so may be overtaken by frames on this one.
+const controlKeyTimeout = 10 * time.Second
+
+// ControlMessage is a single message on the control channel.
+type ControlMessage struct {
+    Type      string   `json:"type"`
+    From      string   `json:"from"`
+    Timestamp int64    `json:"ts"` // sender's clock, Unix milliseconds
+    Name      string   `json:"name,omitempty"`
+    ID        string   `json:"id,omitempty"`
+    Features  []string `json:"features,omitempty"`
+    Seq       uint64   `json:"seq,omitempty"`
+    Ref       string   `json:"ref,omitempty"`
+
+    Version    int `json:"version,omitempty"`
+    MinVersion int `json:"min_version,omitempty"`
+    // What the sender runs, for /whois and debugging interop
+    Client   string `json:"client,omitempty"`
+    Platform string `json:"platform,omitempty"`
+}
+
+// negotiateVersion returns the peer protocol version to speak with the
+// sender of join, or an error if there is none both sides speak.
+func negotiateVersion(join *ControlMessage) (int, error) {
+    theirs, theirMin := max(join.Version, 1), max(join.MinVersion, 1)
+    version := min(theirs, peerProtocolVersion)
+    if version < max(theirMin, minPeerProtocolVersion) {
+        return 0, fmt.Errorf("the peer speaks protocol v%d-v%d, this client v%d-v%d", theirMin, theirs, minPeerProtocolVersion, peerProtocolVersion)
+    }
+    return version, nil
+}
+
+// localFeatures are the optional protocol features this client supports,
+// advertised in the join message along with featureE2E when E2E is on. A
+// feature is used only if both joins list it, so new ones can be rolled out
+// without breaking conversations with builds that lack them.
+var localFeatures = []string{featureZstd, featureProtobuf, featureMsgpack, featureAck, featureKeepalive, featureFiles, featureSync, featurePrivate}
+
+// legacyFeatures are assumed for peers whose join has no version: they
+// predate feature lists but every build had these.
+var legacyFeatures = []string{featureFiles}
+
+// sharedFeatures are the features in both ours and theirs.
+func sharedFeatures(ours, theirs []string) []string {
+    var shared []string
+    for _, feature := range ours {
+        if containsString(theirs, feature) {
+            shared = append(shared, feature)
+        }
+    }
+    return shared
+}
+
+func newControlMessage(typ string, from string) *ControlMessage {
+    return &ControlMessage{
+        Type:      typ,
+        From:      from,
+        Timestamp: time.Now().UnixMilli(),
+    }
+}
+
+func encodeControl(m *ControlMessage) ([]byte, error) {
+    return json.Marshal(m)
+}
+
+func decodeControl(data []byte) (*ControlMessage, error) {
+    var m ControlMessage
+    if err := json.Unmarshal(data, &m); err != nil {
+        return nil, err
+    }
+    if m.Type == "" {
+        return nil, errors.New("control: missing type")
+    }
+    return &m, nil
+}
+
+// controlFromEnvelope converts a control envelope from an older peer.
+func controlFromEnvelope(env *Envelope) *ControlMessage {
+    m := &ControlMessage{
+        Type:      env.Control,
+        From:      env.Sender,
+        Timestamp: env.Timestamp,
+    }
+    if env.Control == controlJoin {
+        m.Name = string(env.Payload)
+    }
+    return m
+}
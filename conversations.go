@@ -0,0 +1,571 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// Several peers can be talked to at once, each in a conversation of its
+// own: a peer connection, the Chat over it and the signaling state that goes
+// with them. One conversation is active: typed lines and commands go to it
+// and its messages are shown as they arrive. Messages in the others are held
+// until /switch makes theirs the active one. With a signaling server, an
+// offer from a peer nobody is talking to yet, or /connect while already
+// paired, starts a new conversation; the other signaling modes pair one
+// peer.
+
+// conversation is the state kept for one peer.
+type conversation struct {
+    conn           Signaler
+    clientID       string
+    peerConnection *webrtc.PeerConnection
+    chat           *Chat
+    negotiation    *negotiation
+    candidates     *candidateQueue
+    reconnector    *peerReconnector // nil when reconnecting is off
+    media          *Media
+    verification   *Verification
+    // where its status goes
+    display Display
+    // the peer, set by its signaling loop or /connect and read from
+    // pion's callbacks, so behind mu
+    mu       sync.Mutex
+    targetID string
+    // called when the conversation ends for good; it reports whether
+    // others carry on, and otherwise the client exits
+    onEnd func(reason string) bool
+    ended atomic.Bool
+
+    number int // shown by /switch, from 1
+    view   *conversationDisplay
+}
+
+func newConversation(conn Signaler, clientID string, peerConnection *webrtc.PeerConnection) *conversation {
+    c := &conversation{
+        conn:           conn,
+        clientID:       clientID,
+        peerConnection: peerConnection,
+        display:        display,
+    }
+    c.candidates = newCandidateQueue(conn, clientID)
+    c.negotiation = newNegotiation(clientID, c.candidates)
+    return c
+}
+
+// end finishes the conversation, exiting with code unless others carry on.
+func (c *conversation) end(code int, format string, args ...interface{}) {
+    if !c.ended.CompareAndSwap(false, true) {
+        return
+    }
+    if c.onEnd != nil && c.onEnd(fmt.Sprintf(format, args...)) {
+        c.conn.Close()
+        return
+    }
+    c.conn.Close()
+    exitWith(code, format, args...)
+}
+
+// target is the peer the conversation is with, "" until there is one.
+func (c *conversation) target() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.targetID
+}
+
+func (c *conversation) setTarget(peerID string) {
+    c.mu.Lock()
+    c.targetID = peerID
+    c.mu.Unlock()
+}
+
+// claimTarget makes peerID the peer unless there is one already, and
+// reports whether it did.
+func (c *conversation) claimTarget(peerID string) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.targetID != "" {
+        return false
+    }
+    c.targetID = peerID
+    return true
+}
+
+// pair sends peerID's signaling to this conversation, for when it calls
+// the peer itself.
+func (c *conversation) pair(peerID string) {
+    if signals, ok := c.conn.(*peerSignaler); ok {
+        signals.Pair(peerID)
+    }
+}
+
+// label is how /switch shows the conversation.
+func (c *conversation) label() string {
+    if name := c.chat.PeerName(); name != "" {
+        return name
+    }
+    if peer := c.chat.PeerInfo().ID; peer != "" {
+        return contacts.Label(peer)
+    }
+    if target := c.target(); target != "" {
+        return contacts.Label(target)
+    }
+    return "waiting for peer"
+}
+
+// conversationDisplay is a conversation's view of the display. While the
+// conversation isn't the active one its peer's messages are held back and
+// its status is only remembered; activate shows both.
+type conversationDisplay struct {
+    Display
+
+    mu     sync.Mutex
+    active bool
+    held   []heldMessage
+    status map[string]string
+    onHeld func() // called when a message is held
+}
+
+func newConversationDisplay(d Display, onHeld func()) *conversationDisplay {
+    return &conversationDisplay{Display: d, status: map[string]string{}, onHeld: onHeld}
+}
+
+func (d *conversationDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    d.mu.Lock()
+    if d.active {
+        d.mu.Unlock()
+        d.Display.PrintMessage(sender, senderID, id, data, isString, sentAt)
+        return
+    }
+    d.held = append(d.held, heldMessage{sender, senderID, id, data, isString, sentAt})
+    d.mu.Unlock()
+    d.onHeld()
+}
+
+func (d *conversationDisplay) SetStatus(key, value string) {
+    d.mu.Lock()
+    d.status[key] = value
+    active := d.active
+    d.mu.Unlock()
+    if active {
+        d.Display.SetStatus(key, value)
+    }
+}
+
+// Unread is how many messages are held.
+func (d *conversationDisplay) Unread() int {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return len(d.held)
+}
+
+// release returns what is held and stops holding it, for a conversation
+// that has ended.
+func (d *conversationDisplay) release() []heldMessage {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    held := d.held
+    d.held = nil
+    return held
+}
+
+// activate makes this the shown conversation in place of previous, which
+// may be nil, and shows what was held.
+func (d *conversationDisplay) activate(previous *conversationDisplay) {
+    var stale []string
+    if previous != nil {
+        previous.mu.Lock()
+        previous.active = false
+        for key := range previous.status {
+            stale = append(stale, key)
+        }
+        previous.mu.Unlock()
+    }
+
+    d.mu.Lock()
+    d.active = true
+    status := make(map[string]string, len(d.status))
+    for key, value := range d.status {
+        status[key] = value
+    }
+    held := d.held
+    d.held = nil
+    d.mu.Unlock()
+
+    for _, key := range stale {
+        if _, ok := status[key]; !ok {
+            d.Display.SetStatus(key, "")
+        }
+    }
+    for key, value := range status {
+        d.Display.SetStatus(key, value)
+    }
+    for _, msg := range held {
+        d.Display.PrintMessage(msg.sender, msg.senderID, msg.id, msg.data, msg.isString, msg.sentAt)
+    }
+}
+
+// conversations keeps track of the conversations and which is active.
+type conversations struct {
+    mu     sync.Mutex
+    list   []*conversation
+    active *conversation
+    next   int
+}
+
+// Add numbers c and makes it active if it is the first.
+func (cs *conversations) Add(c *conversation) {
+    cs.mu.Lock()
+    cs.next++
+    c.number = cs.next
+    cs.list = append(cs.list, c)
+    first := cs.active == nil
+    if first {
+        cs.active = c
+    }
+    cs.mu.Unlock()
+    if first {
+        c.view.activate(nil)
+    }
+}
+
+// Active returns the conversation typed lines go to.
+func (cs *conversations) Active() *conversation {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    return cs.active
+}
+
+// List returns the conversations in the order they started.
+func (cs *conversations) List() []*conversation {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    return append([]*conversation(nil), cs.list...)
+}
+
+// Switch makes c the active conversation.
+func (cs *conversations) Switch(c *conversation) {
+    cs.mu.Lock()
+    previous := cs.active
+    cs.active = c
+    cs.mu.Unlock()
+    if previous == c {
+        return
+    }
+    c.view.activate(previous.view)
+    cs.showUnread()
+}
+
+// Remove forgets c, switching to another conversation if it was active. It
+// reports whether any are left.
+func (cs *conversations) Remove(c *conversation) bool {
+    cs.mu.Lock()
+    for i, other := range cs.list {
+        if other == c {
+            cs.list = append(cs.list[:i], cs.list[i+1:]...)
+            break
+        }
+    }
+    left := len(cs.list) > 0
+    var next *conversation
+    if cs.active == c && left {
+        next = cs.list[0]
+    }
+    cs.mu.Unlock()
+    if next != nil {
+        cs.Switch(next)
+        display.Printf("[switch] now in #%d with %s\n", next.number, next.label())
+    }
+    return left
+}
+
+// Find returns the conversation arg names: its number as /switch lists
+// it, or its peer's ID, alias, code or name.
+func (cs *conversations) Find(arg string) (*conversation, error) {
+    list := cs.List()
+    if n, err := strconv.Atoi(strings.TrimPrefix(arg, "#")); err == nil {
+        for _, c := range list {
+            if c.number == n {
+                return c, nil
+            }
+        }
+        return nil, fmt.Errorf("no conversation #%d", n)
+    }
+    id, err := resolvePeer(arg)
+    if err != nil {
+        return nil, err
+    }
+    for _, c := range list {
+        if c.chat.PeerInfo().ID == id || c.chat.PeerName() == arg {
+            return c, nil
+        }
+    }
+    return nil, fmt.Errorf("no conversation with %s", arg)
+}
+
+// showUnread puts the conversations with held messages in the status.
+func (cs *conversations) showUnread() {
+    var unread []string
+    for _, c := range cs.List() {
+        if n := c.view.Unread(); n > 0 {
+            unread = append(unread, fmt.Sprintf("#%d %s (%d)", c.number, c.label(), n))
+        }
+    }
+    display.SetStatus("unread", strings.Join(unread, ", "))
+}
+
+// Format lists the conversations for /switch.
+func (cs *conversations) Format() string {
+    active := cs.Active()
+    var b strings.Builder
+    for _, c := range cs.List() {
+        marker := ""
+        if c == active {
+            marker = " (active)"
+        } else if n := c.view.Unread(); n > 0 {
+            marker = fmt.Sprintf(" (%d new)", n)
+        }
+        fmt.Fprintf(&b, "  #%d %s%s\n", c.number, c.label(), marker)
+    }
+    return b.String()
+}
+
+// errNotConnected is what /all reports for a peer whose data channel
+// hasn't opened yet; it isn't queued for them.
+var errNotConnected = errors.New("not connected")
+
+// broadcastResult is how a message sent with /all fared with one peer.
+type broadcastResult struct {
+    conversation *conversation
+    err          error // nil once the message is on its way
+}
+
+// Broadcast sends data to every conversation with an open data channel and
+// reports how it went with each peer. Conversations still waiting for a
+// peer are left out.
+func (cs *conversations) Broadcast(data []byte) []broadcastResult {
+    var results []broadcastResult
+    for _, c := range cs.List() {
+        if c.chat == nil || (c.target() == "" && c.chat.PeerInfo().ID == "") {
+            continue
+        }
+        result := broadcastResult{conversation: c, err: errNotConnected}
+        if c.chat.Connected() {
+            result.err = c.chat.Send(data)
+        }
+        results = append(results, result)
+    }
+    return results
+}
+
+// formatBroadcast lists the results of /all, one peer to a line.
+func formatBroadcast(results []broadcastResult) string {
+    var b strings.Builder
+    for _, result := range results {
+        status := "sent"
+        if result.err != nil {
+            status = result.err.Error()
+        }
+        fmt.Fprintf(&b, "[all] #%d %s: %s\n", result.conversation.number, result.conversation.label(), status)
+    }
+    return b.String()
+}
+
+// errSignalerClosed is what a closed conversation's signaler reads.
+var errSignalerClosed = errors.New("conversation ended")
+
+// signalRouter shares one signaling connection between the conversations.
+// It reads every message and hands it to the signaler of the conversation it
+// concerns, so each conversation's signaling loop runs as if it had the
+// connection to itself. Messages from the server that aren't about a peer
+// go to the oldest conversation.
+type signalRouter struct {
+    conn Signaler
+    // starts a conversation for an offer from a new peer; nil if the
+    // signaling mode pairs one peer only
+    onNewPeer func() *peerSignaler
+
+    mu        sync.Mutex
+    signalers []*peerSignaler
+    peers     map[string]*peerSignaler // by the peer's client ID
+}
+
+// peerSignaler is a conversation's view of the signaling connection.
+type peerSignaler struct {
+    router   *signalRouter
+    messages chan SignalingMessage
+    done     chan struct{}
+    once     sync.Once
+}
+
+func newSignalRouter(conn Signaler) *signalRouter {
+    return &signalRouter{conn: conn, peers: map[string]*peerSignaler{}}
+}
+
+// Signaler adds a conversation's signaler.
+func (r *signalRouter) Signaler() *peerSignaler {
+    s := &peerSignaler{router: r, messages: make(chan SignalingMessage, 64), done: make(chan struct{})}
+    r.mu.Lock()
+    r.signalers = append(r.signalers, s)
+    r.mu.Unlock()
+    return s
+}
+
+// Unpaired reports whether a conversation is still waiting to be paired.
+func (r *signalRouter) Unpaired() bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.unpaired() != nil
+}
+
+func (r *signalRouter) unpaired() *peerSignaler {
+    for _, s := range r.signalers {
+        if !r.paired(s) {
+            return s
+        }
+    }
+    return nil
+}
+
+func (r *signalRouter) paired(s *peerSignaler) bool {
+    for _, other := range r.peers {
+        if other == s {
+            return true
+        }
+    }
+    return false
+}
+
+// Run reads from the connection until shutdown.
+func (r *signalRouter) Run() {
+    for {
+        var message SignalingMessage
+        if err := r.conn.ReadJSON(&message); err != nil {
+            if shuttingDown.Load() {
+                return
+            }
+            // The conversations' loops only see what is routed to them, so
+            // a message that couldn't be read is logged and skipped here
+            log.Println("シグナリングメッセージ受信エラー: ", err)
+            continue
+        }
+        s := r.route(message)
+        if s == nil {
+            continue
+        }
+        select {
+        case s.messages <- message:
+        case <-s.done:
+        }
+    }
+}
+
+// route picks the signaler message goes to, starting a conversation for an
+// offer from a new peer.
+func (r *signalRouter) route(message SignalingMessage) *peerSignaler {
+    r.mu.Lock()
+    if len(r.signalers) == 0 {
+        r.mu.Unlock()
+        return nil
+    }
+    oldest := r.signalers[0]
+    if fromPeer(message) {
+        if s := r.peers[message.ID]; s != nil {
+            r.mu.Unlock()
+            return s
+        }
+        if message.Type != "offer" || message.ID == "" {
+            // The oldest conversation logs and drops it as before
+            r.mu.Unlock()
+            return oldest
+        }
+        s := r.unpaired()
+        if s == nil && r.onNewPeer != nil {
+            r.mu.Unlock()
+            s = r.onNewPeer()
+            r.mu.Lock()
+        }
+        if s == nil {
+            s = oldest
+        } else {
+            r.peers[message.ID] = s
+        }
+        r.mu.Unlock()
+        return s
+    }
+    defer r.mu.Unlock()
+    if message.Type == "signaling_response" {
+        // The server pairs whoever asked, which is a conversation still
+        // waiting
+        s := r.unpaired()
+        if s == nil {
+            return oldest
+        }
+        if message.Request == "offer" && message.TargetID != "" {
+            r.peers[message.TargetID] = s
+        }
+        return s
+    }
+    return oldest
+}
+
+// Pair routes peerID's messages to s, for conversations that call the peer
+// themselves.
+func (s *peerSignaler) Pair(peerID string) {
+    s.router.mu.Lock()
+    defer s.router.mu.Unlock()
+    s.router.peers[peerID] = s
+}
+
+func (s *peerSignaler) WriteJSON(v interface{}) error {
+    return s.router.conn.WriteJSON(v)
+}
+
+func (s *peerSignaler) ReadJSON(v interface{}) error {
+    var message SignalingMessage
+    select {
+    case message = <-s.messages:
+    case <-s.done:
+        return errSignalerClosed
+    }
+    if m, ok := v.(*SignalingMessage); ok {
+        *m = message
+        return nil
+    }
+    data, err := json.Marshal(message)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// Close ends the conversation's signaling; the connection stays open for
+// the others.
+func (s *peerSignaler) Close() error {
+    s.once.Do(func() {
+        close(s.done)
+        r := s.router
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        for i, other := range r.signalers {
+            if other == s {
+                r.signalers = append(r.signalers[:i], r.signalers[i+1:]...)
+                break
+            }
+        }
+        for peer, other := range r.peers {
+            if other == s {
+                delete(r.peers, peer)
+            }
+        }
+    })
+    return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSignalRouterRoutesByPeer(t *testing.T) {
+    conn, _ := newFakeSignalerPair()
+    router := newSignalRouter(conn)
+    first := router.Signaler()
+    created := make(chan *peerSignaler, 1)
+    router.onNewPeer = func() *peerSignaler {
+        s := router.Signaler()
+        created <- s
+        return s
+    }
+    go router.Run()
+
+    read := func(s *peerSignaler) SignalingMessage {
+        t.Helper()
+        done := make(chan SignalingMessage, 1)
+        go func() {
+            var message SignalingMessage
+            if err := s.ReadJSON(&message); err == nil {
+                done <- message
+            }
+        }()
+        select {
+        case message := <-done:
+            return message
+        case <-time.After(5 * time.Second):
+            t.Fatal("nothing was routed")
+        }
+        return SignalingMessage{}
+    }
+
+    // The waiting conversation is the one the server pairs
+    conn.inject(SignalingMessage{Type: "signaling_response", Request: "offer", TargetID: "bob-id"})
+    if got := read(first); got.TargetID != "bob-id" {
+        t.Fatalf("the first conversation got %+v", got)
+    }
+    if router.Unpaired() {
+        t.Error("the first conversation is still unpaired")
+    }
+
+    // An offer from someone else starts a conversation of its own
+    conn.inject(SignalingMessage{Type: "offer", ID: "carol-id", Offer: "v=0"})
+    var second *peerSignaler
+    select {
+    case second = <-created:
+    case <-time.After(5 * time.Second):
+        t.Fatal("no conversation was started for carol")
+    }
+    if got := read(second); got.ID != "carol-id" {
+        t.Fatalf("the new conversation got %+v", got)
+    }
+    conn.inject(SignalingMessage{Type: "answer", ID: "bob-id", Answer: "v=0"})
+    if got := read(first); got.Type != "answer" {
+        t.Fatalf("bob's answer went elsewhere: %+v", got)
+    }
+    conn.inject(SignalingMessage{Type: "candidate", ID: "carol-id"})
+    if got := read(second); got.Type != "candidate" {
+        t.Fatalf("carol's candidate went elsewhere: %+v", got)
+    }
+
+    second.Close()
+    var message SignalingMessage
+    if err := second.ReadJSON(&message); err != errSignalerClosed {
+        t.Errorf("a closed signaler read %v", err)
+    }
+}
+
+func TestConversationDisplayHoldsMessages(t *testing.T) {
+    shown := useFakeDisplay(t)
+    heldCount := 0
+    first := newConversationDisplay(display, func() {})
+    second := newConversationDisplay(display, func() { heldCount++ })
+    first.activate(nil)
+
+    second.SetStatus("peer", "carol")
+    second.PrintMessage("carol", "carol-id", "", []byte("hi\n"), true, time.Now())
+    if len(shown.Messages()) != 0 || heldCount != 1 || second.Unread() != 1 {
+        t.Fatalf("an inactive conversation's message was shown: %q", shown.Messages())
+    }
+
+    second.activate(first)
+    if got := shown.Messages(); len(got) != 1 || got[0] != "carol: hi\n" {
+        t.Errorf("switching showed %q", got)
+    }
+    if second.Unread() != 0 {
+        t.Error("the message is still held")
+    }
+    first.PrintMessage("bob", "bob-id", "", []byte("hello\n"), true, time.Now())
+    if len(shown.Messages()) != 1 {
+        t.Error("the conversation switched away from still shows messages")
+    }
+}
+
+func TestBroadcastReportsEachPeer(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    open(t, shown, alice, bob)
+    waiting, _ := newChatPair(t)
+
+    convs := &conversations{}
+    for _, c := range []*conversation{
+        {chat: alice.Chat},
+        {chat: waiting.Chat, targetID: "carol-id"},
+        {chat: newChat(newFakeTransport(), newFakeTransport(), newFakeTransport(), nil, nil, "x", Config{})},
+    } {
+        c.view = newConversationDisplay(display, func() {})
+        convs.Add(c)
+    }
+
+    results := convs.Broadcast([]byte("hi all\n"))
+    if len(results) != 2 {
+        t.Fatalf("got %d results, want one per peer", len(results))
+    }
+    if results[0].err != nil || results[1].err != errNotConnected {
+        t.Errorf("got %v and %v", results[0].err, results[1].err)
+    }
+    eventually(t, "the message", func() bool { return len(shown.Messages()) == 1 })
+    if got := shown.Messages()[0]; got != "alice: hi all\n" {
+        t.Errorf("bob saw %q", got)
+    }
+    if got := formatBroadcast(results); got != "[all] #1 bob: sent\n[all] #2 carol-id: not connected\n" {
+        t.Errorf("reported %q", got)
+    }
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+    "archive/tar"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Directories travel as a tar stream inside an ordinary file transfer. The
+// receiver keeps the archive aside until the user runs /unpack, then
+// extracts only regular files and directories, refusing any entry whose
+// path would land outside the destination.
+
+// receivedArchive is a directory that arrived and awaits /unpack or /discard.
+type receivedArchive struct {
+    meta fileMetadata
+    path string // the tar file
+}
+
+// sendDirectory streams a tar of dir. Symlinks and special files are
+// skipped, so the peer only ever gets plain files.
+func (t *FileTransfers) sendDirectory(dir string) error {
+    files, size, err := directorySize(dir)
+    if err != nil {
+        return err
+    }
+
+    pr, pw := io.Pipe()
+    go func() {
+        pw.CloseWithError(writeTar(pw, dir))
+    }()
+    defer pr.Close()
+
+    name := filepath.Base(filepath.Clean(dir))
+    meta := fileMetadata{Name: name, Size: size, Kind: fileKindDir, Files: files}
+    return t.sendStream(meta, name+"/", pr)
+}
+
+// directorySize counts the files under dir and estimates the size of their
+// tar archive: a 512-byte header per entry, contents padded to 512 bytes
+// and the two-block trailer.
+func directorySize(dir string) (files int, size int64, err error) {
+    size = 2 * 512
+    err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if p == dir {
+            return nil
+        }
+        switch {
+        case d.IsDir():
+            size += 512
+        case d.Type().IsRegular():
+            info, err := d.Info()
+            if err != nil {
+                return err
+            }
+            files++
+            size += 512 + (info.Size()+511)/512*512
+        }
+        return nil
+    })
+    return files, size, err
+}
+
+func writeTar(w io.Writer, dir string) error {
+    tw := tar.NewWriter(w)
+    err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if p == dir || !(d.IsDir() || d.Type().IsRegular()) {
+            return nil
+        }
+        rel, err := filepath.Rel(dir, p)
+        if err != nil {
+            return err
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        header, err := tar.FileInfoHeader(info, "")
+        if err != nil {
+            return err
+        }
+        header.Name = filepath.ToSlash(rel)
+        if d.IsDir() {
+            header.Name += "/"
+        }
+        // Local account names mean nothing to the peer
+        header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+        if err := tw.WriteHeader(header); err != nil {
+            return err
+        }
+        if d.IsDir() {
+            return nil
+        }
+        file, err := os.Open(p)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        _, err = io.Copy(tw, file)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    return tw.Close()
+}
+
+// holdArchive keeps a received directory until the user decides what to
+// do with it.
+func (t *FileTransfers) holdArchive(in *incomingFile) {
+    t.mu.Lock()
+    t.archives = append(t.archives, &receivedArchive{meta: in.meta, path: in.path})
+    t.mu.Unlock()
+    display.Printf("[file] peer sent directory %s/ (%d files). /unpack to extract it into %s, /discard to delete it\n",
+        sanitizeFileName(in.meta.Name), in.meta.Files, t.downloadDir)
+}
+
+// nextArchive removes and returns the oldest directory awaiting a decision.
+func (t *FileTransfers) nextArchive() (*receivedArchive, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if len(t.archives) == 0 {
+        return nil, errors.New("no received directory to unpack")
+    }
+    archive := t.archives[0]
+    t.archives = t.archives[1:]
+    return archive, nil
+}
+
+// Unpack extracts the oldest received directory into the download
+// directory.
+func (t *FileTransfers) Unpack() error {
+    archive, err := t.nextArchive()
+    if err != nil {
+        return err
+    }
+    defer os.Remove(archive.path)
+
+    dest, err := createUniqueDir(t.downloadDir, sanitizeFileName(archive.meta.Name))
+    if err != nil {
+        return err
+    }
+    files, err := extractTar(archive.path, dest)
+    if err != nil {
+        return fmt.Errorf("%s: %w (partially extracted into %s)", archive.meta.Name, err, dest)
+    }
+    display.Printf("[file] unpacked %d files -> %s\n", files, dest)
+    return nil
+}
+
+// Discard deletes the oldest received directory without extracting it.
+func (t *FileTransfers) Discard() error {
+    archive, err := t.nextArchive()
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(archive.path); err != nil {
+        return err
+    }
+    display.Printf("[file] discarded directory %s\n", archive.meta.Name)
+    return nil
+}
+
+// Cleanup deletes archives that were never unpacked.
+func (t *FileTransfers) Cleanup() {
+    t.mu.Lock()
+    archives := t.archives
+    t.archives = nil
+    t.mu.Unlock()
+    for _, archive := range archives {
+        if err := os.Remove(archive.path); err != nil {
+            log.Println("一時ファイル削除エラー: ", err)
+        }
+    }
+}
+
+// extractTar unpacks the archive at tarPath into dest and returns the
+// number of files written.
+func extractTar(tarPath, dest string) (int, error) {
+    file, err := os.Open(tarPath)
+    if err != nil {
+        return 0, err
+    }
+    defer file.Close()
+
+    files := 0
+    tr := tar.NewReader(file)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return files, nil
+        }
+        if err != nil {
+            return files, err
+        }
+
+        target, err := archiveEntryPath(dest, header.Name)
+        if err != nil {
+            return files, err
+        }
+        switch header.Typeflag {
+        case tar.TypeDir:
+            if err := os.MkdirAll(target, 0o755); err != nil {
+                return files, err
+            }
+        case tar.TypeReg:
+            if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+                return files, err
+            }
+            if err := writeArchiveFile(target, tr, header.Mode); err != nil {
+                return files, err
+            }
+            files++
+        default:
+            log.Printf("Skipping %s: unsupported tar entry type %c\n", header.Name, header.Typeflag)
+        }
+    }
+}
+
+// archiveEntryPath resolves an entry name inside dest, rejecting absolute
+// paths and anything that climbs out with "..".
+func archiveEntryPath(dest, name string) (string, error) {
+    if name == "" || strings.Contains(name, "\\") || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+        return "", fmt.Errorf("refusing unsafe path %q", name)
+    }
+    clean := path.Clean(name)
+    if clean == ".." || strings.HasPrefix(clean, "../") {
+        return "", fmt.Errorf("refusing unsafe path %q", name)
+    }
+    target := filepath.Join(dest, filepath.FromSlash(clean))
+    if rel, err := filepath.Rel(dest, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("refusing unsafe path %q", name)
+    }
+    return target, nil
+}
+
+// writeArchiveFile creates target from r. Only the executable bit is kept
+// from mode; nothing from the peer can set setuid or world-writable bits.
+func writeArchiveFile(target string, r io.Reader, mode int64) error {
+    perm := os.FileMode(0o644)
+    if mode&0o111 != 0 {
+        perm = 0o755
+    }
+    file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(file, r); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// createUniqueDir creates name in dir, appending a counter instead of
+// merging into an existing directory.
+func createUniqueDir(dir, name string) (string, error) {
+    for i := 0; ; i++ {
+        candidate := name
+        if i > 0 {
+            candidate = name + "." + strconv.Itoa(i)
+        }
+        p := filepath.Join(dir, candidate)
+        err := os.Mkdir(p, 0o755)
+        if errors.Is(err, os.ErrExist) {
+            continue
+        }
+        return p, err
+    }
+}
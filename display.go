@@ -0,0 +1,162 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "time"
+
+    "golang.org/x/term"
+)
+
+// Display is where everything meant for the user ends up: the peer's
+// messages, client notices, transfer progress and connection status.
+type Display interface {
+    // PrintMessage shows content received from the peer. sender is the
+    // peer's display name, empty if they haven't announced one; senderID is
+    // their client ID, empty if not known yet; id is the message ID, empty
+    // for legacy messages; sentAt is the peer's clock when they sent it.
+    PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time)
+    // PrintSent echoes a message the user sent, for displays where the
+    // typed line doesn't stay visible on its own.
+    PrintSent(id string, data []byte, sentAt time.Time)
+    // Printf shows a client notice such as a transfer or encryption event.
+    Printf(format string, args ...interface{})
+    // Error shows a problem the user should know about, such as a failed
+    // command.
+    Error(text string)
+    // Progress shows a transient progress line identified by key; done
+    // finishes it.
+    Progress(key, line string, done bool)
+    // SetStatus updates a named connection status field (peer, state, ...).
+    SetStatus(key, value string)
+    // Alert draws attention to a new message with a beep, or a flash if
+    // visual is set.
+    Alert(visual bool)
+    Close()
+}
+
+var display Display = terminalDisplay{}
+
+// timestampFormat is the time.Format layout shown before messages, or ""
+// for none.
+var timestampFormat string
+
+// showMessageIDs shows each message's short ID, which /react refers to.
+var showMessageIDs bool
+
+// messagePrefix returns what goes before message id sent at t: its short ID
+// and timestamp when those are enabled.
+func messagePrefix(id string, t time.Time) string {
+    prefix := ""
+    if showMessageIDs && id != "" {
+        prefix = "#" + shortID(id) + " "
+    }
+    if timestampFormat != "" {
+        prefix += "[" + t.Local().Format(timestampFormat) + "] "
+    }
+    return prefix
+}
+
+// styleMessage renders the Markdown in a peer's message, unless -plain is
+// set, and highlights mentions of our name with mention's on and off
+// strings.
+func styleMessage(text string, style markdownStyle, mention [2]string) string {
+    escape := style.escape
+    style.escape = func(s string) string {
+        return highlightMentions(s, mention[0], mention[1], escape)
+    }
+    if plainOutput {
+        return style.escape(text)
+    }
+    return renderMarkdown(text, style)
+}
+
+// terminalDisplay is the plain line-oriented interface: peer content goes to
+// stdout so it can be piped, everything else goes to stderr. Text is
+// sanitized and transcoded for the terminal; binary content is written
+// untouched unless stdout is a terminal, where it is only summarized.
+type terminalDisplay struct{}
+
+// stdoutIsTerminal keeps styling out of piped output, and
+// stderrIsTerminal keeps bells out of redirected logs.
+var (
+    stdoutIsTerminal = term.IsTerminal(int(os.Stdout.Fd()))
+    stderrIsTerminal = term.IsTerminal(int(os.Stderr.Fd()))
+)
+
+var ansiMention = [2]string{"\x1b[7m", "\x1b[27m"}
+
+func (terminalDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    if isString {
+        fmt.Fprint(terminalOut, messagePrefix(id, sentAt))
+        if sender != "" {
+            name := sanitizeText(sender)
+            if stdoutIsTerminal {
+                name = ansiPeerName(senderID, name)
+            }
+            fmt.Fprintf(terminalOut, "%s: ", name)
+        }
+        text := sanitizeText(string(data))
+        if stdoutIsTerminal {
+            text = styleMessage(text, ansiMessageStyle(), ansiMention)
+        }
+        fmt.Fprintf(terminalOut, "%s", text)
+    } else if stdoutIsTerminal {
+        fmt.Fprint(terminalOut, messagePrefix(id, sentAt))
+        if sender != "" {
+            fmt.Fprintf(terminalOut, "%s: ", ansiPeerName(senderID, sanitizeText(sender)))
+        }
+        fmt.Fprintf(terminalOut, "<binary message, %d bytes>\n", len(data))
+    } else {
+        os.Stdout.Write(data)
+    }
+}
+
+// PrintSent only prints when there is a prefix to show: the typed line is
+// already on screen, but not its ID or when it was sent. The echo goes to
+// stderr so stdout keeps carrying just the peer's content.
+func (terminalDisplay) PrintSent(id string, data []byte, sentAt time.Time) {
+    prefix := messagePrefix(id, sentAt)
+    if prefix == "" {
+        return
+    }
+    fmt.Fprintf(terminalErr, "%syou: %s", prefix, ensureNewline(string(data)))
+}
+
+func (terminalDisplay) Printf(format string, args ...interface{}) {
+    fmt.Fprintf(terminalErr, format, sanitizeArgs(args)...)
+}
+
+func (terminalDisplay) Error(text string) {
+    fmt.Fprintln(terminalErr, sanitizeText(text))
+}
+
+func (terminalDisplay) Progress(key, line string, done bool) {
+    fmt.Fprintf(terminalErr, "\r%s", sanitizeText(line))
+    if done {
+        fmt.Fprintln(terminalErr)
+    }
+}
+
+func (terminalDisplay) SetStatus(key, value string) {
+    log.Printf("Status %s: %s\n", key, sanitizeText(value))
+}
+
+// Alert rings the terminal bell, or with visual briefly switches the
+// terminal to reverse video.
+func (terminalDisplay) Alert(visual bool) {
+    if !stderrIsTerminal {
+        return
+    }
+    if !visual {
+        writeTerminalControl("\a")
+        return
+    }
+    writeTerminalControl("\x1b[?5h")
+    time.AfterFunc(150*time.Millisecond, func() {
+        writeTerminalControl("\x1b[?5l")
+    })
+}
+
+func (terminalDisplay) Close() {}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/hkdf"
+)
+
+// Frames exchanged on the data channel when E2E is enabled. Every frame is
+// sent as binary and starts with one of these type bytes.
+const (
+    e2eKeyFrame  byte = 0x01 // followed by the sender's X25519 public key
+    e2eDataFrame byte = 0x02 // followed by a 24-byte nonce and the ciphertext
+)
+
+const e2eKeyInfo = "webrtc-chat e2e v1"
+
+// featureE2E is listed in the join when E2E is on. The join itself is
+// sealed then, so a peer that can read it has E2E on too; the listing is
+// for showing the user what the conversation uses.
+const featureE2E = "e2e"
+
+var errE2ENotReady = errors.New("e2e: key exchange not complete")
+
+// E2ESession encrypts data channel payloads with XChaCha20-Poly1305 under a
+// key agreed via X25519, so nothing between the two peers (signaling server,
+// TURN relay) can read them. The session is only as trustworthy as the
+// out-of-band comparison of Fingerprint by both users.
+type E2ESession struct {
+    privateKey *ecdh.PrivateKey
+
+    mu          sync.Mutex
+    peerKey     []byte
+    aead        cipher.AEAD
+    fingerprint string
+    ready       chan struct{}
+}
+
+func newE2ESession() (*E2ESession, error) {
+    privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    return &E2ESession{
+        privateKey: privateKey,
+        ready:      make(chan struct{}),
+    }, nil
+}
+
+// KeyFrame returns the frame announcing our public key to the peer.
+func (s *E2ESession) KeyFrame() []byte {
+    return append([]byte{e2eKeyFrame}, s.privateKey.PublicKey().Bytes()...)
+}
+
+// Ready is closed once the shared key has been derived.
+func (s *E2ESession) Ready() <-chan struct{} {
+    return s.ready
+}
+
+// Fingerprint is a short code derived from both public keys. It is the same
+// on both ends unless someone is intercepting the key exchange.
+func (s *E2ESession) Fingerprint() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.fingerprint
+}
+
+// Seal encrypts a message into a data frame.
+func (s *E2ESession) Seal(plaintext []byte) ([]byte, error) {
+    s.mu.Lock()
+    aead := s.aead
+    s.mu.Unlock()
+    if aead == nil {
+        return nil, errE2ENotReady
+    }
+
+    frame := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+    frame[0] = e2eDataFrame
+    if _, err := io.ReadFull(rand.Reader, frame[1:]); err != nil {
+        return nil, err
+    }
+    return aead.Seal(frame, frame[1:], plaintext, nil), nil
+}
+
+// Open handles an incoming frame. Key frames complete the key exchange and
+// yield no data; data frames are decrypted.
+func (s *E2ESession) Open(frame []byte) ([]byte, error) {
+    if len(frame) == 0 {
+        return nil, errors.New("e2e: empty frame")
+    }
+
+    switch frame[0] {
+    case e2eKeyFrame:
+        return nil, s.establish(frame[1:])
+    case e2eDataFrame:
+        s.mu.Lock()
+        aead := s.aead
+        s.mu.Unlock()
+        if aead == nil {
+            return nil, errE2ENotReady
+        }
+        if len(frame) < 1+aead.NonceSize()+aead.Overhead() {
+            return nil, errors.New("e2e: short data frame")
+        }
+        nonce := frame[1 : 1+aead.NonceSize()]
+        plaintext, err := aead.Open(nil, nonce, frame[1+aead.NonceSize():], nil)
+        if err != nil {
+            return nil, errors.New("e2e: message authentication failed")
+        }
+        return plaintext, nil
+    default:
+        return nil, fmt.Errorf("e2e: unknown frame type %#x", frame[0])
+    }
+}
+
+func (s *E2ESession) establish(peerKey []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.peerKey != nil {
+        if bytes.Equal(s.peerKey, peerKey) {
+            return nil
+        }
+        return errors.New("e2e: peer key changed mid-session, ignoring")
+    }
+
+    remote, err := ecdh.X25519().NewPublicKey(peerKey)
+    if err != nil {
+        return err
+    }
+    secret, err := s.privateKey.ECDH(remote)
+    if err != nil {
+        return err
+    }
+
+    // Order the keys so both peers derive the same key and fingerprint
+    localKey := s.privateKey.PublicKey().Bytes()
+    keys := [][]byte{localKey, peerKey}
+    if bytes.Compare(localKey, peerKey) > 0 {
+        keys[0], keys[1] = keys[1], keys[0]
+    }
+    transcript := bytes.Join(keys, nil)
+
+    key := make([]byte, chacha20poly1305.KeySize)
+    kdf := hkdf.New(sha256.New, secret, nil, append([]byte(e2eKeyInfo), transcript...))
+    if _, err := io.ReadFull(kdf, key); err != nil {
+        return err
+    }
+    aead, err := chacha20poly1305.NewX(key)
+    if err != nil {
+        return err
+    }
+
+    sum := sha256.Sum256(transcript)
+    s.peerKey = append([]byte(nil), peerKey...)
+    s.aead = aead
+    s.fingerprint = formatFingerprint(sum[:10])
+    close(s.ready)
+    return nil
+}
+
+// formatFingerprint renders b as space-separated groups of four hex digits.
+func formatFingerprint(b []byte) string {
+    digits := hex.EncodeToString(b)
+    groups := make([]string, 0, len(digits)/4)
+    for i := 0; i < len(digits); i += 4 {
+        groups = append(groups, digits[i:i+4])
+    }
+    return strings.Join(groups, " ")
+}
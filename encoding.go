@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/htmlindex"
+    "golang.org/x/text/transform"
+)
+
+// The wire is always UTF-8. When the terminal uses another encoding, such
+// as CP932 on Japanese Windows, what the user types is decoded before it is
+// sent and what is shown is encoded on the way out, so mixed-platform chats
+// don't turn into mojibake.
+
+// Where the plain terminal interface reads and writes text. They pass
+// through unchanged on UTF-8 terminals.
+var (
+    terminalIn  io.Reader = os.Stdin
+    terminalOut io.Writer = os.Stdout
+    terminalErr io.Writer = os.Stderr
+)
+
+// encodingAliases maps names that the WHATWG index behind htmlindex doesn't
+// know, such as Windows code pages and glibc locale charsets.
+var encodingAliases = map[string]string{
+    "cp932":   "shift_jis",
+    "cp936":   "gbk",
+    "cp949":   "euc-kr",
+    "cp950":   "big5",
+    "cp65001": "utf-8",
+    "utf8":    "utf-8",
+    "eucjp":   "euc-jp",
+    "euckr":   "euc-kr",
+    "sjis":    "shift_jis",
+}
+
+// lookupEncoding returns the encoding called name, or nil for UTF-8.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+    name = strings.ToLower(strings.TrimSpace(name))
+    if alias, ok := encodingAliases[name]; ok {
+        name = alias
+    } else if strings.HasPrefix(name, "cp") {
+        // Other Windows code pages have WHATWG names like windows-1252
+        name = "windows-" + strings.TrimPrefix(name, "cp")
+    }
+    if name == "" || name == "utf-8" {
+        return nil, nil
+    }
+    enc, err := htmlindex.Get(name)
+    if err != nil {
+        return nil, fmt.Errorf("unknown encoding %q", name)
+    }
+    return enc, nil
+}
+
+// localeCharset returns the charset part of a POSIX locale such as
+// "ja_JP.SJIS" or "ja_JP.eucJP@euro", or "" if there is none.
+func localeCharset() string {
+    for _, key := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+        locale := os.Getenv(key)
+        if locale == "" {
+            continue
+        }
+        _, charset, ok := strings.Cut(locale, ".")
+        if !ok {
+            return ""
+        }
+        charset, _, _ = strings.Cut(charset, "@")
+        return charset
+    }
+    return ""
+}
+
+// setupTerminalEncoding transcodes the terminal to and from name, or the
+// detected terminal encoding when name is empty.
+func setupTerminalEncoding(name string) error {
+    detected := name == ""
+    if detected {
+        name = detectTerminalEncoding()
+    }
+    enc, err := lookupEncoding(name)
+    if err != nil && detected {
+        // An odd locale shouldn't stop the client; assume UTF-8
+        return nil
+    }
+    if err != nil || enc == nil {
+        return err
+    }
+
+    terminalIn = transform.NewReader(os.Stdin, enc.NewDecoder())
+    // Characters the terminal can't show, such as emoji on CP932, become
+    // replacement characters instead of failing the whole write
+    terminalOut = transform.NewWriter(os.Stdout, encoding.ReplaceUnsupported(enc.NewEncoder()))
+    terminalErr = transform.NewWriter(os.Stderr, encoding.ReplaceUnsupported(enc.NewEncoder()))
+    return nil
+}
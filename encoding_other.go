@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// detectTerminalEncoding returns the charset of the current locale, such as
+// "eucJP", or "" if the locale doesn't name one.
+func detectTerminalEncoding() string {
+    return localeCharset()
+}
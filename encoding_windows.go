@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+    "fmt"
+    "syscall"
+)
+
+var procGetConsoleOutputCP = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleOutputCP")
+
+// detectTerminalEncoding returns the console's output code page, such as
+// "cp932", or "" if it can't be read.
+func detectTerminalEncoding() string {
+    if procGetConsoleOutputCP.Find() != nil {
+        return ""
+    }
+    cp, _, _ := procGetConsoleOutputCP.Call()
+    if cp == 0 {
+        return ""
+    }
+    return fmt.Sprintf("cp%d", cp)
+}
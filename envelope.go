@@ -0,0 +1,98 @@
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// Envelope types
+const (
+    envelopeText     = "text"     // payload is UTF-8 chat text
+    envelopeBinary   = "binary"   // payload is a non-UTF-8 chat line
+    envelopeFile     = "file"     // payload is a file transfer frame
+    envelopeReaction = "reaction" // payload is an emoji, Ref the message it reacts to
+    envelopeControl  = "control"  // legacy: Control names the action, payload is its argument
+)
+
+const maxEnvelopeHeaderSize = 64 * 1024
+
+// Envelope wraps every message sent over the data channel. On the wire it is
+//
+//	header length (uint32, big endian) | JSON header | payload
+//
+// so routing metadata stays extensible while payloads such as file chunks
+// travel as raw bytes instead of being base64-inflated inside the JSON.
+//
+// The msgpack tags are for the MessagePack form, which carries the payload
+// in the same map; see featureMsgpack.
+type Envelope struct {
+    ID          string `json:"id" msgpack:"id"`
+    Type        string `json:"type" msgpack:"type"`
+    Sender      string `json:"sender" msgpack:"sender"`
+    Timestamp   int64  `json:"ts" msgpack:"ts"` // sender's clock, Unix milliseconds
+    Control     string `json:"control,omitempty" msgpack:"control,omitempty"`
+    Ref         string `json:"ref,omitempty" msgpack:"ref,omitempty"`         // ID of the message a reaction refers to
+    Compression string `json:"comp,omitempty" msgpack:"comp,omitempty"`       // how Payload is compressed, empty if it isn't
+    Seq         uint64 `json:"seq,omitempty" msgpack:"seq,omitempty"`         // chat channel only; see reorderBuffer
+    Private     bool   `json:"private,omitempty" msgpack:"private,omitempty"` // sent with /msg; see featurePrivate
+
+    Payload []byte `json:"-" msgpack:"payload,omitempty"`
+}
+
+func newEnvelope(typ string, sender string, payload []byte) *Envelope {
+    return &Envelope{
+        ID:        uuid.New().String(),
+        Type:      typ,
+        Sender:    sender,
+        Timestamp: time.Now().UnixMilli(),
+        Payload:   payload,
+    }
+}
+
+func (e *Envelope) Time() time.Time {
+    return time.UnixMilli(e.Timestamp)
+}
+
+func encodeEnvelope(e *Envelope) ([]byte, error) {
+    header, err := json.Marshal(e)
+    if err != nil {
+        return nil, err
+    }
+
+    data := make([]byte, 4, 4+len(header)+len(e.Payload))
+    binary.BigEndian.PutUint32(data, uint32(len(header)))
+    data = append(data, header...)
+    return append(data, e.Payload...), nil
+}
+
+// decodeEnvelope decodes any of the wire forms; see featureProtobuf and
+// featureMsgpack.
+func decodeEnvelope(data []byte) (*Envelope, error) {
+    if isMsgpackEnvelope(data) {
+        return decodeEnvelopeMsgpack(data)
+    }
+    if isProtobufEnvelope(data) {
+        return decodeEnvelopeProto(data)
+    }
+    if len(data) < 4 {
+        return nil, errors.New("envelope: short message")
+    }
+    headerLen := binary.BigEndian.Uint32(data)
+    if headerLen > maxEnvelopeHeaderSize || int(headerLen) > len(data)-4 {
+        return nil, errors.New("envelope: invalid header length")
+    }
+
+    var e Envelope
+    if err := json.Unmarshal(data[4:4+headerLen], &e); err != nil {
+        return nil, err
+    }
+    if e.ID == "" || e.Type == "" {
+        return nil, errors.New("envelope: missing id or type")
+    }
+    e.Payload = data[4+headerLen:]
+    return &e, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+)
+
+// Exit codes, so scripts and supervisors can tell why the client stopped.
+// 128+n is used when signal n ended it, as shells do.
+const (
+    exitOK                   = 0
+    exitFailure              = 1 // anything not listed below
+    exitUsage                = 2 // bad flags or config
+    exitSignalingUnreachable = 3 // couldn't reach (or lost) the signaling server
+    exitAuthRejected         = 4 // the signaling server refused our token
+    exitICEFailed            = 5 // no working connection to the peer
+    exitPeerClosed           = 6 // the peer hung up or disappeared
+    exitProtocolMismatch     = 7 // the peer speaks a signaling or peer protocol version we don't
+)
+
+var exitReasons = map[int]string{
+    exitFailure:              "failure",
+    exitUsage:                "usage",
+    exitSignalingUnreachable: "signaling_unreachable",
+    exitAuthRejected:         "auth_rejected",
+    exitICEFailed:            "ice_failed",
+    exitPeerClosed:           "peer_closed",
+    exitProtocolMismatch:     "protocol_mismatch",
+}
+
+// exitWith ends the program with code after a final line saying why, in
+// logfmt on stderr:
+//
+//	exit code=5 reason=ice_failed message="..."
+//
+// or as an "exit" event with -json.
+func exitWith(code int, format string, args ...interface{}) {
+    shuttingDown.Store(true)
+    message := fmt.Sprintf(format, args...)
+    reason := exitReasons[code]
+    if jsonEvents != nil && !jsonEvents.failed.Load() {
+        jsonEvents.emit(jsonEvent{Event: "exit", Code: code, Reason: reason, Text: message})
+    } else {
+        // Closing first lets the line land on the normal screen after the TUI
+        display.Close()
+        restoreTerminal()
+        fmt.Fprintf(os.Stderr, "exit code=%d reason=%s message=%s\n", code, reason, strconv.Quote(message))
+    }
+    os.Exit(code)
+}
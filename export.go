@@ -0,0 +1,108 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// Formats for /export
+const (
+    exportText = "txt"
+    exportJSON = "json"
+)
+
+// exportedMessage is one message in a JSON export. Text is set for text
+// messages and Data, base64 in the JSON, for binary ones.
+type exportedMessage struct {
+    ID        string    `json:"id"`
+    SenderID  string    `json:"sender_id"`
+    Sender    string    `json:"sender"`
+    Direction string    `json:"direction"`
+    SentAt    time.Time `json:"sent_at"`
+    Text      string    `json:"text,omitempty"`
+    Data      []byte    `json:"data,omitempty"`
+}
+
+// parseExportArgs splits "/export [json|txt] <path>". Without a format the
+// path's extension decides, and anything but .json is text.
+func parseExportArgs(arg string) (format, path string, err error) {
+    first, rest, _ := strings.Cut(arg, " ")
+    switch first {
+    case exportText, exportJSON:
+        format, path = first, strings.TrimSpace(rest)
+    default:
+        path = arg
+        format = exportText
+        if strings.EqualFold(filepath.Ext(path), ".json") {
+            format = exportJSON
+        }
+    }
+    if path == "" {
+        return "", "", fmt.Errorf("usage: /export [json|txt] <path>")
+    }
+    return format, path, nil
+}
+
+// exportConversation writes entries to path in format. The file is only
+// readable by the user, like the history it comes from.
+func exportConversation(entries []HistoryEntry, format, path string) error {
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+    if err != nil {
+        return err
+    }
+    if format == exportJSON {
+        err = writeExportJSON(file, entries)
+    } else {
+        err = writeExportText(file, entries)
+    }
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+func writeExportText(w io.Writer, entries []HistoryEntry) error {
+    for _, entry := range entries {
+        // The export is as likely to end up in a terminal as the chat was,
+        // so the peer's text is escaped the same way
+        text := fmt.Sprintf("<binary message, %d bytes>", len(entry.Body))
+        if entry.Type == envelopeText && utf8.Valid(entry.Body) {
+            // Continuation lines are indented so every message starts a line
+            text = strings.ReplaceAll(strings.TrimRight(sanitizeText(string(entry.Body)), "\n"), "\n", "\n    ")
+        }
+        sender := strings.ReplaceAll(sanitizeText(entry.SenderName), "\n", " ")
+        sentAt := entry.SentAt.Format("2006-01-02 15:04:05")
+        if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", sentAt, sender, text); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func writeExportJSON(w io.Writer, entries []HistoryEntry) error {
+    messages := make([]exportedMessage, 0, len(entries))
+    for _, entry := range entries {
+        message := exportedMessage{
+            ID:        entry.ID,
+            SenderID:  entry.SenderID,
+            Sender:    entry.SenderName,
+            Direction: entry.Direction,
+            SentAt:    entry.SentAt,
+        }
+        if entry.Type == envelopeText {
+            message.Text = string(entry.Body)
+        } else {
+            message.Data = entry.Body
+        }
+        messages = append(messages, message)
+    }
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(messages)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestExportConversation(t *testing.T) {
+    history, err := openHistory(filepath.Join(t.TempDir(), "history.db"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer history.Close()
+    sentAt := time.Date(2026, 10, 17, 9, 30, 0, 0, time.Local)
+    for i, entry := range []HistoryEntry{
+        {ID: "1", PeerID: "bob-id", SenderID: "alice-id", SenderName: "alice", Direction: directionOut, Type: envelopeText, Body: []byte("hi\nhow are you?\n")},
+        {ID: "2", PeerID: "bob-id", SenderID: "bob-id", SenderName: "bob", Direction: directionIn, Type: envelopeBinary, Body: []byte{0xff, 0xfe}},
+        {ID: "3", PeerID: "bob-id", SenderID: "bob-id", SenderName: "bob\x1b[2J\nalice", Direction: directionIn, Type: envelopeText, Body: []byte("\x1b]2;pwned\a\r\n")},
+        {ID: "4", PeerID: "carol-id", SenderID: "carol-id", SenderName: "carol", Direction: directionIn, Type: envelopeText, Body: []byte("not this one\n")},
+    } {
+        entry.SentAt = sentAt.Add(time.Duration(i) * time.Minute)
+        if err := history.Record(entry); err != nil {
+            t.Fatal(err)
+        }
+    }
+    entries, err := history.Conversation("bob-id")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    dir := t.TempDir()
+    format, path, err := parseExportArgs(filepath.Join(dir, "chat.txt"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := exportConversation(entries, format, path); err != nil {
+        t.Fatal(err)
+    }
+    data, _ := os.ReadFile(path)
+    want := "[2026-10-17 09:30:00] alice: hi\n    how are you?\n[2026-10-17 09:31:00] bob: <binary message, 2 bytes>\n" +
+        `[2026-10-17 09:32:00] bob\x1b[2J alice: \x1b]2;pwned\x07` + "\n"
+    if string(data) != want {
+        t.Errorf("text export:\n%s\nwant:\n%s", data, want)
+    }
+
+    format, path, err = parseExportArgs("json " + filepath.Join(dir, "chat.log"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := exportConversation(entries, format, path); err != nil {
+        t.Fatal(err)
+    }
+    data, _ = os.ReadFile(path)
+    var messages []exportedMessage
+    if err := json.Unmarshal(data, &messages); err != nil {
+        t.Fatal(err)
+    }
+    if len(messages) != 3 || messages[0].Text != "hi\nhow are you?\n" || string(messages[1].Data) != "\xff\xfe" || !messages[1].SentAt.Equal(sentAt.Add(time.Minute)) {
+        t.Errorf("JSON export: %+v", messages)
+    }
+
+    if _, _, err := parseExportArgs("json"); err == nil || !strings.Contains(err.Error(), "usage") {
+        t.Errorf("a missing path gave %v", err)
+    }
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// In-memory stand-ins for the signaling server, the data channels and the
+// display, so the handshake and message routing can be tested without a
+// network or a terminal.
+
+// fakeSignaler is one end of an in-memory signaling link. Messages go
+// through JSON as they would through a server.
+type fakeSignaler struct {
+    in  chan []byte
+    out chan []byte
+}
+
+func newFakeSignalerPair() (*fakeSignaler, *fakeSignaler) {
+    ab := make(chan []byte, 64)
+    ba := make(chan []byte, 64)
+    return &fakeSignaler{in: ba, out: ab}, &fakeSignaler{in: ab, out: ba}
+}
+
+func (s *fakeSignaler) WriteJSON(v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    s.out <- data
+    return nil
+}
+
+// ReadJSON blocks until a message arrives, as a quiet server would.
+func (s *fakeSignaler) ReadJSON(v interface{}) error {
+    return json.Unmarshal(<-s.in, v)
+}
+
+func (s *fakeSignaler) Close() error {
+    return nil
+}
+
+// inject hands v to this end's reader as if the server had sent it.
+func (s *fakeSignaler) inject(v interface{}) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        panic(err)
+    }
+    s.in <- data
+}
+
+// fakeTransport delivers what is sent on it to the peer's handler, in order
+// and on its own goroutine like a data channel.
+type fakeTransport struct {
+    queue chan webrtc.DataChannelMessage
+
+    mu        sync.Mutex
+    state     webrtc.DataChannelState
+    duplicate bool // deliver everything twice
+    drop      bool // deliver nothing, as a dead link would
+}
+
+func newFakeTransport() *fakeTransport {
+    return &fakeTransport{
+        queue: make(chan webrtc.DataChannelMessage, 1024),
+        state: webrtc.DataChannelStateOpen,
+    }
+}
+
+// connect starts delivering to handler.
+func (t *fakeTransport) connect(handler func(webrtc.DataChannelMessage)) {
+    go func() {
+        for msg := range t.queue {
+            handler(msg)
+        }
+    }()
+}
+
+func (t *fakeTransport) Send(data []byte) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.state != webrtc.DataChannelStateOpen {
+        return fmt.Errorf("transport is %s", t.state)
+    }
+    if t.drop {
+        return nil
+    }
+    msg := webrtc.DataChannelMessage{Data: append([]byte(nil), data...)}
+    t.queue <- msg
+    if t.duplicate {
+        t.queue <- msg
+    }
+    return nil
+}
+
+func (t *fakeTransport) setDuplicate(duplicate bool) {
+    t.mu.Lock()
+    t.duplicate = duplicate
+    t.mu.Unlock()
+}
+
+func (t *fakeTransport) setDrop(drop bool) {
+    t.mu.Lock()
+    t.drop = drop
+    t.mu.Unlock()
+}
+
+func (t *fakeTransport) ReadyState() webrtc.DataChannelState {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.state
+}
+
+func (t *fakeTransport) BufferedAmount() uint64               { return 0 }
+func (t *fakeTransport) SetBufferedAmountLowThreshold(uint64) {}
+func (t *fakeTransport) OnBufferedAmountLow(func())           {}
+func (t *fakeTransport) MaxRetransmits() *uint16              { return nil }
+func (t *fakeTransport) MaxPacketLifeTime() *uint16           { return nil }
+
+func (t *fakeTransport) Close() error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.state = webrtc.DataChannelStateClosed
+    return nil
+}
+
+// fakeDisplay records what would have been shown.
+type fakeDisplay struct {
+    mu       sync.Mutex
+    messages []string // "sender: text"
+    notices  []string
+    status   map[string]string
+}
+
+// useFakeDisplay swaps in a fakeDisplay for the rest of the test.
+func useFakeDisplay(t *testing.T) *fakeDisplay {
+    fake := &fakeDisplay{status: map[string]string{}}
+    previous := display
+    display = fake
+    t.Cleanup(func() { display = previous })
+    return fake
+}
+
+func (d *fakeDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.messages = append(d.messages, sender+": "+string(data))
+}
+
+func (d *fakeDisplay) PrintSent(id string, data []byte, sentAt time.Time) {}
+
+func (d *fakeDisplay) Printf(format string, args ...interface{}) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.notices = append(d.notices, fmt.Sprintf(format, args...))
+}
+
+func (d *fakeDisplay) Error(text string) {
+    d.Printf("%s\n", text)
+}
+
+func (d *fakeDisplay) Progress(key, line string, done bool) {}
+
+func (d *fakeDisplay) SetStatus(key, value string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.status[key] = value
+}
+
+func (d *fakeDisplay) Alert(visual bool) {}
+func (d *fakeDisplay) Close()            {}
+
+func (d *fakeDisplay) Messages() []string {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return append([]string(nil), d.messages...)
+}
+
+// HasNotice reports whether a notice containing text was shown.
+func (d *fakeDisplay) HasNotice(text string) bool {
+    return d.NoticeCount(text) > 0
+}
+
+// NoticeCount counts the notices shown that contain text.
+func (d *fakeDisplay) NoticeCount(text string) int {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    n := 0
+    for _, notice := range d.notices {
+        if strings.Contains(notice, text) {
+            n++
+        }
+    }
+    return n
+}
+
+// eventually fails the test if cond doesn't hold within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
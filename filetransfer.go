@@ -0,0 +1,397 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+
+    "github.com/google/uuid"
+)
+
+// featureFiles is listed in the join by peers that accept file transfers,
+// voice messages included. Peers older than feature lists all do.
+const featureFiles = "files"
+
+// File transfer frames travel as the payload of "file" envelopes, laid out as
+//
+//	kind(1) | transfer id(16) | payload
+//
+// where the payload is JSON metadata for fileStart, raw file bytes for
+// fileChunk, the SHA-256 of the whole file for fileEnd and a single status
+// byte for fileAck.
+const (
+    fileStart byte = iota + 1
+    fileChunk
+    fileEnd
+    fileAck
+)
+
+const (
+    fileFrameHeaderSize = 1 + 16
+    fileChunkSize       = 16 * 1024
+)
+
+type fileMetadata struct {
+    Name  string `json:"name"`
+    Size  int64  `json:"size"`
+    Kind  string `json:"kind,omitempty"`  // "voice" for voice messages, "dir" for directories
+    Files int    `json:"files,omitempty"` // directories: number of files inside
+}
+
+const (
+    fileKindVoice = "voice"
+    fileKindDir   = "dir" // the payload is a tar archive and Size an estimate
+)
+
+type incomingFile struct {
+    meta     fileMetadata
+    path     string
+    file     *os.File
+    hash     hash.Hash
+    received int64
+    progress *progress
+}
+
+// FileTransfers sends files as a sequence of framed chunks and reassembles
+// the peer's files into downloadDir.
+type FileTransfers struct {
+    downloadDir string
+    send        func(frame []byte) error
+
+    mu        sync.Mutex
+    incoming  map[uuid.UUID]*incomingFile
+    outgoing  map[uuid.UUID]string
+    lastVoice string
+    archives  []*receivedArchive // directories waiting for /unpack or /discard
+}
+
+func newFileTransfers(downloadDir string, send func(frame []byte) error) *FileTransfers {
+    return &FileTransfers{
+        downloadDir: downloadDir,
+        send:        send,
+        incoming:    map[uuid.UUID]*incomingFile{},
+        outgoing:    map[uuid.UUID]string{},
+    }
+}
+
+func encodeFileFrame(kind byte, id uuid.UUID, payload []byte) []byte {
+    frame := make([]byte, 0, fileFrameHeaderSize+len(payload))
+    frame = append(frame, kind)
+    frame = append(frame, id[:]...)
+    return append(frame, payload...)
+}
+
+// SendFile streams the file or directory at path to the peer, reporting
+// progress as it goes.
+func (t *FileTransfers) SendFile(path string) error {
+    info, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    if info.IsDir() {
+        return t.sendDirectory(path)
+    }
+    return t.sendFile(path, "")
+}
+
+// SendVoice sends a recorded Ogg/Opus clip as a voice message.
+func (t *FileTransfers) SendVoice(path string) error {
+    return t.sendFile(path, fileKindVoice)
+}
+
+// LastVoice returns where the peer's latest voice message was saved.
+func (t *FileTransfers) LastVoice() string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.lastVoice
+}
+
+func (t *FileTransfers) sendFile(path, kind string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+    if info.IsDir() {
+        return fmt.Errorf("%s is a directory", path)
+    }
+
+    label := filepath.Base(path)
+    if kind == fileKindVoice {
+        label = "voice message"
+    }
+    meta := fileMetadata{Name: filepath.Base(path), Size: info.Size(), Kind: kind}
+    return t.sendStream(meta, label, file)
+}
+
+// sendStream sends everything read from r as one transfer described by
+// meta; label is how the transfer is named in notices.
+func (t *FileTransfers) sendStream(meta fileMetadata, label string, r io.Reader) error {
+    id := uuid.New()
+    header, err := json.Marshal(meta)
+    if err != nil {
+        return err
+    }
+
+    t.mu.Lock()
+    t.outgoing[id] = label
+    t.mu.Unlock()
+
+    if err := t.send(encodeFileFrame(fileStart, id, header)); err != nil {
+        return err
+    }
+
+    sum := sha256.New()
+    progress := newProgress("send", meta.Name, meta.Size)
+    buf := make([]byte, fileChunkSize)
+    for {
+        n, err := io.ReadFull(r, buf)
+        if n > 0 {
+            sum.Write(buf[:n])
+            if err := t.send(encodeFileFrame(fileChunk, id, buf[:n])); err != nil {
+                return err
+            }
+            progress.Add(int64(n))
+        }
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+    }
+    progress.Done()
+
+    log.Printf("File sent, waiting for peer confirmation: %s\n", meta.Name)
+    return t.send(encodeFileFrame(fileEnd, id, sum.Sum(nil)))
+}
+
+func (t *FileTransfers) handleFrame(frame []byte) {
+    if len(frame) < fileFrameHeaderSize {
+        log.Println("Short file frame")
+        return
+    }
+    kind := frame[0]
+    id, _ := uuid.FromBytes(frame[1:fileFrameHeaderSize])
+    payload := frame[fileFrameHeaderSize:]
+
+    var err error
+    switch kind {
+    case fileStart:
+        err = t.handleStart(id, payload)
+    case fileChunk:
+        err = t.handleChunk(id, payload)
+    case fileEnd:
+        err = t.handleEnd(id, payload)
+    case fileAck:
+        t.handleAck(id, payload)
+    default:
+        err = fmt.Errorf("unknown file frame kind %d", kind)
+    }
+    if err != nil {
+        log.Println("ファイル受信エラー: ", err)
+        display.Printf("[file] receive failed: %v\n", err)
+    }
+}
+
+func (t *FileTransfers) handleStart(id uuid.UUID, payload []byte) error {
+    var meta fileMetadata
+    if err := json.Unmarshal(payload, &meta); err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(t.downloadDir, 0o755); err != nil {
+        return err
+    }
+    var file *os.File
+    var path string
+    var err error
+    if meta.Kind == fileKindDir {
+        // Held as an archive until the user agrees to unpack it
+        file, err = os.CreateTemp(t.downloadDir, ".incoming-*.tar")
+        if err == nil {
+            path = file.Name()
+        }
+    } else {
+        file, path, err = createUniqueFile(t.downloadDir, sanitizeFileName(meta.Name))
+    }
+    if err != nil {
+        return err
+    }
+
+    t.mu.Lock()
+    t.incoming[id] = &incomingFile{
+        meta:     meta,
+        path:     path,
+        file:     file,
+        hash:     sha256.New(),
+        progress: newProgress("recv", meta.Name, meta.Size),
+    }
+    t.mu.Unlock()
+    return nil
+}
+
+func (t *FileTransfers) handleChunk(id uuid.UUID, payload []byte) error {
+    t.mu.Lock()
+    in, ok := t.incoming[id]
+    t.mu.Unlock()
+    if !ok {
+        return errors.New("chunk for unknown transfer")
+    }
+
+    if _, err := in.file.Write(payload); err != nil {
+        t.abort(id, in)
+        return err
+    }
+    in.hash.Write(payload)
+    in.received += int64(len(payload))
+    in.progress.Add(int64(len(payload)))
+    return nil
+}
+
+func (t *FileTransfers) handleEnd(id uuid.UUID, payload []byte) error {
+    t.mu.Lock()
+    in, ok := t.incoming[id]
+    delete(t.incoming, id)
+    t.mu.Unlock()
+    if !ok {
+        return errors.New("end of unknown transfer")
+    }
+    in.progress.Done()
+
+    if err := in.file.Close(); err != nil {
+        os.Remove(in.path)
+        t.send(encodeFileFrame(fileAck, id, []byte{0}))
+        return err
+    }
+    sizeOK := in.received == in.meta.Size || in.meta.Kind == fileKindDir
+    if !sizeOK || !bytes.Equal(in.hash.Sum(nil), payload) {
+        os.Remove(in.path)
+        t.send(encodeFileFrame(fileAck, id, []byte{0}))
+        return fmt.Errorf("%s: checksum mismatch, file discarded", in.meta.Name)
+    }
+
+    if in.meta.Kind == fileKindDir {
+        t.holdArchive(in)
+    } else if in.meta.Kind == fileKindVoice {
+        t.mu.Lock()
+        t.lastVoice = in.path
+        t.mu.Unlock()
+        display.Printf("[voice] voice message saved to %s, /play to listen\n", in.path)
+    } else {
+        display.Printf("[file] received %s (%d bytes) -> %s\n", in.meta.Name, in.received, in.path)
+    }
+    return t.send(encodeFileFrame(fileAck, id, []byte{1}))
+}
+
+func (t *FileTransfers) handleAck(id uuid.UUID, payload []byte) {
+    t.mu.Lock()
+    name, ok := t.outgoing[id]
+    delete(t.outgoing, id)
+    t.mu.Unlock()
+    if !ok {
+        return
+    }
+
+    if len(payload) > 0 && payload[0] == 1 {
+        display.Printf("[file] peer saved %s\n", name)
+    } else {
+        display.Printf("[file] peer failed to save %s\n", name)
+    }
+}
+
+func (t *FileTransfers) abort(id uuid.UUID, in *incomingFile) {
+    t.mu.Lock()
+    delete(t.incoming, id)
+    t.mu.Unlock()
+    in.file.Close()
+    os.Remove(in.path)
+    t.send(encodeFileFrame(fileAck, id, []byte{0}))
+}
+
+// sanitizeFileName keeps only the final path element of a peer-supplied
+// name so a transfer can never write outside the download directory.
+func sanitizeFileName(name string) string {
+    name = filepath.Base(filepath.Clean("/" + filepath.ToSlash(name)))
+    if name == "/" || name == "." || name == ".." || name == "" {
+        return "file"
+    }
+    return name
+}
+
+// createUniqueFile creates name in dir, appending a counter instead of
+// overwriting an existing file.
+func createUniqueFile(dir, name string) (*os.File, string, error) {
+    ext := filepath.Ext(name)
+    base := name[:len(name)-len(ext)]
+    for i := 0; ; i++ {
+        candidate := name
+        if i > 0 {
+            candidate = base + "." + strconv.Itoa(i) + ext
+        }
+        path := filepath.Join(dir, candidate)
+        file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+        if errors.Is(err, os.ErrExist) {
+            continue
+        }
+        return file, path, err
+    }
+}
+
+// progress reports how far a transfer has got, updating once per percent.
+type progress struct {
+    verb    string
+    name    string
+    total   int64
+    done    int64
+    percent int64
+}
+
+func newProgress(verb, name string, total int64) *progress {
+    p := &progress{verb: verb, name: name, total: total, percent: -1}
+    p.print()
+    return p
+}
+
+func (p *progress) Add(n int64) {
+    p.done += n
+    p.print()
+}
+
+func (p *progress) Done() {
+    display.Progress(p.key(), p.line(), true)
+}
+
+func (p *progress) print() {
+    percent := int64(100)
+    if p.total > 0 {
+        percent = min(p.done*100/p.total, 100)
+    }
+    if percent == p.percent {
+        return
+    }
+    p.percent = percent
+    display.Progress(p.key(), p.line(), false)
+}
+
+func (p *progress) key() string {
+    return p.verb + " " + p.name
+}
+
+func (p *progress) line() string {
+    return fmt.Sprintf("[file] %s %s %3d%% (%d/%d bytes)", p.verb, p.name, p.percent, p.done, p.total)
+}
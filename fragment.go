@@ -0,0 +1,172 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// Messages larger than maxFrameSize are split into fragments before they go
+// on the wire, since SCTP refuses (or silently drops) oversized messages.
+// Each fragment is laid out as
+//
+//	fragmentMarker(1) | message id(4) | index(2) | count(2) | payload
+//
+// Whole envelopes start with a zero byte and E2E frames with 0x01 or 0x02,
+// so the marker can't be mistaken for either.
+const (
+    fragmentMarker     byte = 0xff
+    fragmentHeaderSize      = 1 + 4 + 2 + 2
+    maxFrameSize            = 64 * 1024
+    fragmentSize            = 16 * 1024
+
+    // Partial messages are dropped after this long; on an unreliable
+    // channel the missing pieces may never come.
+    reassemblyTimeout = 30 * time.Second
+
+    // The largest message either side sends or takes back together. How
+    // many messages may be partly received and the bytes they hold are
+    // limited too, so a peer can't fill our memory with messages it never
+    // finishes; the oldest is dropped to make room.
+    maxMessageSize     = 16 * 1024 * 1024
+    maxFragments       = maxMessageSize / fragmentSize
+    maxPartialMessages = 16
+    maxReassemblyBytes = 4 * maxMessageSize
+)
+
+func isFragment(data []byte) bool {
+    return len(data) >= fragmentHeaderSize && data[0] == fragmentMarker
+}
+
+// fragmentFrame splits data into fragments tagged with id, or returns it
+// unchanged if it is small enough to send as one message.
+func fragmentFrame(id uint32, data []byte) ([][]byte, error) {
+    if len(data) <= maxFrameSize {
+        return [][]byte{data}, nil
+    }
+    if len(data) > maxMessageSize {
+        return nil, fmt.Errorf("message too large to send (%d bytes)", len(data))
+    }
+    count := (len(data) + fragmentSize - 1) / fragmentSize
+
+    fragments := make([][]byte, 0, count)
+    for i := 0; i < count; i++ {
+        end := (i + 1) * fragmentSize
+        if end > len(data) {
+            end = len(data)
+        }
+        fragment := make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-i*fragmentSize)
+        fragment[0] = fragmentMarker
+        binary.BigEndian.PutUint32(fragment[1:5], id)
+        binary.BigEndian.PutUint16(fragment[5:7], uint16(i))
+        binary.BigEndian.PutUint16(fragment[7:9], uint16(count))
+        fragments = append(fragments, append(fragment, data[i*fragmentSize:end]...))
+    }
+    return fragments, nil
+}
+
+type partialMessage struct {
+    pieces   [][]byte
+    received int
+    size     int
+    started  time.Time
+}
+
+// reassembler puts the peer's fragmented messages back together. Fragments
+// may arrive out of order when the channel is unordered.
+type reassembler struct {
+    mu      sync.Mutex
+    partial map[uint32]*partialMessage
+    size    int // bytes held in partial
+}
+
+func newReassembler() *reassembler {
+    return &reassembler{partial: map[uint32]*partialMessage{}}
+}
+
+// add records a fragment and returns the whole message once every piece has
+// arrived, or nil while it is still incomplete.
+func (r *reassembler) add(fragment []byte) ([]byte, error) {
+    id := binary.BigEndian.Uint32(fragment[1:5])
+    index := int(binary.BigEndian.Uint16(fragment[5:7]))
+    count := int(binary.BigEndian.Uint16(fragment[7:9]))
+    payload := fragment[fragmentHeaderSize:]
+    if count == 0 || index >= count {
+        return nil, fmt.Errorf("bad fragment %d/%d", index, count)
+    }
+    if count > maxFragments {
+        return nil, fmt.Errorf("message %d is too large (%d fragments)", id, count)
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.expire()
+
+    msg, ok := r.partial[id]
+    if !ok {
+        for len(r.partial) >= maxPartialMessages {
+            r.dropOldest()
+        }
+        msg = &partialMessage{pieces: make([][]byte, count), started: time.Now()}
+        r.partial[id] = msg
+    }
+    if len(msg.pieces) != count {
+        r.remove(id)
+        return nil, fmt.Errorf("fragment count changed for message %d", id)
+    }
+    if msg.pieces[index] != nil {
+        return nil, nil
+    }
+    if msg.size+len(payload) > maxMessageSize {
+        r.remove(id)
+        return nil, fmt.Errorf("message %d is too large", id)
+    }
+    msg.pieces[index] = append([]byte(nil), payload...)
+    msg.received++
+    msg.size += len(payload)
+    r.size += len(payload)
+    for r.size > maxReassemblyBytes {
+        r.dropOldest()
+    }
+    if r.partial[id] == nil {
+        return nil, fmt.Errorf("message %d dropped: too much is waiting to be put together", id)
+    }
+    if msg.received < count {
+        return nil, nil
+    }
+
+    r.remove(id)
+    data := make([]byte, 0, msg.size)
+    for _, piece := range msg.pieces {
+        data = append(data, piece...)
+    }
+    return data, nil
+}
+
+func (r *reassembler) expire() {
+    for id, msg := range r.partial {
+        if time.Since(msg.started) > reassemblyTimeout {
+            r.remove(id)
+        }
+    }
+}
+
+// dropOldest drops the partial message started first.
+func (r *reassembler) dropOldest() {
+    var oldest uint32
+    var started time.Time
+    for id, msg := range r.partial {
+        if started.IsZero() || msg.started.Before(started) {
+            oldest, started = id, msg.started
+        }
+    }
+    r.remove(oldest)
+}
+
+func (r *reassembler) remove(id uint32) {
+    if msg, ok := r.partial[id]; ok {
+        r.size -= msg.size
+        delete(r.partial, id)
+    }
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+func testFragment(id uint32, index, count int, payload []byte) []byte {
+    fragment := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(payload))
+    fragment[0] = fragmentMarker
+    binary.BigEndian.PutUint32(fragment[1:5], id)
+    binary.BigEndian.PutUint16(fragment[5:7], uint16(index))
+    binary.BigEndian.PutUint16(fragment[7:9], uint16(count))
+    return append(fragment, payload...)
+}
+
+func TestReassemblerPutsFragmentsBackTogether(t *testing.T) {
+    data := bytes.Repeat([]byte("0123456789"), maxFrameSize/5)
+    fragments, err := fragmentFrame(7, data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := newReassembler()
+    var whole []byte
+    for i := len(fragments) - 1; i >= 0; i-- {
+        if whole, err = r.add(fragments[i]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if !bytes.Equal(whole, data) {
+        t.Errorf("got %d bytes back, want %d", len(whole), len(data))
+    }
+    if r.size != 0 || len(r.partial) != 0 {
+        t.Errorf("still holding %d bytes in %d messages", r.size, len(r.partial))
+    }
+}
+
+func TestReassemblerLimitsWhatItHolds(t *testing.T) {
+    r := newReassembler()
+    if _, err := r.add(testFragment(1, 0, maxFragments+1, []byte("x"))); err == nil {
+        t.Error("a message with too many fragments was accepted")
+    }
+
+    for id := uint32(1); id <= maxPartialMessages+1; id++ {
+        if _, err := r.add(testFragment(id, 0, 2, []byte("x"))); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(r.partial) != maxPartialMessages || r.partial[1] != nil {
+        t.Errorf("holding %d partial messages, the first among them: %v", len(r.partial), r.partial[1] != nil)
+    }
+
+    // Pieces bigger than we would send add up to the byte limit sooner
+    big := make([]byte, maxMessageSize/2)
+    for i := 0; i < maxReassemblyBytes/len(big); i++ {
+        r.add(testFragment(uint32(100+i), 0, 2, big))
+    }
+    if r.size > maxReassemblyBytes {
+        t.Errorf("holding %d bytes, more than %d", r.size, maxReassemblyBytes)
+    }
+    if _, err := r.add(testFragment(200, 0, 3, make([]byte, maxMessageSize))); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.add(testFragment(200, 1, 3, []byte("x"))); err == nil {
+        t.Error("a message over the size limit was accepted")
+    }
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/url"
+
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcConnectMethod is the bidirectional stream defined in signaling.proto.
+// Each Frame carries one signaling message as the same JSON that goes over
+// WebSocket, so a server can handle both transports with one protocol.
+const grpcConnectMethod = "/webrtcchat.signaling.v1.Signaling/Connect"
+
+var grpcConnectStream = &grpc.StreamDesc{
+    StreamName:    "Connect",
+    ServerStreams: true,
+    ClientStreams: true,
+}
+
+// grpcFrame is the Frame message of signaling.proto.
+type grpcFrame struct {
+    JSON []byte // field 1
+}
+
+// frameCodec encodes grpcFrame as protobuf by hand. Frame has one bytes
+// field, which isn't worth generated code and a protoc step in the build.
+type frameCodec struct{}
+
+func (frameCodec) Name() string {
+    return "proto"
+}
+
+func (frameCodec) Marshal(v interface{}) ([]byte, error) {
+    frame, ok := v.(*grpcFrame)
+    if !ok {
+        return nil, fmt.Errorf("grpc: cannot encode %T", v)
+    }
+    data := protowire.AppendTag(nil, 1, protowire.BytesType)
+    return protowire.AppendBytes(data, frame.JSON), nil
+}
+
+func (frameCodec) Unmarshal(data []byte, v interface{}) error {
+    frame, ok := v.(*grpcFrame)
+    if !ok {
+        return fmt.Errorf("grpc: cannot decode into %T", v)
+    }
+    frame.JSON = nil
+    for len(data) > 0 {
+        num, typ, n := protowire.ConsumeTag(data)
+        if n < 0 {
+            return protowire.ParseError(n)
+        }
+        data = data[n:]
+        if num == 1 && typ == protowire.BytesType {
+            value, n := protowire.ConsumeBytes(data)
+            if n < 0 {
+                return protowire.ParseError(n)
+            }
+            frame.JSON = append([]byte(nil), value...)
+            data = data[n:]
+            continue
+        }
+        // Fields added by newer servers are skipped
+        n = protowire.ConsumeFieldValue(num, typ, data)
+        if n < 0 {
+            return protowire.ParseError(n)
+        }
+        data = data[n:]
+    }
+    return nil
+}
+
+func isGRPCURL(serverURL string) bool {
+    u, err := url.Parse(serverURL)
+    return err == nil && (u.Scheme == "grpc" || u.Scheme == "grpcs")
+}
+
+// grpcConn is a signaling connection over a gRPC stream, for servers behind
+// gRPC infrastructure. grpcs:// uses TLS with the same CA and client
+// certificate options as wss://, so mTLS works the same way.
+type grpcConn struct {
+    client *grpc.ClientConn
+    stream grpc.ClientStream
+    cancel context.CancelFunc
+}
+
+func dialGRPC(serverURL string, options SignalingOptions) (*grpcConn, error) {
+    u, err := url.Parse(serverURL)
+    if err != nil {
+        return nil, err
+    }
+    creds := insecure.NewCredentials()
+    if u.Scheme == "grpcs" {
+        creds = credentials.NewTLS(options.TLSConfig)
+    }
+    client, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(creds))
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    if options.AuthToken != "" {
+        ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+options.AuthToken)
+    }
+    // NewStream fails fast if the server can't be reached. A refused token
+    // only shows up on the first read, as servers send nothing before then
+    stream, err := client.NewStream(ctx, grpcConnectStream, grpcConnectMethod, grpc.ForceCodec(frameCodec{}))
+    if err != nil {
+        cancel()
+        client.Close()
+        return nil, grpcError(err)
+    }
+    return &grpcConn{client: client, stream: stream, cancel: cancel}, nil
+}
+
+// grpcError maps the statuses a server uses to refuse a client onto
+// errAuthRejected.
+func grpcError(err error) error {
+    switch status.Code(err) {
+    case codes.Unauthenticated, codes.PermissionDenied:
+        return fmt.Errorf("%w (%s)", errAuthRejected, status.Convert(err).Message())
+    }
+    return err
+}
+
+func (c *grpcConn) WriteJSON(v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return grpcError(c.stream.SendMsg(&grpcFrame{JSON: data}))
+}
+
+func (c *grpcConn) ReadJSON(v interface{}) error {
+    var frame grpcFrame
+    if err := c.stream.RecvMsg(&frame); err != nil {
+        return grpcError(err)
+    }
+    return json.Unmarshal(frame.JSON, v)
+}
+
+// Goodbye half-closes the stream so the server sees a clean end.
+func (c *grpcConn) Goodbye() error {
+    return c.stream.CloseSend()
+}
+
+func (c *grpcConn) Close() error {
+    c.cancel()
+    return c.client.Close()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+    "crypto/cipher"
+    "database/sql"
+    "strings"
+    "time"
+
+    _ "modernc.org/sqlite"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS messages (
+    id          TEXT PRIMARY KEY,
+    peer_id     TEXT NOT NULL,
+    sender_id   TEXT NOT NULL,
+    sender_name TEXT NOT NULL,
+    direction   TEXT NOT NULL,
+    type        TEXT NOT NULL,
+    body        BLOB NOT NULL,
+    sent_at     INTEGER NOT NULL,
+    recorded_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_peer_sent_at ON messages (peer_id, sent_at);
+CREATE TABLE IF NOT EXISTS history_meta (
+    name  TEXT PRIMARY KEY,
+    value BLOB NOT NULL
+);
+`
+
+const (
+    directionIn  = "in"
+    directionOut = "out"
+)
+
+type HistoryEntry struct {
+    ID         string
+    PeerID     string
+    SenderID   string
+    SenderName string
+    Direction  string
+    Type       string
+    Body       []byte
+    SentAt     time.Time
+}
+
+// History stores sent and received chat messages in a local SQLite database.
+type History struct {
+    db   *sql.DB
+    aead cipher.AEAD // nil unless the history is encrypted
+}
+
+// openHistory opens the history at path. With key, the history is
+// encrypted, and a plain one is encrypted now; see historycrypt.go.
+func openHistory(path string, key historyKeyFunc) (*History, error) {
+    db, err := sql.Open("sqlite", path)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := db.Exec(historySchema); err != nil {
+        db.Close()
+        return nil, err
+    }
+    h := &History{db: db}
+    if err := h.unlock(key); err != nil {
+        db.Close()
+        return nil, err
+    }
+    return h, nil
+}
+
+func (h *History) Record(entry HistoryEntry) error {
+    name, body := []byte(entry.SenderName), entry.Body
+    if h.aead != nil {
+        name, body = h.seal(entry.ID, name), h.seal(entry.ID, body)
+    }
+    _, err := h.db.Exec(
+        `INSERT OR IGNORE INTO messages (id, peer_id, sender_id, sender_name, direction, type, body, sent_at, recorded_at)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        entry.ID, entry.PeerID, entry.SenderID, name, entry.Direction, entry.Type, body,
+        entry.SentAt.UnixMilli(), time.Now().UnixMilli(),
+    )
+    return err
+}
+
+// Conversation returns every message to and from peerID, oldest first.
+func (h *History) Conversation(peerID string) ([]HistoryEntry, error) {
+    rows, err := h.db.Query(
+        `SELECT id, peer_id, sender_id, sender_name, direction, type, body, sent_at FROM messages
+         WHERE peer_id = ? ORDER BY sent_at, recorded_at`,
+        peerID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return h.scanEntries(rows)
+}
+
+// likePattern matches term anywhere in a LIKE, with its wildcards escaped.
+func likePattern(term string) string {
+    escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+    return "%" + escaped + "%"
+}
+
+// CountMatches returns how many text messages contain term, ignoring ASCII
+// case.
+func (h *History) CountMatches(term string) (int, error) {
+    if h.aead != nil {
+        matches, err := h.searchSealed(term)
+        return len(matches), err
+    }
+    var n int
+    err := h.db.QueryRow(
+        `SELECT COUNT(*) FROM messages WHERE type = ? AND CAST(body AS TEXT) LIKE ? ESCAPE '\'`,
+        envelopeText, likePattern(term),
+    ).Scan(&n)
+    return n, err
+}
+
+// Search returns up to limit text messages containing term, newest first,
+// skipping the first offset.
+func (h *History) Search(term string, offset, limit int) ([]HistoryEntry, error) {
+    if h.aead != nil {
+        matches, err := h.searchSealed(term)
+        if err != nil || offset >= len(matches) {
+            return nil, err
+        }
+        return matches[offset:min(offset+limit, len(matches))], nil
+    }
+    rows, err := h.db.Query(
+        `SELECT id, peer_id, sender_id, sender_name, direction, type, body, sent_at FROM messages
+         WHERE type = ? AND CAST(body AS TEXT) LIKE ? ESCAPE '\'
+         ORDER BY sent_at DESC, recorded_at DESC LIMIT ? OFFSET ?`,
+        envelopeText, likePattern(term), limit, offset,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return h.scanEntries(rows)
+}
+
+// Around returns up to n messages either side of entry in its
+// conversation, oldest first.
+func (h *History) Around(entry HistoryEntry, n int) (before, after []HistoryEntry, err error) {
+    rows, err := h.db.Query(
+        `SELECT id, peer_id, sender_id, sender_name, direction, type, body, sent_at FROM messages
+         WHERE peer_id = ? AND id != ? AND sent_at <= ? ORDER BY sent_at DESC, recorded_at DESC LIMIT ?`,
+        entry.PeerID, entry.ID, entry.SentAt.UnixMilli(), n,
+    )
+    if err != nil {
+        return nil, nil, err
+    }
+    if before, err = h.scanEntries(rows); err != nil {
+        return nil, nil, err
+    }
+    for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+        before[i], before[j] = before[j], before[i]
+    }
+    rows, err = h.db.Query(
+        `SELECT id, peer_id, sender_id, sender_name, direction, type, body, sent_at FROM messages
+         WHERE peer_id = ? AND id != ? AND sent_at > ? ORDER BY sent_at, recorded_at LIMIT ?`,
+        entry.PeerID, entry.ID, entry.SentAt.UnixMilli(), n,
+    )
+    if err != nil {
+        return nil, nil, err
+    }
+    after, err = h.scanEntries(rows)
+    return before, after, err
+}
+
+// LastReceived returns the ID of the latest message from peerID, or "" if
+// there is none.
+func (h *History) LastReceived(peerID string) (string, error) {
+    var id string
+    err := h.db.QueryRow(
+        `SELECT id FROM messages WHERE peer_id = ? AND direction = ? ORDER BY sent_at DESC, recorded_at DESC LIMIT 1`,
+        peerID, directionIn,
+    ).Scan(&id)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return id, err
+}
+
+// SentAfter returns up to limit messages sent to peerID after the one with
+// ID ref, oldest first. There are none if ref isn't a message to peerID.
+func (h *History) SentAfter(peerID, ref string, limit int) ([]HistoryEntry, error) {
+    rows, err := h.db.Query(
+        `SELECT id, peer_id, sender_id, sender_name, direction, type, body, sent_at FROM messages
+         WHERE peer_id = ? AND direction = ? AND id != ?
+           AND sent_at >= (SELECT sent_at FROM messages WHERE id = ? AND peer_id = ? AND direction = ?)
+         ORDER BY sent_at, recorded_at LIMIT ?`,
+        peerID, directionOut, ref, ref, peerID, directionOut, limit,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return h.scanEntries(rows)
+}
+
+func (h *History) scanEntries(rows *sql.Rows) ([]HistoryEntry, error) {
+    defer rows.Close()
+    var entries []HistoryEntry
+    for rows.Next() {
+        var entry HistoryEntry
+        var name []byte
+        var sentAt int64
+        if err := rows.Scan(&entry.ID, &entry.PeerID, &entry.SenderID, &name, &entry.Direction, &entry.Type, &entry.Body, &sentAt); err != nil {
+            return nil, err
+        }
+        if h.aead != nil {
+            var err error
+            if name, err = h.open(entry.ID, name); err != nil {
+                return nil, err
+            }
+            if entry.Body, err = h.open(entry.ID, entry.Body); err != nil {
+                return nil, err
+            }
+        }
+        entry.SenderName = string(name)
+        entry.SentAt = time.UnixMilli(sentAt)
+        entries = append(entries, entry)
+    }
+    return entries, rows.Err()
+}
+
+// Has reports whether the message with id is in the history.
+func (h *History) Has(id string) (bool, error) {
+    var n int
+    err := h.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, id).Scan(&n)
+    return n > 0, err
+}
+
+func (h *History) Close() error {
+    return h.db.Close()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "database/sql"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strings"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/term"
+)
+
+// An encrypted history keeps each message's body and sender name sealed
+// with XChaCha20-Poly1305, bound to the message ID. Who a conversation was
+// with and when messages were sent stay readable, so the history can still
+// be ordered and looked up without the key. The key is derived from a
+// passphrase with Argon2id, or kept in the OS keyring.
+const (
+    historyEncryptionPassphrase = "passphrase"
+    historyEncryptionKeyring    = "keyring"
+)
+
+var historyEncryptionModes = []string{historyEncryptionPassphrase, historyEncryptionKeyring}
+
+const (
+    historyPassphraseEnv = "WEBRTC_CHAT_HISTORY_PASSPHRASE"
+    // Sealed with the key and kept with the salt, so a wrong passphrase is
+    // caught before anything is read or written with it
+    historyKeyCheck = "webrtc-chat history key"
+    keyringService  = "webrtc-chat"
+)
+
+var errHistoryEncrypted = errors.New("the history is encrypted; start with -history-passphrase or set history_encryption in the config file")
+
+// historyKeyFunc returns the key for a history given its salt. fresh is set
+// when the history is being encrypted for the first time.
+type historyKeyFunc func(salt []byte, fresh bool) ([]byte, error)
+
+// historyKeyFor returns how to get the history key config asks for, or nil
+// if the history isn't encrypted.
+func historyKeyFor(config Config) historyKeyFunc {
+    switch config.HistoryEncryption {
+    case historyEncryptionPassphrase:
+        return func(salt []byte, fresh bool) ([]byte, error) {
+            passphrase, err := readHistoryPassphrase(fresh)
+            if err != nil {
+                return nil, err
+            }
+            return argon2.IDKey(passphrase, salt, 3, 64*1024, 4, 32), nil
+        }
+    case historyEncryptionKeyring:
+        return func(salt []byte, fresh bool) ([]byte, error) {
+            path, err := filepath.Abs(config.HistoryPath)
+            if err != nil {
+                return nil, err
+            }
+            return keyringKey(path, fresh)
+        }
+    }
+    return nil
+}
+
+// unlock sets the history up to encrypt with the key from key, checking it
+// against the one the history was encrypted with or, for a history that
+// wasn't, encrypting what is already there. Without key an encrypted
+// history can't be opened.
+func (h *History) unlock(key historyKeyFunc) error {
+    var salt, check []byte
+    err := h.db.QueryRow(`SELECT value FROM history_meta WHERE name = 'salt'`).Scan(&salt)
+    if err != nil && err != sql.ErrNoRows {
+        return err
+    }
+    if err := h.db.QueryRow(`SELECT value FROM history_meta WHERE name = 'check'`).Scan(&check); err != nil && err != sql.ErrNoRows {
+        return err
+    }
+    encrypted := check != nil
+    if key == nil {
+        if encrypted {
+            return errHistoryEncrypted
+        }
+        return nil
+    }
+
+    if !encrypted {
+        salt = make([]byte, 16)
+        if _, err := rand.Read(salt); err != nil {
+            return err
+        }
+    }
+    k, err := key(salt, !encrypted)
+    if err != nil {
+        return err
+    }
+    if h.aead, err = chacha20poly1305.NewX(k); err != nil {
+        return err
+    }
+    if encrypted {
+        if plain, err := h.open("", check); err != nil || string(plain) != historyKeyCheck {
+            return errors.New("wrong passphrase or key for the history")
+        }
+        return nil
+    }
+    return h.encryptExisting(salt)
+}
+
+// encryptExisting encrypts the messages of a history that was plain until
+// now and records the salt and key check, all or nothing. The plain text
+// they replace is overwritten too, rather than left in freed space.
+func (h *History) encryptExisting(salt []byte) error {
+    tx, err := h.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    // Zeroes what the updates free on the way
+    if _, err := tx.Exec(`PRAGMA secure_delete = ON`); err != nil {
+        return err
+    }
+
+    rows, err := tx.Query(`SELECT id, sender_name, body FROM messages`)
+    if err != nil {
+        return err
+    }
+    type row struct {
+        id         string
+        name, body []byte
+    }
+    var plain []row
+    for rows.Next() {
+        var r row
+        if err := rows.Scan(&r.id, &r.name, &r.body); err != nil {
+            rows.Close()
+            return err
+        }
+        plain = append(plain, r)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    for _, r := range plain {
+        _, err := tx.Exec(`UPDATE messages SET sender_name = ?, body = ? WHERE id = ?`, h.seal(r.id, r.name), h.seal(r.id, r.body), r.id)
+        if err != nil {
+            return err
+        }
+    }
+    _, err = tx.Exec(`INSERT INTO history_meta (name, value) VALUES ('salt', ?), ('check', ?)`, salt, h.seal("", []byte(historyKeyCheck)))
+    if err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    if len(plain) == 0 {
+        return nil
+    }
+    // Rewrite the file from what is left, and empty the write-ahead log of
+    // a history in WAL mode, so no copy of the plain pages remains
+    if _, err := h.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+        return err
+    }
+    if _, err := h.db.Exec(`VACUUM`); err != nil {
+        return err
+    }
+    log.Printf("Encrypted %d message(s) already in the history\n", len(plain))
+    return nil
+}
+
+// seal encrypts data for the message with id, nonce first.
+func (h *History) seal(id string, data []byte) []byte {
+    nonce := make([]byte, h.aead.NonceSize(), h.aead.NonceSize()+len(data)+h.aead.Overhead())
+    if _, err := rand.Read(nonce); err != nil {
+        panic(err)
+    }
+    return h.aead.Seal(nonce, nonce, data, []byte(id))
+}
+
+func (h *History) open(id string, sealed []byte) ([]byte, error) {
+    if len(sealed) < h.aead.NonceSize() {
+        return nil, fmt.Errorf("history: message %s is not encrypted", id)
+    }
+    nonce, ciphertext := sealed[:h.aead.NonceSize()], sealed[h.aead.NonceSize():]
+    plain, err := h.aead.Open(nil, nonce, ciphertext, []byte(id))
+    if err != nil {
+        return nil, fmt.Errorf("history: message %s: %w", id, err)
+    }
+    return plain, nil
+}
+
+// searchSealed finds the text messages containing term, newest first, by
+// decrypting them all: the database can't look inside them.
+func (h *History) searchSealed(term string) ([]HistoryEntry, error) {
+    rows, err := h.db.Query(
+        `SELECT id, peer_id, sender_id, sender_name, direction, type, body, sent_at FROM messages
+         WHERE type = ? ORDER BY sent_at DESC, recorded_at DESC`,
+        envelopeText,
+    )
+    if err != nil {
+        return nil, err
+    }
+    entries, err := h.scanEntries(rows)
+    if err != nil {
+        return nil, err
+    }
+    term = strings.ToLower(term)
+    var matches []HistoryEntry
+    for _, entry := range entries {
+        if strings.Contains(strings.ToLower(string(entry.Body)), term) {
+            matches = append(matches, entry)
+        }
+    }
+    return matches, nil
+}
+
+// readHistoryPassphrase takes the passphrase from the environment, or asks
+// for it on the terminal, twice for a new one.
+func readHistoryPassphrase(confirm bool) ([]byte, error) {
+    if passphrase := os.Getenv(historyPassphraseEnv); passphrase != "" {
+        return []byte(passphrase), nil
+    }
+    fd := int(os.Stdin.Fd())
+    if !term.IsTerminal(fd) {
+        return nil, fmt.Errorf("no terminal to ask for the history passphrase on; set %s", historyPassphraseEnv)
+    }
+    ask := func(prompt string) ([]byte, error) {
+        fmt.Fprint(os.Stderr, prompt)
+        defer fmt.Fprintln(os.Stderr)
+        return term.ReadPassword(fd)
+    }
+    passphrase, err := ask("History passphrase: ")
+    if err != nil {
+        return nil, err
+    }
+    if len(passphrase) == 0 {
+        return nil, errors.New("the history passphrase can't be empty")
+    }
+    if confirm {
+        again, err := ask("Repeat it: ")
+        if err != nil {
+            return nil, err
+        }
+        if !bytes.Equal(passphrase, again) {
+            return nil, errors.New("the passphrases don't match")
+        }
+    }
+    return passphrase, nil
+}
+
+// keyringKey returns the history key kept in the OS keyring for the history
+// at path, creating one if fresh. The keyring is reached through the
+// platform's own tool: secret-tool (libsecret) on Linux and the BSDs and
+// security on macOS.
+func keyringKey(path string, fresh bool) ([]byte, error) {
+    if fresh {
+        key := make([]byte, 32)
+        if _, err := rand.Read(key); err != nil {
+            return nil, err
+        }
+        if err := keyringStore(path, base64.StdEncoding.EncodeToString(key)); err != nil {
+            return nil, fmt.Errorf("saving the history key in the keyring: %w", err)
+        }
+        return key, nil
+    }
+    secret, err := keyringLookup(path)
+    if err != nil {
+        return nil, fmt.Errorf("reading the history key from the keyring: %w", err)
+    }
+    return base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+}
+
+func keyringStore(path, secret string) error {
+    var cmd *exec.Cmd
+    switch runtime.GOOS {
+    case "darwin":
+        // As an argument the secret would show in the process list, so
+        // security reads the whole command from stdin instead
+        if strings.ContainsAny(path, "\r\n") {
+            return fmt.Errorf("can't name a history at %q in the keychain", path)
+        }
+        cmd = exec.Command("security", "-i")
+        cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+            securityQuote(keyringService), securityQuote(path), securityQuote(secret)))
+    case "linux", "freebsd", "openbsd", "netbsd":
+        cmd = exec.Command("secret-tool", "store", "--label=webrtc-chat history key", "service", keyringService, "history", path)
+        cmd.Stdin = strings.NewReader(secret)
+    default:
+        return fmt.Errorf("no keyring support on %s; use history_encryption %q", runtime.GOOS, historyEncryptionPassphrase)
+    }
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+    }
+    if runtime.GOOS == "darwin" {
+        // security -i exits cleanly whether or not the command worked
+        saved, err := keyringLookup(path)
+        if err != nil {
+            return err
+        }
+        if strings.TrimSpace(saved) != secret {
+            return errors.New("the key saved in the keychain doesn't match")
+        }
+    }
+    return nil
+}
+
+// securityQuote quotes s as one argument on a line for security -i.
+func securityQuote(s string) string {
+    return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func keyringLookup(path string) (string, error) {
+    var cmd *exec.Cmd
+    switch runtime.GOOS {
+    case "darwin":
+        cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", path, "-w")
+    case "linux", "freebsd", "openbsd", "netbsd":
+        cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "history", path)
+    default:
+        return "", fmt.Errorf("no keyring support on %s; use history_encryption %q", runtime.GOOS, historyEncryptionPassphrase)
+    }
+    cmd.Stderr = os.Stderr
+    output, err := cmd.Output()
+    if err != nil {
+        return "", err
+    }
+    if len(bytes.TrimSpace(output)) == 0 {
+        return "", errors.New("no key saved for this history")
+    }
+    return string(output), nil
+}
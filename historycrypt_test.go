@@ -0,0 +1,81 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestEncryptedHistory(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "history.db")
+    entry := HistoryEntry{ID: "1", PeerID: "bob-id", SenderID: "bob-id", SenderName: "bob", Direction: directionIn, Type: envelopeText, Body: []byte("the secret plan\n"), SentAt: time.Now()}
+
+    // Written before encryption was turned on
+    history, err := openHistory(path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := history.Record(entry); err != nil {
+        t.Fatal(err)
+    }
+    // Enough for the encrypted copies not to fit where the plain ones were
+    for i := 0; i < 20; i++ {
+        other := HistoryEntry{ID: fmt.Sprintf("carol-%d", i), PeerID: "carol-id", SenderID: "carol-id", SenderName: "carol", Direction: directionIn, Type: envelopeText, Body: bytes.Repeat([]byte("carol's plan "), 8), SentAt: time.Now()}
+        if err := history.Record(other); err != nil {
+            t.Fatal(err)
+        }
+    }
+    history.Close()
+
+    t.Setenv(historyPassphraseEnv, "correct horse")
+    key := historyKeyFor(Config{HistoryEncryption: historyEncryptionPassphrase, HistoryPath: path})
+    history, err = openHistory(path, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Nor is the plain text left behind in the file
+    for _, file := range []string{path, path + "-wal", path + "-journal"} {
+        if data, _ := os.ReadFile(file); bytes.Contains(data, []byte("the secret plan")) || bytes.Contains(data, []byte("carol's plan")) {
+            t.Errorf("%s still holds the message in the clear", filepath.Base(file))
+        }
+    }
+    entry.ID = "2"
+    entry.Body = []byte("more secrets\n")
+    if err := history.Record(entry); err != nil {
+        t.Fatal(err)
+    }
+    var raw []byte
+    rows, err := history.db.Query(`SELECT body FROM messages UNION ALL SELECT sender_name FROM messages`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for rows.Next() {
+        rows.Scan(&raw)
+        if bytes.Contains(raw, []byte("secret")) || bytes.Equal(raw, []byte("bob")) {
+            t.Errorf("stored in the clear: %q", raw)
+        }
+    }
+    rows.Close()
+    entries, err := history.Conversation("bob-id")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 || string(entries[0].Body) != "the secret plan\n" || entries[1].SenderName != "bob" {
+        t.Errorf("got %+v", entries)
+    }
+    if n, err := history.CountMatches("SECRET"); n != 2 || err != nil {
+        t.Errorf("search found %d, %v", n, err)
+    }
+    history.Close()
+
+    if _, err := openHistory(path, nil); err != errHistoryEncrypted {
+        t.Errorf("opening without a key gave %v", err)
+    }
+    t.Setenv(historyPassphraseEnv, "wrong horse")
+    if _, err := openHistory(path, key); err == nil {
+        t.Error("a wrong passphrase opened the history")
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/pion/webrtc/v3"
+)
+
+// identityNamespace scopes the UUIDs derived from identity keys.
+var identityNamespace = uuid.MustParse("6f1c3a52-8d0e-4c55-9b3e-2f7d41a0c9e8")
+
+const identityValidity = 10 * 365 * 24 * time.Hour
+
+// Identity is this client's long-lived DTLS certificate. The client ID is
+// derived from its public key, so peers see the same ID, fingerprint and
+// security code across restarts.
+type Identity struct {
+    Certificate webrtc.Certificate
+    ID          string
+}
+
+func defaultIdentityPath() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return "identity.pem"
+    }
+    return filepath.Join(dir, "webrtc-chat", "identity.pem")
+}
+
+// loadIdentity reads the identity at path, creating it on first run. The
+// certificate is reissued from the same key when it expires, which keeps
+// the client ID.
+func loadIdentity(path string) (*Identity, error) {
+    key, cert, err := readIdentity(path)
+    if errors.Is(err, os.ErrNotExist) {
+        key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+    } else if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+
+    if cert == nil || time.Now().After(cert.NotAfter) {
+        cert, err = issueCertificate(key)
+        if err != nil {
+            return nil, err
+        }
+        if err := writeIdentity(path, key, cert); err != nil {
+            return nil, err
+        }
+    }
+
+    spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    if err != nil {
+        return nil, err
+    }
+    return &Identity{
+        Certificate: webrtc.CertificateFromX509(key, cert),
+        ID:          uuid.NewSHA1(identityNamespace, spki).String(),
+    }, nil
+}
+
+func readIdentity(path string) (*ecdsa.PrivateKey, *x509.Certificate, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var key *ecdsa.PrivateKey
+    var cert *x509.Certificate
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            break
+        }
+        switch block.Type {
+        case "PRIVATE KEY":
+            parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+            if err != nil {
+                return nil, nil, err
+            }
+            ecKey, ok := parsed.(*ecdsa.PrivateKey)
+            if !ok {
+                return nil, nil, errors.New("identity key is not an ECDSA key")
+            }
+            key = ecKey
+        case "CERTIFICATE":
+            cert, err = x509.ParseCertificate(block.Bytes)
+            if err != nil {
+                return nil, nil, err
+            }
+        }
+    }
+    if key == nil {
+        return nil, nil, errors.New("no private key found")
+    }
+    return key, cert, nil
+}
+
+func issueCertificate(key *ecdsa.PrivateKey) (*x509.Certificate, error) {
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    template := &x509.Certificate{
+        SerialNumber: serial,
+        Subject:      pkix.Name{CommonName: "webrtc-chat"},
+        NotBefore:    now.Add(-24 * time.Hour),
+        NotAfter:     now.Add(identityValidity),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return nil, err
+    }
+    return x509.ParseCertificate(der)
+}
+
+func writeIdentity(path string, key *ecdsa.PrivateKey, cert *x509.Certificate) error {
+    keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+        return err
+    }
+
+    data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+    data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+    if err := os.WriteFile(path, data, 0o600); err != nil {
+        return err
+    }
+    log.Printf("Saved identity to %s\n", path)
+    return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "io"
+)
+
+// lineReader reads user input a line at a time, the same way on every
+// platform: "\r\n" from Windows consoles and files becomes "\n", and a final
+// line without a newline (common when input is piped) is still returned.
+type lineReader struct {
+    reader *bufio.Reader
+}
+
+func newLineReader(r io.Reader) *lineReader {
+    return &lineReader{reader: bufio.NewReader(r)}
+}
+
+// ReadLine returns the next line ending in "\n", or io.EOF once input ends.
+func (r *lineReader) ReadLine() ([]byte, error) {
+    data, err := r.reader.ReadBytes('\n')
+    if err != nil && !(errors.Is(err, io.EOF) && len(data) > 0) {
+        return nil, err
+    }
+    if isEndOfInput(data) {
+        return nil, io.EOF
+    }
+
+    data = bytes.TrimSuffix(data, []byte("\n"))
+    data = bytes.TrimSuffix(data, []byte("\r"))
+    return append(data, '\n'), nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// isEndOfInput reports whether line marks the end of input. Elsewhere Ctrl-D
+// closes stdin itself, so no line does.
+func isEndOfInput(line []byte) bool {
+    return false
+}
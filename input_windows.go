@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// isEndOfInput reports whether line is the console's end-of-input: Ctrl-Z
+// followed by Enter arrives as a line starting with 0x1a.
+func isEndOfInput(line []byte) bool {
+    return len(line) > 0 && line[0] == 0x1a
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/pion/logging"
+    "github.com/pion/transport/v2/vnet"
+    "github.com/pion/webrtc/v3"
+)
+
+// The integration harness runs a signaling server and two complete clients
+// in one process: real WebSocket signaling, real pion peer connections
+// talking over pion's virtual network, and the same wiring main does, so
+// the whole offer/answer/candidate/chat flow is exercised.
+
+// testSignalingServer pairs clients and relays messages addressed to a peer,
+// like the real server does.
+type testSignalingServer struct {
+    *httptest.Server
+
+    mu      sync.Mutex
+    clients map[string]*websocket.Conn
+    writeMu map[*websocket.Conn]*sync.Mutex
+    waiting map[string]string // room -> the client waiting for a peer there
+}
+
+func startSignalingServer(t *testing.T) *testSignalingServer {
+    s := &testSignalingServer{
+        clients: map[string]*websocket.Conn{},
+        writeMu: map[*websocket.Conn]*sync.Mutex{},
+        waiting: map[string]string{},
+    }
+    upgrader := websocket.Upgrader{}
+    s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        s.serve(conn)
+    }))
+    t.Cleanup(s.Close)
+    return s
+}
+
+func (s *testSignalingServer) URL() string {
+    return "ws" + strings.TrimPrefix(s.Server.URL, "http")
+}
+
+func (s *testSignalingServer) serve(conn *websocket.Conn) {
+    defer conn.Close()
+    s.mu.Lock()
+    s.writeMu[conn] = &sync.Mutex{}
+    s.mu.Unlock()
+    for {
+        _, data, err := conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        var message SignalingMessage
+        if err := json.Unmarshal(data, &message); err != nil {
+            continue
+        }
+        s.mu.Lock()
+        if message.ID != "" {
+            s.clients[message.ID] = conn
+        }
+        s.mu.Unlock()
+
+        switch message.Type {
+        case "signaling_request":
+            s.mu.Lock()
+            other, ok := s.waiting[message.Room]
+            if ok && other != message.ID {
+                delete(s.waiting, message.Room)
+            } else {
+                s.waiting[message.Room] = message.ID
+            }
+            s.mu.Unlock()
+            if ok && other != message.ID {
+                s.send(message.ID, SignalingMessage{Type: "signaling_response", Request: "offer", TargetID: other})
+            }
+        case "join_room":
+            s.send(message.ID, SignalingMessage{Type: "room_joined", Room: message.Room})
+        case "offer", "answer", "candidate":
+            s.relay(message.TargetID, data)
+        }
+    }
+}
+
+func (s *testSignalingServer) send(id string, message SignalingMessage) {
+    data, err := json.Marshal(message)
+    if err != nil {
+        panic(err)
+    }
+    s.relay(id, data)
+}
+
+func (s *testSignalingServer) relay(id string, data []byte) {
+    s.mu.Lock()
+    conn := s.clients[id]
+    mu := s.writeMu[conn]
+    s.mu.Unlock()
+    if conn == nil {
+        return
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// newVirtualNetwork returns one virtual network interface per IP, all on
+// the same LAN.
+func newVirtualNetwork(t *testing.T, ips ...string) []*vnet.Net {
+    router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var nets []*vnet.Net
+    for _, ip := range ips {
+        network, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := router.AddNet(network); err != nil {
+            t.Fatal(err)
+        }
+        nets = append(nets, network)
+    }
+    if err := router.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { router.Stop() })
+    return nets
+}
+
+type testClient struct {
+    id             string
+    chat           *Chat
+    peerConnection *webrtc.PeerConnection
+    conn           *SignalingClient
+    done           chan struct{}
+}
+
+// startClient sets a client up the way main does and asks to be paired.
+// The client runs as if already shutting down: a lost connection or
+// signaling server would otherwise end the whole test binary through
+// exitWith instead of failing one test.
+func startClient(t *testing.T, server *testSignalingServer, network *vnet.Net, id, name string) *testClient {
+    shuttingDown.Store(true)
+    config := defaultConfig()
+    config.Name = name
+    config.DownloadDir = t.TempDir()
+    config.NoHistory = true
+    // Host candidates on the virtual LAN are all it takes
+    config.ICEServers = []ICEServer{{URLs: []string{"stun:10.0.0.254:3478"}}}
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certificate, err := webrtc.GenerateCertificate(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    peerConnection, dataChannel, fileChannel, controlChannel := setupWebRTC(config, nil, *certificate, &rtpStats{}, network)
+    conn := connectToSignalingServer(server.URL(), SignalingOptions{Reconnect: config.Reconnect})
+
+    client := &testClient{id: id, peerConnection: peerConnection, conn: conn, done: make(chan struct{})}
+    client.chat = newChat(dataChannel, fileChannel, controlChannel, nil, nil, id, config)
+    setupDataChannelEventHandlers(dataChannel, fileChannel, controlChannel, client.chat)
+
+    conversation := newConversation(conn, id, peerConnection)
+    conversation.chat = client.chat
+    setupPeerConnectionEventHandlers(conversation)
+    sendSignalingRequest(conn, id, "")
+    go func() {
+        defer close(client.done)
+        handleSignalingMessages(conversation)
+    }()
+    return client
+}
+
+// stopClients shuts the clients down as main would on exit, and waits for
+// their signaling loops and close handlers to finish before letting later
+// tests run.
+func stopClients(t *testing.T, shown *fakeDisplay, clients ...*testClient) {
+    for _, client := range clients {
+        client.chat.Leave()
+        client.peerConnection.Close()
+        client.conn.Close()
+    }
+    for _, client := range clients {
+        select {
+        case <-client.done:
+        case <-time.After(5 * time.Second):
+            t.Errorf("%s's signaling loop didn't stop", client.id)
+        }
+    }
+    eventually(t, "leave notices", func() bool {
+        return shown.HasNotice("* alice left") && shown.HasNotice("* bob left")
+    })
+}
+
+func TestIntegrationChat(t *testing.T) {
+    shown := useFakeDisplay(t)
+    server := startSignalingServer(t)
+    nets := newVirtualNetwork(t, "10.0.0.1", "10.0.0.2")
+
+    alice := startClient(t, server, nets[0], "alice-id", "alice")
+    bob := startClient(t, server, nets[1], "bob-id", "bob")
+    t.Cleanup(func() { stopClients(t, shown, alice, bob) })
+
+    eventually(t, "the peers to connect", func() bool {
+        return alice.peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected &&
+            bob.peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected
+    })
+    eventually(t, "joins", func() bool {
+        return shown.HasNotice("* alice joined") && shown.HasNotice("* bob joined")
+    })
+
+    if err := alice.chat.Send([]byte("hello bob\n")); err != nil {
+        t.Fatal(err)
+    }
+    if err := bob.chat.Send([]byte("hi alice\n")); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the messages", func() bool { return len(shown.Messages()) == 2 })
+    for _, want := range []string{"alice: hello bob\n", "bob: hi alice\n"} {
+        found := false
+        for _, message := range shown.Messages() {
+            found = found || message == want
+        }
+        if !found {
+            t.Errorf("%q wasn't shown; got %q", want, shown.Messages())
+        }
+    }
+}
+
+func TestIntegrationCustomChannel(t *testing.T) {
+    shown := useFakeDisplay(t)
+    server := startSignalingServer(t)
+    nets := newVirtualNetwork(t, "10.0.0.1", "10.0.0.2")
+
+    alice := startClient(t, server, nets[0], "alice-id", "alice")
+    bob := startClient(t, server, nets[1], "bob-id", "bob")
+    t.Cleanup(func() { stopClients(t, shown, alice, bob) })
+
+    received := make(chan string, 1)
+    bob.chat.HandleChannel("game", messageHandler(func(msg webrtc.DataChannelMessage) {
+        received <- string(msg.Data)
+    }))
+    eventually(t, "joins", func() bool {
+        return shown.HasNotice("* alice joined") && shown.HasNotice("* bob joined")
+    })
+
+    game, err := alice.peerConnection.CreateDataChannel("game", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    game.OnOpen(func() { game.SendText("e2e4") })
+    select {
+    case move := <-received:
+        if move != "e2e4" {
+            t.Errorf("got %q", move)
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatal("the game channel's message never arrived")
+    }
+}
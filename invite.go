@@ -0,0 +1,101 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/url"
+    "strings"
+)
+
+// An invite link carries everything the invited client needs to reach this
+// one:
+//
+//	webrtc-chat://chat.example.com/invite-3f2a9c41d07e8b65?token=<signaling token>
+//
+// The host and any path before the room are the signaling server, reached
+// over wss:// unless a scheme parameter says otherwise (scheme=ws for a
+// server without TLS). -invite makes up a fresh room for every invite and
+// leaves it once someone has joined, so each link pairs one person. The
+// token is the one from the config file, not one made for the invite: the
+// signaling server has no way to hand out a token that only works once, so
+// whoever gets the link can go on using the server with it.
+const inviteScheme = "webrtc-chat"
+
+var inviteServerSchemes = []string{"wss", "ws", "grpcs", "grpc"}
+
+// Invite is what an invite link encodes.
+type Invite struct {
+    Server string
+    Room   string
+    Token  string
+}
+
+// newInviteRoom makes up a room name nobody else will guess.
+func newInviteRoom() (string, error) {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return "invite-" + hex.EncodeToString(b), nil
+}
+
+// Link formats the invite as a webrtc-chat:// link.
+func (i Invite) Link() (string, error) {
+    server, err := url.Parse(i.Server)
+    if err != nil {
+        return "", err
+    }
+    if !containsString(inviteServerSchemes, server.Scheme) || server.Host == "" {
+        return "", fmt.Errorf("can't invite to %q: not a signaling server URL", i.Server)
+    }
+    if i.Room == "" {
+        return "", errors.New("an invite needs a room")
+    }
+    query := url.Values{}
+    if i.Token != "" {
+        query.Set("token", i.Token)
+    }
+    if server.Scheme != "wss" {
+        query.Set("scheme", server.Scheme)
+    }
+    link := inviteScheme + "://" + server.Host + strings.TrimSuffix(server.EscapedPath(), "/") + "/" + url.PathEscape(i.Room)
+    if len(query) > 0 {
+        link += "?" + query.Encode()
+    }
+    return link, nil
+}
+
+// parseInvite reads an invite link.
+func parseInvite(link string) (Invite, error) {
+    u, err := url.Parse(link)
+    if err != nil {
+        return Invite{}, err
+    }
+    if u.Scheme != inviteScheme || u.Host == "" {
+        return Invite{}, fmt.Errorf("%q is not a %s:// invite link", link, inviteScheme)
+    }
+    path := u.EscapedPath()
+    slash := strings.LastIndex(path, "/")
+    if slash < 0 || slash == len(path)-1 {
+        return Invite{}, errors.New("the invite link has no room")
+    }
+    room, err := url.PathUnescape(path[slash+1:])
+    if err != nil {
+        return Invite{}, err
+    }
+    query := u.Query()
+    scheme := query.Get("scheme")
+    if scheme == "" {
+        scheme = "wss"
+    }
+    if !containsString(inviteServerSchemes, scheme) {
+        return Invite{}, fmt.Errorf("unknown server scheme %q in the invite link", scheme)
+    }
+    return Invite{
+        Server: scheme + "://" + u.Host + path[:slash],
+        Room:   room,
+        Token:  query.Get("token"),
+    }, nil
+}
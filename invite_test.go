@@ -0,0 +1,51 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestInviteLink(t *testing.T) {
+    tests := []struct {
+        invite Invite
+        link   string
+    }{
+        {Invite{Server: "wss://chat.example.com", Room: "invite-1", Token: "s3cret"}, "webrtc-chat://chat.example.com/invite-1?token=s3cret"},
+        {Invite{Server: "ws://127.0.0.1:8080/signal/", Room: "a room"}, "webrtc-chat://127.0.0.1:8080/signal/a%20room?scheme=ws"},
+        {Invite{Server: "grpcs://chat.example.com:443", Room: "r/1"}, "webrtc-chat://chat.example.com:443/r%2F1?scheme=grpcs"},
+    }
+    for _, tt := range tests {
+        link, err := tt.invite.Link()
+        if err != nil {
+            t.Fatalf("%+v: %v", tt.invite, err)
+        }
+        if link != tt.link {
+            t.Errorf("%+v: got %q, want %q", tt.invite, link, tt.link)
+        }
+        parsed, err := parseInvite(link)
+        if err != nil {
+            t.Fatalf("%s: %v", link, err)
+        }
+        want := tt.invite
+        want.Server = strings.TrimSuffix(want.Server, "/")
+        if parsed != want {
+            t.Errorf("%s: parsed %+v, want %+v", link, parsed, want)
+        }
+    }
+}
+
+func TestParseInviteRejects(t *testing.T) {
+    for _, link := range []string{
+        "https://chat.example.com/room",
+        "webrtc-chat://chat.example.com",
+        "webrtc-chat://chat.example.com/",
+        "webrtc-chat://chat.example.com/room?scheme=http",
+    } {
+        if _, err := parseInvite(link); err == nil {
+            t.Errorf("%s was accepted", link)
+        }
+    }
+    if _, err := (Invite{Server: "chat.example.com", Room: "r"}).Link(); err == nil {
+        t.Error("a server without a scheme was accepted")
+    }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// -json turns the client into something other programs can drive. Every
+// event is one JSON object per line on stdout:
+//
+//	{"event":"message","ts":<unix ms>,"from":<name>,"from_id":<client id>,"id":<message id>,"text":<text>}
+//	{"event":"message",...,"data":<base64>}    binary message
+//	{"event":"sent","ts":<unix ms>,"id":<message id>,"text":<text>}
+//	{"event":"notice","ts":<unix ms>,"text":<text>}
+//	{"event":"error","ts":<unix ms>,"text":<text>}
+//	{"event":"state","ts":<unix ms>,"value":<connection state>}
+//	{"event":"status","ts":<unix ms>,"key":<key>,"value":<value>}
+//	{"event":"progress","ts":<unix ms>,"key":<key>,"text":<line>,"done":true}
+//	{"event":"log","ts":<unix ms>,"text":<log line>}    with -log
+//	{"event":"exit","ts":<unix ms>,"code":<exit code>,"reason":<reason>,"text":<why>}
+//
+// and stdin takes one JSON command per line:
+//
+//	{"type":"message","text":"hello"}
+//	{"type":"command","command":"send","arg":"photo.jpg"}
+
+type jsonEvent struct {
+    Event  string `json:"event"`
+    Time   int64  `json:"ts"` // Unix milliseconds; the sender's clock for messages
+    From   string `json:"from,omitempty"`
+    FromID string `json:"from_id,omitempty"` // the sender's client ID, for messages
+    ID     string `json:"id,omitempty"`
+    Key    string `json:"key,omitempty"`
+    Value  string `json:"value,omitempty"`
+    Text   string `json:"text,omitempty"`
+    Data   []byte `json:"data,omitempty"`
+    Done   bool   `json:"done,omitempty"`
+
+    Code   int    `json:"code,omitempty"` // exit event only
+    Reason string `json:"reason,omitempty"`
+}
+
+// jsonEvents is the display in -json mode, nil otherwise.
+var jsonEvents *jsonDisplay
+
+// jsonDisplay writes every event as a JSON line.
+type jsonDisplay struct {
+    mu     sync.Mutex
+    enc    *json.Encoder
+    failed atomic.Bool // stdout is gone
+}
+
+func newJSONDisplay(w io.Writer) *jsonDisplay {
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(false)
+    return &jsonDisplay{enc: enc}
+}
+
+func (j *jsonDisplay) emit(event jsonEvent) {
+    if event.Time == 0 {
+        event.Time = time.Now().UnixMilli()
+    }
+    if j.failed.Load() {
+        return
+    }
+    j.mu.Lock()
+    err := j.enc.Encode(event)
+    j.mu.Unlock()
+    if err != nil && !j.failed.Swap(true) {
+        // stdout is gone, so the exit is told on stderr
+        exitWith(exitFailure, "JSON出力エラー: %v", err)
+    }
+}
+
+// Write makes the display usable as the log output with -log.
+func (j *jsonDisplay) Write(p []byte) (int, error) {
+    j.emit(jsonEvent{Event: "log", Text: strings.TrimSuffix(string(p), "\n")})
+    return len(p), nil
+}
+
+func (j *jsonDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    event := jsonEvent{Event: "message", Time: sentAt.UnixMilli(), From: sender, FromID: senderID, ID: id}
+    if isString {
+        event.Text = strings.TrimSuffix(string(data), "\n")
+    } else {
+        event.Data = data
+    }
+    j.emit(event)
+}
+
+func (j *jsonDisplay) PrintSent(id string, data []byte, sentAt time.Time) {
+    j.emit(jsonEvent{Event: "sent", Time: sentAt.UnixMilli(), ID: id, Text: strings.TrimSuffix(string(data), "\n")})
+}
+
+func (j *jsonDisplay) Printf(format string, args ...interface{}) {
+    j.emit(jsonEvent{Event: "notice", Text: strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")})
+}
+
+func (j *jsonDisplay) Error(text string) {
+    j.emit(jsonEvent{Event: "error", Text: text})
+}
+
+func (j *jsonDisplay) Progress(key, line string, done bool) {
+    j.emit(jsonEvent{Event: "progress", Key: key, Text: line, Done: done})
+}
+
+func (j *jsonDisplay) SetStatus(key, value string) {
+    if key == "state" {
+        j.emit(jsonEvent{Event: "state", Value: value})
+        return
+    }
+    j.emit(jsonEvent{Event: "status", Key: key, Value: value})
+}
+
+func (j *jsonDisplay) Alert(bool) {}
+
+func (j *jsonDisplay) Close() {}
+
+// jsonCommand is one line of -json input.
+type jsonCommand struct {
+    Type    string `json:"type"`
+    Text    string `json:"text"`
+    Command string `json:"command"`
+    Arg     string `json:"arg"`
+}
+
+// readJSONCommands turns JSON commands from stdin into the same input lines
+// the terminal produces.
+func readJSONCommands(lines chan<- []byte) {
+    reader := newLineReader(os.Stdin)
+    for {
+        data, err := reader.ReadLine()
+        if err != nil {
+            if err == io.EOF {
+                log.Println("Reached end of stdin")
+                return
+            }
+            exitWith(exitFailure, "stdin read error: %v", err)
+        }
+        if strings.TrimSpace(string(data)) == "" {
+            continue
+        }
+        line, err := jsonCommandLine(data)
+        if err != nil {
+            display.Error(err.Error())
+            continue
+        }
+        lines <- line
+    }
+}
+
+func jsonCommandLine(data []byte) ([]byte, error) {
+    var cmd jsonCommand
+    if err := json.Unmarshal(data, &cmd); err != nil {
+        return nil, fmt.Errorf("invalid command: %v", err)
+    }
+    switch cmd.Type {
+    case "message":
+        if cmd.Text == "" {
+            return nil, fmt.Errorf("message: text is required")
+        }
+        text := cmd.Text
+        if strings.HasPrefix(text, "/") {
+            // Escaped so it's sent rather than run as a command
+            text = "/" + text
+        }
+        return []byte(ensureNewline(text)), nil
+    case "command":
+        if cmd.Command == "" || strings.ContainsAny(cmd.Command, " \n") {
+            return nil, fmt.Errorf("command: a command name such as \"send\" is required")
+        }
+        if strings.Contains(cmd.Arg, "\n") {
+            return nil, fmt.Errorf("command: arg must be a single line")
+        }
+        return []byte(strings.TrimSpace("/"+cmd.Command+" "+cmd.Arg) + "\n"), nil
+    default:
+        return nil, fmt.Errorf("unknown command type %q (use message or command)", cmd.Type)
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "log"
+    "time"
+)
+
+// When nothing has been sent for a keepalive interval, a keepalive goes out
+// on the control channel so NATs that forget idle UDP mappings after a
+// minute or so keep this one. Peers that list featureKeepalive do the same,
+// so hearing nothing from them for keepaliveMissed intervals means the
+// connection is dead even if ICE hasn't noticed yet.
+const (
+    featureKeepalive         = "keepalive"
+    defaultKeepaliveInterval = 15 * time.Second
+    keepaliveMissed          = 3
+)
+
+// markSent and markReceived record traffic on any channel, so keepalives
+// are only sent and expected when there is none.
+func (c *Chat) markSent() {
+    c.lastSentAt.Store(time.Now().UnixNano())
+}
+
+func (c *Chat) markReceived() {
+    c.lastRecvAt.Store(time.Now().UnixNano())
+}
+
+// runKeepalive sends keepalives and watches for a silent peer until stop is
+// closed.
+func (c *Chat) runKeepalive(interval time.Duration, stop <-chan struct{}) {
+    c.markReceived()
+    // Checking more often than the interval keeps the idle time before a
+    // keepalive close to it
+    ticker := time.NewTicker(interval / 4)
+    defer ticker.Stop()
+    reported := false
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+
+        now := time.Now()
+        if now.Sub(time.Unix(0, c.lastSentAt.Load())) >= interval {
+            if err := c.sendControl(newControlMessage(controlKeepalive, c.clientID)); err != nil {
+                log.Println("キープアライブ送信エラー: ", err)
+            }
+        }
+
+        silence := now.Sub(time.Unix(0, c.lastRecvAt.Load()))
+        if silence < keepaliveMissed*interval {
+            if reported && c.onPeerBack != nil {
+                c.onPeerBack()
+            }
+            reported = false
+            continue
+        }
+        if c.peerSupports(featureKeepalive) && !reported {
+            // Once per silence: reconnecting may bring the peer back
+            reported = true
+            log.Printf("Nothing from peer for %s\n", silence.Round(time.Second))
+            display.Printf("* %s stopped responding\n", displayName(c.PeerName()))
+            if c.onPeerDead != nil {
+                c.onPeerDead()
+            }
+        }
+    }
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    lanGroupAddress     = "239.255.42.99:42424"
+    lanAnnounceInterval = time.Second
+    lanPeerTimeout      = 5 * lanAnnounceInterval
+    lanMaxPacketSize    = 64 * 1024
+)
+
+var errLANClosed = errors.New("lan: signaler closed")
+
+type lanPeer struct {
+    room     string
+    lastSeen time.Time
+}
+
+// LANSignaler stands in for the signaling server when running with --lan.
+// Clients announce themselves on a UDP multicast group and every signaling
+// message is multicast to the group; each client keeps only messages
+// addressed to it. The server's job of pairing is done locally: when two
+// unpaired clients in the same room hear each other, the one with the lower
+// ID is told to send the offer.
+type LANSignaler struct {
+    clientID string
+    group    *net.UDPAddr
+    listener *net.UDPConn
+    sender   *net.UDPConn
+
+    incoming chan []byte
+    done     chan struct{}
+
+    mu        sync.Mutex
+    room      string
+    announced bool
+    paired    bool
+    peers     map[string]*lanPeer
+    closed    bool
+}
+
+func newLANSignaler(clientID string) (*LANSignaler, error) {
+    group, err := net.ResolveUDPAddr("udp4", lanGroupAddress)
+    if err != nil {
+        return nil, err
+    }
+    listener, err := net.ListenMulticastUDP("udp4", nil, group)
+    if err != nil {
+        return nil, err
+    }
+    listener.SetReadBuffer(lanMaxPacketSize * 4)
+    sender, err := net.ListenUDP("udp4", nil)
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+
+    s := &LANSignaler{
+        clientID: clientID,
+        group:    group,
+        listener: listener,
+        sender:   sender,
+        incoming: make(chan []byte, 64),
+        done:     make(chan struct{}),
+        peers:    map[string]*lanPeer{},
+    }
+    go s.receive()
+    log.Printf("LAN discovery on %s\n", lanGroupAddress)
+    return s, nil
+}
+
+// WriteJSON handles the messages a server would: room membership and pairing
+// requests are kept locally, everything else is multicast to the peers.
+func (s *LANSignaler) WriteJSON(v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    var message SignalingMessage
+    if err := json.Unmarshal(data, &message); err != nil {
+        return err
+    }
+
+    switch message.Type {
+    case "join_room":
+        s.mu.Lock()
+        s.room = message.Room
+        s.mu.Unlock()
+        return nil
+    case "leave_room":
+        return nil
+    case "signaling_request":
+        s.mu.Lock()
+        s.room = message.Room
+        start := !s.announced
+        s.announced = true
+        s.mu.Unlock()
+        if start {
+            go s.announce()
+        }
+        return nil
+    case "list_peers":
+        return s.deliverPeerList()
+    case "presence":
+        s.mu.Lock()
+        presence := lanPresence(s.peers, message.TargetID, time.Now())
+        s.mu.Unlock()
+        data, err := json.Marshal(SignalingMessage{Type: "presence", Presence: []PeerPresence{presence}})
+        if err != nil {
+            return err
+        }
+        s.deliver(data)
+        return nil
+    case "queue_message":
+        return errors.New("offline messages need a signaling server")
+    case "fetch_queue":
+        return nil
+    case "offer", "answer":
+        s.mu.Lock()
+        s.paired = true
+        s.mu.Unlock()
+    }
+
+    _, err = s.sender.WriteToUDP(data, s.group)
+    return err
+}
+
+func (s *LANSignaler) ReadJSON(v interface{}) error {
+    select {
+    case data := <-s.incoming:
+        return json.Unmarshal(data, v)
+    case <-s.done:
+        return errLANClosed
+    }
+}
+
+func (s *LANSignaler) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return nil
+    }
+    s.closed = true
+    close(s.done)
+    s.sender.Close()
+    return s.listener.Close()
+}
+
+func (s *LANSignaler) announce() {
+    ticker := time.NewTicker(lanAnnounceInterval)
+    defer ticker.Stop()
+    for {
+        s.mu.Lock()
+        paired := s.paired
+        room := s.room
+        s.mu.Unlock()
+
+        if !paired {
+            data, _ := json.Marshal(SignalingMessage{
+                Type: "lan_announce",
+                ID:   s.clientID,
+                Room: room,
+            })
+            if _, err := s.sender.WriteToUDP(data, s.group); err != nil {
+                log.Println("LANアナウンス送信エラー: ", err)
+            }
+        }
+
+        select {
+        case <-ticker.C:
+        case <-s.done:
+            return
+        }
+    }
+}
+
+func (s *LANSignaler) receive() {
+    buf := make([]byte, lanMaxPacketSize)
+    for {
+        n, _, err := s.listener.ReadFromUDP(buf)
+        if err != nil {
+            select {
+            case <-s.done:
+                return
+            default:
+            }
+            log.Println("LAN受信エラー: ", err)
+            continue
+        }
+
+        var message SignalingMessage
+        if err := json.Unmarshal(buf[:n], &message); err != nil || message.ID == s.clientID {
+            continue
+        }
+
+        if message.Type == "lan_announce" {
+            s.handleAnnounce(message)
+            continue
+        }
+        if message.TargetID != s.clientID {
+            continue
+        }
+        s.deliver(append([]byte(nil), buf[:n]...))
+    }
+}
+
+func (s *LANSignaler) handleAnnounce(message SignalingMessage) {
+    s.mu.Lock()
+    _, known := s.peers[message.ID]
+    s.peers[message.ID] = &lanPeer{room: message.Room, lastSeen: time.Now()}
+    offer := s.announced && !s.paired && message.Room == s.room && s.clientID < message.ID
+    if offer {
+        s.paired = true
+    }
+    s.mu.Unlock()
+
+    if !known {
+        log.Printf("LAN peer discovered: %s\n", message.ID)
+    }
+    if offer {
+        data, _ := json.Marshal(SignalingMessage{
+            Type:     "signaling_response",
+            Request:  "offer",
+            TargetID: message.ID,
+        })
+        s.deliver(data)
+    }
+}
+
+func (s *LANSignaler) deliverPeerList() error {
+    s.mu.Lock()
+    peers := []string{s.clientID}
+    var offline []PeerPresence
+    now := time.Now()
+    for id, peer := range s.peers {
+        if peer.room != s.room {
+            continue
+        }
+        if presence := lanPresence(s.peers, id, now); presence.Online {
+            peers = append(peers, id)
+        } else {
+            offline = append(offline, presence)
+        }
+    }
+    s.mu.Unlock()
+
+    data, err := json.Marshal(SignalingMessage{Type: "peer_list", Peers: peers, Presence: offline})
+    if err != nil {
+        return err
+    }
+    s.deliver(data)
+    return nil
+}
+
+func (s *LANSignaler) deliver(data []byte) {
+    select {
+    case s.incoming <- data:
+    case <-s.done:
+    }
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "sync/atomic"
+
+    "unicode/utf8"
+
+    "github.com/mattn/go-runewidth"
+    "golang.org/x/term"
+)
+
+// When stdin, stdout and stderr are all the terminal, typed lines are read
+// with golang.org/x/term's line editor instead of the terminal's own line
+// discipline: the arrow keys move along the line and recall earlier lines,
+// Ctrl-A and Ctrl-E jump to either end, Ctrl-W and Ctrl-U delete the word
+// or everything before the cursor, Ctrl-D on an empty line ends input, and
+// PageUp and PageDown page through the scrollback.
+// The terminal is in raw mode meanwhile, so everything shown goes through
+// the editor, which keeps the line being typed pinned below it and redraws
+// it whenever a message is printed or the window is resized. -no-readline
+// keeps the plain line discipline.
+const lineEditorPrompt = "> "
+
+// lineEditor reads typed lines with editing and history.
+type lineEditor struct {
+    in      io.Reader
+    out     io.Writer
+    restore func()
+    // set when Ctrl-C was typed, which the editor reports as end of input
+    interrupted atomic.Bool
+    // called for PageUp (older) and PageDown, and for every key typed;
+    // set before Start
+    onPage  func(older bool)
+    onInput func()
+
+    mu           sync.Mutex
+    term         *term.Terminal // nil until Start
+    width        int
+    pending      []byte // output written so far that doesn't end a line yet
+    progressRows int    // rows of a rewritten line shown above the prompt
+    once         sync.Once
+}
+
+// editor is the line editor typed lines are read with, nil when they are
+// read plainly.
+var editor *lineEditor
+
+// useLineEditor reports whether the line editor can take over the
+// terminal.
+func useLineEditor() bool {
+    return term.IsTerminal(int(os.Stdin.Fd())) && stdoutIsTerminal && stderrIsTerminal
+}
+
+// newLineEditor routes the terminal output through a line editor, which
+// passes it straight on until Start. The editor works in UTF-8 and sits on
+// top of any transcoding of the terminal.
+func newLineEditor() *lineEditor {
+    e := &lineEditor{in: terminalIn, out: terminalOut}
+    terminalOut = e
+    terminalErr = e
+    return e
+}
+
+// Start puts the terminal in raw mode and starts editing. Anything that
+// exits after it has to restore the terminal, as exitWith does.
+func (e *lineEditor) Start() error {
+    fd := int(os.Stdin.Fd())
+    state, err := term.MakeRaw(fd)
+    if err != nil {
+        return err
+    }
+    e.mu.Lock()
+    e.restore = func() { term.Restore(fd, state) }
+    e.mu.Unlock()
+    e.attach(&validUTF8Reader{r: e.in})
+    e.resize()
+    go watchTerminalSize(e.resize)
+    return nil
+}
+
+// attach starts editing the keys read from in.
+func (e *lineEditor) attach(in io.Reader) {
+    t := term.NewTerminal(struct {
+        io.Reader
+        io.Writer
+    }{keyWatcher{in, e}, e.out}, lineEditorPrompt)
+    e.mu.Lock()
+    e.term = t
+    e.mu.Unlock()
+}
+
+// active reports whether Start has taken over the terminal.
+func (e *lineEditor) active() bool {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.term != nil
+}
+
+// resize tells the editor the window's size, which it needs to redraw a
+// line that wraps.
+func (e *lineEditor) resize() {
+    if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 {
+        e.mu.Lock()
+        e.width = width
+        e.mu.Unlock()
+        e.term.SetSize(width, height)
+    }
+}
+
+// ReadLine returns the next typed line ending in "\n", io.EOF once input
+// ends, or errInterrupted for Ctrl-C.
+func (e *lineEditor) ReadLine() ([]byte, error) {
+    // Where the window size can't be watched, this is the next best time
+    e.resize()
+    line, err := e.term.ReadLine()
+    if errors.Is(err, term.ErrPasteIndicator) {
+        err = nil
+    }
+    if errors.Is(err, io.EOF) && e.interrupted.Swap(false) {
+        return nil, errInterrupted
+    }
+    if err != nil {
+        return nil, err
+    }
+    return []byte(line + "\n"), nil
+}
+
+// Write passes whole lines to the editor, which can only redraw the line
+// being typed below complete ones. A line rewritten in place with "\r",
+// such as transfer progress, is shown above the prompt as it changes, each
+// version over the last, until it ends.
+func (e *lineEditor) Write(p []byte) (int, error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.term == nil {
+        return e.out.Write(p)
+    }
+    e.pending = append(e.pending, p...)
+    end := bytes.LastIndexByte(e.pending, '\n')
+    if end < 0 {
+        cr := bytes.LastIndexByte(e.pending, '\r')
+        if cr < 0 {
+            return len(p), nil
+        }
+        e.pending = append(e.pending[:0], e.pending[cr:]...)
+        line := e.pending[1:]
+        if err := e.writeLines(append(append([]byte{'\r'}, line...), '\n')); err != nil {
+            return 0, err
+        }
+        e.progressRows = e.rows(line)
+        return len(p), nil
+    }
+    lines := e.pending[:end+1]
+    if cr := bytes.LastIndexByte(lines[:bytes.IndexByte(lines, '\n')], '\r'); cr > 0 {
+        lines = lines[cr:]
+    }
+    if err := e.writeLines(lines); err != nil {
+        return 0, err
+    }
+    e.pending = append(e.pending[:0], e.pending[end+1:]...)
+    return len(p), nil
+}
+
+// writeLines writes whole lines through the editor, over a rewritten line
+// still shown above the prompt. It is called with mu held.
+func (e *lineEditor) writeLines(lines []byte) error {
+    if e.progressRows > 0 {
+        lines = append([]byte(fmt.Sprintf("\x1b[%dA\x1b[J", e.progressRows)), lines...)
+        e.progressRows = 0
+    }
+    _, err := e.term.Write(lines)
+    return err
+}
+
+// rows is how many rows line takes up on the screen.
+func (e *lineEditor) rows(line []byte) int {
+    width := runewidth.StringWidth(string(line))
+    if e.width <= 0 || width <= e.width {
+        return 1
+    }
+    return (width + e.width - 1) / e.width
+}
+
+// WriteControl writes seq, an escape sequence that doesn't move the
+// cursor, right away instead of waiting for a whole line like Write.
+func (e *lineEditor) WriteControl(seq string) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.term == nil {
+        io.WriteString(e.out, seq)
+        return
+    }
+    e.term.Write([]byte(seq))
+}
+
+// Close clears the prompt and gives the terminal back as it was.
+func (e *lineEditor) Close() {
+    e.once.Do(func() {
+        e.mu.Lock()
+        restore := e.restore
+        e.mu.Unlock()
+        if restore == nil {
+            return
+        }
+        os.Stdout.WriteString("\r\x1b[K")
+        restore()
+    })
+}
+
+// restoreTerminal undoes the line editor's raw mode before exiting.
+func restoreTerminal() {
+    if editor != nil {
+        editor.Close()
+    }
+}
+
+var errInterrupted = errors.New("interrupted")
+
+// The keys the editor doesn't know and drops.
+var (
+    keyPageUp   = []byte("\x1b[5~")
+    keyPageDown = []byte("\x1b[6~")
+)
+
+// keyWatcher handles what is typed before the editor sees it: it reports
+// the typing, notes Ctrl-C, so it can be told apart from Ctrl-D, and takes
+// out PageUp and PageDown for the scrollback.
+type keyWatcher struct {
+    r io.Reader
+    e *lineEditor
+}
+
+func (w keyWatcher) Read(p []byte) (int, error) {
+    n, err := w.r.Read(p)
+    if n > 0 && w.e.onInput != nil {
+        w.e.onInput()
+    }
+    if bytes.IndexByte(p[:n], 3) >= 0 {
+        w.e.interrupted.Store(true)
+    }
+    for _, key := range [][]byte{keyPageUp, keyPageDown} {
+        for {
+            i := bytes.Index(p[:n], key)
+            if i < 0 {
+                break
+            }
+            n = copy(p[i:], p[i+len(key):n]) + i
+            if w.e.onPage != nil {
+                w.e.onPage(bytes.Equal(key, keyPageUp))
+            }
+        }
+    }
+    return n, err
+}
+
+// validUTF8Reader drops what isn't UTF-8 from r. The editor takes
+// utf8.RuneError for the start of a character still arriving and waits for
+// the rest forever, ignoring every key typed after it, so neither stray
+// bytes (a misdetected terminal encoding) nor U+FFFD may reach it.
+type validUTF8Reader struct {
+    r    io.Reader
+    tail []byte // a character whose last bytes haven't been read yet
+}
+
+func (v *validUTF8Reader) Read(p []byte) (int, error) {
+    for {
+        n := copy(p, v.tail)
+        m, err := v.r.Read(p[n:])
+        data := p[:n+m]
+        kept, i := 0, 0
+        for i < len(data) && utf8.FullRune(data[i:]) {
+            r, size := utf8.DecodeRune(data[i:])
+            if r != utf8.RuneError {
+                kept += copy(p[kept:], data[i:i+size])
+            }
+            i += size
+        }
+        v.tail = append(v.tail[:0], data[i:]...)
+        if kept > 0 || err != nil {
+            return kept, err
+        }
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "bytes"
+    "io"
+    "strings"
+    "testing"
+    "testing/iotest"
+    "time"
+
+    "golang.org/x/term"
+)
+
+func TestLineEditorWritesWholeLines(t *testing.T) {
+    var screen bytes.Buffer
+    e := &lineEditor{}
+    e.term = term.NewTerminal(struct {
+        io.Reader
+        io.Writer
+    }{strings.NewReader(""), &screen}, lineEditorPrompt)
+
+    e.Write([]byte("alice: "))
+    if screen.Len() != 0 {
+        t.Fatalf("a partial line was shown: %q", screen.String())
+    }
+    e.Write([]byte("hi\nbob"))
+    if got := screen.String(); got != "alice: hi\r\n" {
+        t.Errorf("showed %q", got)
+    }
+
+    // A progress line shows as it changes, each version over the last
+    screen.Reset()
+    e.pending = nil
+    e.Write([]byte("\rsending 10%"))
+    e.Write([]byte("\rsending 50%"))
+    e.Write([]byte("\n"))
+    want := "\rsending 10%\r\n" + "\x1b[1A\x1b[J\rsending 50%\r\n" + "\x1b[1A\x1b[J\rsending 50%\r\n"
+    if got := screen.String(); got != want {
+        t.Errorf("a progress line showed as %q, want %q", got, want)
+    }
+
+    // One that wraps is taken back row by row
+    screen.Reset()
+    e.width = 10
+    e.Write([]byte("\r送信中 report.pdf"))
+    e.Write([]byte("\rdone\n"))
+    if got := screen.String(); !strings.HasSuffix(got, "\x1b[2A\x1b[J\rdone\r\n") {
+        t.Errorf("a wrapped progress line was replaced with %q", got)
+    }
+}
+
+func TestCtrlDInLineEditorQuits(t *testing.T) {
+    keys, typing := io.Pipe()
+    defer typing.Close()
+    e := &lineEditor{out: io.Discard}
+    e.attach(keys)
+    previous := editor
+    editor = e
+    defer func() { editor = previous }()
+
+    quit := make(chan struct{})
+    go readStdinLines(make(chan []byte), quit, func() {})
+    typing.Write([]byte{4})
+    select {
+    case <-quit:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Ctrl-D on an empty line didn't quit")
+    }
+}
+
+func TestValidUTF8ReaderDropsStrayBytes(t *testing.T) {
+    // One byte at a time splits every multibyte character across reads
+    input := append([]byte("こん\xa4\xb3に\ufffdちは"), 3)
+    r := &validUTF8Reader{r: iotest.OneByteReader(bytes.NewReader(input))}
+    got, err := io.ReadAll(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(got) != "こんにちは\x03" {
+        t.Errorf("got %q", got)
+    }
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "io"
+    "log"
+
+    "github.com/pion/logging"
+)
+
+// logLevelAtLeast reports whether level is as verbose as min. An empty level
+// counts as off.
+func logLevelAtLeast(level, min string) bool {
+    return logLevelIndex(level) >= logLevelIndex(min)
+}
+
+func logLevelIndex(level string) int {
+    for i, name := range logLevels {
+        if name == level {
+            return i
+        }
+    }
+    return 0
+}
+
+// newPionLoggerFactory sends pion's internal logging at level through the
+// standard logger, so it lands wherever this client's own log goes.
+func newPionLoggerFactory(level string) logging.LoggerFactory {
+    pionLevel := map[string]logging.LogLevel{
+        "off":   logging.LogLevelDisabled,
+        "error": logging.LogLevelError,
+        "warn":  logging.LogLevelWarn,
+        "info":  logging.LogLevelInfo,
+        "debug": logging.LogLevelDebug,
+        "trace": logging.LogLevelTrace,
+    }[level]
+    return &logging.DefaultLoggerFactory{
+        Writer:          logOutput{},
+        DefaultLogLevel: pionLevel,
+        ScopeLevels:     map[string]logging.LogLevel{},
+    }
+}
+
+// logOutput writes to whatever the standard logger currently writes to, or
+// shows the line as a notice when this client's own log is turned off (as it
+// is below the info level).
+type logOutput struct{}
+
+func (logOutput) Write(p []byte) (int, error) {
+    if w := log.Writer(); w != io.Discard {
+        return w.Write(p)
+    }
+    display.Printf("%s", p)
+    return len(p), nil
+}
@@ -1,93 +1,1387 @@
 package main
 
 import (
-    "bufio"
-    "encoding/json"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "flag"
     "fmt"
     "io"
     "log"
+    "net"
+    "net/url"
     "os"
-    "flag"
-    "unicode/utf8"
+    "os/signal"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
 
-    "github.com/google/uuid"
-    "github.com/gorilla/websocket"
+    "github.com/atotto/clipboard"
+    "github.com/pion/ice/v2"
+    "github.com/pion/interceptor"
+    "github.com/pion/transport/v2/vnet"
     "github.com/pion/webrtc/v3"
 )
 
 type SignalingMessage struct {
-    Type      string `json:"type"`
-    TargetID  string `json:"target_id"`
-    Request   string `json:"request"`
-    Offer     string `json:"offer"`
-    Answer    string `json:"answer"`
-    Candidate string `json:"candidate"`
-    ID        string `json:"id"`
+    Type      string           `json:"type"`
+    TargetID  string           `json:"target_id"`
+    Request   string           `json:"request"`
+    Offer     descriptionField `json:"offer"`
+    Answer    descriptionField `json:"answer"`
+    Candidate candidateField   `json:"candidate"`
+    ID        string           `json:"id"`
+    Room      string           `json:"room,omitempty"`
+    Peers     []string         `json:"peers,omitempty"`
+    Error     string           `json:"error,omitempty"`
+    Version   int              `json:"version,omitempty"` // see signalingVersion
+
+    Payload  string          `json:"payload,omitempty"`
+    TTL      int             `json:"ttl,omitempty"` // seconds
+    Messages []QueuedMessage `json:"messages,omitempty"`
+    Presence []PeerPresence  `json:"presence,omitempty"`
+}
+
+type RoomMessage struct {
+    Type string `json:"type"`
+    Room string `json:"room"`
+    ID   string `json:"id"`
 }
 
 type OfferMessage struct {
-    Type     string `json:"type"`
-    TargetID string `json:"target_id"`
-    Offer    string `json:"offer"`
-    ID       string `json:"id"`
+    Type     string      `json:"type"`
+    TargetID string      `json:"target_id"`
+    Offer    interface{} `json:"offer"` // see descriptionPayload
+    ID       string      `json:"id"`
+    Version  int         `json:"version"`
 }
 
 type AnswerMessage struct {
-    Type     string `json:"type"`
-    TargetID string `json:"target_id"`
-    Answer   string `json:"answer"`
-    ID       string `json:"id"`
+    Type     string      `json:"type"`
+    TargetID string      `json:"target_id"`
+    Answer   interface{} `json:"answer"` // see descriptionPayload
+    ID       string      `json:"id"`
+    Version  int         `json:"version"`
 }
 
 type CandidateMessage struct {
-    Type      string `json:"type"`
-    TargetID  string `json:"target_id"`
-    Candidate string `json:"candidate"`
-    ID        string `json:"id"`
+    Type      string      `json:"type"`
+    TargetID  string      `json:"target_id"`
+    Candidate interface{} `json:"candidate"` // see candidatePayload
+    ID        string      `json:"id"`
+    Version   int         `json:"version"`
 }
 
 func main() {
     var serverIP string
     var enableLogging bool
-    flag.StringVar(&serverIP, "server", "", "Signaling Server IP address")
+    var room string
+    var stunFlag string
+    var turnServer TURNServer
+    var tlsFlags TLSConfig
+    var enableE2E bool
+    var downloadDir string
+    var enableTUI bool
+    var name string
+    var historyPath string
+    var noHistory bool
+    var historyPassphrase bool
+    var unordered bool
+    var maxRetransmits int
+    var maxPacketLifeTime int
+    var authToken string
+    var proxy string
+    var lanMode bool
+    var matrixMode bool
+    var matrixRoom string
+    var manualMode bool
+    var resume bool
+    var makeInvite bool
+    var browser bool
+    var wire string
+    var configFile string
+    var identityPath string
+    var pingInterval time.Duration
+    var keepaliveInterval time.Duration
+    var checkNAT bool
+    var candidatePolicy string
+    var mdns bool
+    var networkTypes string
+    var ipv6Policy string
+    var terminalEncoding string
+    var timestampLayout string
+    var showIDs bool
+    var plain bool
+    var noColor bool
+    var noReadline bool
+    var noTitle bool
+    var alert string
+    var alertMentions bool
+    var maxSendRate string
+    var pipeMode bool
+    var jsonMode bool
+    flag.StringVar(&configFile, "config", defaultConfigPath, "Path to the JSON config file")
+    flag.StringVar(&identityPath, "identity", "", "Identity key file (default in the user config dir)")
+    flag.StringVar(&serverIP, "server", "", "Signaling server URL (ws://, wss://, grpc:// or grpcs://)")
+    flag.StringVar(&room, "room", "", "Room name to join (only peers in the same room are paired)")
     flag.BoolVar(&enableLogging, "log", false, "Enable logging")
+    flag.StringVar(&stunFlag, "stun", "", "Comma-separated STUN server URLs (e.g. stun:stun.example.com:3478), or \"none\" to use no STUN server")
+    flag.StringVar(&turnServer.URL, "turn", "", "TURN server URL (e.g. turn:turn.example.com:3478)")
+    flag.StringVar(&turnServer.Username, "turn-username", "", "TURN server username")
+    flag.StringVar(&turnServer.Credential, "turn-credential", "", "TURN server credential")
+    flag.StringVar(&tlsFlags.CACert, "ca-cert", "", "PEM CA bundle used to verify a wss:// signaling server")
+    flag.StringVar(&tlsFlags.ClientCert, "client-cert", "", "PEM client certificate for wss:// signaling")
+    flag.StringVar(&tlsFlags.ClientKey, "client-key", "", "PEM client private key for wss:// signaling")
+    flag.BoolVar(&tlsFlags.InsecureSkipVerify, "insecure", false, "Skip TLS certificate verification (testing only)")
+    flag.BoolVar(&enableE2E, "e2e", false, "Encrypt messages end-to-end (both peers must enable it)")
+    flag.StringVar(&downloadDir, "download-dir", "", "Directory where received files are saved")
+    flag.BoolVar(&enableTUI, "tui", false, "Use the full-screen terminal interface")
+    flag.StringVar(&name, "name", "", "Display name shown to the peer")
+    flag.StringVar(&historyPath, "history", "", "SQLite database where chat history is saved")
+    flag.BoolVar(&noHistory, "no-history", false, "Don't save chat history")
+    flag.BoolVar(&historyPassphrase, "history-passphrase", false, "Encrypt the chat history with a passphrase, asked for at startup or taken from $"+historyPassphraseEnv)
+    flag.BoolVar(&unordered, "unordered", false, "Allow the chat channel to deliver messages out of order")
+    flag.IntVar(&maxRetransmits, "max-retransmits", -1, "Give up on a message after this many retransmissions (unreliable mode)")
+    flag.IntVar(&maxPacketLifeTime, "max-packet-lifetime", -1, "Give up on a message after this many milliseconds (unreliable mode)")
+    flag.StringVar(&authToken, "token", "", "Auth token for the signaling server (default $WEBRTC_CHAT_TOKEN)")
+    flag.StringVar(&proxy, "proxy", "", "Proxy for the signaling connection (http:// or socks5://)")
+    flag.BoolVar(&jsonMode, "json", false, "Emit events as JSON lines on stdout and read JSON commands from stdin")
+    flag.BoolVar(&pipeMode, "pipe", false, "Stream stdin to the peer and the peer's data to stdout as raw bytes, like nc")
+    flag.BoolVar(&lanMode, "lan", false, "Find a peer on the local network instead of using a signaling server")
+    flag.BoolVar(&matrixMode, "matrix", false, "Signal through a Matrix room (the matrix section of the config) instead of a signaling server")
+    flag.StringVar(&matrixRoom, "matrix-room", "", "Matrix room ID or alias to signal through, with -matrix")
+    flag.BoolVar(&resume, "resume", false, "Call the peer from the last session again and send the messages left unsent")
+    flag.BoolVar(&manualMode, "manual", false, "Exchange pairing codes by copy and paste instead of using a signaling server")
+    flag.BoolVar(&makeInvite, "invite", false, "Make an invite link for someone to connect to you with, and wait for them; its room works once, but any signaling token in it keeps working")
+    flag.BoolVar(&showQR, "qr", false, "Also show -manual pairing codes and -invite links as QR codes")
+    flag.BoolVar(&browser, "browser-compat", false, "Send offers, answers and candidates as the JSON objects browsers expect")
+    flag.StringVar(&wire, "wire-format", "", "Preferred message encoding: protobuf (default), msgpack or json")
+    flag.StringVar(&candidatePolicy, "candidates", "", "Local addresses offered to the peer: all, no-host (hide LAN IPs) or relay (TURN only)")
+    flag.BoolVar(&mdns, "mdns", false, "Hide LAN IPs behind random .local names")
+    flag.StringVar(&networkTypes, "network-types", "", "Comma-separated candidate network types to use: udp4, udp6, tcp4, tcp6")
+    flag.StringVar(&ipv6Policy, "ipv6", "", "prefer to rank IPv6 above IPv4, disable to skip IPv6 entirely")
+    flag.StringVar(&timestampLayout, "timestamp-format", "", "Show when each message was sent, as a Go time layout (e.g. 15:04)")
+    flag.StringVar(&alert, "alert", "", "Alert when a message arrives: bell, visual (flash the screen) or off")
+    flag.BoolVar(&alertMentions, "alert-mentions", false, "Only alert for messages that mention your -name")
+    flag.BoolVar(&plain, "plain", false, "Show messages as sent, without rendering Markdown")
+    flag.BoolVar(&noReadline, "no-readline", false, "Read typed lines as the terminal delivers them, without line editing and history")
+    flag.BoolVar(&noTitle, "no-title", false, "Don't show the peer and the number of new messages in the terminal window's title")
+    flag.BoolVar(&noColor, "no-color", false, "Don't colour peers' names (also set by the NO_COLOR environment variable)")
+    flag.BoolVar(&showIDs, "show-ids", false, "Show each message's short ID, for /react")
+    flag.StringVar(&terminalEncoding, "encoding", "", "Terminal character encoding, e.g. cp932 or euc-jp (default: detected)")
+    flag.BoolVar(&checkNAT, "check-nat", false, "Test the local NAT with STUN, report whether direct connections are likely and exit")
+    flag.StringVar(&maxSendRate, "max-send-rate", "", "Limit outgoing data to this rate, e.g. 1MBps, 500KBps or 8Mbps")
+    flag.DurationVar(&pingInterval, "ping-interval", 0, "Ping the peer this often and show the round-trip time (e.g. 5s)")
+    flag.DurationVar(&keepaliveInterval, "keepalive", defaultKeepaliveInterval, "Send a keepalive after this long without traffic, so NATs keep the connection open; 0 disables")
     flag.Parse()
 
+    explicitConfig, explicitKeepalive := false, false
+    flag.Visit(func(f *flag.Flag) {
+        switch f.Name {
+        case "config":
+            explicitConfig = true
+        case "keepalive":
+            explicitKeepalive = true
+        }
+    })
+    // An invite link someone sent, as the only argument
+    switch flag.NArg() {
+    case 0:
+    case 1:
+        if room != "" || makeInvite {
+            fmt.Fprintln(os.Stderr, "an invite link cannot be used with -room or -invite")
+            os.Exit(exitUsage)
+        }
+        invite, err := parseInvite(flag.Arg(0))
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "招待リンクエラー:", err)
+            os.Exit(exitUsage)
+        }
+        serverIP, room = invite.Server, invite.Room
+        if invite.Token != "" {
+            authToken = invite.Token
+        }
+    default:
+        fmt.Fprintln(os.Stderr, "only one invite link can be given")
+        os.Exit(exitUsage)
+    }
+    config, err := loadConfig(configFile, explicitConfig)
+    if err == nil {
+        // -turn goes through the same checks as turn_servers
+        if turnServer.URL != "" {
+            config.TURNServers = append(config.TURNServers, turnServer)
+        }
+        if err = config.Validate(); err != nil {
+            err = fmt.Errorf("%s: %w", configFile, err)
+        }
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "設定ファイルエラー:", err)
+        os.Exit(exitUsage)
+    }
+    if enableLogging && !logLevelAtLeast(config.LogLevel, "info") {
+        config.LogLevel = "info"
+    }
+    if stunFlag != "" {
+        if err := applySTUNFlag(&config, stunFlag); err != nil {
+            fmt.Fprintln(os.Stderr, "-stun:", err)
+            os.Exit(exitUsage)
+        }
+    }
+    if checkNAT {
+        os.Exit(runNATCheck(config))
+    }
+    enableLogging = logLevelAtLeast(config.LogLevel, "info")
+    if historyPath != "" {
+        config.HistoryPath = historyPath
+    }
+    if noHistory {
+        config.NoHistory = true
+    }
+    if historyPassphrase {
+        config.HistoryEncryption = historyEncryptionPassphrase
+    }
+    // Opened before the terminal is taken over, as it may ask for the
+    // history passphrase
+    var history *History
+    if !config.NoHistory {
+        history, err = openHistory(config.HistoryPath, historyKeyFor(config))
+        if err != nil {
+            exitWith(exitFailure, "履歴データベースオープンエラー: %v", err)
+        }
+    }
+    if terminalEncoding != "" {
+        config.Encoding = terminalEncoding
+    }
+    if !enableTUI {
+        // The TUI library handles the terminal's encoding itself
+        if err := setupTerminalEncoding(config.Encoding); err != nil {
+            fmt.Fprintln(os.Stderr, "文字コード設定エラー:", err)
+            os.Exit(exitUsage)
+        }
+        log.SetOutput(sanitizingWriter{terminalErr})
+    }
     if !enableLogging {
         log.SetOutput(io.Discard)
     }
 
+    if jsonMode && (enableTUI || pipeMode) {
+        fmt.Fprintln(os.Stderr, "-json cannot be used with -tui or -pipe")
+        os.Exit(exitUsage)
+    }
+    lines := make(chan []byte, 64)
+    quit := make(chan struct{})
+    // Typed lines are read once the options have been checked, since the
+    // line editor takes the terminal out of its normal mode
+    readTyped := false
+    if enableTUI {
+        tui := newTUIDisplay(func(line []byte) {
+            lines <- line
+        })
+        display = tui
+        if enableLogging {
+            log.SetOutput(tui)
+        }
+        go func() {
+            if err := tui.Run(); err != nil {
+                log.Println("TUI error: ", err)
+            }
+            close(quit)
+        }()
+    } else if jsonMode {
+        jsonEvents = newJSONDisplay(os.Stdout)
+        display = jsonEvents
+        if enableLogging {
+            log.SetOutput(jsonEvents)
+        }
+        go readJSONCommands(lines)
+    } else if !pipeMode {
+        readTyped = true
+    }
+    var scroll *scrollbackDisplay
+    if !jsonMode {
+        scroll = newScrollbackDisplay(display, config.ScrollbackSize)
+        display = scroll
+    }
+    if noTitle {
+        config.NoTitle = true
+    }
+    var title *titleDisplay
+    if readTyped && stderrIsTerminal && !config.NoTitle {
+        title = newTitleDisplay(display)
+        display = title
+    }
+    mute := newMuteDisplay(display)
+    display = mute
+
     if serverIP == "" {
-        serverIP = getServerIPFromConfig()
+        serverIP = config.ServerIP
+    }
+    if tlsFlags.CACert != "" {
+        config.TLS.CACert = tlsFlags.CACert
+    }
+    if tlsFlags.ClientCert != "" {
+        config.TLS.ClientCert = tlsFlags.ClientCert
+        config.TLS.ClientKey = tlsFlags.ClientKey
+    }
+    if tlsFlags.InsecureSkipVerify {
+        config.TLS.InsecureSkipVerify = true
+    }
+    if downloadDir != "" {
+        config.DownloadDir = downloadDir
+    }
+    if name != "" {
+        config.Name = name
+    }
+    if unordered {
+        ordered := false
+        config.DataChannel.Ordered = &ordered
+    }
+    if maxRetransmits >= 0 {
+        value := uint16(maxRetransmits)
+        config.DataChannel.MaxRetransmits = &value
+    }
+    if maxPacketLifeTime >= 0 {
+        value := uint16(maxPacketLifeTime)
+        config.DataChannel.MaxPacketLifeTime = &value
+    }
+    if config.DataChannel.MaxRetransmits != nil && config.DataChannel.MaxPacketLifeTime != nil {
+        fmt.Fprintln(os.Stderr, "max-retransmits and max-packet-lifetime cannot be used together")
+        os.Exit(exitUsage)
+    }
+    if pipeMode {
+        unreliable := config.DataChannel.MaxRetransmits != nil || config.DataChannel.MaxPacketLifeTime != nil ||
+            (config.DataChannel.Ordered != nil && !*config.DataChannel.Ordered)
+        switch {
+        case enableTUI:
+            fmt.Fprintln(os.Stderr, "-pipe cannot be used with -tui")
+            os.Exit(exitUsage)
+        case enableE2E:
+            fmt.Fprintln(os.Stderr, "-pipe cannot be used with -e2e")
+            os.Exit(exitUsage)
+        case unreliable:
+            fmt.Fprintln(os.Stderr, "-pipe needs a reliable, ordered data channel")
+            os.Exit(exitUsage)
+        }
+    }
+    if authToken == "" {
+        authToken = os.Getenv("WEBRTC_CHAT_TOKEN")
+    }
+    if authToken != "" {
+        config.AuthToken = authToken
+    }
+    if proxy != "" {
+        config.Proxy = proxy
+    }
+    if timestampLayout != "" {
+        config.TimestampFormat = timestampLayout
+    }
+    timestampFormat = config.TimestampFormat
+    if showIDs {
+        config.ShowMessageIDs = true
+    }
+    showMessageIDs = config.ShowMessageIDs
+    if plain {
+        config.Plain = true
+    }
+    plainOutput = config.Plain
+    if noColor {
+        config.NoColor = true
+    }
+    colorOutput = !config.NoColor && !noColorEnv()
+    if alert != "" {
+        if !containsString(alertModes, alert) {
+            fmt.Fprintf(os.Stderr, "-alert must be one of %s\n", strings.Join(alertModes, ", "))
+            os.Exit(exitUsage)
+        }
+        config.Alert = alert
+    }
+    if alertMentions {
+        config.AlertMentionsOnly = true
+    }
+    if config.Alert != "" {
+        alertMode = config.Alert
+    }
+    alertMentionsOnly = config.AlertMentionsOnly
+    setOwnName(config.Name)
+    if alertMentionsOnly && config.Name == "" {
+        fmt.Fprintln(os.Stderr, "alerting on mentions needs a -name to look for")
+        os.Exit(exitUsage)
+    }
+    if pingInterval > 0 {
+        config.PingInterval = Duration(pingInterval)
+    }
+    if explicitKeepalive {
+        if keepaliveInterval < 0 {
+            fmt.Fprintln(os.Stderr, "-keepalive must not be negative")
+            os.Exit(exitUsage)
+        }
+        config.KeepaliveInterval = Duration(keepaliveInterval)
+    }
+    if maxSendRate != "" {
+        rate, err := parseByteRate(maxSendRate)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "-max-send-rate:", err)
+            os.Exit(exitUsage)
+        }
+        config.MaxSendRate = rate
+    }
+    if candidatePolicy != "" {
+        if !containsString(iceCandidatePolicies, candidatePolicy) {
+            fmt.Fprintf(os.Stderr, "-candidates must be one of %s\n", strings.Join(iceCandidatePolicies, ", "))
+            os.Exit(exitUsage)
+        }
+        config.ICE.Candidates = candidatePolicy
+    }
+    if mdns {
+        config.ICE.MDNS = true
+    }
+    if networkTypes != "" {
+        config.ICE.NetworkTypes = strings.Split(networkTypes, ",")
+        for _, t := range config.ICE.NetworkTypes {
+            if !containsString(iceNetworkTypes, t) {
+                fmt.Fprintf(os.Stderr, "-network-types: %q must be one of %s\n", t, strings.Join(iceNetworkTypes, ", "))
+                os.Exit(exitUsage)
+            }
+        }
+    }
+    if ipv6Policy != "" {
+        if !containsString(ipv6Policies, ipv6Policy) {
+            fmt.Fprintln(os.Stderr, "-ipv6 must be prefer or disable")
+            os.Exit(exitUsage)
+        }
+        config.ICE.IPv6 = ipv6Policy
+    }
+    if len(config.ICE.NetworkTypes) > 0 && len(config.ICE.GatherNetworkTypes()) == 0 {
+        fmt.Fprintln(os.Stderr, "IPv6 is disabled but only IPv6 network types were given")
+        os.Exit(exitUsage)
+    }
+    preferIPv6 = config.ICE.IPv6 == "prefer"
+    if config.ICE.Candidates == "relay" && !config.HasTURNServer() {
+        fmt.Fprintln(os.Stderr, "relay-only candidates need a TURN server (-turn or turn_servers in the config)")
+        os.Exit(exitUsage)
+    }
+    if manualMode && (lanMode || matrixMode || pipeMode) {
+        fmt.Fprintln(os.Stderr, "-manual cannot be used with -lan, -matrix or -pipe")
+        os.Exit(exitUsage)
+    }
+    if resume && (manualMode || lanMode || matrixMode) {
+        fmt.Fprintln(os.Stderr, "-resume calls the peer through the signaling server and cannot be used with -manual, -lan or -matrix")
+        os.Exit(exitUsage)
+    }
+    if wire != "" {
+        if !containsString(wireFormats, wire) {
+            fmt.Fprintf(os.Stderr, "-wire-format must be one of %s\n", strings.Join(wireFormats, ", "))
+            os.Exit(exitUsage)
+        }
+        config.WireFormat = wire
+    }
+    if config.WireFormat != "" {
+        wireFormat = config.WireFormat
+    }
+    if browser {
+        config.BrowserCompat = true
+    }
+    browserCompat = config.BrowserCompat
+    if showQR && !manualMode && !makeInvite {
+        fmt.Fprintln(os.Stderr, "-qr needs -manual or -invite")
+        os.Exit(exitUsage)
+    }
+    var inviteLink string
+    if makeInvite {
+        if room != "" || resume || manualMode || lanMode || matrixMode {
+            fmt.Fprintln(os.Stderr, "-invite makes its own room on the signaling server and cannot be used with -room, -resume, -manual, -lan or -matrix")
+            os.Exit(exitUsage)
+        }
+        room, err = newInviteRoom()
+        if err != nil {
+            exitWith(exitFailure, "招待ルーム作成エラー: %v", err)
+        }
+        inviteLink, err = Invite{Server: serverIP, Room: room, Token: config.AuthToken}.Link()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "-invite:", err)
+            os.Exit(exitUsage)
+        }
+    }
+    if matrixRoom != "" {
+        config.Matrix.Room = matrixRoom
+    }
+    if matrixMode {
+        if lanMode {
+            fmt.Fprintln(os.Stderr, "-matrix and -lan cannot be used together")
+            os.Exit(exitUsage)
+        }
+        if config.Matrix.Homeserver == "" || config.Matrix.AccessToken == "" || config.Matrix.Room == "" {
+            fmt.Fprintln(os.Stderr, "-matrix needs matrix.homeserver, matrix.access_token and a room (matrix.room or -matrix-room) in the config")
+            os.Exit(exitUsage)
+        }
+        if !strings.HasPrefix(config.Matrix.Room, "!") && !strings.HasPrefix(config.Matrix.Room, "#") {
+            fmt.Fprintf(os.Stderr, "Matrix room %q must be a room ID (!...) or alias (#...)\n", config.Matrix.Room)
+            os.Exit(exitUsage)
+        }
+    }
+    signalingOptions := SignalingOptions{
+        TLSConfig: buildTLSConfig(config.TLS),
+        AuthToken: config.AuthToken,
+        Reconnect: config.Reconnect,
+        Msgpack:   wireFormat == wireFormatMsgpack,
+    }
+    if config.Proxy != "" && isGRPCURL(serverIP) && !lanMode && !matrixMode && !manualMode {
+        fmt.Fprintln(os.Stderr, "-proxy is not used for grpc:// servers; set HTTPS_PROXY instead")
+        os.Exit(exitUsage)
+    }
+    if config.Proxy != "" {
+        proxyURL, err := url.Parse(config.Proxy)
+        if err != nil {
+            exitWith(exitUsage, "プロキシURL解析エラー: %v", err)
+        }
+        signalingOptions.Proxy = proxyURL
+    }
+
+    if identityPath != "" {
+        config.IdentityPath = identityPath
+    }
+    if config.IdentityPath == "" {
+        config.IdentityPath = defaultIdentityPath()
+    }
+    identity, err := loadIdentity(config.IdentityPath)
+    if err != nil {
+        exitWith(exitFailure, "ID読み込みエラー: %v", err)
+    }
+    clientID := identity.ID
+    if config.ContactsPath == "" {
+        config.ContactsPath = defaultContactsPath()
+    }
+    contacts, err = loadContacts(config.ContactsPath)
+    if err != nil {
+        exitWith(exitFailure, "連絡先読み込みエラー: %v", err)
+    }
+    if config.SessionPath == "" {
+        config.SessionPath = defaultSessionPath()
+    }
+    sessions, err := loadSessionStore(config.SessionPath)
+    if err != nil {
+        exitWith(exitFailure, "セッション読み込みエラー: %v", err)
+    }
+    var resumed Session
+    if resume {
+        resumed = sessions.Session()
+        if resumed.PeerID == "" {
+            fmt.Fprintln(os.Stderr, "-resume: there is no earlier session to resume")
+            os.Exit(exitUsage)
+        }
+        if room == "" {
+            room = resumed.Room
+        }
+    }
+    if noReadline {
+        config.NoReadline = true
+    }
+    if readTyped && !config.NoReadline && useLineEditor() {
+        editor = newLineEditor()
+        if enableLogging {
+            log.SetOutput(sanitizingWriter{terminalErr})
+        }
+    }
+    display.SetStatus("id", clientID)
+    display.SetStatus("code", peerCode(clientID))
+    rtp := &rtpStats{}
+    var fetchedServers []ICEServer
+    var turnCredentialsTTL time.Duration
+    turnCredentials := newTURNCredentialProvider(config.TURNCredentials, signalingOptions)
+    if turnCredentials != nil {
+        fetchedServers, turnCredentialsTTL, err = turnCredentials.Fetch()
+        if err != nil {
+            // Direct and STUN-assisted connections may still work
+            display.Printf("[turn] could not fetch TURN credentials: %v\n", err)
+        } else {
+            log.Printf("Fetched TURN credentials for %d server(s)\n", len(fetchedServers))
+        }
+    }
+    for _, server := range append(append([]ICEServer(nil), config.ICEServers...), fetchedServers...) {
+        if server.CredentialType == "oauth" {
+            // pion checks the credential but its TURN client doesn't do
+            // RFC 7635 yet, so these relays may refuse the allocation
+            log.Printf("TURN server %s uses OAuth credentials, which the ICE library doesn't fully support yet\n", server.URLs[0])
+        }
+    }
+    peerConnection, dataChannel, fileChannel, controlChannel := setupWebRTC(config, fetchedServers, identity.Certificate, rtp, nil)
+    if turnCredentialsTTL > 0 {
+        go refreshTURNCredentials(peerConnection, config, turnCredentials, turnCredentialsTTL)
+    }
+
+    // Set once someone has joined through the -invite link
+    var inviteUsed atomic.Bool
+    var conn Signaler
+    var router *signalRouter
+    var manual *ManualSignaler
+    if manualMode {
+        manual = newManualSignaler(clientID, peerConnection, lines)
+        conn = manual
+    } else if lanMode {
+        lan, err := newLANSignaler(clientID)
+        if err != nil {
+            exitWith(exitFailure, "LAN探索開始エラー: %v", err)
+        }
+        conn = lan
+    } else if matrixMode {
+        matrix, err := newMatrixSignaler(clientID, config.Matrix, signalingOptions)
+        if isMatrixAuthError(err) {
+            exitWith(exitAuthRejected, "Matrix接続エラー: %v", err)
+        }
+        if err != nil {
+            exitWith(exitSignalingUnreachable, "Matrix接続エラー: %v", err)
+        }
+        conn = matrix
+    } else {
+        ws := connectToSignalingServer(serverIP, signalingOptions)
+        ws.OnReconnect = func() {
+            if room != "" && !inviteUsed.Load() {
+                joinRoom(ws, room, clientID)
+            }
+            // Once paired, the server is only needed to reach the same
+            // peers again; a conversation still waiting asks to be paired
+            // again
+            if router.Unpaired() {
+                sendSignalingRequest(ws, clientID, room)
+            }
+            fetchQueuedMessages(ws, clientID)
+        }
+        conn = ws
+    }
+    router = newSignalRouter(conn)
+
+    if config.MaxSendRate > 0 {
+        display.SetStatus("send limit", config.MaxSendRate.String())
+    }
+    if config.Name != "" {
+        display.SetStatus("name", config.Name)
+    }
+
+    var convs conversations
+    // startConversation wires a peer connection up for a conversation of
+    // its own. Its signaling loop is left to the caller to start.
+    startConversation := func(peerConnection *webrtc.PeerConnection, dataChannel, fileChannel, controlChannel *webrtc.DataChannel, rtp *rtpStats) *conversation {
+        c := newConversation(router.Signaler(), clientID, peerConnection)
+        c.view = newConversationDisplay(display, convs.showUnread)
+        c.display = c.view
+
+        var e2e *E2ESession
+        if enableE2E {
+            var err error
+            e2e, err = newE2ESession()
+            if err != nil {
+                exitWith(exitFailure, "E2E鍵生成エラー: %v", err)
+            }
+        }
+        chatConfig := config
+        chatConfig.Name = ownName()
+        chat := newChat(dataChannel, fileChannel, controlChannel, e2e, history, clientID, chatConfig)
+        chat.display = c.view
+        c.chat = chat
+        if enableLogging {
+            chat.Use(loggingMiddleware{})
+        }
+        setupDataChannelEventHandlers(dataChannel, fileChannel, controlChannel, chat)
+
+        // Reconnecting needs a signaling channel that can carry a new offer
+        // unattended, and a -pipe stream can't be resumed halfway
+        if config.Reconnect.IsEnabled() && manual == nil && !pipeMode {
+            c.reconnector = newPeerReconnector(peerConnection, c.conn, c.negotiation, c.target, config.Reconnect, func() {
+                chat.handlePeerGone()
+                c.end(exitICEFailed, "could not reconnect to the peer")
+            })
+        }
+        chat.onPeerDead = func() {
+            if c.reconnector == nil {
+                // The state change to closed ends the session like any other loss
+                peerConnection.Close()
+                return
+            }
+            if c.reconnector.Start() {
+                display.Printf("* reconnecting to %s...\n", displayName(chat.PeerName()))
+            }
+        }
+        chat.onPeerBack = func() {
+            // ICE may never have noticed the outage, so no state change ends it
+            if c.reconnector != nil && c.reconnector.Connected() {
+                display.Printf("* reconnected to %s\n", displayName(chat.PeerName()))
+                go chat.SyncHistory()
+            }
+        }
+
+        setupPeerConnectionEventHandlers(c)
+        c.media = newMedia(peerConnection, config.Media)
+        c.verification = newVerification(peerConnection)
+        chat.onIncompatible = func(err error) {
+            peerConnection.Close()
+            c.end(exitProtocolMismatch, "incompatible peer: %v", err)
+        }
+        chat.onPeerJoined = func(id, name string) {
+            fingerprint := c.verification.RemoteFingerprint()
+            if resume && id == resumed.PeerID && resumed.Fingerprint != "" && fingerprint != resumed.Fingerprint {
+                display.Printf("[resume] WARNING: %s's certificate has changed since the last session. Compare security codes before trusting them\n", displayName(chat.PeerName()))
+            }
+            err := sessions.Update(func(session *Session) {
+                *session = Session{PeerID: id, PeerName: name, Fingerprint: fingerprint, Room: room}
+            })
+            if err != nil {
+                log.Println("セッション保存エラー: ", err)
+            }
+            // An invite pairs one person: leave its room so the link can't
+            // be used again
+            if makeInvite && inviteUsed.CompareAndSwap(false, true) {
+                leaveRoom(conn, room, clientID)
+                display.SetStatus("room", "")
+            }
+        }
+        chat.onPeerRenamed = func(name string) {
+            err := sessions.Update(func(session *Session) {
+                if session.PeerID == chat.PeerInfo().ID {
+                    session.PeerName = name
+                }
+            })
+            if err != nil {
+                log.Println("セッション保存エラー: ", err)
+            }
+        }
+        c.onEnd = func(reason string) bool {
+            if len(convs.List()) < 2 {
+                return false
+            }
+            display.Printf("* conversation #%d with %s ended: %s\n", c.number, c.label(), reason)
+            convs.Remove(c)
+            // It can no longer be switched to, so show what was never read
+            for _, msg := range c.view.release() {
+                display.PrintMessage(msg.sender, msg.senderID, msg.id, msg.data, msg.isString, msg.sentAt)
+            }
+            convs.showUnread()
+            c.media.Close()
+            // This may run in the peer connection's own callbacks
+            go peerConnection.Close()
+            return true
+        }
+        peerConnection.OnTrack(c.media.handleTrack)
+        go newQualityMonitor(peerConnection, rtp).Run()
+        convs.Add(c)
+        return c
+    }
+    primary := startConversation(peerConnection, dataChannel, fileChannel, controlChannel, rtp)
+    var pipeDone <-chan struct{}
+    if pipeMode {
+        primary.chat.pipe = newPipeStream(os.Stdin, os.Stdout)
+        pipeDone = primary.chat.pipe.Done()
+    }
+
+    // Other peers can only be reached through a signaling server, and -pipe
+    // streams to one
+    var newPeerConversation func() *conversation
+    if manual == nil && !lanMode && !matrixMode && !pipeMode {
+        newPeerConversation = func() *conversation {
+            rtp := &rtpStats{}
+            servers, ttl := fetchedServers, turnCredentialsTTL
+            if turnCredentials != nil {
+                // The ones fetched at startup may have expired
+                if fresh, freshTTL, err := turnCredentials.Fetch(); err != nil {
+                    log.Println("TURN認証情報取得エラー: ", err)
+                } else {
+                    servers, ttl = fresh, freshTTL
+                }
+            }
+            peerConnection, dataChannel, fileChannel, controlChannel := setupWebRTC(config, servers, identity.Certificate, rtp, nil)
+            if ttl > 0 {
+                go refreshTURNCredentials(peerConnection, config, turnCredentials, ttl)
+            }
+            c := startConversation(peerConnection, dataChannel, fileChannel, controlChannel, rtp)
+            go handleSignalingMessages(c)
+            return c
+        }
+        router.onNewPeer = func() *peerSignaler {
+            c := newPeerConversation()
+            display.Printf("[switch] someone new is calling in #%d, /switch %d to talk to them\n", c.number, c.number)
+            return c.conn.(*peerSignaler)
+        }
     }
-    conn := connectToWebSocket(serverIP)
-    defer conn.Close()
 
-    clientID := uuid.New().String()
-    peerConnection, dataChannel := setupWebRTC()
-    defer peerConnection.Close()
+    if resume {
+        primary.setTarget(resumed.PeerID)
+        primary.pair(resumed.PeerID)
+        primary.chat.restorePeer(resumed.PeerID, resumed.PeerName)
+        for _, text := range resumed.Unsent {
+            primary.chat.Queue([]byte(text))
+        }
+        primary.display.SetStatus("peer", contacts.Label(resumed.PeerID))
+    }
 
-    setupDataChannelEventHandlers(dataChannel)
+    if room != "" {
+        joinRoom(conn, room, clientID)
+        display.SetStatus("room", room)
+    }
+    if makeInvite {
+        display.Printf("[invite] Send this link to the person you're inviting; its room works once:\n%s\n", inviteLink)
+        if showQR {
+            if qrCode, err := renderQR(inviteLink); err != nil {
+                log.Println("QRコード作成エラー: ", err)
+            } else {
+                display.Printf("[invite] or let them scan it:\n%s", qrCode)
+            }
+        }
+        if config.AuthToken != "" {
+            display.Printf("[invite] The link includes your signaling server token, which keeps working after the invite is used, so only send it to people you would give the token to\n")
+        }
+    }
+    if resume {
+        name := primary.chat.PeerName()
+        if name == "" {
+            name = contacts.Label(resumed.PeerID)
+        }
+        display.Printf("[resume] calling %s again\n", name)
+        if len(resumed.Unsent) > 0 {
+            display.Printf("[resume] %d unsent message(s) will be sent once connected\n", len(resumed.Unsent))
+        }
+        go resumeSession(primary.conn, peerConnection, primary.negotiation, resumed.PeerID)
+    } else {
+        sendSignalingRequest(conn, clientID, room)
+    }
+    primary.display.SetStatus("state", "waiting for peer")
+    if err := fetchQueuedMessages(conn, clientID); err != nil {
+        log.Println("キュー取得エラー: ", err)
+    }
 
-    targetID := ""
-    pendingCandidates := []*webrtc.ICECandidate{}
+    go handleSignalingMessages(primary)
+    go router.Run()
+    commands := newCommands()
+    commands.Register("send", "<path>", "Send a file or directory to the peer", func(path string) error {
+        c := convs.Active()
+        if path == "" {
+            return fmt.Errorf("usage: /send <path>")
+        }
+        // Transfers run in the background so chatting can continue
+        go func() {
+            if err := c.chat.SendFile(path); err != nil {
+                display.Printf("[file] send failed: %v\n", err)
+            }
+        }()
+        return nil
+    })
 
-    setupPeerConnectionEventHandlers(peerConnection, conn, &targetID, &pendingCandidates, clientID)
+    commands.Register("unpack", "", "Extract a directory the peer sent", func(string) error {
+        c := convs.Active()
+        return c.chat.UnpackDirectory()
+    })
+    commands.Register("discard", "", "Delete a directory the peer sent without extracting it", func(string) error {
+        c := convs.Active()
+        return c.chat.DiscardDirectory()
+    })
 
-    sendSignalingRequest(conn, clientID)
+    commands.Register("stats", "", "Show connection statistics", func(string) error {
+        c := convs.Active()
+        display.Printf("%s", formatStats(c.peerConnection))
+        return nil
+    })
 
-    go handleSignalingMessages(conn, peerConnection, dataChannel, &targetID, &pendingCandidates, clientID)
-    go sendUserMessages(dataChannel)
+    commands.Register("export", "[json|txt] <path>", "Save this conversation from the history to a file", func(arg string) error {
+        c := convs.Active()
+        format, path, err := parseExportArgs(arg)
+        if err != nil {
+            return err
+        }
+        if history == nil {
+            return fmt.Errorf("history is off, so there is nothing to export")
+        }
+        peerID := c.chat.PeerInfo().ID
+        if peerID == "" {
+            return fmt.Errorf("no conversation yet")
+        }
+        entries, err := history.Conversation(peerID)
+        if err != nil {
+            return err
+        }
+        if err := exportConversation(entries, format, path); err != nil {
+            return err
+        }
+        display.Printf("[export] %d message(s) written to %s\n", len(entries), path)
+        return nil
+    })
 
-    // Wait for the program to be interrupted or terminated
-    select {}
+    var search historySearch
+    commands.Register("search", "[term]", "Search the history; without a term, show more matches", func(term string) error {
+        if history == nil {
+            return fmt.Errorf("history is off, so there is nothing to search")
+        }
+        page, err := search.Page(history, term)
+        if err != nil {
+            return err
+        }
+        display.Printf("%s", page)
+        return nil
+    })
+
+    commands.Register("whois", "", "Show who the peer is and what client they run", func(string) error {
+        c := convs.Active()
+        info := c.chat.PeerInfo()
+        if info.Version == 0 {
+            return fmt.Errorf("the peer hasn't joined yet")
+        }
+        display.Printf("%s", formatPeerInfo(info, c.verification.RemoteFingerprint()))
+        return nil
+    })
+
+    commands.Register("ping", "", "Measure the round-trip time to the peer", func(string) error {
+        c := convs.Active()
+        go func() {
+            rtt, err := c.chat.Ping()
+            if err != nil {
+                display.Printf("[ping] %v\n", err)
+                return
+            }
+            display.Printf("[ping] reply from %s: %s\n", displayName(c.chat.PeerName()), formatRTT(rtt))
+        }()
+        return nil
+    })
+
+    commands.Register("peers", "", "List peers registered on the signaling server", func(string) error {
+        return requestPeerList(conn, clientID, room)
+    })
+    commands.Register("presence", "<id|alias|code>", "Ask the signaling server whether a peer is online and when they were last seen", func(arg string) error {
+        if arg == "" {
+            return fmt.Errorf("usage: /presence <id|alias|code>")
+        }
+        id, err := resolvePeer(arg)
+        if err != nil {
+            return err
+        }
+        return requestPresence(conn, clientID, id)
+    })
+    commands.Register("connect", "<id|alias|code>", "Call a specific peer from /peers", func(arg string) error {
+        if arg == "" {
+            return fmt.Errorf("usage: /connect <id|alias|code>")
+        }
+        id, err := resolvePeer(arg)
+        if err != nil {
+            return err
+        }
+        for _, other := range convs.List() {
+            if other.target() == id {
+                return fmt.Errorf("already talking to %s in #%d", contacts.Label(id), other.number)
+            }
+        }
+        c := convs.Active()
+        if !c.claimTarget(id) {
+            if newPeerConversation == nil {
+                return fmt.Errorf("already paired with %s", c.target())
+            }
+            c = newPeerConversation()
+            convs.Switch(c)
+            display.Printf("[switch] calling %s in #%d\n", contacts.Label(id), c.number)
+            c.setTarget(id)
+        }
+        c.pair(id)
+        c.display.SetStatus("peer", contacts.Label(id))
+        c.negotiation.Offer(c.conn, c.peerConnection, id)
+        return nil
+    })
+    commands.Register("switch", "[#n|peer]", "Change the conversation typed lines go to; without an argument, list them", func(arg string) error {
+        if arg == "" {
+            display.Printf("%d conversation(s):\n%s", len(convs.List()), convs.Format())
+            return nil
+        }
+        c, err := convs.Find(arg)
+        if err != nil {
+            return err
+        }
+        display.Printf("[switch] now in #%d with %s\n", c.number, c.label())
+        convs.Switch(c)
+        return nil
+    })
+    commands.Register("msg", "<#n|peer> <message>", "Send a private message to one peer without switching to them", func(arg string) error {
+        fields := strings.SplitN(arg, " ", 2)
+        if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+            return fmt.Errorf("usage: /msg <#n|peer> <message>")
+        }
+        text := strings.TrimSpace(fields[1])
+        c, err := convs.Find(fields[0])
+        if err != nil {
+            return err
+        }
+        if err := c.chat.SendPrivate([]byte(text + "\n")); err != nil {
+            return fmt.Errorf("%s: %w", c.label(), err)
+        }
+        display.Printf("[msg] to %s (private): %s\n", c.label(), text)
+        return nil
+    })
+    commands.Register("all", "<message>", "Send a message to every connected peer", func(arg string) error {
+        if arg == "" {
+            return fmt.Errorf("usage: /all <message>")
+        }
+        results := convs.Broadcast([]byte(arg + "\n"))
+        if len(results) == 0 {
+            return fmt.Errorf("no peers to send to")
+        }
+        display.Printf("%s", formatBroadcast(results))
+        return nil
+    })
+
+    commands.Register("nick", "<name>", "Change your display name; connected peers see the new one", func(arg string) error {
+        if arg == "" {
+            return fmt.Errorf("usage: /nick <name>")
+        }
+        setOwnName(arg)
+        display.SetStatus("name", arg)
+        for _, c := range convs.List() {
+            if err := c.chat.SetName(arg); err != nil {
+                log.Println("名前変更通知送信エラー: ", err)
+            }
+        }
+        display.Printf("* you are now known as %s\n", arg)
+        return nil
+    })
+    commands.Register("paste", "", "Send the clipboard contents", func(string) error {
+        c := convs.Active()
+        text, err := clipboard.ReadAll()
+        if err != nil {
+            return fmt.Errorf("clipboard: %w", err)
+        }
+        if text == "" {
+            return fmt.Errorf("clipboard is empty")
+        }
+        if !strings.HasSuffix(text, "\n") {
+            text += "\n"
+        }
+        if err := c.chat.Send([]byte(text)); err != nil {
+            return err
+        }
+        display.Printf("[clipboard] sent %d bytes\n", len(text))
+        return nil
+    })
+    commands.Register("copy", "", "Copy the last received message to the clipboard", func(string) error {
+        c := convs.Active()
+        data := c.chat.LastReceived()
+        if data == nil {
+            return fmt.Errorf("no message received yet")
+        }
+        if isBinaryData(data) {
+            return fmt.Errorf("the last message is binary and can't be copied as text")
+        }
+        if err := clipboard.WriteAll(strings.TrimSuffix(string(data), "\n")); err != nil {
+            return fmt.Errorf("clipboard: %w", err)
+        }
+        display.Printf("[clipboard] copied %d bytes\n", len(data))
+        return nil
+    })
+    commands.Register("mute", "[duration]", "Hold back incoming messages and alerts until /unmute (or for e.g. 10m)", func(arg string) error {
+        var d time.Duration
+        if arg != "" {
+            var err error
+            d, err = time.ParseDuration(arg)
+            if err != nil || d <= 0 {
+                return fmt.Errorf("usage: /mute [duration], e.g. /mute 10m")
+            }
+        }
+        mute.Mute(d)
+        if d > 0 {
+            display.Printf("[mute] muted for %v, /unmute to show messages sooner\n", d)
+        } else {
+            display.Printf("[mute] muted, /unmute to show messages\n")
+        }
+        return nil
+    })
+    commands.Register("more", "", "Page back through earlier messages; PageUp and PageDown do the same while typing", func(string) error {
+        if scroll == nil {
+            return fmt.Errorf("there is no scrollback in -json mode")
+        }
+        scroll.Older(scrollbackPageSize())
+        return nil
+    })
+    commands.Register("unmute", "", "Show messages held back by /mute", func(string) error {
+        if !mute.Unmute() {
+            return fmt.Errorf("not muted")
+        }
+        return nil
+    })
+    commands.Register("react", "[msg-id] <emoji>", "React to a message (default: the peer's latest; IDs shown with -show-ids)", func(arg string) error {
+        c := convs.Active()
+        fields := strings.Fields(arg)
+        switch len(fields) {
+        case 1:
+            return c.chat.React("", fields[0])
+        case 2:
+            return c.chat.React(strings.TrimPrefix(fields[0], "#"), fields[1])
+        default:
+            return fmt.Errorf("usage: /react [msg-id] <emoji>")
+        }
+    })
+
+    commands.Register("call", "", "Start an audio call with the peer", func(string) error {
+        c := convs.Active()
+        if err := c.media.StartAudio(); err != nil {
+            return err
+        }
+        display.Printf("[call] sending microphone audio, /hangup to stop\n")
+        return nil
+    })
+    commands.Register("hangup", "", "Stop sending audio", func(string) error {
+        c := convs.Active()
+        if err := c.media.StopAudio(); err != nil {
+            return err
+        }
+        display.Printf("[call] stopped sending audio\n")
+        return nil
+    })
+
+    commands.Register("video", "start|stop", "Start or stop sending camera video", func(arg string) error {
+        c := convs.Active()
+        switch arg {
+        case "start":
+            if err := c.media.StartVideo(); err != nil {
+                return err
+            }
+            display.Printf("[video] sending camera video, /video stop to stop\n")
+        case "stop":
+            if err := c.media.StopVideo(); err != nil {
+                return err
+            }
+            display.Printf("[video] stopped sending video\n")
+        default:
+            return fmt.Errorf("usage: /video start|stop")
+        }
+        return nil
+    })
+
+    commands.Register("voice", "[seconds]", "Record and send a voice message (default 5s)", func(arg string) error {
+        c := convs.Active()
+        seconds := 5
+        if arg != "" {
+            n, err := strconv.Atoi(arg)
+            if err != nil || n < 1 || n > maxVoiceSeconds {
+                return fmt.Errorf("usage: /voice [seconds], up to %d", maxVoiceSeconds)
+            }
+            seconds = n
+        }
+        go func() {
+            path := filepath.Join(os.TempDir(), "voice-"+time.Now().Format("20060102-150405")+".ogg")
+            defer os.Remove(path)
+            display.Printf("[voice] recording for %ds...\n", seconds)
+            if err := c.media.RecordVoice(path, time.Duration(seconds)*time.Second); err != nil {
+                display.Printf("[voice] recording failed: %v\n", err)
+                return
+            }
+            if err := c.chat.SendVoice(path); err != nil {
+                display.Printf("[voice] send failed: %v\n", err)
+            }
+        }()
+        return nil
+    })
+    commands.Register("play", "[path]", "Play the last voice message received (or an Ogg file)", func(path string) error {
+        c := convs.Active()
+        if path == "" {
+            path = c.chat.LastVoice()
+        }
+        if path == "" {
+            return fmt.Errorf("no voice message received yet")
+        }
+        return c.media.PlayFile(path)
+    })
+
+    commands.Register("verify", "[code]", "Mark the peer verified after comparing security codes", func(code string) error {
+        c := convs.Active()
+        if err := c.verification.Verify(code); err != nil {
+            return err
+        }
+        display.Printf("[verify] %s marked as verified\n", displayName(c.chat.PeerName()))
+        return nil
+    })
+
+    commands.Register("contact", "add <id|code> <alias>|rm <alias>|list", "Manage the address book", func(arg string) error {
+        fields := strings.Fields(arg)
+        switch {
+        case len(fields) == 3 && fields[0] == "add":
+            id, err := resolvePeer(fields[1])
+            if err != nil {
+                return err
+            }
+            if err := contacts.Add(id, fields[2]); err != nil {
+                return err
+            }
+            display.Printf("[contact] saved %s as %s\n", id, fields[2])
+        case len(fields) == 2 && fields[0] == "rm":
+            if err := contacts.Remove(fields[1]); err != nil {
+                return err
+            }
+            display.Printf("[contact] removed %s\n", fields[1])
+        case len(fields) <= 1 && (arg == "" || fields[0] == "list"):
+            list := contacts.List()
+            display.Printf("%d contact(s):\n", len(list))
+            for _, contact := range list {
+                display.Printf("  %s  %s  %s\n", contact.Alias, contact.ID, peerCode(contact.ID))
+            }
+        default:
+            return fmt.Errorf("usage: /contact add <id|code> <alias>|rm <alias>|list")
+        }
+        return nil
+    })
+
+    commands.Register("later", "<id|alias|code> <message>", "Leave a message on the server for an offline peer", func(arg string) error {
+        target, text, ok := strings.Cut(arg, " ")
+        if !ok || text == "" {
+            return fmt.Errorf("usage: /later <id|alias|code> <message>")
+        }
+        id, err := resolvePeer(target)
+        if err != nil {
+            return err
+        }
+        return queueMessage(conn, clientID, id, text)
+    })
+
+    // The line editor takes the terminal only now that setup is done, so a
+    // failure during setup leaves the terminal as it was
+    if readTyped {
+        if editor != nil {
+            if title != nil {
+                editor.onInput = title.Seen
+            }
+            editor.onPage = func(older bool) {
+                if older {
+                    scroll.Older(scrollbackPageSize())
+                } else {
+                    scroll.Newer(scrollbackPageSize())
+                }
+            }
+            if err := editor.Start(); err != nil {
+                log.Println("ラインエディタ開始エラー: ", err)
+            }
+        }
+        seen := func() {}
+        if title != nil {
+            seen = title.Seen
+        }
+        go readStdinLines(lines, quit, seen)
+    }
+
+    go func() {
+        if manual != nil {
+            // The pairing codes are read from the same input
+            <-manual.Ready()
+        }
+        sendUserMessages(func() *Chat { return convs.Active().chat }, commands, lines)
+    }()
+
+    // Wait for the program to be interrupted or terminated, or in -pipe
+    // mode for the peer's stream to end
+    sig := waitForSignal(quit, pipeDone)
+    if sig != nil {
+        log.Printf("Received %s, shutting down\n", sig)
+    } else {
+        log.Println("Pipe finished, shutting down")
+    }
+    if room != "" && !inviteUsed.Load() {
+        leaveRoom(conn, room, clientID)
+    }
+    if sessions.Session().PeerID != "" {
+        // Whatever is still in the outbox goes out with the next -resume
+        err := sessions.Update(func(session *Session) {
+            for _, c := range convs.List() {
+                if c.chat.PeerInfo().ID == session.PeerID {
+                    session.Unsent = c.chat.Unsent()
+                }
+            }
+        })
+        if err != nil {
+            log.Println("セッション保存エラー: ", err)
+        }
+    }
+    shutdown(conn, convs.List())
+    if history != nil {
+        history.Close()
+    }
+    restoreTerminal()
+    os.Exit(exitCodeForSignal(sig))
+}
+
+// fromPeer reports whether message was written by a peer rather than the
+// signaling server.
+func fromPeer(message SignalingMessage) bool {
+    switch message.Type {
+    case "offer", "answer", "candidate", "version_mismatch":
+        return true
+    }
+    return false
+}
+
+// shuttingDown is set once a graceful shutdown has started so that the
+// connection state and signaling handlers don't race it with exitWith.
+var shuttingDown atomic.Bool
+
+const shutdownFlushTimeout = 3 * time.Second
+
+// waitForSignal returns the signal that asked us to stop, os.Interrupt if
+// quit is closed first (the TUI swallows Ctrl-C as a key press), or nil if
+// finished is closed first.
+func waitForSignal(quit, finished <-chan struct{}) os.Signal {
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(sigCh)
+    select {
+    case sig := <-sigCh:
+        return sig
+    case <-quit:
+        return os.Interrupt
+    case <-finished:
+        return nil
+    }
+}
+
+func exitCodeForSignal(sig os.Signal) int {
+    if sig == nil {
+        return exitOK
+    }
+    if s, ok := sig.(syscall.Signal); ok {
+        return 128 + int(s)
+    }
+    return 1
+}
+
+func shutdown(conn Signaler, list []*conversation) {
+    shuttingDown.Store(true)
+    for _, c := range list {
+        c.media.Close()
+        c.chat.Leave()
+    }
+
+    // Give queued messages a chance to leave before tearing down SCTP
+    deadline := time.Now().Add(shutdownFlushTimeout)
+    for _, c := range list {
+        for _, dataChannel := range []Transport{c.chat.dataChannel, c.chat.fileChannel, c.chat.controlChannel} {
+            for dataChannel.ReadyState() == webrtc.DataChannelStateOpen && dataChannel.BufferedAmount() > 0 && time.Now().Before(deadline) {
+                time.Sleep(50 * time.Millisecond)
+            }
+        }
+    }
+
+    for _, c := range list {
+        c.chat.files.Cleanup()
+        for _, dataChannel := range []Transport{c.chat.dataChannel, c.chat.fileChannel, c.chat.controlChannel} {
+            if err := dataChannel.Close(); err != nil {
+                log.Println("DataChannel close error: ", err)
+            }
+        }
+        if err := c.peerConnection.Close(); err != nil {
+            log.Println("PeerConnection close error: ", err)
+        }
+    }
+
+    conn.Close()
+    display.Close()
+    log.Println("Shutdown complete")
 }
 
 func getServerIP() string {
     fmt.Print("Signaling Server IP address (default: ws://localhost:8080): ")
-    reader := bufio.NewReader(os.Stdin)
-    serverIP, _ := reader.ReadString('\n')
-    serverIP = serverIP[:len(serverIP)-1]
+    line, _ := newLineReader(os.Stdin).ReadLine()
+    serverIP := strings.TrimSpace(string(line))
 
     if serverIP == "" {
         serverIP = "ws://localhost:8080"
@@ -96,323 +1390,564 @@ func getServerIP() string {
     return serverIP
 }
 
-func getServerIPFromConfig() string {
-    configPath := "config.json"
-
-    // Check if config file exists
-    _, err := os.Stat(configPath)
-    if os.IsNotExist(err) {
-        // If config file doesn't exist, create it with default values
-        defaultConfig := struct {
-            ServerIP string `json:"server_ip"`
-        }{
-            ServerIP: "ws://localhost:8080",
-        }
+func buildTLSConfig(config TLSConfig) *tls.Config {
+    tlsConfig := &tls.Config{
+        InsecureSkipVerify: config.InsecureSkipVerify,
+    }
+    if config.InsecureSkipVerify {
+        log.Println("TLS certificate verification is disabled")
+    }
 
-        file, err := os.Create(configPath)
+    if config.CACert != "" {
+        pem, err := os.ReadFile(config.CACert)
         if err != nil {
-            log.Fatal("Config file create error: ", err)
+            exitWith(exitUsage, "CA証明書読み込みエラー: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            exitWith(exitUsage, "CA証明書解析エラー: %s", config.CACert)
         }
-        defer file.Close()
+        tlsConfig.RootCAs = pool
+    }
 
-        err = json.NewEncoder(file).Encode(defaultConfig)
+    if config.ClientCert != "" || config.ClientKey != "" {
+        cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
         if err != nil {
-            log.Fatal("Config file encode error: ", err)
+            exitWith(exitUsage, "クライアント証明書読み込みエラー: %v", err)
         }
-
-        log.Printf("Created default config file: %s\n", configPath)
-        return defaultConfig.ServerIP
+        tlsConfig.Certificates = []tls.Certificate{cert}
     }
 
-    // Read config file
-    file, err := os.Open(configPath)
-    if err != nil {
-        log.Fatal("Config file open error: ", err)
-    }
-    defer file.Close()
+    return tlsConfig
+}
 
-    var config struct {
-        ServerIP string `json:"server_ip"`
+// iceServersFor returns the STUN and TURN servers to offer the ICE agent:
+// those configured, plus fetched, the ones with credentials from
+// turn_credentials.url.
+func iceServersFor(config Config, fetched []ICEServer) []webrtc.ICEServer {
+    var iceServers []webrtc.ICEServer
+    for _, server := range append(append([]ICEServer(nil), config.ICEServers...), fetched...) {
+        iceServer := webrtc.ICEServer{
+            URLs:           server.URLs,
+            Username:       server.Username,
+            Credential:     server.Credential,
+            CredentialType: webrtc.ICECredentialTypePassword,
+        }
+        if server.CredentialType == "oauth" {
+            iceServer.Credential = webrtc.OAuthCredential{MACKey: server.MACKey, AccessToken: server.AccessToken}
+            iceServer.CredentialType = webrtc.ICECredentialTypeOauth
+        }
+        iceServers = append(iceServers, iceServer)
     }
-    err = json.NewDecoder(file).Decode(&config)
-    if err != nil {
-        log.Fatal("Config file decode error: ", err)
+    if urls := config.STUNURLs(); len(urls) > 0 {
+        iceServers = append(iceServers, webrtc.ICEServer{URLs: urls})
     }
-
-    return config.ServerIP
+    for _, turn := range config.TURNServers {
+        iceServers = append(iceServers, webrtc.ICEServer{
+            URLs:       []string{turn.URL},
+            Username:   turn.Username,
+            Credential: turn.Credential,
+        })
+    }
+    return iceServers
 }
 
-func connectToWebSocket(serverIP string) *websocket.Conn {
-    conn, _, err := websocket.DefaultDialer.Dial(serverIP, nil)
-    if err != nil {
-        log.Fatal("WebSocket接続エラー: ", err)
+// setupWebRTC creates the peer connection and its channels. fetched are ICE
+// servers with credentials fetched at startup. network, if not nil, stands
+// in for the real one (tests use pion's virtual network).
+func setupWebRTC(config Config, fetched []ICEServer, certificate webrtc.Certificate, rtp *rtpStats, network *vnet.Net) (*webrtc.PeerConnection, *webrtc.DataChannel, *webrtc.DataChannel, *webrtc.DataChannel) {
+    iceServers := iceServersFor(config, fetched)
+    for _, turn := range config.TURNServers {
+        log.Printf("TURN server: %s\n", turn.URL)
     }
-    log.Println("WebSocketサーバーに接続しました")
-    return conn
-}
 
-func setupWebRTC() (*webrtc.PeerConnection, *webrtc.DataChannel) {
-    config := webrtc.Configuration{
-        ICEServers: []webrtc.ICEServer{
-            {
-                URLs: []string{"stun:stun.l.google.com:19302"},
-            },
-        },
+    settingEngine := webrtc.SettingEngine{}
+    if config.LogLevel != "" {
+        settingEngine.LoggerFactory = newPionLoggerFactory(config.LogLevel)
     }
+    if network != nil {
+        settingEngine.SetVNet(network)
+    }
+    transportPolicy := webrtc.ICETransportPolicyAll
+    switch config.ICE.Candidates {
+    case "no-host":
+        // Filtering out every interface address stops host candidates
+        // only; server reflexive and relay candidates are gathered on
+        // their own sockets.
+        settingEngine.SetIPFilter(func(net.IP) bool { return false })
+    case "relay":
+        transportPolicy = webrtc.ICETransportPolicyRelay
+    }
+    if config.ICE.MDNS {
+        settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+    }
+    if types := config.ICE.GatherNetworkTypes(); len(types) > 0 {
+        var networkTypes []webrtc.NetworkType
+        for _, t := range types {
+            networkType, err := webrtc.NewNetworkType(t)
+            if err != nil {
+                exitWith(exitFailure, "ネットワーク種別設定エラー: %v", err)
+            }
+            networkTypes = append(networkTypes, networkType)
+        }
+        settingEngine.SetNetworkTypes(networkTypes)
+    }
+    if preferIPv6 {
+        // Host pairs are otherwise nominated as soon as one succeeds, which
+        // is often the IPv4 one; give the IPv6 check time to finish
+        settingEngine.SetHostAcceptanceMinWait(preferIPv6HostWait)
+    }
+    if config.ICE.UDPPortMin != 0 {
+        if err := settingEngine.SetEphemeralUDPPortRange(config.ICE.UDPPortMin, config.ICE.UDPPortMax); err != nil {
+            exitWith(exitFailure, "UDPポート範囲設定エラー: %v", err)
+        }
+    }
+    mediaEngine := &webrtc.MediaEngine{}
+    if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+        exitWith(exitFailure, "MediaEngine設定エラー: %v", err)
+    }
+    interceptors := &interceptor.Registry{}
+    if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors); err != nil {
+        exitWith(exitFailure, "MediaEngine設定エラー: %v", err)
+    }
+    if err := rtp.register(interceptors); err != nil {
+        exitWith(exitFailure, "MediaEngine設定エラー: %v", err)
+    }
+    api := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine), webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptors))
 
-    peerConnection, err := webrtc.NewPeerConnection(config)
+    peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
+        ICEServers:         iceServers,
+        ICETransportPolicy: transportPolicy,
+        Certificates:       []webrtc.Certificate{certificate},
+    })
     if err != nil {
-        log.Fatal("PeerConnection作成エラー: ", err)
+        exitWith(exitFailure, "PeerConnection作成エラー: %v", err)
     }
     log.Println("PeerConnectionを作成しました")
 
-    dataChannel, err := peerConnection.CreateDataChannel("chat", nil)
+    // pion never re-arms negotiationneeded if it first fires with no handler
+    // installed, which would break renegotiation for later tracks. The real
+    // handler is set in setupPeerConnectionEventHandlers.
+    peerConnection.OnNegotiationNeeded(func() {})
+
+    dataChannel, err := peerConnection.CreateDataChannel("chat", &webrtc.DataChannelInit{
+        Ordered:           config.DataChannel.Ordered,
+        MaxRetransmits:    config.DataChannel.MaxRetransmits,
+        MaxPacketLifeTime: config.DataChannel.MaxPacketLifeTime,
+    })
     if err != nil {
-        log.Fatal("DataChannel作成エラー: ", err)
+        exitWith(exitFailure, "DataChannel作成エラー: %v", err)
     }
     log.Println("DataChannelを作成しました")
 
-    return peerConnection, dataChannel
+    // File transfers always want every byte, in order, whatever the chat
+    // channel's reliability settings are
+    fileChannel, err := peerConnection.CreateDataChannel("file", nil)
+    if err != nil {
+        exitWith(exitFailure, "DataChannel作成エラー: %v", err)
+    }
+
+    // Protocol metadata gets a reliable channel of its own too, so receipts
+    // and the like are never dropped or stuck behind user content
+    controlChannel, err := peerConnection.CreateDataChannel("control", nil)
+    if err != nil {
+        exitWith(exitFailure, "DataChannel作成エラー: %v", err)
+    }
+
+    return peerConnection, dataChannel, fileChannel, controlChannel
 }
 
-func setupDataChannelEventHandlers(dataChannel *webrtc.DataChannel) {
-    dataChannel.OnOpen(func() {
-        log.Println("DataChannel opened")
-    })
+func setupDataChannelEventHandlers(dataChannel, fileChannel, controlChannel *webrtc.DataChannel, chat *Chat) {
+    dataChannel.OnOpen(chat.handleOpen)
     dataChannel.OnClose(func() {
         log.Println("DataChannel closed")
+        chat.handlePeerGone()
     })
-    dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-        if msg.IsString {
-            fmt.Printf("%s", string(msg.Data))
-        } else {
-            os.Stdout.Write(msg.Data)
-        }
-    })
+    dataChannel.OnMessage(chat.handleMessage)
+    fileChannel.OnMessage(chat.handleMessage)
+    controlChannel.OnOpen(chat.handleControlOpen)
+    controlChannel.OnClose(chat.handleControlClose)
+    controlChannel.OnMessage(chat.handleControlMessage)
 }
 
-func setupPeerConnectionEventHandlers(peerConnection *webrtc.PeerConnection, conn *websocket.Conn, targetID *string, pendingCandidates *[]*webrtc.ICECandidate, clientID string) {
+func setupPeerConnectionEventHandlers(c *conversation) {
+    conn, peerConnection, chat, negotiation, reconnector, candidates := c.conn, c.peerConnection, c.chat, c.negotiation, c.reconnector, c.candidates
     peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
-        log.Printf("New DataChannel: %s\n", dc.Label())
+        label := dc.Label()
+        log.Printf("New DataChannel: %s\n", label)
 
-        if dc.Label() != "chat" {
-            log.Printf("Unknown DataChannel: %s\n", dc.Label())
+        handler := chat.channels.lookup(label)
+        if handler == nil {
+            log.Printf("Unknown DataChannel: %s\n", label)
             return
         }
 
         dc.OnOpen(func() {
-            log.Println("DataChannel opened")
+            log.Printf("DataChannel opened: %s\n", label)
         })
 
         dc.OnClose(func() {
-            log.Println("DataChannel closed")
+            log.Printf("DataChannel closed: %s\n", label)
         })
 
-        dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-            if msg.IsString {
-                fmt.Printf("%s", string(msg.Data))
-            } else {
-                os.Stdout.Write(msg.Data)
-            }
-        })
+        handler(dc)
     })
 
-    peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-        if candidate == nil {
+    // The initial offer is driven by the server's signaling_response; after
+    // that, adding channels or tracks triggers a fresh offer/answer round
+    // with the peer we're already talking to.
+    peerConnection.OnNegotiationNeeded(func() {
+        targetID := c.target()
+        if targetID == "" || peerConnection.CurrentRemoteDescription() == nil {
+            return
+        }
+        if peerConnection.SignalingState() != webrtc.SignalingStateStable {
+            log.Println("Negotiation needed while signaling is in progress, skipping")
             return
         }
+        log.Println("Renegotiating with peer")
+        negotiation.Offer(conn, peerConnection, targetID)
+    })
 
-        log.Println("ICE candidate")
-        if peerConnection.LocalDescription == nil {
-            log.Println("ICE candidate 追加")
-            *pendingCandidates = append(*pendingCandidates, candidate)
+    peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+        if candidate == nil {
             return
         }
 
-        sendICECandidate(conn, candidate, *targetID, clientID)
+        log.Println("ICE candidate")
+        candidates.Add(candidate)
     })
 
     peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
         log.Printf("Peer connection state changed: %s\n", state.String())
+        if shuttingDown.Load() {
+            return
+        }
+        c.display.SetStatus("state", state.String())
+        if state == webrtc.PeerConnectionStateConnected && reconnector != nil && reconnector.Connected() {
+            display.Printf("* reconnected to %s\n", displayName(chat.PeerName()))
+            go chat.SyncHistory()
+        }
         if state == webrtc.PeerConnectionStateDisconnected || state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+            if reconnector != nil && state != webrtc.PeerConnectionStateClosed && !chat.PeerLeft() {
+                if reconnector.Start() {
+                    display.Printf("* connection to %s lost, reconnecting...\n", displayName(chat.PeerName()))
+                }
+                return
+            }
             log.Println("Peer connection closed")
-            conn.Close()
-            os.Exit(0)
+            chat.handlePeerGone()
+            if state != webrtc.PeerConnectionStateFailed && chat.pipe != nil {
+                // The end of the peer's stream; main shuts down normally
+                return
+            }
+            if state == webrtc.PeerConnectionStateFailed {
+                c.end(exitICEFailed, "connection to the peer failed")
+                return
+            }
+            c.end(exitPeerClosed, "peer connection %s", state)
         }
     })
 }
 
-func sendSignalingRequest(conn *websocket.Conn, clientID string) {
+func joinRoom(conn Signaler, room string, clientID string) {
+    err := conn.WriteJSON(RoomMessage{
+        Type: "join_room",
+        Room: room,
+        ID:   clientID,
+    })
+    if err != nil {
+        exitWith(exitSignalingUnreachable, "ルーム参加要求送信エラー: %v", err)
+    }
+    log.Printf("ルーム参加要求を送信しました: %s\n", room)
+}
+
+func leaveRoom(conn Signaler, room string, clientID string) {
+    err := conn.WriteJSON(RoomMessage{
+        Type: "leave_room",
+        Room: room,
+        ID:   clientID,
+    })
+    if err != nil {
+        log.Println("ルーム退出要求送信エラー: ", err)
+        return
+    }
+    log.Printf("ルーム退出要求を送信しました: %s\n", room)
+}
+
+func requestPeerList(conn Signaler, clientID string, room string) error {
+    return conn.WriteJSON(SignalingMessage{
+        Type: "list_peers",
+        ID:   clientID,
+        Room: room,
+    })
+}
+
+func printPeerList(peers []string, presence []PeerPresence, clientID string, targetID string) {
+    rememberListedPeers(peers)
+    display.Printf("%d peer(s) online:\n", len(peers))
+    for _, peer := range peers {
+        marker := ""
+        switch peer {
+        case clientID:
+            marker = " (you)"
+        case targetID:
+            marker = " (connected)"
+        }
+        label := peer
+        if alias := contacts.Alias(peer); alias != "" {
+            label = fmt.Sprintf("%s (%s)", alias, peer)
+        }
+        display.Printf("  %s  %s%s\n", label, peerCode(peer), marker)
+    }
+    now := time.Now()
+    for _, p := range presence {
+        if p.Online || containsString(peers, p.ID) {
+            continue
+        }
+        display.Printf("  %s  %s  (%s)\n", contacts.Label(p.ID), peerCode(p.ID), formatPresence(p, now))
+    }
+}
+
+func sendSignalingRequest(conn Signaler, clientID string, room string) {
     signalingRequest := SignalingMessage{
         Type:     "signaling_request",
         TargetID: "",
         ID:       clientID,
+        Room:     room,
     }
     err := conn.WriteJSON(signalingRequest)
     if err != nil {
-        log.Fatal("シグナリング要求送信エラー: ", err)
+        exitWith(exitSignalingUnreachable, "シグナリング要求送信エラー: %v", err)
     }
     log.Println("シグナリング要求を送信しました")
 }
 
-func handleSignalingMessages(conn *websocket.Conn, peerConnection *webrtc.PeerConnection, dataChannel *webrtc.DataChannel, targetID *string, pendingCandidates *[]*webrtc.ICECandidate, clientID string) {
+func handleSignalingMessages(c *conversation) {
+    conn, peerConnection, negotiation, clientID := c.conn, c.peerConnection, c.negotiation, c.clientID
     for {
         var message SignalingMessage
         err := conn.ReadJSON(&message)
         if err != nil {
-            log.Fatal("シグナリングメッセージ受信エラー: ", err)
+            if shuttingDown.Load() || errors.Is(err, errSignalerClosed) {
+                return
+            }
+            log.Println("シグナリングメッセージ受信エラー: ", err)
+            continue
         }
         log.Println("シグナリングメッセージを受信しました: ", message.Type)
+        if err := validateSignalingMessage(message); err != nil {
+            log.Println("不正なシグナリングメッセージを破棄しました: ", err)
+            continue
+        }
+        if fromPeer(message) && !supportedVersion(messageVersion(message)) && message.Type != "version_mismatch" {
+            if message.Type == "offer" {
+                display.Printf("[signaling] %s uses signaling protocol v%d, which this client (v%d) can't speak\n", contacts.Label(message.ID), messageVersion(message), signalingVersion)
+                rejectVersion(conn, message.ID, clientID)
+            } else {
+                log.Printf("Dropping %s from %s: unsupported protocol version %d\n", message.Type, message.ID, messageVersion(message))
+            }
+            continue
+        }
+        targetID := c.target()
+        if targetID != "" && message.ID != targetID && (message.Type == "answer" || message.Type == "candidate" ||
+            (message.Type == "offer" && peerConnection.RemoteDescription() != nil)) {
+            log.Printf("Dropping %s from %s: not the current peer\n", message.Type, message.ID)
+            continue
+        }
 
         switch message.Type {
+        case "room_joined":
+            log.Printf("Joined room: %s\n", message.Room)
+        case "room_left":
+            log.Printf("Left room: %s\n", message.Room)
+        case "peer_joined":
+            log.Printf("Peer %s joined room %s\n", message.ID, message.Room)
+        case "peer_left":
+            log.Printf("Peer %s left room %s\n", message.ID, message.Room)
+            if message.ID == targetID {
+                log.Println("Current peer left the room")
+            }
+        case "auth_error":
+            // Servers that authenticate after the handshake report it here
+            exitWith(exitAuthRejected, "シグナリング認証エラー: %s", message.Error)
+        case "peer_list":
+            printPeerList(message.Peers, message.Presence, clientID, targetID)
+        case "message_queued":
+            display.Printf("[queue] message held for %s\n", contacts.Label(message.TargetID))
+        case "queued_messages":
+            printQueuedMessages(message.Messages)
+        case "presence":
+            printPresence(message.Presence)
         case "signaling_response":
             if message.Request == "offer" {
-                *targetID = message.TargetID
-                sendOffer(conn, peerConnection, message.TargetID, clientID)
-                sendPendingICECandidates(conn, pendingCandidates, *targetID, clientID)
-                *pendingCandidates = []*webrtc.ICECandidate{}
+                c.setTarget(message.TargetID)
+                c.display.SetStatus("peer", contacts.Label(message.TargetID))
+                negotiation.Offer(conn, peerConnection, message.TargetID)
             }
         case "offer":
-            *targetID = message.ID
-            handleOffer(peerConnection, message.Offer)
-            sendAnswer(conn, peerConnection, *targetID, clientID)
-            sendPendingICECandidates(conn, pendingCandidates, *targetID, clientID)
-            *pendingCandidates = []*webrtc.ICECandidate{}
+            if peerConnection.CurrentRemoteDescription() != nil {
+                log.Println("Renegotiation offer received")
+            }
+            c.setTarget(message.ID)
+            c.display.SetStatus("peer", contacts.Label(message.ID))
+            negotiation.Answer(conn, peerConnection, message.ID, string(message.Offer))
         case "answer":
-            *targetID = message.ID
-            handleAnswer(peerConnection, message.Answer)
+            c.setTarget(message.ID)
+            c.display.SetStatus("peer", contacts.Label(message.ID))
+            negotiation.HandleAnswer(peerConnection, string(message.Answer))
         case "candidate":
-            handleICECandidate(peerConnection, message.Candidate)
+            if message.Candidate.Candidate == "" {
+                // A browser's end-of-candidates marker
+                continue
+            }
+            negotiation.HandleCandidate(peerConnection, webrtc.ICECandidateInit(message.Candidate))
+        case "version_mismatch":
+            if message.ID == targetID {
+                c.end(exitProtocolMismatch, "%s uses signaling protocol v%d, this client v%d", contacts.Label(message.ID), messageVersion(message), signalingVersion)
+                return
+            }
         }
     }
 }
 
-func sendOffer(conn *websocket.Conn, peerConnection *webrtc.PeerConnection, targetID string, clientID string) {
-    offer, err := peerConnection.CreateOffer(nil)
+func createOffer(peerConnection *webrtc.PeerConnection, options *webrtc.OfferOptions) webrtc.SessionDescription {
+    offer, err := peerConnection.CreateOffer(options)
     if err != nil {
-        log.Fatal("Offer作成エラー: ", err)
+        exitWith(exitFailure, "Offer作成エラー: %v", err)
     }
-    err = peerConnection.SetLocalDescription(offer)
+    log.Println("Offerを作成しました")
+    return offer
+}
+
+func applyOffer(peerConnection *webrtc.PeerConnection, offer webrtc.SessionDescription) {
+    err := peerConnection.SetLocalDescription(offer)
     if err != nil {
-        log.Fatal("LocalDescription設定エラー: ", err)
+        exitWith(exitFailure, "LocalDescription設定エラー: %v", err)
     }
-    log.Println("Offerを作成しました")
+}
 
+func sendOffer(conn Signaler, offer webrtc.SessionDescription, targetID string, clientID string) {
     offerMessage := OfferMessage{
         Type:     "offer",
         TargetID: targetID,
-        Offer:    offer.SDP,
+        Offer:    descriptionPayload(offer),
         ID:       clientID,
+        Version:  signalingVersion,
     }
-    err = conn.WriteJSON(offerMessage)
+    err := conn.WriteJSON(offerMessage)
     if err != nil {
-        log.Fatal("Offer送信エラー: ", err)
+        exitWith(exitSignalingUnreachable, "Offer送信エラー: %v", err)
     }
     log.Println("Offerを送信しました")
 }
 
-func handleOffer(peerConnection *webrtc.PeerConnection, offerSDP string) {
+func handleOffer(peerConnection *webrtc.PeerConnection, offerSDP string) error {
     err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
         Type: webrtc.SDPTypeOffer,
         SDP:  offerSDP,
     })
     if err != nil {
-        log.Fatal("RemoteDescription設定エラー: ", err)
+        return err
     }
     log.Println("Offerを設定しました")
+    return nil
 }
 
-func sendAnswer(conn *websocket.Conn, peerConnection *webrtc.PeerConnection, targetID string, clientID string) {
+func sendAnswer(conn Signaler, peerConnection *webrtc.PeerConnection, targetID string, clientID string) {
     answer, err := peerConnection.CreateAnswer(nil)
     if err != nil {
-        log.Fatal("Answer作成エラー: ", err)
+        exitWith(exitFailure, "Answer作成エラー: %v", err)
     }
     err = peerConnection.SetLocalDescription(answer)
     if err != nil {
-        log.Fatal("LocalDescription設定エラー: ", err)
+        exitWith(exitFailure, "LocalDescription設定エラー: %v", err)
     }
     log.Println("Answerを作成しました")
 
     answerMessage := AnswerMessage{
         Type:     "answer",
         TargetID: targetID,
-        Answer:   answer.SDP,
+        Answer:   descriptionPayload(answer),
         ID:       clientID,
+        Version:  signalingVersion,
     }
     err = conn.WriteJSON(answerMessage)
     if err != nil {
-        log.Fatal("Answer送信エラー: ", err)
+        exitWith(exitSignalingUnreachable, "Answer送信エラー: %v", err)
     }
     log.Println("Answerを送信しました")
 }
 
-func handleAnswer(peerConnection *webrtc.PeerConnection, answerSDP string) {
+func handleAnswer(peerConnection *webrtc.PeerConnection, answerSDP string) error {
     err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
         Type: webrtc.SDPTypeAnswer,
         SDP:  answerSDP,
     })
     if err != nil {
-        log.Fatal("RemoteDescription設定エラー: ", err)
+        return err
     }
     log.Println("Answerを設定しました")
+    return nil
 }
 
-func sendICECandidate(conn *websocket.Conn, candidate *webrtc.ICECandidate, targetID string, clientID string) {
+func sendICECandidate(conn Signaler, candidate *webrtc.ICECandidate, targetID string, clientID string) {
     candidateMessage := CandidateMessage{
         Type:      "candidate",
         TargetID:  targetID,
-        Candidate: candidate.ToJSON().Candidate,
+        Candidate: candidatePayload(candidate),
         ID:        clientID,
+        Version:   signalingVersion,
     }
     err := conn.WriteJSON(candidateMessage)
     if err != nil {
-        log.Fatal("ICE candidate送信エラー: ", err)
+        exitWith(exitSignalingUnreachable, "ICE candidate送信エラー: %v", err)
     }
     log.Println("ICE candidateを送信しました")
 }
 
-func sendPendingICECandidates(conn *websocket.Conn, pendingCandidates *[]*webrtc.ICECandidate, targetID string, clientID string) {
-    for _, candidate := range *pendingCandidates {
-        sendICECandidate(conn, candidate, targetID, clientID)
-    }
-}
-
-func handleICECandidate(peerConnection *webrtc.PeerConnection, candidateJSON string) {
-    candidate := webrtc.ICECandidateInit{
-        Candidate: candidateJSON,
-    }
-    err := peerConnection.AddICECandidate(candidate)
-    if err != nil {
-        log.Fatal("ICE candidate追加エラー: ", err)
+// readStdinLines sends typed lines to lines, calling seen for each. Ctrl-C
+// typed into the line editor, which doesn't raise a signal, closes quit, as
+// does Ctrl-D there.
+func readStdinLines(lines chan<- []byte, quit chan<- struct{}, seen func()) {
+    var reader interface{ ReadLine() ([]byte, error) } = newLineReader(terminalIn)
+    editing := editor != nil && editor.active()
+    if editing {
+        reader = editor
     }
-    log.Println("ICE candidateを追加しました")
-}
-
-func sendUserMessages(dataChannel *webrtc.DataChannel) {
-    reader := bufio.NewReader(os.Stdin)
     for {
-        data, err := reader.ReadBytes('\n')
+        data, err := reader.ReadLine()
         if err != nil {
+            // Ctrl-D in the line editor quits as well: nothing would read
+            // the terminal after it, and in raw mode Ctrl-C is just a key
+            if err == errInterrupted || (err == io.EOF && editing) {
+                close(quit)
+                return
+            }
             if err == io.EOF {
                 log.Println("Reached end of stdin")
                 return
             }
-            log.Fatal("stdin read error: ", err)
+            exitWith(exitFailure, "stdin read error: %v", err)
         }
+        seen()
+        lines <- data
+    }
+}
 
-        if isBinaryData(data) {
-            err = dataChannel.Send(data)
-        } else {
-            err = dataChannel.SendText(string(data))
+// sendUserMessages sends typed lines to the chat active returns, or runs
+// them as commands.
+func sendUserMessages(active func() *Chat, commands *Commands, lines <-chan []byte) {
+    for data := range lines {
+        data, handled := commands.Dispatch(data)
+        if handled {
+            continue
         }
 
+        err := active().Send(data)
         if err != nil {
-            log.Fatal("メッセージ送信エラー: ", err)
+            exitWith(exitFailure, "メッセージ送信エラー: %v", err)
         }
         log.Println("メッセージを送信しました")
     }
 }
-
-func isBinaryData(data []byte) bool {
-    return !utf8.Valid(data)
-}
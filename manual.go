@@ -0,0 +1,277 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "strings"
+    "sync"
+
+    "github.com/pion/webrtc/v3"
+)
+
+var errManualClosed = errors.New("manual: signaler closed")
+
+// manualCode is what a pairing code carries: a complete offer or answer,
+// candidates included, so one code each way is the whole exchange.
+type manualCode struct {
+    Type string `json:"t"`
+    ID   string `json:"id"`
+    SDP  string `json:"sdp"`
+}
+
+// ManualSignaler stands in for the signaling server when running with
+// --manual. There is no trickle: once ICE gathering finishes, the local
+// offer or answer is printed as a compact code for the user to pass to the
+// peer over any other channel, and the peer's code is read from the input.
+// One side presses Enter to create the offer code; the other pastes it and
+// gets an answer code to send back.
+//
+// The input is shared with chat, so chat input waits for Ready.
+type ManualSignaler struct {
+    clientID       string
+    peerConnection *webrtc.PeerConnection
+    input          <-chan []byte
+
+    incoming chan []byte
+    ready    chan struct{}
+    done     chan struct{}
+
+    mu        sync.Mutex
+    started   bool
+    readyOnce sync.Once
+    closed    bool
+}
+
+func newManualSignaler(clientID string, peerConnection *webrtc.PeerConnection, input <-chan []byte) *ManualSignaler {
+    return &ManualSignaler{
+        clientID:       clientID,
+        peerConnection: peerConnection,
+        input:          input,
+        incoming:       make(chan []byte, 4),
+        ready:          make(chan struct{}),
+        done:           make(chan struct{}),
+    }
+}
+
+// Ready is closed once the codes have been exchanged and the input is free
+// for chat again.
+func (s *ManualSignaler) Ready() <-chan struct{} {
+    return s.ready
+}
+
+func (s *ManualSignaler) WriteJSON(v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    var message SignalingMessage
+    if err := json.Unmarshal(data, &message); err != nil {
+        return err
+    }
+
+    switch message.Type {
+    case "signaling_request":
+        s.mu.Lock()
+        start := !s.started
+        s.started = true
+        s.mu.Unlock()
+        if start {
+            go s.readPeerCode()
+        }
+        return nil
+    case "offer":
+        go s.printCode("offer")
+        return nil
+    case "answer":
+        go s.printCode("answer")
+        return nil
+    case "list_peers":
+        return errors.New("there is no peer list in manual mode")
+    case "presence":
+        return errors.New("there is no presence in manual mode")
+    case "queue_message":
+        return errors.New("offline messages need a signaling server")
+    }
+    // Candidates are part of the printed description; room messages have
+    // no meaning without a server
+    return nil
+}
+
+func (s *ManualSignaler) ReadJSON(v interface{}) error {
+    select {
+    case data := <-s.incoming:
+        return json.Unmarshal(data, v)
+    case <-s.done:
+        return errManualClosed
+    }
+}
+
+func (s *ManualSignaler) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return nil
+    }
+    s.closed = true
+    close(s.done)
+    s.setReady()
+    return nil
+}
+
+func (s *ManualSignaler) setReady() {
+    s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// readPeerCode asks for the peer's code, or for an empty line to make this
+// side the offerer.
+func (s *ManualSignaler) readPeerCode() {
+    display.Printf("[manual] Paste the peer's code (or the path of a picture of its QR code) and press Enter, or just press Enter to create a code for the peer\n")
+    for {
+        line, ok := s.readLine()
+        if !ok {
+            return
+        }
+        if line == "" {
+            // An empty target makes us the impolite side, so the offer is
+            // applied and gathering starts right away
+            s.deliver(SignalingMessage{Type: "signaling_response", Request: "offer"})
+            return
+        }
+        code, err := readManualCode(line)
+        if err == nil && code.Type != "offer" {
+            err = errors.New("that is an answer code; paste the peer's offer code, or press Enter to create one")
+        }
+        if err != nil {
+            display.Error(fmt.Sprintf("[manual] %v", err))
+            continue
+        }
+        s.deliver(OfferMessage{Type: "offer", ID: code.ID, Offer: code.SDP})
+        return
+    }
+}
+
+// printCode waits for ICE gathering so the description lists every
+// candidate, then prints it as a code. The offerer goes on to wait for the
+// answer code.
+func (s *ManualSignaler) printCode(kind string) {
+    select {
+    case <-webrtc.GatheringCompletePromise(s.peerConnection):
+    case <-s.done:
+        return
+    }
+    code, err := encodeManualCode(manualCode{Type: kind, ID: s.clientID, SDP: s.peerConnection.LocalDescription().SDP})
+    if err != nil {
+        exitWith(exitFailure, "コード作成エラー: %v", err)
+    }
+    display.Printf("[manual] Send this %s code to the peer:\n", kind)
+    display.Printf("%s\n", code)
+    if showQR {
+        if qrCode, err := renderQR(code); err != nil {
+            log.Println("QRコード作成エラー: ", err)
+        } else {
+            display.Printf("[manual] or let the peer scan it:\n%s", qrCode)
+        }
+    }
+
+    if kind == "answer" {
+        display.Printf("[manual] Waiting for the peer to connect\n")
+        s.setReady()
+        return
+    }
+
+    display.Printf("[manual] Then paste the peer's answer code (or the path of a picture of its QR code) and press Enter\n")
+    for {
+        line, ok := s.readLine()
+        if !ok {
+            return
+        }
+        if line == "" {
+            continue
+        }
+        code, err := readManualCode(line)
+        if err == nil && code.Type != "answer" {
+            err = errors.New("that is an offer code; only one side should create an offer, so paste the peer's answer code")
+        }
+        if err != nil {
+            display.Error(fmt.Sprintf("[manual] %v", err))
+            continue
+        }
+        s.deliver(AnswerMessage{Type: "answer", ID: code.ID, Answer: code.SDP})
+        s.setReady()
+        return
+    }
+}
+
+func (s *ManualSignaler) readLine() (string, bool) {
+    select {
+    case line := <-s.input:
+        return strings.TrimSpace(string(line)), true
+    case <-s.done:
+        return "", false
+    }
+}
+
+func (s *ManualSignaler) deliver(message interface{}) {
+    data, _ := json.Marshal(message)
+    select {
+    case s.incoming <- data:
+    case <-s.done:
+    }
+}
+
+// encodeManualCode deflates the code's JSON and encodes it as URL-safe
+// base64, which survives being pasted into chats and mail and never starts
+// with the "/" of a command.
+func encodeManualCode(code manualCode) (string, error) {
+    data, err := json.Marshal(code)
+    if err != nil {
+        return "", err
+    }
+    var buf bytes.Buffer
+    w, err := flate.NewWriter(&buf, flate.BestCompression)
+    if err != nil {
+        return "", err
+    }
+    w.Write(data)
+    if err := w.Close(); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// readManualCode takes a pasted code, or the path of a photo or screenshot
+// of its QR code.
+func readManualCode(line string) (manualCode, error) {
+    if isImagePath(line) {
+        text, err := scanQRImage(line)
+        if err != nil {
+            return manualCode{}, err
+        }
+        line = text
+    }
+    return decodeManualCode(line)
+}
+
+func decodeManualCode(text string) (manualCode, error) {
+    // Spaces picked up while copying are ignored
+    text = strings.Join(strings.Fields(text), "")
+    var code manualCode
+    compressed, err := base64.RawURLEncoding.DecodeString(text)
+    if err != nil {
+        return code, errors.New("not a valid code (was it copied completely?)")
+    }
+    data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxFrameSize))
+    if err != nil {
+        return code, errors.New("not a valid code (was it copied completely?)")
+    }
+    if err := json.Unmarshal(data, &code); err != nil || code.ID == "" || code.SDP == "" {
+        return code, errors.New("not a valid code")
+    }
+    return code, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "strings"
+    "unicode"
+)
+
+// plainOutput turns Markdown rendering off (-plain), showing the peer's
+// text exactly as it was sent.
+var plainOutput bool
+
+// markdownStyle says how a display shows each Markdown element: the strings
+// that switch a style on and off, and how to escape literal text.
+type markdownStyle struct {
+    bold, italic, code, link [2]string
+    escape                   func(string) string
+}
+
+var ansiMarkdown = markdownStyle{
+    bold:   [2]string{"\x1b[1m", "\x1b[22m"},
+    italic: [2]string{"\x1b[3m", "\x1b[23m"},
+    code:   [2]string{"\x1b[36m", "\x1b[39m"},
+    link:   [2]string{"\x1b[4m", "\x1b[24m"},
+    escape: func(s string) string { return s },
+}
+
+// renderMarkdown styles the Markdown in text: **bold**, *italics*, `code`,
+// fenced code blocks and [links](url). It is deliberately small; anything
+// it doesn't recognise is shown as typed.
+func renderMarkdown(text string, style markdownStyle) string {
+    var b strings.Builder
+    inFence := false
+    lines := strings.SplitAfter(text, "\n")
+    for _, line := range lines {
+        content := strings.TrimRight(line, "\r\n")
+        newline := line[len(content):]
+        if strings.HasPrefix(strings.TrimSpace(content), "```") {
+            // The fence lines themselves are dropped, not the newline
+            inFence = !inFence
+            continue
+        }
+        if inFence {
+            b.WriteString(style.code[0] + style.escape(content) + style.code[1] + newline)
+            continue
+        }
+        b.WriteString(renderInline(content, style) + newline)
+    }
+    return b.String()
+}
+
+func renderInline(text string, style markdownStyle) string {
+    var b strings.Builder
+    runes := []rune(text)
+    // Literal text is escaped a run at a time, so escape sees whole words
+    var pending strings.Builder
+    literal := func(s string) { pending.WriteString(s) }
+    styled := func(s string) {
+        b.WriteString(style.escape(pending.String()))
+        pending.Reset()
+        b.WriteString(s)
+    }
+
+    for i := 0; i < len(runes); i++ {
+        r := runes[i]
+        switch {
+        case r == '\\' && i+1 < len(runes) && unicode.IsPunct(runes[i+1]):
+            literal(string(runes[i+1]))
+            i++
+            continue
+
+        case r == '`':
+            if end := indexRune(runes, '`', i+1); end > i+1 {
+                styled(style.code[0] + style.escape(string(runes[i+1:end])) + style.code[1])
+                i = end
+                continue
+            }
+
+        case (r == '*' || r == '_') && i+1 < len(runes) && runes[i+1] == r:
+            delim := string([]rune{r, r})
+            if end := indexDelimiter(runes, delim, i+2); end > i+2 && emphasisBoundary(runes, i, end+2, r) {
+                styled(style.bold[0] + renderInline(string(runes[i+2:end]), style) + style.bold[1])
+                i = end + 1
+                continue
+            }
+
+        case r == '*' || r == '_':
+            if end := indexDelimiter(runes, string(r), i+1); end > i+1 && emphasisBoundary(runes, i, end+1, r) {
+                styled(style.italic[0] + renderInline(string(runes[i+1:end]), style) + style.italic[1])
+                i = end
+                continue
+            }
+
+        case r == '[':
+            if label, url, end, ok := parseLink(runes, i); ok {
+                styled(style.link[0] + style.escape(label) + style.link[1])
+                if url != label {
+                    literal(" (" + url + ")")
+                }
+                i = end
+                continue
+            }
+        }
+        literal(string(r))
+    }
+    styled("")
+    return b.String()
+}
+
+func indexRune(runes []rune, r rune, from int) int {
+    for i := from; i < len(runes); i++ {
+        if runes[i] == r {
+            return i
+        }
+    }
+    return -1
+}
+
+// indexDelimiter finds the closing emphasis delimiter, which like the
+// opening one must hug the text ("*a*", not "* a *").
+func indexDelimiter(runes []rune, delim string, from int) int {
+    if from >= len(runes) || unicode.IsSpace(runes[from]) {
+        return -1
+    }
+    d := []rune(delim)
+    for i := from + 1; i+len(d) <= len(runes); i++ {
+        if string(runes[i:i+len(d)]) == delim && !unicode.IsSpace(runes[i-1]) {
+            return i
+        }
+    }
+    return -1
+}
+
+// emphasisBoundary keeps underscores inside words, as in snake_case,
+// from being read as emphasis.
+func emphasisBoundary(runes []rune, start, end int, delim rune) bool {
+    if delim != '_' {
+        return true
+    }
+    before := start == 0 || !isWordRune(runes[start-1])
+    after := end >= len(runes) || !isWordRune(runes[end])
+    return before && after
+}
+
+func isWordRune(r rune) bool {
+    return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// parseLink parses "[label](url)" starting at runes[start] and returns the
+// index of the closing parenthesis.
+func parseLink(runes []rune, start int) (label, url string, end int, ok bool) {
+    close := indexRune(runes, ']', start+1)
+    if close <= start+1 || close+1 >= len(runes) || runes[close+1] != '(' {
+        return "", "", 0, false
+    }
+    end = indexRune(runes, ')', close+2)
+    if end <= close+2 {
+        return "", "", 0, false
+    }
+    url = string(runes[close+2 : end])
+    if strings.ContainsAny(url, " \t") {
+        return "", "", 0, false
+    }
+    return string(runes[start+1 : close]), url, end, true
+}
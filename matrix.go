@@ -0,0 +1,410 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // matrixEventType is the custom room event signaling messages travel in,
+    // so ordinary Matrix clients in the room don't show them as chat.
+    matrixEventType   = "io.github.fog-zs.webrtc-chat.signal"
+    matrixSyncTimeout = 30 * time.Second
+    matrixMaxBackoff  = 30 * time.Second
+)
+
+var errMatrixClosed = errors.New("matrix: signaler closed")
+
+// MatrixConfig is a Matrix room used for signaling with --matrix. Room is a
+// room ID ("!abc:example.org") or alias ("#chat:example.org"); the account
+// behind AccessToken must be allowed to join it.
+type MatrixConfig struct {
+    Homeserver  string `json:"homeserver,omitempty"`
+    AccessToken string `json:"access_token,omitempty"`
+    Room        string `json:"room,omitempty"`
+}
+
+// matrixError is the error body of the Matrix client-server API.
+type matrixError struct {
+    Code    string `json:"errcode"`
+    Message string `json:"error"`
+    status  int
+}
+
+func (e *matrixError) Error() string {
+    return fmt.Sprintf("%s: %s (HTTP %d)", e.Code, e.Message, e.status)
+}
+
+type matrixSyncResponse struct {
+    NextBatch string `json:"next_batch"`
+    Rooms     struct {
+        Join map[string]struct {
+            Timeline struct {
+                Events []struct {
+                    Type    string          `json:"type"`
+                    Content json.RawMessage `json:"content"`
+                } `json:"events"`
+            } `json:"timeline"`
+        } `json:"join"`
+    } `json:"rooms"`
+}
+
+// MatrixSignaler stands in for the signaling server when running with
+// --matrix. Every signaling message is posted to a Matrix room as a custom
+// event and each client keeps only messages addressed to it, so any
+// homeserver, federated or not, can bootstrap a session. As with --lan,
+// pairing is done locally: a client announces itself once when it asks for
+// a peer, answers new announcements with its own, and when two unpaired
+// clients in the same chat room hear each other the one with the lower ID
+// is told to send the offer.
+type MatrixSignaler struct {
+    clientID    string
+    homeserver  string
+    accessToken string
+    roomID      string
+    client      *http.Client
+
+    // Transaction IDs must be unique per access token or the homeserver
+    // treats the send as a retry and drops it, so they're prefixed with the
+    // start time as well as the client ID, which persists across runs
+    txnPrefix string
+    txn       atomic.Int64
+
+    incoming chan []byte
+    done     chan struct{}
+
+    mu        sync.Mutex
+    room      string
+    announced bool
+    paired    bool
+    peers     map[string]*lanPeer
+    closed    bool
+}
+
+func newMatrixSignaler(clientID string, config MatrixConfig, options SignalingOptions) (*MatrixSignaler, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = options.TLSConfig
+    if options.Proxy != nil {
+        transport.Proxy = http.ProxyURL(options.Proxy)
+    }
+
+    s := &MatrixSignaler{
+        clientID:    clientID,
+        homeserver:  strings.TrimSuffix(config.Homeserver, "/"),
+        accessToken: config.AccessToken,
+        client:      &http.Client{Transport: transport},
+        txnPrefix:   clientID + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+        incoming:    make(chan []byte, 64),
+        done:        make(chan struct{}),
+        peers:       map[string]*lanPeer{},
+    }
+
+    var joined struct {
+        RoomID string `json:"room_id"`
+    }
+    if err := s.call("POST", "/join/"+url.PathEscape(config.Room), struct{}{}, &joined); err != nil {
+        return nil, fmt.Errorf("join %s: %w", config.Room, err)
+    }
+    s.roomID = joined.RoomID
+
+    // An initial sync with no timeline gives the point to read from, so old
+    // announcements from clients long gone aren't replayed
+    since, err := s.sync("", 0)
+    if err != nil {
+        return nil, err
+    }
+    go s.receive(since)
+    log.Printf("Matrix signaling in %s on %s\n", s.roomID, s.homeserver)
+    return s, nil
+}
+
+// isMatrixAuthError reports whether the homeserver refused the access token.
+func isMatrixAuthError(err error) bool {
+    var matrixErr *matrixError
+    return errors.As(err, &matrixErr) && (matrixErr.status == http.StatusUnauthorized || matrixErr.Code == "M_UNKNOWN_TOKEN" || matrixErr.Code == "M_MISSING_TOKEN")
+}
+
+// WriteJSON handles the messages a server would: room membership and pairing
+// requests are kept locally, everything else is posted to the Matrix room.
+func (s *MatrixSignaler) WriteJSON(v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    var message SignalingMessage
+    if err := json.Unmarshal(data, &message); err != nil {
+        return err
+    }
+
+    switch message.Type {
+    case "join_room":
+        s.mu.Lock()
+        s.room = message.Room
+        s.mu.Unlock()
+        return nil
+    case "leave_room":
+        return nil
+    case "signaling_request":
+        s.mu.Lock()
+        s.room = message.Room
+        s.announced = true
+        s.mu.Unlock()
+        return s.announce()
+    case "list_peers":
+        return s.deliverPeerList()
+    case "presence":
+        return errors.New("presence needs a signaling server or --lan")
+    case "queue_message":
+        return errors.New("offline messages need a signaling server")
+    case "fetch_queue":
+        return nil
+    case "offer", "answer":
+        s.mu.Lock()
+        s.paired = true
+        s.mu.Unlock()
+    }
+
+    return s.post(json.RawMessage(data))
+}
+
+func (s *MatrixSignaler) ReadJSON(v interface{}) error {
+    select {
+    case data := <-s.incoming:
+        return json.Unmarshal(data, v)
+    case <-s.done:
+        return errMatrixClosed
+    }
+}
+
+// Close stops syncing. The client stays in the room so the next session
+// doesn't have to join again.
+func (s *MatrixSignaler) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return nil
+    }
+    s.closed = true
+    close(s.done)
+    s.client.CloseIdleConnections()
+    return nil
+}
+
+func (s *MatrixSignaler) announce() error {
+    s.mu.Lock()
+    room := s.room
+    s.mu.Unlock()
+    return s.post(SignalingMessage{
+        Type: "announce",
+        ID:   s.clientID,
+        Room: room,
+    })
+}
+
+func (s *MatrixSignaler) post(content interface{}) error {
+    txnID := s.txnPrefix + "-" + strconv.FormatInt(s.txn.Add(1), 10)
+    path := "/rooms/" + url.PathEscape(s.roomID) + "/send/" + url.PathEscape(matrixEventType) + "/" + url.PathEscape(txnID)
+    return s.call("PUT", path, content, nil)
+}
+
+// sync long-polls the homeserver for new signaling events in the room,
+// delivering those addressed to this client, and returns the token to
+// continue from. An empty since only fetches the starting token.
+func (s *MatrixSignaler) sync(since string, timeout time.Duration) (string, error) {
+    timelineLimit := 50
+    if since == "" {
+        timelineLimit = 0
+    }
+    filter, _ := json.Marshal(map[string]interface{}{
+        "presence":     map[string]interface{}{"not_types": []string{"*"}},
+        "account_data": map[string]interface{}{"not_types": []string{"*"}},
+        "room": map[string]interface{}{
+            "rooms":        []string{s.roomID},
+            "state":        map[string]interface{}{"not_types": []string{"*"}},
+            "ephemeral":    map[string]interface{}{"not_types": []string{"*"}},
+            "account_data": map[string]interface{}{"not_types": []string{"*"}},
+            "timeline":     map[string]interface{}{"types": []string{matrixEventType}, "limit": timelineLimit},
+        },
+    })
+    query := url.Values{}
+    query.Set("filter", string(filter))
+    query.Set("timeout", strconv.FormatInt(timeout.Milliseconds(), 10))
+    if since != "" {
+        query.Set("since", since)
+    }
+
+    var response matrixSyncResponse
+    if err := s.call("GET", "/sync?"+query.Encode(), nil, &response); err != nil {
+        return since, err
+    }
+    if since == "" {
+        return response.NextBatch, nil
+    }
+    for _, event := range response.Rooms.Join[s.roomID].Timeline.Events {
+        if event.Type == matrixEventType {
+            s.handleEvent(event.Content)
+        }
+    }
+    return response.NextBatch, nil
+}
+
+func (s *MatrixSignaler) receive(since string) {
+    backoff := time.Second
+    for {
+        select {
+        case <-s.done:
+            return
+        default:
+        }
+
+        next, err := s.sync(since, matrixSyncTimeout)
+        if err != nil {
+            select {
+            case <-s.done:
+                return
+            default:
+            }
+            if isMatrixAuthError(err) {
+                exitWith(exitAuthRejected, "Matrix同期エラー: %v", err)
+            }
+            log.Printf("Matrix同期エラー、%s後に再試行します: %v\n", backoff, err)
+            select {
+            case <-time.After(backoff):
+            case <-s.done:
+                return
+            }
+            backoff = min(backoff*2, matrixMaxBackoff)
+            continue
+        }
+        backoff = time.Second
+        since = next
+    }
+}
+
+func (s *MatrixSignaler) handleEvent(content []byte) {
+    var message SignalingMessage
+    if err := json.Unmarshal(content, &message); err != nil || message.ID == s.clientID {
+        return
+    }
+
+    if message.Type == "announce" {
+        s.handleAnnounce(message)
+        return
+    }
+    if message.TargetID != s.clientID {
+        return
+    }
+    s.deliver(content)
+}
+
+func (s *MatrixSignaler) handleAnnounce(message SignalingMessage) {
+    s.mu.Lock()
+    _, known := s.peers[message.ID]
+    s.peers[message.ID] = &lanPeer{room: message.Room, lastSeen: time.Now()}
+    ready := s.announced && !s.paired && message.Room == s.room
+    offer := ready && s.clientID < message.ID
+    if offer {
+        s.paired = true
+    }
+    s.mu.Unlock()
+
+    if !known {
+        log.Printf("Matrix peer discovered: %s\n", message.ID)
+        // Our own announcement went out before the peer was listening, so
+        // repeat it for the peer to hear
+        if ready && !offer {
+            if err := s.announce(); err != nil {
+                log.Println("Matrixアナウンス送信エラー: ", err)
+            }
+        }
+    }
+    if offer {
+        data, _ := json.Marshal(SignalingMessage{
+            Type:     "signaling_response",
+            Request:  "offer",
+            TargetID: message.ID,
+        })
+        s.deliver(data)
+    }
+}
+
+// deliverPeerList lists the clients heard from in the chat room. Peers only
+// announce themselves when they ask for a peer, so idle clients are missing.
+func (s *MatrixSignaler) deliverPeerList() error {
+    s.mu.Lock()
+    peers := []string{s.clientID}
+    for id, peer := range s.peers {
+        if peer.room == s.room {
+            peers = append(peers, id)
+        }
+    }
+    s.mu.Unlock()
+
+    data, err := json.Marshal(SignalingMessage{Type: "peer_list", Peers: peers})
+    if err != nil {
+        return err
+    }
+    s.deliver(data)
+    return nil
+}
+
+func (s *MatrixSignaler) deliver(data []byte) {
+    select {
+    case s.incoming <- data:
+    case <-s.done:
+    }
+}
+
+// call makes a client-server API request with body as JSON and decodes the
+// JSON response into result, if not nil.
+func (s *MatrixSignaler) call(method, path string, body, result interface{}) error {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(data)
+    }
+    req, err := http.NewRequest(method, s.homeserver+"/_matrix/client/v3"+path, reader)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+s.accessToken)
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        matrixErr := &matrixError{status: resp.StatusCode}
+        if json.Unmarshal(data, matrixErr) != nil || matrixErr.Code == "" {
+            matrixErr.Code = "M_UNKNOWN"
+            matrixErr.Message = resp.Status
+        }
+        return matrixErr
+    }
+    if result == nil {
+        return nil
+    }
+    return json.Unmarshal(data, result)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+    "github.com/pion/webrtc/v3/pkg/media/h264reader"
+    "github.com/pion/webrtc/v3/pkg/media/h264writer"
+    "github.com/pion/webrtc/v3/pkg/media/ivfreader"
+    "github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+    "github.com/pion/webrtc/v3/pkg/media/oggreader"
+    "github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// MediaConfig names the external commands used for calls. Audio capture
+// commands write Ogg/Opus to stdout; video capture commands write IVF (VP8)
+// or an Annex B stream (H264) depending on VideoCodec. Playback commands
+// read the same formats from stdin. Left empty, ffmpeg and ffplay are used
+// with the platform's default devices.
+type MediaConfig struct {
+    AudioCapture  []string `json:"audio_capture,omitempty"`
+    AudioPlayback []string `json:"audio_playback,omitempty"`
+
+    VideoCapture  []string `json:"video_capture,omitempty"`
+    VideoCodec    string   `json:"video_codec,omitempty"` // vp8 (default) or h264
+    VideoPlayback []string `json:"video_playback,omitempty"`
+    // VideoRecord, if set, saves the peer's video to this file instead of
+    // playing it.
+    VideoRecord string `json:"video_record,omitempty"`
+}
+
+const (
+    h264FrameDuration = time.Second / 30
+    maxVoiceSeconds   = 60
+)
+
+func (m MediaConfig) audioCaptureCommand() ([]string, error) {
+    if len(m.AudioCapture) > 0 {
+        return m.AudioCapture, nil
+    }
+    var input []string
+    switch runtime.GOOS {
+    case "linux":
+        input = []string{"-f", "pulse", "-i", "default"}
+    case "darwin":
+        input = []string{"-f", "avfoundation", "-i", ":0"}
+    default:
+        // dshow has no default device, so it has to be named
+        return nil, fmt.Errorf("set media.audio_capture in the config file to record audio on %s", runtime.GOOS)
+    }
+    args := append([]string{"ffmpeg", "-loglevel", "error"}, input...)
+    return append(args, "-c:a", "libopus", "-b:a", "48k", "-page_duration", "20000", "-f", "ogg", "-"), nil
+}
+
+func (m MediaConfig) audioPlaybackCommand() []string {
+    if len(m.AudioPlayback) > 0 {
+        return m.AudioPlayback
+    }
+    return []string{"ffplay", "-loglevel", "error", "-nodisp", "-autoexit", "-i", "-"}
+}
+
+func (m MediaConfig) videoCaptureCommand() ([]string, error) {
+    if len(m.VideoCapture) > 0 {
+        return m.VideoCapture, nil
+    }
+    var input []string
+    switch runtime.GOOS {
+    case "linux":
+        input = []string{"-f", "v4l2", "-i", "/dev/video0"}
+    case "darwin":
+        input = []string{"-f", "avfoundation", "-framerate", "30", "-i", "0"}
+    default:
+        return nil, fmt.Errorf("set media.video_capture in the config file to record video on %s", runtime.GOOS)
+    }
+    args := append([]string{"ffmpeg", "-loglevel", "error"}, input...)
+    if m.videoMimeType() == webrtc.MimeTypeH264 {
+        return append(args, "-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-profile:v", "baseline", "-r", "30", "-f", "h264", "-"), nil
+    }
+    return append(args, "-c:v", "libvpx", "-deadline", "realtime", "-b:v", "1M", "-f", "ivf", "-"), nil
+}
+
+func (m MediaConfig) videoPlaybackCommand() []string {
+    if len(m.VideoPlayback) > 0 {
+        return m.VideoPlayback
+    }
+    return []string{"ffplay", "-loglevel", "error", "-autoexit", "-i", "-"}
+}
+
+func (m MediaConfig) videoMimeType() string {
+    if strings.EqualFold(m.VideoCodec, "h264") {
+        return webrtc.MimeTypeH264
+    }
+    return webrtc.MimeTypeVP8
+}
+
+// sampleSource yields encoded samples parsed from a capture process.
+type sampleSource interface {
+    NextSample() (media.Sample, error)
+}
+
+type oggSource struct {
+    reader      *oggreader.OggReader
+    lastGranule uint64
+}
+
+func (s *oggSource) NextSample() (media.Sample, error) {
+    page, header, err := s.reader.ParseNextPage()
+    if err != nil {
+        return media.Sample{}, err
+    }
+    // Opus granule positions count 48kHz samples
+    samples := header.GranulePosition - s.lastGranule
+    s.lastGranule = header.GranulePosition
+    return media.Sample{Data: page, Duration: time.Duration(samples) * time.Second / 48000}, nil
+}
+
+type ivfSource struct {
+    reader        *ivfreader.IVFReader
+    header        *ivfreader.IVFFileHeader
+    lastTimestamp uint64
+}
+
+func (s *ivfSource) NextSample() (media.Sample, error) {
+    frame, header, err := s.reader.ParseNextFrame()
+    if err != nil {
+        return media.Sample{}, err
+    }
+    ticks := header.Timestamp - s.lastTimestamp
+    s.lastTimestamp = header.Timestamp
+    duration := time.Duration(ticks) * time.Second * time.Duration(s.header.TimebaseNumerator) / time.Duration(s.header.TimebaseDenominator)
+    return media.Sample{Data: frame, Duration: duration}, nil
+}
+
+type h264Source struct {
+    reader *h264reader.H264Reader
+}
+
+func (s *h264Source) NextSample() (media.Sample, error) {
+    nal, err := s.reader.NextNAL()
+    if err != nil {
+        return media.Sample{}, err
+    }
+    return media.Sample{Data: nal.Data, Duration: h264FrameDuration}, nil
+}
+
+func newSampleSource(mimeType string, r io.Reader) (sampleSource, error) {
+    switch mimeType {
+    case webrtc.MimeTypeOpus:
+        reader, _, err := oggreader.NewWith(r)
+        if err != nil {
+            return nil, err
+        }
+        return &oggSource{reader: reader}, nil
+    case webrtc.MimeTypeVP8:
+        reader, header, err := ivfreader.NewWith(r)
+        if err != nil {
+            return nil, err
+        }
+        return &ivfSource{reader: reader, header: header}, nil
+    case webrtc.MimeTypeH264:
+        reader, err := h264reader.NewReader(r)
+        if err != nil {
+            return nil, err
+        }
+        return &h264Source{reader: reader}, nil
+    }
+    return nil, fmt.Errorf("unsupported codec %s", mimeType)
+}
+
+// rtpSink writes the peer's RTP packets out as a media file or stream.
+type rtpSink interface {
+    WriteRTP(packet *rtp.Packet) error
+    Close() error
+}
+
+func newRTPSink(codec webrtc.RTPCodecParameters, w io.Writer) (rtpSink, error) {
+    switch strings.ToLower(codec.MimeType) {
+    case strings.ToLower(webrtc.MimeTypeOpus):
+        return oggwriter.NewWith(w, codec.ClockRate, codec.Channels)
+    case strings.ToLower(webrtc.MimeTypeVP8):
+        return ivfwriter.NewWith(w)
+    case strings.ToLower(webrtc.MimeTypeH264):
+        return h264writer.NewWith(w), nil
+    }
+    return nil, fmt.Errorf("unsupported codec %s", codec.MimeType)
+}
+
+// outgoingTrack is a local track fed by a capture process.
+type outgoingTrack struct {
+    sender  *webrtc.RTPSender
+    capture *exec.Cmd
+}
+
+func (t *outgoingTrack) stop() {
+    t.capture.Process.Kill()
+    t.capture.Wait()
+}
+
+// Media sends and plays audio and video tracks on the peer connection.
+// Adding or removing a track triggers renegotiation through
+// OnNegotiationNeeded.
+type Media struct {
+    peerConnection *webrtc.PeerConnection
+    config         MediaConfig
+
+    mu    sync.Mutex
+    audio *outgoingTrack
+    video *outgoingTrack
+}
+
+func newMedia(peerConnection *webrtc.PeerConnection, config MediaConfig) *Media {
+    return &Media{peerConnection: peerConnection, config: config}
+}
+
+// StartAudio starts capturing the microphone and sends it to the peer.
+func (m *Media) StartAudio() error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.audio != nil {
+        return errors.New("a call is already in progress")
+    }
+    command, err := m.config.audioCaptureCommand()
+    if err != nil {
+        return err
+    }
+    m.audio, err = m.startTrack(command, webrtc.MimeTypeOpus, "audio")
+    if err != nil {
+        return err
+    }
+    display.SetStatus("call", "active")
+    return nil
+}
+
+// StopAudio ends our side of the call.
+func (m *Media) StopAudio() error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.audio == nil {
+        return errors.New("no call in progress")
+    }
+    err := m.stopTrack(m.audio)
+    m.audio = nil
+    display.SetStatus("call", "")
+    return err
+}
+
+// StartVideo starts capturing the camera and sends it to the peer.
+func (m *Media) StartVideo() error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.video != nil {
+        return errors.New("video is already on")
+    }
+    command, err := m.config.videoCaptureCommand()
+    if err != nil {
+        return err
+    }
+    m.video, err = m.startTrack(command, m.config.videoMimeType(), "video")
+    if err != nil {
+        return err
+    }
+    display.SetStatus("video", "on")
+    return nil
+}
+
+// StopVideo stops sending our camera.
+func (m *Media) StopVideo() error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.video == nil {
+        return errors.New("video is not on")
+    }
+    err := m.stopTrack(m.video)
+    m.video = nil
+    display.SetStatus("video", "")
+    return err
+}
+
+func (m *Media) startTrack(command []string, mimeType, id string) (*outgoingTrack, error) {
+    capture := exec.Command(command[0], command[1:]...)
+    stdout, err := capture.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := capture.Start(); err != nil {
+        return nil, fmt.Errorf("starting %s: %w", command[0], err)
+    }
+
+    track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, id, "webrtc-chat")
+    if err != nil {
+        capture.Process.Kill()
+        return nil, err
+    }
+    sender, err := m.peerConnection.AddTrack(track)
+    if err != nil {
+        capture.Process.Kill()
+        return nil, err
+    }
+    go drainRTCP(sender)
+    go streamSamples(stdout, mimeType, track)
+
+    return &outgoingTrack{sender: sender, capture: capture}, nil
+}
+
+func (m *Media) stopTrack(t *outgoingTrack) error {
+    t.stop()
+    return m.peerConnection.RemoveTrack(t.sender)
+}
+
+// Close stops any capture still running.
+func (m *Media) Close() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for _, t := range []*outgoingTrack{m.audio, m.video} {
+        if t != nil {
+            t.stop()
+        }
+    }
+}
+
+// RecordVoice records d of microphone audio into the Ogg file at path.
+func (m *Media) RecordVoice(path string, d time.Duration) error {
+    command, err := m.config.audioCaptureCommand()
+    if err != nil {
+        return err
+    }
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    capture := exec.Command(command[0], command[1:]...)
+    capture.Stdout = file
+    if err := capture.Start(); err != nil {
+        return fmt.Errorf("starting %s: %w", command[0], err)
+    }
+    timer := time.AfterFunc(d, func() {
+        // Interrupt rather than kill so ffmpeg finishes the last Ogg page;
+        // Windows can't deliver an interrupt, so fall back to killing
+        if err := capture.Process.Signal(os.Interrupt); err != nil {
+            capture.Process.Kill()
+        }
+    })
+    defer timer.Stop()
+    capture.Wait()
+
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+    if info.Size() == 0 {
+        return fmt.Errorf("%s recorded nothing", command[0])
+    }
+    return nil
+}
+
+// PlayFile plays an Ogg/Opus file with the audio playback command.
+func (m *Media) PlayFile(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    command := m.config.audioPlaybackCommand()
+    player := exec.Command(command[0], command[1:]...)
+    player.Stdin = file
+    if err := player.Start(); err != nil {
+        file.Close()
+        return fmt.Errorf("starting %s: %w", command[0], err)
+    }
+    go func() {
+        player.Wait()
+        file.Close()
+    }()
+    return nil
+}
+
+// handleTrack plays (or, for video, optionally records) the peer's track
+// until it ends.
+func (m *Media) handleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+    kind := track.Kind().String()
+    log.Printf("New track: %s %s\n", kind, track.Codec().MimeType)
+
+    var out io.WriteCloser
+    var wait func()
+    if track.Kind() == webrtc.RTPCodecTypeVideo && m.config.VideoRecord != "" {
+        file, path, err := createUniqueFile(filepath.Dir(m.config.VideoRecord), filepath.Base(m.config.VideoRecord))
+        if err != nil {
+            display.Printf("[video] can't record: %v\n", err)
+            return
+        }
+        display.Printf("[video] recording peer video to %s\n", path)
+        out, wait = file, func() {}
+    } else {
+        command := m.config.audioPlaybackCommand()
+        if track.Kind() == webrtc.RTPCodecTypeVideo {
+            command = m.config.videoPlaybackCommand()
+        }
+        player := exec.Command(command[0], command[1:]...)
+        stdin, err := player.StdinPipe()
+        if err != nil {
+            log.Println("メディア再生エラー: ", err)
+            return
+        }
+        if err := player.Start(); err != nil {
+            display.Printf("[%s] can't play: starting %s: %v\n", kind, command[0], err)
+            return
+        }
+        display.Printf("[%s] receiving %s from peer\n", kind, kind)
+        out, wait = stdin, func() { player.Wait() }
+    }
+    defer func() {
+        out.Close()
+        wait()
+    }()
+
+    sink, err := newRTPSink(track.Codec(), out)
+    if err != nil {
+        log.Println("メディア再生エラー: ", err)
+        return
+    }
+    defer sink.Close()
+    for {
+        packet, _, err := track.ReadRTP()
+        if err != nil {
+            display.Printf("[%s] peer %s ended\n", kind, kind)
+            return
+        }
+        if err := sink.WriteRTP(packet); err != nil {
+            log.Println("メディア再生エラー: ", err)
+            return
+        }
+    }
+}
+
+// streamSamples sends each sample parsed from r to track.
+func streamSamples(r io.Reader, mimeType string, track *webrtc.TrackLocalStaticSample) {
+    source, err := newSampleSource(mimeType, r)
+    if err != nil {
+        log.Println("メディア入力エラー: ", err)
+        return
+    }
+    for {
+        sample, err := source.NextSample()
+        if err != nil {
+            if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+                log.Println("メディア入力エラー: ", err)
+            }
+            return
+        }
+        if err := track.WriteSample(sample); err != nil {
+            log.Println("メディア送信エラー: ", err)
+            return
+        }
+    }
+}
+
+// drainRTCP reads the sender's incoming RTCP so interceptors such as NACK
+// keep working.
+func drainRTCP(sender *webrtc.RTPSender) {
+    buf := make([]byte, 1500)
+    for {
+        if _, _, err := sender.Read(buf); err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "log"
+    "sync"
+)
+
+// Middleware sees every envelope on its way to and from the peer, so
+// features such as compression, logging or filtering can be added without
+// touching Chat's send and receive code. Outbound middleware runs in the
+// order it was registered and inbound middleware in reverse, so the last
+// one registered is closest to the wire. Returning a nil envelope drops
+// it; returning an error drops it and logs why.
+//
+// Middleware works on envelopes. E2E encryption and fragmentation happen
+// below it, on the encoded frame.
+type Middleware interface {
+    Outbound(env *Envelope) (*Envelope, error)
+    Inbound(env *Envelope) (*Envelope, error)
+}
+
+// pipeline is the ordered middleware of a Chat.
+type pipeline struct {
+    mu          sync.RWMutex
+    middlewares []Middleware
+}
+
+func (p *pipeline) Use(m Middleware) {
+    p.mu.Lock()
+    p.middlewares = append(p.middlewares, m)
+    p.mu.Unlock()
+}
+
+func (p *pipeline) outbound(env *Envelope) (*Envelope, error) {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    for _, m := range p.middlewares {
+        var err error
+        if env, err = m.Outbound(env); env == nil || err != nil {
+            return nil, err
+        }
+    }
+    return env, nil
+}
+
+func (p *pipeline) inbound(env *Envelope) (*Envelope, error) {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    for i := len(p.middlewares) - 1; i >= 0; i-- {
+        var err error
+        if env, err = p.middlewares[i].Inbound(env); env == nil || err != nil {
+            return nil, err
+        }
+    }
+    return env, nil
+}
+
+// loggingMiddleware logs the type and size of every envelope except file
+// chunks, which would flood the log, for -log.
+type loggingMiddleware struct{}
+
+func (loggingMiddleware) Outbound(env *Envelope) (*Envelope, error) {
+    if env.Type != envelopeFile {
+        log.Printf("-> %s %s (%d bytes%s)\n", env.Type, env.ID, len(env.Payload), compressionNote(env))
+    }
+    return env, nil
+}
+
+func (loggingMiddleware) Inbound(env *Envelope) (*Envelope, error) {
+    if env.Type != envelopeFile {
+        log.Printf("<- %s %s (%d bytes%s)\n", env.Type, env.ID, len(env.Payload), compressionNote(env))
+    }
+    return env, nil
+}
+
+func compressionNote(env *Envelope) string {
+    if env.Compression == "" {
+        return ""
+    }
+    return ", " + env.Compression
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// MessagePack is a third wire form for envelopes, next to JSON and
+// protobuf, for peers that list featureMsgpack in their join message. It
+// can also carry signaling messages, if the server accepts the
+// msgpackSubprotocol when the WebSocket connects.
+const (
+    featureMsgpack     = "msgpack"
+    msgpackSubprotocol = "webrtc-chat.msgpack"
+)
+
+// Wire formats for wire_format. Envelopes go out in the preferred format
+// when the peer supports it and as JSON otherwise.
+const (
+    wireFormatProtobuf = "protobuf"
+    wireFormatMsgpack  = "msgpack"
+    wireFormatJSON     = "json"
+)
+
+var wireFormats = []string{wireFormatProtobuf, wireFormatMsgpack, wireFormatJSON}
+
+// wireFormat is the preferred envelope wire format.
+var wireFormat = wireFormatProtobuf
+
+var errMalformedSignaling = errors.New("malformed signaling message")
+
+// isMsgpackEnvelope reports whether data starts with a MessagePack map,
+// which neither JSON envelopes (a zero byte) nor protobuf ones (a tag
+// below 0x80) do.
+func isMsgpackEnvelope(data []byte) bool {
+    return len(data) > 0 && (data[0]&0xf0 == 0x80 || data[0] == 0xde || data[0] == 0xdf)
+}
+
+func encodeEnvelopeMsgpack(e *Envelope) ([]byte, error) {
+    return msgpack.Marshal(e)
+}
+
+func decodeEnvelopeMsgpack(data []byte) (*Envelope, error) {
+    var e Envelope
+    if err := msgpack.Unmarshal(data, &e); err != nil {
+        return nil, err
+    }
+    if e.ID == "" || e.Type == "" {
+        return nil, errors.New("envelope: missing id or type")
+    }
+    return &e, nil
+}
+
+// jsonToMsgpack re-encodes v's JSON form as MessagePack, so signaling
+// messages keep the exact field names and shapes a JSON server sees.
+func jsonToMsgpack(v interface{}) ([]byte, error) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    var value interface{}
+    if err := decoder.Decode(&value); err != nil {
+        return nil, err
+    }
+    return msgpack.Marshal(jsonNumbers(value))
+}
+
+// jsonNumbers turns json.Numbers into integers where they fit, so they
+// aren't sent as floats or strings.
+func jsonNumbers(value interface{}) interface{} {
+    switch v := value.(type) {
+    case json.Number:
+        if n, err := v.Int64(); err == nil {
+            return n
+        }
+        f, _ := v.Float64()
+        return f
+    case map[string]interface{}:
+        for key, item := range v {
+            v[key] = jsonNumbers(item)
+        }
+    case []interface{}:
+        for i, item := range v {
+            v[i] = jsonNumbers(item)
+        }
+    }
+    return value
+}
+
+// msgpackToJSON decodes a MessagePack signaling message into v by way of
+// JSON, so v's JSON decoding rules apply as they would to a JSON message.
+func msgpackToJSON(data []byte, v interface{}) error {
+    var value interface{}
+    if err := msgpack.Unmarshal(data, &value); err != nil {
+        return fmt.Errorf("%w: %v", errMalformedSignaling, err)
+    }
+    data, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Errorf("%w: %v", errMalformedSignaling, err)
+    }
+    return json.Unmarshal(data, v)
+}
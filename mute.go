@@ -0,0 +1,98 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// heldMessage is a peer message that arrived while muted.
+type heldMessage struct {
+    sender, senderID, id string
+    data                 []byte
+    isString             bool
+    sentAt               time.Time
+}
+
+// muteDisplay wraps a Display for /mute: while muted the peer's messages
+// are held back instead of shown and alerts are dropped. Notices, progress
+// and status still go through, so a running transfer stays visible.
+type muteDisplay struct {
+    Display
+
+    mu    sync.Mutex
+    muted bool
+    timer *time.Timer // ends a timed mute, nil otherwise
+    held  []heldMessage
+}
+
+func newMuteDisplay(d Display) *muteDisplay {
+    return &muteDisplay{Display: d}
+}
+
+func (m *muteDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    m.mu.Lock()
+    if !m.muted {
+        m.mu.Unlock()
+        m.Display.PrintMessage(sender, senderID, id, data, isString, sentAt)
+        return
+    }
+    m.held = append(m.held, heldMessage{sender, senderID, id, data, isString, sentAt})
+    count := len(m.held)
+    m.mu.Unlock()
+    m.Display.SetStatus("muted", fmt.Sprintf("%d new", count))
+}
+
+func (m *muteDisplay) Alert(visual bool) {
+    m.mu.Lock()
+    muted := m.muted
+    m.mu.Unlock()
+    if !muted {
+        m.Display.Alert(visual)
+    }
+}
+
+// Mute holds back messages until Unmute, or for d if it is positive.
+func (m *muteDisplay) Mute(d time.Duration) {
+    m.mu.Lock()
+    m.muted = true
+    if m.timer != nil {
+        m.timer.Stop()
+        m.timer = nil
+    }
+    if d > 0 {
+        m.timer = time.AfterFunc(d, func() { m.Unmute() })
+    }
+    count := len(m.held)
+    m.mu.Unlock()
+    m.Display.SetStatus("muted", fmt.Sprintf("%d new", count))
+}
+
+// Unmute shows the messages held while muted. It reports false if the
+// display wasn't muted.
+func (m *muteDisplay) Unmute() bool {
+    m.mu.Lock()
+    if !m.muted {
+        m.mu.Unlock()
+        return false
+    }
+    m.muted = false
+    if m.timer != nil {
+        m.timer.Stop()
+        m.timer = nil
+    }
+    held := m.held
+    m.held = nil
+    m.mu.Unlock()
+
+    m.Display.SetStatus("muted", "")
+    if len(held) == 0 {
+        m.Display.Printf("[mute] unmuted, no new messages\n")
+        return true
+    }
+    m.Display.Printf("[mute] unmuted, %d message(s) while muted:\n", len(held))
+    for _, msg := range held {
+        m.Display.PrintMessage(msg.sender, msg.senderID, msg.id, msg.data, msg.isString, msg.sentAt)
+    }
+    return true
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/pion/stun"
+)
+
+// The NAT check follows RFC 5780: the mapping behaviour is found by asking
+// two STUN servers what address they see for the same local socket, and the
+// filtering behaviour by asking a server that supports CHANGE-REQUEST to
+// answer from another address or port. Servers without RFC 5780 support
+// (most public ones) still give the mapping behaviour, which is what decides
+// whether hole punching can work.
+
+var defaultNATCheckServers = []string{
+    "stun:stun.l.google.com:19302",
+    "stun:stun1.l.google.com:19302",
+}
+
+const (
+    stunAttempts = 3
+    stunTimeout  = 500 * time.Millisecond
+
+    changeIP   = 0x04
+    changePort = 0x02
+)
+
+var errNoSTUNResponse = errors.New("no response")
+
+type stunResult struct {
+    mapped *net.UDPAddr
+    other  *net.UDPAddr // RFC 5780 alternate address, nil if unsupported
+}
+
+// runNATCheck prints a report on the local NAT and returns the exit code.
+func runNATCheck(config Config) int {
+    servers := natCheckServers(config)
+    if len(servers) == 0 {
+        fmt.Println("No STUN server to test with: no_stun is set")
+        return 1
+    }
+    conn, err := net.ListenUDP("udp4", nil)
+    if err != nil {
+        fmt.Println("UDP socket error:", err)
+        return 1
+    }
+    defer conn.Close()
+    localPort := conn.LocalAddr().(*net.UDPAddr).Port
+
+    var results []stunResult
+    var other *net.UDPAddr
+    for _, server := range servers {
+        addr, err := resolveSTUNServer(server)
+        if err != nil {
+            fmt.Printf("%-40s %v\n", server, err)
+            continue
+        }
+        result, err := stunBinding(conn, addr, 0)
+        if err != nil {
+            fmt.Printf("%-40s %v\n", server, err)
+            continue
+        }
+        fmt.Printf("%-40s mapped to %s\n", server, result.mapped)
+        results = append(results, result)
+        if other == nil && result.other != nil {
+            other = result.other
+        }
+    }
+    // A single RFC 5780 server can stand in for the second server
+    if len(results) == 1 && other != nil {
+        if result, err := stunBinding(conn, other, 0); err == nil {
+            fmt.Printf("%-40s mapped to %s\n", other.String()+" (alternate)", result.mapped)
+            results = append(results, result)
+        }
+    }
+    fmt.Println()
+
+    if len(results) == 0 {
+        fmt.Println("NAT type:  unknown, no STUN server answered")
+        fmt.Println("UDP looks blocked. A TURN server (preferably over TCP or TLS) is required.")
+        return 1
+    }
+
+    if isLocalAddress(results[0].mapped.IP) && results[0].mapped.Port == localPort {
+        fmt.Println("NAT type:  none (public address)")
+        fmt.Println("Direct connections should work.")
+        return 0
+    }
+
+    if len(results) < 2 {
+        fmt.Println("NAT type:  unknown, need answers from two STUN servers to tell cone from symmetric NAT")
+        return 0
+    }
+    for _, result := range results[1:] {
+        if result.mapped.String() != results[0].mapped.String() {
+            fmt.Println("NAT type:  symmetric (a new mapping for every destination)")
+            fmt.Println("Direct connections only work with peers that have no NAT or a full cone NAT; configure a TURN server.")
+            return 0
+        }
+    }
+
+    if other == nil {
+        fmt.Println("NAT type:  cone (filtering not tested: the STUN servers don't support RFC 5780)")
+        fmt.Println("Direct connections are likely to work, except with peers behind symmetric NATs.")
+        return 0
+    }
+    serverAddr, _ := resolveSTUNServer(servers[0])
+    switch {
+    case stunAnswers(conn, serverAddr, changeIP|changePort):
+        fmt.Println("NAT type:  full cone")
+        fmt.Println("Direct connections should work with almost any peer.")
+    case stunAnswers(conn, serverAddr, changePort):
+        fmt.Println("NAT type:  restricted cone")
+        fmt.Println("Direct connections are likely to work, except with peers behind symmetric NATs.")
+    default:
+        fmt.Println("NAT type:  port restricted cone")
+        fmt.Println("Direct connections are likely to work, except with peers behind symmetric NATs.")
+    }
+    return 0
+}
+
+// natCheckServers returns the stun: URLs from the config, or public
+// defaults when there are none and no_stun isn't set.
+func natCheckServers(config Config) []string {
+    var servers []string
+    for _, server := range config.ICEServers {
+        for _, u := range server.URLs {
+            if strings.HasPrefix(u, "stun:") {
+                servers = append(servers, u)
+            }
+        }
+    }
+    for _, u := range config.STUNServers {
+        if strings.HasPrefix(u, "stun:") {
+            servers = append(servers, u)
+        }
+    }
+    if len(servers) == 0 && !config.NoSTUN {
+        return defaultNATCheckServers
+    }
+    return servers
+}
+
+func resolveSTUNServer(u string) (*net.UDPAddr, error) {
+    hostport := strings.TrimPrefix(u, "stun:")
+    if _, _, err := net.SplitHostPort(hostport); err != nil {
+        hostport = net.JoinHostPort(hostport, "3478")
+    }
+    return net.ResolveUDPAddr("udp4", hostport)
+}
+
+// stunAnswers reports whether server replies to a binding request with the
+// given CHANGE-REQUEST flags.
+func stunAnswers(conn *net.UDPConn, server *net.UDPAddr, change uint32) bool {
+    if server == nil {
+        return false
+    }
+    _, err := stunBinding(conn, server, change)
+    return err == nil
+}
+
+// stunBinding sends a binding request to server from conn, retrying a few
+// times. The reply is matched by transaction ID rather than source address,
+// since CHANGE-REQUEST replies come from elsewhere.
+func stunBinding(conn *net.UDPConn, server *net.UDPAddr, change uint32) (stunResult, error) {
+    setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+    if change != 0 {
+        value := make([]byte, 4)
+        binary.BigEndian.PutUint32(value, change)
+        setters = append(setters, stun.RawAttribute{Type: stun.AttrChangeRequest, Value: value})
+    }
+    request, err := stun.Build(setters...)
+    if err != nil {
+        return stunResult{}, err
+    }
+
+    buf := make([]byte, 1500)
+    for attempt := 0; attempt < stunAttempts; attempt++ {
+        if _, err := conn.WriteToUDP(request.Raw, server); err != nil {
+            return stunResult{}, err
+        }
+        conn.SetReadDeadline(time.Now().Add(stunTimeout))
+        for {
+            n, _, err := conn.ReadFromUDP(buf)
+            if err != nil {
+                break
+            }
+            response := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+            if response.Decode() != nil || response.TransactionID != request.TransactionID {
+                continue
+            }
+            return parseBindingResponse(response)
+        }
+    }
+    return stunResult{}, errNoSTUNResponse
+}
+
+func parseBindingResponse(m *stun.Message) (stunResult, error) {
+    if m.Type != stun.BindingSuccess {
+        return stunResult{}, fmt.Errorf("unexpected STUN response %s", m.Type)
+    }
+
+    var result stunResult
+    var xorAddr stun.XORMappedAddress
+    var mappedAddr stun.MappedAddress
+    if err := xorAddr.GetFrom(m); err == nil {
+        result.mapped = &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}
+    } else if err := mappedAddr.GetFrom(m); err == nil {
+        result.mapped = &net.UDPAddr{IP: mappedAddr.IP, Port: mappedAddr.Port}
+    } else {
+        return stunResult{}, errors.New("response has no mapped address")
+    }
+
+    var otherAddr stun.OtherAddress
+    if err := otherAddr.GetFrom(m); err == nil {
+        result.other = &net.UDPAddr{IP: otherAddr.IP, Port: otherAddr.Port}
+    }
+    return result, nil
+}
+
+func isLocalAddress(ip net.IP) bool {
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return false
+    }
+    for _, addr := range addrs {
+        if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "log"
+    "sync"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// negotiation runs offer/answer exchanges with the "perfect negotiation"
+// pattern, so offers that cross on the wire (both sides told to offer, or
+// both starting a call at once) converge instead of deadlocking. The side
+// with the smaller client ID is polite: on a collision it drops its own
+// offer and answers the peer's. The impolite side ignores the colliding
+// offer and waits for the answer to its own.
+//
+// pion v3 can't roll back a local offer, so the polite side only applies
+// its offer once the answer arrives; dropping it is then just forgetting
+// it. ICE gathering for that offer starts a little later as a result.
+type negotiation struct {
+    clientID string
+    local    *candidateQueue // our candidates, held while a description is made
+
+    // mu serializes description changes, so a collision always shows up as
+    // a pending offer or a non-stable signaling state
+    mu           sync.Mutex
+    pendingOffer *webrtc.SessionDescription // polite side: sent, not applied
+    candidates   []webrtc.ICECandidateInit  // remote candidates waiting for a remote description
+}
+
+func newNegotiation(clientID string, local *candidateQueue) *negotiation {
+    return &negotiation{clientID: clientID, local: local}
+}
+
+func (n *negotiation) polite(peerID string) bool {
+    return n.clientID < peerID
+}
+
+// Offer creates an offer and sends it to targetID.
+func (n *negotiation) Offer(conn Signaler, peerConnection *webrtc.PeerConnection, targetID string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.offer(conn, peerConnection, targetID, nil)
+}
+
+// Restart sends targetID an offer that restarts ICE. If an earlier offer is
+// still unanswered it is sent again instead: pion can't replace it, and an
+// answer to one offer doesn't fit another.
+func (n *negotiation) Restart(conn Signaler, peerConnection *webrtc.PeerConnection, targetID string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    switch {
+    case n.pendingOffer != nil:
+        sendOffer(conn, *n.pendingOffer, targetID, n.clientID)
+        n.local.Flush(targetID)
+    case peerConnection.SignalingState() == webrtc.SignalingStateHaveLocalOffer:
+        sendOffer(conn, *peerConnection.PendingLocalDescription(), targetID, n.clientID)
+        n.local.Flush(targetID)
+    default:
+        n.offer(conn, peerConnection, targetID, &webrtc.OfferOptions{ICERestart: true})
+    }
+}
+
+// offer makes and sends an offer. The candidates gathered for it wait until
+// it has gone out.
+func (n *negotiation) offer(conn Signaler, peerConnection *webrtc.PeerConnection, targetID string, options *webrtc.OfferOptions) {
+    n.local.Hold()
+    offer := createOffer(peerConnection, options)
+    if n.polite(targetID) {
+        n.pendingOffer = &offer
+    } else {
+        applyOffer(peerConnection, offer)
+    }
+    sendOffer(conn, offer, targetID, n.clientID)
+    n.local.Flush(targetID)
+}
+
+// Answer applies an offer from targetID and answers it. It reports false if
+// the offer collided with ours and was ignored, or couldn't be applied.
+func (n *negotiation) Answer(conn Signaler, peerConnection *webrtc.PeerConnection, targetID string, offerSDP string) bool {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    collision := n.pendingOffer != nil || peerConnection.SignalingState() != webrtc.SignalingStateStable
+    if collision && !n.polite(targetID) {
+        log.Println("Offer collision: ignoring the peer's offer")
+        return false
+    }
+    if collision {
+        log.Println("Offer collision: dropping our offer")
+        n.pendingOffer = nil
+    }
+
+    if err := handleOffer(peerConnection, offerSDP); err != nil {
+        log.Println("Offer設定エラー: ", err)
+        return false
+    }
+    n.applyCandidates(peerConnection)
+    n.local.Hold()
+    sendAnswer(conn, peerConnection, targetID, n.clientID)
+    n.local.Flush(targetID)
+    return true
+}
+
+// HandleAnswer applies the peer's answer to our offer.
+func (n *negotiation) HandleAnswer(peerConnection *webrtc.PeerConnection, answerSDP string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    if n.pendingOffer == nil && peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+        // An offer sent again while reconnecting can be answered twice
+        log.Println("Ignoring answer: no offer outstanding")
+        return
+    }
+    if n.pendingOffer != nil {
+        applyOffer(peerConnection, *n.pendingOffer)
+        n.pendingOffer = nil
+    }
+    if err := handleAnswer(peerConnection, answerSDP); err != nil {
+        log.Println("Answer設定エラー: ", err)
+        return
+    }
+    n.applyCandidates(peerConnection)
+}
+
+// HandleCandidate adds a remote candidate. After a collision the peer's
+// candidates can arrive before the description they go with, so they wait
+// for it.
+func (n *negotiation) HandleCandidate(peerConnection *webrtc.PeerConnection, candidate webrtc.ICECandidateInit) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    if peerConnection.RemoteDescription() == nil {
+        n.candidates = append(n.candidates, candidate)
+        return
+    }
+    addICECandidate(peerConnection, candidate)
+}
+
+func (n *negotiation) applyCandidates(peerConnection *webrtc.PeerConnection) {
+    for _, candidate := range n.candidates {
+        addICECandidate(peerConnection, candidate)
+    }
+    n.candidates = nil
+}
+
+func addICECandidate(peerConnection *webrtc.PeerConnection, candidate webrtc.ICECandidateInit) {
+    candidate.Candidate = rankCandidate(candidate.Candidate)
+    err := peerConnection.AddICECandidate(candidate)
+    if err != nil {
+        // One bad candidate from the peer shouldn't end the session
+        log.Println("ICE candidate追加エラー: ", err)
+        return
+    }
+    log.Println("ICE candidateを追加しました")
+}
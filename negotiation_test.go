@@ -0,0 +1,162 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+type testPeer struct {
+    *conversation
+    id   string
+    conn *fakeSignaler
+}
+
+// newHandshakePair starts the signaling loops of two peers, a and b, talking
+// through an in-memory signaler. Nothing is offered until the "server"
+// pairs them.
+func newHandshakePair(t *testing.T) (a, b *testPeer) {
+    connA, connB := newFakeSignalerPair()
+    newPeer := func(id string, conn *fakeSignaler) *testPeer {
+        peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { peerConnection.Close() })
+        if _, err := peerConnection.CreateDataChannel("chat", nil); err != nil {
+            t.Fatal(err)
+        }
+        peer := &testPeer{conversation: newConversation(conn, id, peerConnection), id: id, conn: conn}
+        go handleSignalingMessages(peer.conversation)
+        return peer
+    }
+    return newPeer("a-id", connA), newPeer("b-id", connB)
+}
+
+// tellToOffer delivers the server's pairing response telling from to call
+// to.
+func tellToOffer(from, to *testPeer) {
+    from.conn.inject(SignalingMessage{Type: "signaling_response", Request: "offer", TargetID: to.id})
+}
+
+func negotiated(peers ...*testPeer) func() bool {
+    return func() bool {
+        for _, peer := range peers {
+            if peer.peerConnection.RemoteDescription() == nil || peer.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+                return false
+            }
+        }
+        return true
+    }
+}
+
+func TestHandshakeOfferAnswer(t *testing.T) {
+    useFakeDisplay(t)
+    a, b := newHandshakePair(t)
+
+    tellToOffer(a, b)
+    eventually(t, "offer and answer", negotiated(a, b))
+    if a.target() != b.id || b.target() != a.id {
+        t.Errorf("targets are %q and %q", a.target(), b.target())
+    }
+    if a.peerConnection.LocalDescription().Type != webrtc.SDPTypeOffer {
+        t.Error("a didn't offer")
+    }
+}
+
+// Both told to offer at once, the polite side (the smaller ID) gives way and
+// the exchange still completes.
+func TestHandshakeOfferCollision(t *testing.T) {
+    useFakeDisplay(t)
+    a, b := newHandshakePair(t)
+
+    tellToOffer(a, b)
+    tellToOffer(b, a)
+    eventually(t, "offer and answer", negotiated(a, b))
+    if b.peerConnection.LocalDescription().Type != webrtc.SDPTypeOffer {
+        t.Error("the impolite side's offer didn't win")
+    }
+}
+
+// An offer in a protocol version we don't speak is refused, not answered.
+func TestHandshakeRejectsUnsupportedVersion(t *testing.T) {
+    shown := useFakeDisplay(t)
+    _, b := newHandshakePair(t)
+
+    b.conn.inject(SignalingMessage{Type: "offer", ID: "a-id", TargetID: b.id, Offer: "v=0", Version: signalingVersion + 1})
+    eventually(t, "the refusal", func() bool { return shown.HasNotice("can't speak") })
+    if b.peerConnection.RemoteDescription() != nil {
+        t.Error("the offer was applied")
+    }
+}
+
+// A candidate pion can't parse is dropped; the session carries on.
+func TestHandshakeSurvivesBadCandidate(t *testing.T) {
+    shown := useFakeDisplay(t)
+    a, b := newHandshakePair(t)
+
+    tellToOffer(a, b)
+    eventually(t, "offer and answer", negotiated(a, b))
+    b.conn.inject(SignalingMessage{Type: "candidate", ID: a.id, TargetID: b.id, Candidate: candidateField{Candidate: "candidate:garbage"}})
+    b.conn.inject(SignalingMessage{Type: "peer_list", Peers: []string{a.id, b.id}})
+    eventually(t, "the next message", func() bool { return shown.HasNotice("peer(s) online") })
+}
+
+// slowOffers holds offers up on their way out, as a busy server might, so
+// candidates gathered meanwhile could overtake them.
+type slowOffers struct {
+    Signaler
+}
+
+func (s slowOffers) WriteJSON(v interface{}) error {
+    if _, ok := v.(OfferMessage); ok {
+        time.Sleep(300 * time.Millisecond)
+    }
+    return s.Signaler.WriteJSON(v)
+}
+
+func TestRestartSendsCandidatesAfterTheOffer(t *testing.T) {
+    newPeerConnection := func() *webrtc.PeerConnection {
+        peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { peerConnection.Close() })
+        return peerConnection
+    }
+    ours, theirs := newPeerConnection(), newPeerConnection()
+    if _, err := ours.CreateDataChannel("chat", nil); err != nil {
+        t.Fatal(err)
+    }
+    // The first exchange is over, its candidates gathered
+    offer, _ := ours.CreateOffer(nil)
+    gathered := webrtc.GatheringCompletePromise(ours)
+    ours.SetLocalDescription(offer)
+    theirs.SetRemoteDescription(offer)
+    answer, _ := theirs.CreateAnswer(nil)
+    theirs.SetLocalDescription(answer)
+    if err := ours.SetRemoteDescription(answer); err != nil {
+        t.Fatal(err)
+    }
+    <-gathered
+
+    fake, server := newFakeSignalerPair()
+    conn := slowOffers{fake}
+    candidates := newCandidateQueue(conn, "z-id")
+    candidates.Flush("a-id")
+    ours.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+        if candidate != nil {
+            candidates.Add(candidate)
+        }
+    })
+
+    newNegotiation("z-id", candidates).Restart(conn, ours, "a-id")
+    var message SignalingMessage
+    if err := server.ReadJSON(&message); err != nil {
+        t.Fatal(err)
+    }
+    if message.Type != "offer" {
+        t.Errorf("a %s went out before the restart offer", message.Type)
+    }
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "log"
+    "sync/atomic"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// ownNameValue holds our display name: config.Name at startup, then
+// whatever /nick set. Mentions of it are highlighted and conversations
+// started later join with it.
+var ownNameValue atomic.Value
+
+func setOwnName(name string) {
+    ownNameValue.Store(name)
+}
+
+func ownName() string {
+    name, _ := ownNameValue.Load().(string)
+    return name
+}
+
+// SetName changes the name we go by and tells the peer, if they are
+// connected. Messages recorded from now on carry the new name.
+func (c *Chat) SetName(name string) error {
+    c.mu.Lock()
+    c.name = name
+    c.mu.Unlock()
+    if c.controlChannel.ReadyState() != webrtc.DataChannelStateOpen {
+        return nil
+    }
+    m := newControlMessage(controlNick, c.clientID)
+    m.Name = name
+    return c.sendControl(m)
+}
+
+// handleNick takes the peer's new name.
+func (c *Chat) handleNick(m *ControlMessage) {
+    c.mu.Lock()
+    old := c.peerName
+    c.peerName = m.Name
+    c.mu.Unlock()
+    c.display.Printf("* %s is now known as %s\n", displayName(old), displayName(m.Name))
+    c.display.SetStatus("peer name", displayName(c.PeerName()))
+    if c.onPeerRenamed != nil {
+        c.onPeerRenamed(m.Name)
+    }
+    log.Printf("Peer %s renamed to %q\n", m.From, m.Name)
+}
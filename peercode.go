@@ -0,0 +1,115 @@
+package main
+
+import (
+    "crypto/sha256"
+    "fmt"
+    "strings"
+    "sync"
+)
+
+// Client IDs are UUIDs, which are painful to read out over the phone. Each
+// ID also has a peer code of three words picked by its hash, like
+// tiger-maple-seven, which is shown next to it and accepted wherever a peer
+// ID is. A code can't be turned back into an ID, so it is matched against
+// the IDs this client knows: its contacts and the peers /peers listed.
+const peerCodeWords = 3
+
+// peerCodeWordList has 256 words, so each word is one byte of the hash.
+var peerCodeWordList = [256]string{
+    "acid", "acorn", "actor", "agent", "alarm", "album", "alpha", "amber", "anchor", "angel",
+    "apple", "april", "arrow", "atlas", "autumn", "bacon", "badge", "baker", "bamboo", "banjo",
+    "barrel", "basil", "beach", "beaver", "berry", "bingo", "bison", "blade", "blanket", "bloom",
+    "board", "bonus", "boot", "bottle", "brain", "brave", "bread", "brick", "bridge", "brook",
+    "brush", "bucket", "buddy", "buffalo", "cabin", "cactus", "camel", "candle", "canoe", "canyon",
+    "carbon", "carpet", "castle", "cedar", "chalk", "cherry", "chess", "cider", "cinema", "circus",
+    "clover", "cobra", "coconut", "comet", "copper", "coral", "cotton", "crane", "crystal", "dancer",
+    "delta", "desert", "diesel", "dingo", "doctor", "dolphin", "donkey", "dragon", "dream", "eagle",
+    "echo", "eight", "elbow", "ember", "engine", "falcon", "fancy", "feather", "fiddle", "fifty",
+    "flame", "flute", "forest", "fossil", "fox", "frost", "galaxy", "garden", "garlic", "gecko",
+    "ginger", "glacier", "globe", "goose", "grape", "gravel", "guitar", "hammer", "harbor", "hazel",
+    "helmet", "honey", "hotel", "husky", "igloo", "indigo", "iron", "island", "ivory", "jacket",
+    "jaguar", "jelly", "jungle", "kettle", "kiwi", "koala", "ladder", "lagoon", "lemon", "lentil",
+    "letter", "lily", "lion", "lizard", "lobster", "lotus", "magnet", "mango", "maple", "marble",
+    "meadow", "melon", "metal", "mint", "mirror", "monkey", "moose", "mosaic", "motor", "mountain",
+    "muffin", "nectar", "needle", "nickel", "ninja", "noodle", "north", "ocean", "olive", "onion",
+    "orange", "orbit", "otter", "owl", "oyster", "paddle", "panda", "paper", "parrot", "peach",
+    "pebble", "pepper", "piano", "pickle", "pilot", "pine", "pirate", "planet", "plum", "poem",
+    "pony", "potato", "pretzel", "pumpkin", "puzzle", "quartz", "quill", "rabbit", "radar", "radio",
+    "raven", "ribbon", "river", "robin", "rocket", "rose", "ruby", "saddle", "salmon", "sandal",
+    "saturn", "scarf", "seven", "shadow", "shark", "silver", "sketch", "sleigh", "slipper", "snake",
+    "socket", "spider", "spoon", "squid", "stamp", "storm", "sugar", "summer", "sunset", "swan",
+    "table", "tango", "teapot", "temple", "thunder", "tiger", "timber", "toast", "tomato", "topaz",
+    "tower", "tractor", "trumpet", "tulip", "turtle", "twelve", "uncle", "union", "valley", "velvet",
+    "violet", "violin", "volcano", "waffle", "walnut", "walrus", "wagon", "water", "whale", "willow",
+    "window", "winter", "wizard", "wolf", "yogurt", "zebra",
+}
+
+// peerCode is the word code for id.
+func peerCode(id string) string {
+    sum := sha256.Sum256([]byte(id))
+    words := make([]string, peerCodeWords)
+    for i := range words {
+        words[i] = peerCodeWordList[sum[i]]
+    }
+    return strings.Join(words, "-")
+}
+
+// isPeerCode reports whether s is shaped like a peer code.
+func isPeerCode(s string) bool {
+    return strings.Count(s, "-") == peerCodeWords-1 && len(s) < 40 && strings.IndexFunc(s, func(r rune) bool {
+        return r != '-' && (r < 'a' || r > 'z')
+    }) < 0
+}
+
+// listedPeers are the peers the signaling server listed for /peers, kept
+// so their codes can be resolved.
+var listedPeers struct {
+    mu  sync.Mutex
+    ids map[string]bool
+}
+
+func rememberListedPeers(ids []string) {
+    listedPeers.mu.Lock()
+    defer listedPeers.mu.Unlock()
+    if listedPeers.ids == nil {
+        listedPeers.ids = map[string]bool{}
+    }
+    for _, id := range ids {
+        listedPeers.ids[id] = true
+    }
+}
+
+// resolvePeer turns an alias or a peer code into a peer ID; anything else
+// is taken to be an ID already.
+func resolvePeer(arg string) (string, error) {
+    id := contacts.Resolve(arg)
+    if id != arg || !isPeerCode(strings.ToLower(arg)) {
+        return id, nil
+    }
+    code := strings.ToLower(arg)
+    candidates := map[string]bool{}
+    if contacts != nil {
+        for _, contact := range contacts.List() {
+            candidates[contact.ID] = true
+        }
+    }
+    listedPeers.mu.Lock()
+    for id := range listedPeers.ids {
+        candidates[id] = true
+    }
+    listedPeers.mu.Unlock()
+
+    var matches []string
+    for id := range candidates {
+        if peerCode(id) == code {
+            matches = append(matches, id)
+        }
+    }
+    switch len(matches) {
+    case 0:
+        return "", fmt.Errorf("no known peer has the code %s; list them with /peers first", code)
+    case 1:
+        return matches[0], nil
+    }
+    return "", fmt.Errorf("%d peers have the code %s; use the ID instead", len(matches), code)
+}
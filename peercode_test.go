@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestPeerCode(t *testing.T) {
+    code := peerCode("3551430c-6a61-597b-afa3-514bd1d1bdd8")
+    if code != peerCode("3551430c-6a61-597b-afa3-514bd1d1bdd8") {
+        t.Error("the code isn't stable")
+    }
+    if !isPeerCode(code) {
+        t.Errorf("%q isn't taken for a code", code)
+    }
+    for _, s := range []string{"3551430c-6a61-597b-afa3-514bd1d1bdd8", "alice", "tiger-maple", "Tiger-maple-seven"} {
+        if isPeerCode(s) {
+            t.Errorf("%q is taken for a code", s)
+        }
+    }
+}
+
+func TestResolvePeer(t *testing.T) {
+    t.Cleanup(func() { listedPeers.ids = nil })
+    rememberListedPeers([]string{"alice-id", "bob-id"})
+
+    id, err := resolvePeer(peerCode("bob-id"))
+    if err != nil || id != "bob-id" {
+        t.Errorf("got %q, %v", id, err)
+    }
+    if _, err := resolvePeer(peerCode("carol-id")); err == nil {
+        t.Error("an unknown code was resolved")
+    }
+    if id, err := resolvePeer("dave-id"); err != nil || id != "dave-id" {
+        t.Errorf("an ID wasn't passed through: %q, %v", id, err)
+    }
+}
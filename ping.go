@@ -0,0 +1,105 @@
+package main
+
+import (
+    "errors"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+const pingTimeout = 10 * time.Second
+
+var errPingTimeout = errors.New("no reply from peer")
+
+// Pinger measures the application-level round-trip time to the peer: the
+// time for a ping to cross the control channel and the pong to come back,
+// including everything the peer's client does in between.
+type Pinger struct {
+    send func(*ControlMessage) error
+    from string
+
+    mu      sync.Mutex
+    pending map[string]chan time.Time
+}
+
+func newPinger(from string, send func(*ControlMessage) error) *Pinger {
+    return &Pinger{
+        send:    send,
+        from:    from,
+        pending: map[string]chan time.Time{},
+    }
+}
+
+// Ping sends a ping and waits for its pong.
+func (p *Pinger) Ping() (time.Duration, error) {
+    ping := newControlMessage(controlPing, p.from)
+    ping.ID = uuid.New().String()
+    reply := make(chan time.Time, 1)
+
+    p.mu.Lock()
+    p.pending[ping.ID] = reply
+    p.mu.Unlock()
+    defer func() {
+        p.mu.Lock()
+        delete(p.pending, ping.ID)
+        p.mu.Unlock()
+    }()
+
+    start := time.Now()
+    if err := p.send(ping); err != nil {
+        return 0, err
+    }
+    select {
+    case received := <-reply:
+        return received.Sub(start), nil
+    case <-time.After(pingTimeout):
+        return 0, errPingTimeout
+    }
+}
+
+// handlePing answers a ping from the peer.
+func (p *Pinger) handlePing(ping *ControlMessage) {
+    pong := newControlMessage(controlPong, p.from)
+    pong.ID = ping.ID
+    if err := p.send(pong); err != nil {
+        log.Println("Pong送信エラー: ", err)
+    }
+}
+
+// handlePong hands a pong to the Ping waiting for it. Late pongs are dropped.
+func (p *Pinger) handlePong(pong *ControlMessage) {
+    now := time.Now()
+    p.mu.Lock()
+    reply, ok := p.pending[pong.ID]
+    p.mu.Unlock()
+    if ok {
+        reply <- now
+    }
+}
+
+// Run pings every interval until stop is closed, showing each round-trip
+// time in the status.
+func (p *Pinger) Run(interval time.Duration, stop <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+        rtt, err := p.Ping()
+        if err != nil {
+            log.Println("Pingエラー: ", err)
+            display.SetStatus("rtt", "timeout")
+            continue
+        }
+        display.SetStatus("rtt", formatRTT(rtt))
+    }
+}
+
+func formatRTT(rtt time.Duration) string {
+    return rtt.Round(100 * time.Microsecond).String()
+}
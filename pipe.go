@@ -0,0 +1,76 @@
+package main
+
+import (
+    "io"
+    "log"
+    "sync"
+)
+
+// pipeChunkSize keeps every pipe chunk below maxFrameSize, so chunks go out
+// as single data channel messages.
+const pipeChunkSize = 16 * 1024
+
+// pipeStream is -pipe mode: stdin is streamed to the peer as raw data
+// channel messages and everything the peer sends is written verbatim to
+// stdout, with no envelopes, lines or commands in between. Like nc, the end
+// of stdin half-closes the stream with an empty message, and the end of
+// the peer's stream (or the peer going away) finishes the session.
+type pipeStream struct {
+    in   io.Reader
+    out  io.Writer
+    done chan struct{}
+    once sync.Once
+}
+
+func newPipeStream(in io.Reader, out io.Writer) *pipeStream {
+    return &pipeStream{in: in, out: out, done: make(chan struct{})}
+}
+
+// Done is closed once the peer's stream has ended.
+func (p *pipeStream) Done() <-chan struct{} {
+    return p.done
+}
+
+func (p *pipeStream) finish() {
+    p.once.Do(func() { close(p.done) })
+}
+
+// run sends stdin until it ends, then sends the empty end-of-stream message.
+func (p *pipeStream) run(send func(data []byte) error) {
+    buf := make([]byte, pipeChunkSize)
+    for {
+        n, err := p.in.Read(buf)
+        if n > 0 {
+            if err := send(buf[:n]); err != nil {
+                log.Println("パイプ送信エラー: ", err)
+                p.finish()
+                return
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            log.Println("stdin read error: ", err)
+            break
+        }
+    }
+    log.Println("Reached end of stdin, closing our side of the pipe")
+    if err := send([]byte{}); err != nil {
+        log.Println("パイプ送信エラー: ", err)
+    }
+}
+
+// receive writes a chunk from the peer to stdout.
+func (p *pipeStream) receive(data []byte) {
+    if len(data) == 0 {
+        log.Println("Peer closed its side of the pipe")
+        p.finish()
+        return
+    }
+    if _, err := p.out.Write(data); err != nil {
+        // Usually the reader went away, as with "| head"
+        log.Println("stdout write error: ", err)
+        p.finish()
+    }
+}
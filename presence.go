@@ -0,0 +1,73 @@
+package main
+
+import (
+    "fmt"
+    "time"
+)
+
+// The signaling server keeps track of which registered IDs are connected
+// and when each was last seen. A client asks about one with
+//
+//	client -> server  {"type":"presence","id":<self>,"target_id":<peer>}
+//	server -> client  {"type":"presence","presence":[{"id":<peer>,"online":false,"last_seen":<unix ms>}]}
+//
+// and a peer_list reply may carry the same entries for IDs that have gone
+// offline, next to the online ones in peers. last_seen is 0 for an ID the
+// server has never seen. Servers without presence answer with an "error"
+// message or not at all; --lan answers from the announcements it has heard.
+
+// PeerPresence is what the server knows about whether a peer is around.
+type PeerPresence struct {
+    ID       string `json:"id"`
+    Online   bool   `json:"online"`
+    LastSeen int64  `json:"last_seen,omitempty"` // unix milliseconds
+}
+
+func requestPresence(conn Signaler, clientID string, targetID string) error {
+    return conn.WriteJSON(SignalingMessage{
+        Type:     "presence",
+        ID:       clientID,
+        TargetID: targetID,
+    })
+}
+
+func printPresence(presence []PeerPresence) {
+    now := time.Now()
+    for _, p := range presence {
+        display.Printf("[presence] %s  %s  %s\n", contacts.Label(p.ID), peerCode(p.ID), formatPresence(p, now))
+    }
+}
+
+// formatPresence describes p for /presence and /peers.
+func formatPresence(p PeerPresence, now time.Time) string {
+    switch {
+    case p.Online:
+        return "online"
+    case p.LastSeen == 0:
+        return "offline, never seen"
+    }
+    return "offline, last seen " + formatLastSeen(time.UnixMilli(p.LastSeen), now)
+}
+
+func formatLastSeen(seen time.Time, now time.Time) string {
+    ago := now.Sub(seen)
+    switch {
+    case ago < time.Minute:
+        return "just now"
+    case ago < time.Hour:
+        return fmt.Sprintf("%dm ago", int(ago/time.Minute))
+    case ago < 48*time.Hour:
+        return fmt.Sprintf("%dh ago", int(ago/time.Hour))
+    }
+    return "on " + seen.Format("2006-01-02")
+}
+
+// lanPresence answers a presence request from the announcements a --lan
+// client has heard.
+func lanPresence(peers map[string]*lanPeer, id string, now time.Time) PeerPresence {
+    peer, ok := peers[id]
+    if !ok {
+        return PeerPresence{ID: id}
+    }
+    return PeerPresence{ID: id, Online: now.Sub(peer.lastSeen) < lanPeerTimeout, LastSeen: peer.lastSeen.UnixMilli()}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestLANPresence(t *testing.T) {
+    now := time.Now()
+    peers := map[string]*lanPeer{
+        "bob-id":   {lastSeen: now.Add(-time.Second)},
+        "carol-id": {lastSeen: now.Add(-3 * time.Hour)},
+    }
+    for _, tt := range []struct {
+        id   string
+        want string
+    }{
+        {"bob-id", "online"},
+        {"carol-id", "offline, last seen 3h ago"},
+        {"dave-id", "offline, never seen"},
+    } {
+        if got := formatPresence(lanPresence(peers, tt.id, now), now); got != tt.want {
+            t.Errorf("%s: got %q, want %q", tt.id, got, tt.want)
+        }
+    }
+}
+
+func TestFormatLastSeen(t *testing.T) {
+    now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+    for _, tt := range []struct {
+        ago  time.Duration
+        want string
+    }{
+        {10 * time.Second, "just now"},
+        {25 * time.Minute, "25m ago"},
+        {47 * time.Hour, "47h ago"},
+        {72 * time.Hour, "on 2026-10-14"},
+    } {
+        if got := formatLastSeen(now.Add(-tt.ago), now); got != tt.want {
+            t.Errorf("%v ago: got %q, want %q", tt.ago, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+)
+
+// Messages between peers (offer, answer, candidate) carry the version of the
+// signaling protocol they were written in. A peer's offer in a version this
+// client can't speak is refused with a version_mismatch message instead of
+// an answer:
+//
+//	{"type": "version_mismatch", "target_id": "<offerer>", "id": "<us>", "version": 1}
+//
+// and the offerer gives up. Messages without a version come from clients
+// older than versioning, which spoke what is now version 1. Messages from
+// the server itself aren't versioned.
+const (
+    signalingVersion    = 1 // the version this client writes
+    minSignalingVersion = 1 // the oldest version it still understands
+)
+
+// Limits on what a peer can send through the server. Real descriptions are
+// a few kilobytes and candidate lines a couple hundred bytes.
+const (
+    maxSDPLength       = 64 * 1024
+    maxCandidateLength = 1024
+)
+
+// messageVersion is the protocol version a peer's message was written in.
+func messageVersion(message SignalingMessage) int {
+    if message.Version == 0 {
+        return 1
+    }
+    return message.Version
+}
+
+func supportedVersion(version int) bool {
+    return version >= minSignalingVersion && version <= signalingVersion
+}
+
+// validateSignalingMessage checks an incoming message is a known type and
+// has the fields that type needs, so the handlers can trust it.
+func validateSignalingMessage(message SignalingMessage) error {
+    switch message.Type {
+    case "offer":
+        return validateDescription(message, string(message.Offer))
+    case "answer":
+        return validateDescription(message, string(message.Answer))
+    case "candidate":
+        if message.ID == "" {
+            return errors.New("candidate without a sender")
+        }
+        if len(message.Candidate.Candidate) > maxCandidateLength {
+            return fmt.Errorf("candidate from %s is %d bytes", message.ID, len(message.Candidate.Candidate))
+        }
+    case "version_mismatch", "peer_joined", "peer_left":
+        if message.ID == "" {
+            return fmt.Errorf("%s without an id", message.Type)
+        }
+    case "room_joined", "room_left":
+        if message.Room == "" {
+            return fmt.Errorf("%s without a room", message.Type)
+        }
+    case "signaling_response", "auth_error", "peer_list", "message_queued", "queued_messages", "presence":
+    case "":
+        return errors.New("message without a type")
+    default:
+        return fmt.Errorf("unknown message type %q", message.Type)
+    }
+    return nil
+}
+
+func validateDescription(message SignalingMessage, sdp string) error {
+    if message.ID == "" {
+        return fmt.Errorf("%s without a sender", message.Type)
+    }
+    if sdp == "" {
+        return fmt.Errorf("%s from %s has no description", message.Type, message.ID)
+    }
+    if len(sdp) > maxSDPLength {
+        return fmt.Errorf("%s from %s is %d bytes", message.Type, message.ID, len(sdp))
+    }
+    return nil
+}
+
+// rejectVersion tells targetID we can't speak the version of their offer.
+func rejectVersion(conn Signaler, targetID string, clientID string) {
+    err := conn.WriteJSON(SignalingMessage{
+        Type:     "version_mismatch",
+        TargetID: targetID,
+        ID:       clientID,
+        Version:  signalingVersion,
+    })
+    if err != nil {
+        log.Println("バージョン不一致通知送信エラー: ", err)
+    }
+}
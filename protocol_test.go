@@ -0,0 +1,44 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestValidateSignalingMessage(t *testing.T) {
+    tests := []struct {
+        name    string
+        message SignalingMessage
+        valid   bool
+    }{
+        {"offer", SignalingMessage{Type: "offer", ID: "a", Offer: "v=0"}, true},
+        {"offer without sender", SignalingMessage{Type: "offer", Offer: "v=0"}, false},
+        {"offer without description", SignalingMessage{Type: "offer", ID: "a"}, false},
+        {"oversized offer", SignalingMessage{Type: "offer", ID: "a", Offer: descriptionField(strings.Repeat("a", maxSDPLength+1))}, false},
+        {"answer without description", SignalingMessage{Type: "answer", ID: "a"}, false},
+        {"candidate", SignalingMessage{Type: "candidate", ID: "a", Candidate: candidateField{Candidate: "candidate:1 1 udp 1 10.0.0.1 5000 typ host"}}, true},
+        {"end of candidates", SignalingMessage{Type: "candidate", ID: "a"}, true},
+        {"candidate without sender", SignalingMessage{Type: "candidate", Candidate: candidateField{Candidate: "candidate:1"}}, false},
+        {"oversized candidate", SignalingMessage{Type: "candidate", ID: "a", Candidate: candidateField{Candidate: strings.Repeat("a", maxCandidateLength+1)}}, false},
+        {"pairing", SignalingMessage{Type: "signaling_response", Request: "offer", TargetID: "a"}, true},
+        {"peer_joined without id", SignalingMessage{Type: "peer_joined", Room: "r"}, false},
+        {"room_joined without room", SignalingMessage{Type: "room_joined"}, false},
+        {"no type", SignalingMessage{ID: "a"}, false},
+        {"unknown type", SignalingMessage{Type: "surprise", ID: "a"}, false},
+    }
+    for _, test := range tests {
+        err := validateSignalingMessage(test.message)
+        if (err == nil) != test.valid {
+            t.Errorf("%s: got %v", test.name, err)
+        }
+    }
+}
+
+func TestMessageVersion(t *testing.T) {
+    if v := messageVersion(SignalingMessage{Type: "offer"}); v != 1 || !supportedVersion(v) {
+        t.Errorf("unversioned message is v%d", v)
+    }
+    if supportedVersion(signalingVersion + 1) {
+        t.Error("a newer version is supported")
+    }
+}
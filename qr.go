@@ -0,0 +1,96 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    _ "image/gif"
+    _ "image/jpeg"
+    _ "image/png"
+    "os"
+    "strings"
+
+    "github.com/makiuchi-d/gozxing"
+    "github.com/makiuchi-d/gozxing/qrcode"
+    "rsc.io/qr"
+)
+
+// qrQuietZone is the blank border scanners need around a QR code, in
+// modules.
+const qrQuietZone = 2
+
+// showQR prints pairing codes as QR codes too, with -qr.
+var showQR bool
+
+// renderQR draws text as a QR code with half-block characters, two modules
+// per line. Like qrencode's UTF8 output it assumes light text on a dark
+// terminal: dark modules are left blank and light ones drawn.
+func renderQR(text string) (string, error) {
+    code, err := qr.Encode(text, qr.L)
+    if err != nil {
+        return "", err
+    }
+    dark := func(x, y int) bool {
+        x -= qrQuietZone
+        y -= qrQuietZone
+        return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+    }
+
+    size := code.Size + 2*qrQuietZone
+    var b strings.Builder
+    for y := 0; y < size; y += 2 {
+        for x := 0; x < size; x++ {
+            top, bottom := !dark(x, y), y+1 < size && !dark(x, y+1)
+            switch {
+            case top && bottom:
+                b.WriteString("█")
+            case top:
+                b.WriteString("▀")
+            case bottom:
+                b.WriteString("▄")
+            default:
+                b.WriteString(" ")
+            }
+        }
+        b.WriteString("\n")
+    }
+    return b.String(), nil
+}
+
+// isImagePath reports whether line names an image file rather than being a
+// code, so a photo or screenshot of the peer's QR code can be given instead.
+func isImagePath(line string) bool {
+    ext := strings.ToLower(line[strings.LastIndex(line, ".")+1:])
+    if ext != "png" && ext != "jpg" && ext != "jpeg" && ext != "gif" {
+        return false
+    }
+    info, err := os.Stat(line)
+    return err == nil && info.Mode().IsRegular()
+}
+
+// scanQRImage reads the text of the QR code in the image at path.
+func scanQRImage(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    img, _, err := image.Decode(file)
+    if err != nil {
+        return "", fmt.Errorf("%s: %w", path, err)
+    }
+    // Screenshots of renderQR's output are light on dark, so the inverted
+    // image is tried as well
+    source := gozxing.NewLuminanceSourceFromImage(img)
+    hints := map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_TRY_HARDER: true}
+    for _, s := range []gozxing.LuminanceSource{source, source.Invert()} {
+        bitmap, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(s))
+        if err != nil {
+            return "", fmt.Errorf("%s: %w", path, err)
+        }
+        if result, err := qrcode.NewQRCodeReader().Decode(bitmap, hints); err == nil {
+            return result.GetText(), nil
+        }
+    }
+    return "", errors.New(path + ": no readable QR code found")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/pion/interceptor"
+    "github.com/pion/interceptor/pkg/stats"
+    "github.com/pion/webrtc/v3"
+)
+
+const qualitySampleInterval = 2 * time.Second
+
+// Connection quality levels, from best to worst
+const (
+    qualityGood = "good"
+    qualityFair = "fair"
+    qualityPoor = "poor"
+)
+
+// Thresholds for each level; a sample is graded by its worst metric.
+const (
+    goodMaxRTT  = 150 * time.Millisecond
+    fairMaxRTT  = 400 * time.Millisecond
+    goodMaxLoss = 0.02
+    fairMaxLoss = 0.10
+)
+
+// rtpStats collects the per-stream RTP counters that pion's GetStats
+// doesn't report, so packet loss can be measured during calls.
+type rtpStats struct {
+    mu     sync.Mutex
+    getter stats.Getter
+}
+
+func (s *rtpStats) register(registry *interceptor.Registry) error {
+    factory, err := stats.NewInterceptor()
+    if err != nil {
+        return err
+    }
+    factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+        s.mu.Lock()
+        s.getter = getter
+        s.mu.Unlock()
+    })
+    registry.Add(factory)
+    return nil
+}
+
+// totals returns the packets received and lost across the given streams.
+func (s *rtpStats) totals(ssrcs []uint32) (received, lost uint64) {
+    s.mu.Lock()
+    getter := s.getter
+    s.mu.Unlock()
+    if getter == nil {
+        return 0, 0
+    }
+    for _, ssrc := range ssrcs {
+        stream := getter.Get(ssrc)
+        if stream == nil {
+            continue
+        }
+        received += stream.InboundRTPStreamStats.PacketsReceived
+        if stream.InboundRTPStreamStats.PacketsLost > 0 {
+            lost += uint64(stream.InboundRTPStreamStats.PacketsLost)
+        }
+    }
+    return received, lost
+}
+
+// qualitySample is one measurement of the connection.
+type qualitySample struct {
+    RTT        time.Duration
+    Loss       float64 // fraction of RTP packets lost; -1 without media
+    Throughput float64 // bytes per second, both directions
+}
+
+func (s qualitySample) Level() string {
+    switch {
+    case s.RTT > fairMaxRTT || s.Loss > fairMaxLoss:
+        return qualityPoor
+    case s.RTT > goodMaxRTT || s.Loss > goodMaxLoss:
+        return qualityFair
+    default:
+        return qualityGood
+    }
+}
+
+func (s qualitySample) String() string {
+    out := fmt.Sprintf("%s rtt %dms", s.Level(), s.RTT.Milliseconds())
+    if s.Loss >= 0 {
+        out += fmt.Sprintf(" loss %.1f%%", s.Loss*100)
+    }
+    return out + " " + formatRate(s.Throughput)
+}
+
+func formatRate(bytesPerSecond float64) string {
+    switch {
+    case bytesPerSecond >= 1024*1024:
+        return fmt.Sprintf("%.1f MB/s", bytesPerSecond/(1024*1024))
+    case bytesPerSecond >= 1024:
+        return fmt.Sprintf("%.1f KB/s", bytesPerSecond/1024)
+    default:
+        return fmt.Sprintf("%.0f B/s", bytesPerSecond)
+    }
+}
+
+// QualityMonitor samples the connection's stats, shows a compact quality
+// indicator in the status and warns when the connection gets worse.
+type QualityMonitor struct {
+    peerConnection *webrtc.PeerConnection
+    rtp            *rtpStats
+
+    // counters at the previous sample
+    at          time.Time
+    bytes       uint64
+    rtpReceived uint64
+    rtpLost     uint64
+    level       string
+}
+
+func newQualityMonitor(peerConnection *webrtc.PeerConnection, rtp *rtpStats) *QualityMonitor {
+    return &QualityMonitor{peerConnection: peerConnection, rtp: rtp}
+}
+
+// Run samples every qualitySampleInterval while the peer is connected.
+func (m *QualityMonitor) Run() {
+    ticker := time.NewTicker(qualitySampleInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if m.peerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+            m.at = time.Time{}
+            continue
+        }
+        sample, ok := m.sample()
+        if !ok {
+            continue
+        }
+        display.SetStatus("quality", sample.String())
+
+        level := sample.Level()
+        if qualityRank(level) > qualityRank(m.level) && m.level != "" {
+            display.Printf("[quality] connection is %s (was %s): %s\n", level, m.level, sample)
+        }
+        m.level = level
+    }
+}
+
+// sample measures RTT now and loss and throughput since the previous call.
+// The first call only records counters and reports ok == false.
+func (m *QualityMonitor) sample() (qualitySample, bool) {
+    report := m.peerConnection.GetStats()
+    pair, ok := selectedCandidatePair(report)
+    if !ok {
+        return qualitySample{}, false
+    }
+    rtt, sent, received := pairTraffic(report, pair)
+    bytes := sent + received
+    rtpReceived, rtpLost := m.rtp.totals(m.remoteSSRCs())
+
+    now := time.Now()
+    prevAt, prevBytes, prevReceived, prevLost := m.at, m.bytes, m.rtpReceived, m.rtpLost
+    m.at, m.bytes, m.rtpReceived, m.rtpLost = now, bytes, rtpReceived, rtpLost
+    if prevAt.IsZero() {
+        return qualitySample{}, false
+    }
+
+    s := qualitySample{
+        RTT:  time.Duration(rtt * float64(time.Second)),
+        Loss: -1,
+    }
+    if elapsed := now.Sub(prevAt).Seconds(); elapsed > 0 && bytes >= prevBytes {
+        s.Throughput = float64(bytes-prevBytes) / elapsed
+    }
+    if rtpReceived >= prevReceived && rtpLost >= prevLost && rtpReceived+rtpLost > prevReceived+prevLost {
+        newLost := float64(rtpLost - prevLost)
+        s.Loss = newLost / (float64(rtpReceived-prevReceived) + newLost)
+    }
+    return s, true
+}
+
+func (m *QualityMonitor) remoteSSRCs() []uint32 {
+    var ssrcs []uint32
+    for _, receiver := range m.peerConnection.GetReceivers() {
+        for _, track := range receiver.Tracks() {
+            ssrcs = append(ssrcs, uint32(track.SSRC()))
+        }
+    }
+    return ssrcs
+}
+
+func qualityRank(level string) int {
+    switch level {
+    case qualityFair:
+        return 1
+    case qualityPoor:
+        return 2
+    default:
+        return 0
+    }
+}
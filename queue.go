@@ -0,0 +1,56 @@
+package main
+
+import (
+    "time"
+)
+
+// Offline messages are held by the signaling server for peers that aren't
+// connected. The exchange is
+//
+//	client -> server  {"type":"queue_message","id":<from>,"target_id":<to>,"payload":<text>,"ttl":<seconds>}
+//	server -> client  {"type":"message_queued","target_id":<to>}
+//	client -> server  {"type":"fetch_queue","id":<self>}
+//	server -> client  {"type":"queued_messages","messages":[{"from","payload","sent_at"}...]}
+//
+// The server drops messages whose TTL has passed and deletes the rest once
+// they are delivered. Servers without queueing answer with an "error"
+// message or not at all. Queued messages pass through the server in the
+// clear, even with -e2e.
+
+const defaultQueueTTL = 7 * 24 * time.Hour
+
+// QueuedMessage is a message the server held while we were offline.
+type QueuedMessage struct {
+    From    string `json:"from"`
+    Payload string `json:"payload"`
+    SentAt  int64  `json:"sent_at"` // unix milliseconds
+}
+
+func queueMessage(conn Signaler, clientID string, targetID string, text string) error {
+    return conn.WriteJSON(SignalingMessage{
+        Type:     "queue_message",
+        ID:       clientID,
+        TargetID: targetID,
+        Payload:  text,
+        TTL:      int(defaultQueueTTL / time.Second),
+    })
+}
+
+// fetchQueuedMessages asks the server to flush anything held for us.
+func fetchQueuedMessages(conn Signaler, clientID string) error {
+    return conn.WriteJSON(SignalingMessage{
+        Type: "fetch_queue",
+        ID:   clientID,
+    })
+}
+
+func printQueuedMessages(messages []QueuedMessage) {
+    if len(messages) == 0 {
+        return
+    }
+    display.Printf("%d message(s) received while you were away:\n", len(messages))
+    for _, message := range messages {
+        sentAt := time.UnixMilli(message.SentAt).Format("2006-01-02 15:04")
+        display.Printf("  [%s] %s: %s\n", sentAt, contacts.Label(message.From), message.Payload)
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ByteRate is a data rate in bytes per second, written like "1MBps",
+// "500KBps" or "8Mbps" (lower-case b for bits).
+type ByteRate int64
+
+var rateUnits = []struct {
+    suffix     string
+    multiplier float64
+}{
+    // Longest suffixes first so "MBps" isn't read as "Bps"
+    {"GBps", 1 << 30},
+    {"MBps", 1 << 20},
+    {"KBps", 1 << 10},
+    {"kBps", 1 << 10},
+    {"Gbps", 1e9 / 8},
+    {"Mbps", 1e6 / 8},
+    {"kbps", 1e3 / 8},
+    {"Kbps", 1e3 / 8},
+    {"Bps", 1},
+    {"bps", 1.0 / 8},
+}
+
+func parseByteRate(s string) (ByteRate, error) {
+    s = strings.TrimSpace(strings.Replace(s, "/s", "ps", 1))
+    for _, unit := range rateUnits {
+        if !strings.HasSuffix(s, unit.suffix) {
+            continue
+        }
+        value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), 64)
+        if err != nil || value < 0 {
+            break
+        }
+        return ByteRate(value * unit.multiplier), nil
+    }
+    return 0, fmt.Errorf("invalid rate %q (use a value such as \"1MBps\", \"500KBps\" or \"8Mbps\")", s)
+}
+
+func (r ByteRate) String() string {
+    return formatRate(float64(r))
+}
+
+func (r ByteRate) MarshalJSON() ([]byte, error) {
+    return json.Marshal(strconv.FormatInt(int64(r), 10) + "Bps")
+}
+
+func (r *ByteRate) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("expected a rate string such as \"1MBps\", got %s", data)
+    }
+    value, err := parseByteRate(s)
+    if err != nil {
+        return err
+    }
+    *r = value
+    return nil
+}
+
+// tokenBucket limits sends to rate bytes per second with bursts of up to
+// burst bytes. Each Wait takes its tokens up front, going into debt if need
+// be, so callers are served in order: a chat line queued behind a file
+// chunk waits for that one chunk, not for the whole transfer.
+type tokenBucket struct {
+    rate  float64 // bytes per second
+    burst float64
+
+    mu     sync.Mutex
+    tokens float64
+    last   time.Time
+}
+
+func newTokenBucket(rate ByteRate) *tokenBucket {
+    // A burst of a tenth of a second smooths timer jitter without
+    // letting a fast link see big spikes
+    burst := float64(rate) / 10
+    if burst < fragmentSize+fragmentHeaderSize {
+        burst = fragmentSize + fragmentHeaderSize
+    }
+    return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n bytes may be sent.
+func (b *tokenBucket) Wait(n int) {
+    b.mu.Lock()
+    now := time.Now()
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+    b.last = now
+    b.tokens -= float64(n)
+    deficit := -b.tokens
+    b.mu.Unlock()
+
+    if deficit > 0 {
+        time.Sleep(time.Duration(deficit / b.rate * float64(time.Second)))
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "sync"
+    "unicode/utf8"
+)
+
+const (
+    shortIDLength  = 8   // characters of a message ID shown with -show-ids
+    minIDPrefix    = 4   // shortest ID prefix /react accepts
+    maxRecent      = 200 // messages kept for reactions to refer to
+    snippetLength  = 30
+    maxReactionLen = 64
+)
+
+func shortID(id string) string {
+    if len(id) > shortIDLength {
+        return id[:shortIDLength]
+    }
+    return id
+}
+
+// recentMessage is a chat message that can still be reacted to.
+type recentMessage struct {
+    ID      string
+    Mine    bool
+    Snippet string
+}
+
+// recentMessages remembers the last maxRecent messages in either direction
+// so reactions can be resolved and shown with the text they refer to.
+type recentMessages struct {
+    mu       sync.Mutex
+    messages []recentMessage // oldest first
+}
+
+func (r *recentMessages) add(id string, mine bool, data []byte) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.messages = append(r.messages, recentMessage{ID: id, Mine: mine, Snippet: snippet(data)})
+    if len(r.messages) > maxRecent {
+        r.messages = r.messages[len(r.messages)-maxRecent:]
+    }
+}
+
+// has reports whether the message with id is among the recent ones.
+func (r *recentMessages) has(id string) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, m := range r.messages {
+        if m.ID == id {
+            return true
+        }
+    }
+    return false
+}
+
+// find returns the message whose ID is or starts with prefix.
+func (r *recentMessages) find(prefix string) (recentMessage, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for i := len(r.messages) - 1; i >= 0; i-- {
+        if strings.HasPrefix(r.messages[i].ID, prefix) {
+            return r.messages[i], true
+        }
+    }
+    return recentMessage{}, false
+}
+
+// lastReceived returns the peer's latest message.
+func (r *recentMessages) lastReceived() (recentMessage, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for i := len(r.messages) - 1; i >= 0; i-- {
+        if !r.messages[i].Mine {
+            return r.messages[i], true
+        }
+    }
+    return recentMessage{}, false
+}
+
+func snippet(data []byte) string {
+    if !utf8.Valid(data) {
+        return fmt.Sprintf("<binary message, %d bytes>", len(data))
+    }
+    text := strings.Join(strings.Fields(string(data)), " ")
+    if utf8.RuneCountInString(text) > snippetLength {
+        text = string([]rune(text)[:snippetLength]) + "…"
+    }
+    return text
+}
+
+// React sends emoji as a reaction to the message whose ID starts with
+// idPrefix, or to the peer's latest message if idPrefix is empty.
+func (c *Chat) React(idPrefix, emoji string) error {
+    if emoji == "" || len(emoji) > maxReactionLen || !utf8.ValidString(emoji) {
+        return errors.New("usage: /react [msg-id] <emoji>")
+    }
+
+    var target recentMessage
+    var ok bool
+    if idPrefix == "" {
+        target, ok = c.recent.lastReceived()
+        if !ok {
+            return errors.New("nothing to react to yet")
+        }
+    } else {
+        if len(idPrefix) < minIDPrefix {
+            return fmt.Errorf("message ID must be at least %d characters", minIDPrefix)
+        }
+        target, ok = c.recent.find(idPrefix)
+        if !ok {
+            return fmt.Errorf("no recent message %s", idPrefix)
+        }
+    }
+
+    env := newEnvelope(envelopeReaction, c.clientID, []byte(emoji))
+    env.Ref = target.ID
+    if err := c.sendEnvelope(env); err != nil {
+        return err
+    }
+    printReaction("you", emoji, target)
+    return nil
+}
+
+func (c *Chat) handleReaction(env *Envelope) {
+    emoji := string(env.Payload)
+    if env.Ref == "" || emoji == "" || len(emoji) > maxReactionLen || !utf8.ValidString(emoji) {
+        log.Println("Ignoring malformed reaction")
+        return
+    }
+    target, ok := c.recent.find(env.Ref)
+    if !ok {
+        target = recentMessage{ID: env.Ref, Snippet: "an older message"}
+    }
+    printReaction(displayName(c.PeerName()), emoji, target)
+}
+
+// printReaction shows a reaction indented under the message it refers to.
+func printReaction(who, emoji string, target recentMessage) {
+    ref := ""
+    if showMessageIDs {
+        ref = "#" + shortID(target.ID) + " "
+    }
+    display.Printf("  ↳ %s reacted %s to %s%q\n", who, emoji, ref, target.Snippet)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// When the connection to the peer drops, ICE is restarted: a fresh offer
+// goes to the same peer over the signaling channel, new candidates are
+// gathered (after a network change, say) and the data channels carry on
+// where they were, so nothing above them notices beyond the wait. Attempts
+// back off as the reconnect config says. After peerReconnectTimeout the
+// session ends as it would have without reconnecting.
+const peerReconnectTimeout = time.Minute
+
+type peerReconnector struct {
+    peerConnection *webrtc.PeerConnection
+    conn           Signaler
+    negotiation    *negotiation
+    targetID       func() string // the peer to offer to
+    policy         ReconnectConfig
+    giveUp         func()
+
+    mu        sync.Mutex
+    running   bool
+    recovered chan struct{}
+}
+
+func newPeerReconnector(peerConnection *webrtc.PeerConnection, conn Signaler, negotiation *negotiation, targetID func() string, policy ReconnectConfig, giveUp func()) *peerReconnector {
+    return &peerReconnector{
+        peerConnection: peerConnection,
+        conn:           conn,
+        negotiation:    negotiation,
+        targetID:       targetID,
+        policy:         policy,
+        giveUp:         giveUp,
+    }
+}
+
+// Start begins reconnecting and reports whether it wasn't already under way.
+func (r *peerReconnector) Start() bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.running {
+        return false
+    }
+    r.running = true
+    r.recovered = make(chan struct{}, 1)
+    go r.run(r.recovered)
+    return true
+}
+
+// Connected reports whether reconnecting was under way, ending it.
+func (r *peerReconnector) Connected() bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if !r.running {
+        return false
+    }
+    r.running = false
+    r.recovered <- struct{}{}
+    return true
+}
+
+func (r *peerReconnector) run(recovered <-chan struct{}) {
+    deadline := time.Now().Add(peerReconnectTimeout)
+    delay := time.Duration(r.policy.InitialDelay)
+    for attempt := 1; ; attempt++ {
+        select {
+        case <-recovered:
+            return
+        case <-time.After(delay):
+        }
+        if shuttingDown.Load() {
+            return
+        }
+        if time.Now().After(deadline) || (r.policy.MaxAttempts > 0 && attempt > r.policy.MaxAttempts) {
+            log.Printf("Giving up reconnecting to peer after %d attempts\n", attempt-1)
+            r.giveUp()
+            return
+        }
+
+        log.Printf("Restarting ICE with peer (attempt %d)\n", attempt)
+        r.negotiation.Restart(r.conn, r.peerConnection, r.targetID())
+        delay *= 2
+        if delay > time.Duration(r.policy.MaxDelay) {
+            delay = time.Duration(r.policy.MaxDelay)
+        }
+    }
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// The session file remembers the last peer talked to, so -resume can call
+// them again directly instead of waiting to be paired: their ID and name,
+// the certificate they connected with, the room, and messages typed that
+// never got sent.
+
+// How often -resume repeats its offer while the peer isn't answering, in
+// case they weren't connected to the signaling server yet.
+const resumeRetryInterval = 5 * time.Second
+
+// Session is the saved state of the last conversation.
+type Session struct {
+    PeerID      string   `json:"peer_id"`
+    PeerName    string   `json:"peer_name,omitempty"`
+    Fingerprint string   `json:"fingerprint,omitempty"` // SHA-256 of the peer's DTLS certificate, hex
+    Room        string   `json:"room,omitempty"`
+    Unsent      []string `json:"unsent,omitempty"`
+}
+
+// SessionStore reads and writes the session file.
+type SessionStore struct {
+    path string
+
+    mu      sync.Mutex
+    session Session
+}
+
+func defaultSessionPath() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return "session.json"
+    }
+    return filepath.Join(dir, "webrtc-chat", "session.json")
+}
+
+// loadSessionStore reads the session file at path; a missing file is an
+// empty session.
+func loadSessionStore(path string) (*SessionStore, error) {
+    s := &SessionStore{path: path}
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &s.session); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return s, nil
+}
+
+// Session returns a copy of the saved session.
+func (s *SessionStore) Session() Session {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    session := s.session
+    session.Unsent = append([]string(nil), s.session.Unsent...)
+    return session
+}
+
+// Update changes the session with fn and saves it. The session is saved
+// on the way out, where the client may be killed mid-write, so it is
+// written alongside and renamed into place: the file is either the old
+// session or the new one, never a part of it.
+func (s *SessionStore) Update(fn func(session *Session)) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    fn(&s.session)
+    data, err := json.MarshalIndent(s.session, "", "  ")
+    if err != nil {
+        return err
+    }
+    dir := filepath.Dir(s.path)
+    if err := os.MkdirAll(dir, 0o700); err != nil {
+        return err
+    }
+    file, err := os.CreateTemp(dir, ".session-*.json")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(file.Name())
+    _, err = file.Write(data)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    return os.Rename(file.Name(), s.path)
+}
+
+// resumeSession calls peerID directly, repeating the offer until they
+// answer or call us.
+func resumeSession(conn Signaler, peerConnection *webrtc.PeerConnection, negotiation *negotiation, peerID string) {
+    negotiation.Offer(conn, peerConnection, peerID)
+    for !shuttingDown.Load() {
+        time.Sleep(resumeRetryInterval)
+        if peerConnection.RemoteDescription() != nil {
+            return
+        }
+        log.Println("No answer from the resumed peer yet, offering again")
+        negotiation.Restart(conn, peerConnection, peerID)
+    }
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// A chat channel with MaxRetransmits or MaxPacketLifeTime set trades
+// reliability for latency: SCTP may give up on a message. Between peers
+// that list featureAck, the receiver then acknowledges every numbered
+// envelope on the control channel, which is always reliable, and the sender
+// resends whatever isn't acknowledged in time:
+//
+//	{"type":"ack","from":<id>,"ts":<unix ms>,"seq":<envelope seq>}
+//
+// At most retransmitWindow envelopes are unacknowledged at once; sends
+// block until the window opens. Resends produce duplicates when only the
+// acknowledgement was slow, which the reorder buffer drops, so each
+// message is still shown once.
+const (
+    featureAck = "ack"
+
+    retransmitWindow      = 64
+    retransmitTimeout     = 500 * time.Millisecond
+    maxRetransmitTimeout  = 2 * time.Second
+    maxRetransmitAttempts = 6
+)
+
+// retransmitGiveUp is about how long the sender keeps resending an
+// envelope. A receiver whose peer resends waits this long on a gap before
+// skipping it.
+const retransmitGiveUp = 12 * time.Second
+
+// isUnreliable reports whether dc may drop messages.
+func isUnreliable(dc Transport) bool {
+    return dc.MaxRetransmits() != nil || dc.MaxPacketLifeTime() != nil
+}
+
+type unackedEnvelope struct {
+    frame    []byte
+    attempts int
+    timeout  time.Duration
+    timer    *time.Timer
+}
+
+// retransmitter holds sent envelopes until they are acknowledged.
+type retransmitter struct {
+    resend func(frame []byte) error
+
+    mu       sync.Mutex
+    windowOK *sync.Cond
+    unacked  map[uint64]*unackedEnvelope
+    stopped  bool
+}
+
+func newRetransmitter(resend func(frame []byte) error) *retransmitter {
+    r := &retransmitter{
+        resend:  resend,
+        unacked: map[uint64]*unackedEnvelope{},
+    }
+    r.windowOK = sync.NewCond(&r.mu)
+    return r
+}
+
+// track starts the resend timer of the envelope numbered seq, whose
+// encoded form is frame. It waits while the window is full.
+func (r *retransmitter) track(seq uint64, frame []byte) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for len(r.unacked) >= retransmitWindow && !r.stopped {
+        r.windowOK.Wait()
+    }
+    if r.stopped {
+        return
+    }
+    entry := &unackedEnvelope{frame: frame, timeout: retransmitTimeout}
+    entry.timer = time.AfterFunc(entry.timeout, func() { r.expire(seq) })
+    r.unacked[seq] = entry
+}
+
+func (r *retransmitter) expire(seq uint64) {
+    r.mu.Lock()
+    entry, ok := r.unacked[seq]
+    if !ok {
+        r.mu.Unlock()
+        return
+    }
+    entry.attempts++
+    if entry.attempts > maxRetransmitAttempts {
+        delete(r.unacked, seq)
+        r.windowOK.Broadcast()
+        r.mu.Unlock()
+        log.Printf("Giving up on message %d: not acknowledged\n", seq)
+        return
+    }
+    entry.timeout *= 2
+    if entry.timeout > maxRetransmitTimeout {
+        entry.timeout = maxRetransmitTimeout
+    }
+    entry.timer = time.AfterFunc(entry.timeout, func() { r.expire(seq) })
+    frame, attempts := entry.frame, entry.attempts
+    r.mu.Unlock()
+
+    log.Printf("Resending message %d (attempt %d)\n", seq, attempts)
+    if err := r.resend(frame); err != nil {
+        log.Println("メッセージ再送エラー: ", err)
+    }
+}
+
+// ack forgets the envelope numbered seq.
+func (r *retransmitter) ack(seq uint64) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if entry, ok := r.unacked[seq]; ok {
+        entry.timer.Stop()
+        delete(r.unacked, seq)
+        r.windowOK.Broadcast()
+    }
+}
+
+// stop drops everything unacknowledged and releases blocked senders, once
+// the peer is gone.
+func (r *retransmitter) stop() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for seq, entry := range r.unacked {
+        entry.timer.Stop()
+        delete(r.unacked, seq)
+    }
+    r.stopped = true
+    r.windowOK.Broadcast()
+}
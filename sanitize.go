@@ -0,0 +1,81 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Text from the peer passes through sanitizeText before it reaches the
+// screen. Control characters would otherwise let them move the cursor,
+// rewrite what is already shown, retitle the window or worse, and the
+// invisible bidirectional controls can make text read differently from
+// what it is. Both are shown escaped instead, as \x1b or \u202e.
+
+// sanitizeText escapes the control characters in text, keeping newlines
+// and tabs. A CRLF line ending is kept as a plain newline.
+func sanitizeText(text string) string {
+    text = strings.ReplaceAll(text, "\r\n", "\n")
+    if strings.IndexFunc(text, isUnsafeRune) < 0 {
+        return text
+    }
+    var b strings.Builder
+    for _, r := range text {
+        switch {
+        case !isUnsafeRune(r):
+            b.WriteRune(r)
+        case r < 0x100:
+            fmt.Fprintf(&b, "\\x%02x", r)
+        default:
+            fmt.Fprintf(&b, "\\u%04x", r)
+        }
+    }
+    return b.String()
+}
+
+func isUnsafeRune(r rune) bool {
+    switch {
+    case r == '\n' || r == '\t':
+        return false
+    case r < 0x20 || r == 0x7f:
+        return true // C0 controls, ESC among them, and DEL
+    case r >= 0x80 && r < 0xa0:
+        return true // C1 controls, which some terminals take as CSI and OSC
+    case r >= 0x202a && r <= 0x202e, r >= 0x2066 && r <= 0x2069, r == 0x200e, r == 0x200f, r == 0x061c:
+        return true // bidirectional embeddings, overrides, isolates and marks
+    }
+    return false
+}
+
+// sanitizeArgs sanitizes the text among Printf arguments. The format itself
+// is ours; names, file names and errors in the arguments may come from the
+// peer.
+func sanitizeArgs(args []interface{}) []interface{} {
+    safe := make([]interface{}, len(args))
+    for i, arg := range args {
+        switch v := arg.(type) {
+        case string:
+            safe[i] = sanitizeText(v)
+        case []byte:
+            safe[i] = sanitizeText(string(v))
+        case error:
+            safe[i] = sanitizeText(v.Error())
+        default:
+            safe[i] = arg
+        }
+    }
+    return safe
+}
+
+// sanitizingWriter sanitizes what is written through it, for log lines,
+// which can quote peer IDs and names.
+type sanitizingWriter struct {
+    w io.Writer
+}
+
+func (s sanitizingWriter) Write(p []byte) (int, error) {
+    if _, err := io.WriteString(s.w, sanitizeText(string(p))); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSanitizeText(t *testing.T) {
+    tests := []struct {
+        in, want string
+    }{
+        {"hello\n", "hello\n"},
+        {"tab\tand CRLF\r\n", "tab\tand CRLF\n"},
+        {"日本語 and emoji 🎉", "日本語 and emoji 🎉"},
+        {"\x1b[2J\x1b[Hgotcha", "\\x1b[2J\\x1b[Hgotcha"},
+        {"\x1b]0;new title\a", "\\x1b]0;new title\\x07"},
+        {"over\rwrite", "over\\x0dwrite"},
+        {"c1 \u009b31m", "c1 \\x9b31m"},
+        {"file\u202egnp.exe", "file\\u202egnp.exe"},
+    }
+    for _, test := range tests {
+        if got := sanitizeText(test.in); got != test.want {
+            t.Errorf("sanitizeText(%q) = %q, want %q", test.in, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "golang.org/x/term"
+)
+
+// The terminal's own scrollback can't be relied on once the line editor
+// has been redrawing below it, so the last messages shown and sent are kept
+// in memory as well, for /more and PageUp to page back through. PageDown
+// pages forward again; a new message goes back to the bottom.
+const (
+    defaultScrollbackSize = 1000
+    defaultPageSize       = 20
+)
+
+// scrollbackEntry is one message in the scrollback.
+type scrollbackEntry struct {
+    heldMessage
+    sent bool // we sent it; sender is empty
+}
+
+// scrollbackDisplay wraps a Display and remembers the messages that went
+// through it.
+type scrollbackDisplay struct {
+    Display
+
+    mu      sync.Mutex
+    entries []scrollbackEntry // a ring of size entries
+    size    int
+    total   int // messages ever kept; entries[total%size] is the oldest
+    // the page shown last, as message numbers counted from the first one
+    // kept: [start, end). Both are total when not paging.
+    start, end int
+}
+
+func newScrollbackDisplay(d Display, size int) *scrollbackDisplay {
+    if size <= 0 {
+        size = defaultScrollbackSize
+    }
+    return &scrollbackDisplay{Display: d, size: size}
+}
+
+func (s *scrollbackDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    s.add(scrollbackEntry{heldMessage: heldMessage{sender, senderID, id, data, isString, sentAt}})
+    s.Display.PrintMessage(sender, senderID, id, data, isString, sentAt)
+}
+
+func (s *scrollbackDisplay) PrintSent(id string, data []byte, sentAt time.Time) {
+    s.add(scrollbackEntry{heldMessage: heldMessage{id: id, data: data, isString: !isBinaryData(data), sentAt: sentAt}, sent: true})
+    s.Display.PrintSent(id, data, sentAt)
+}
+
+func (s *scrollbackDisplay) add(entry scrollbackEntry) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.entries) < s.size {
+        s.entries = append(s.entries, entry)
+    } else {
+        s.entries[s.total%s.size] = entry
+    }
+    s.total++
+    s.start, s.end = s.total, s.total
+}
+
+// page returns the entries numbered [start, end), which must be kept.
+func (s *scrollbackDisplay) page(start, end int) []scrollbackEntry {
+    page := make([]scrollbackEntry, 0, end-start)
+    for n := start; n < end; n++ {
+        page = append(page, s.entries[n%s.size])
+    }
+    return page
+}
+
+// Older shows the page of messages before the last one shown, or the
+// newest messages if not paging yet.
+func (s *scrollbackDisplay) Older(pageSize int) {
+    s.mu.Lock()
+    first := s.total - len(s.entries)
+    if s.start <= first {
+        s.mu.Unlock()
+        s.Display.Printf("[more] no earlier messages\n")
+        return
+    }
+    s.end = s.start
+    s.start = max(first, s.end-pageSize)
+    s.show()
+}
+
+// Newer shows the page after the last one shown.
+func (s *scrollbackDisplay) Newer(pageSize int) {
+    s.mu.Lock()
+    if s.end >= s.total {
+        s.start, s.end = s.total, s.total
+        s.mu.Unlock()
+        s.Display.Printf("[more] no newer messages\n")
+        return
+    }
+    s.start = s.end
+    s.end = min(s.total, s.start+pageSize)
+    s.show()
+}
+
+// show prints the current page. It is called with mu held and releases it.
+func (s *scrollbackDisplay) show() {
+    first := s.total - len(s.entries)
+    start, end, total := s.start-first+1, s.end-first, len(s.entries)
+    page := s.page(s.start, s.end)
+    s.mu.Unlock()
+
+    s.Display.Printf("[more] messages %d-%d of %d (/more or PageUp for older, PageDown for newer):\n", start, end, total)
+    for _, entry := range page {
+        if !entry.sent {
+            s.Display.PrintMessage(entry.sender, entry.senderID, entry.id, entry.data, entry.isString, entry.sentAt)
+            continue
+        }
+        text := ensureNewline(string(entry.data))
+        if !entry.isString {
+            text = fmt.Sprintf("<binary message, %d bytes>\n", len(entry.data))
+        }
+        s.Display.Printf("%syou: %s", messagePrefix(entry.id, entry.sentAt), text)
+    }
+}
+
+// scrollbackPageSize is a screenful less room for the header and the
+// line being typed.
+func scrollbackPageSize() int {
+    if _, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && height > 4 {
+        return height - 2
+    }
+    return defaultPageSize
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestScrollbackPagesThroughKeptMessages(t *testing.T) {
+    fake := &fakeDisplay{status: map[string]string{}}
+    s := newScrollbackDisplay(fake, 5)
+    for i := 1; i <= 7; i++ {
+        s.PrintMessage("alice", "a1", "", []byte(fmt.Sprintf("m%d", i)), true, time.Time{})
+    }
+    fake.messages = nil
+
+    s.Older(2)
+    s.Older(2)
+    s.Older(2)
+    want := []string{"alice: m6", "alice: m7", "alice: m4", "alice: m5", "alice: m3"}
+    if !reflect.DeepEqual(fake.messages, want) {
+        t.Fatalf("paging back showed %q, want %q", fake.messages, want)
+    }
+    s.Older(2)
+    if last := fake.notices[len(fake.notices)-1]; !strings.Contains(last, "no earlier messages") {
+        t.Errorf("paging past the oldest kept message printed %q", last)
+    }
+    if first := fake.notices[0]; !strings.Contains(first, "messages 4-5 of 5") {
+        t.Errorf("the first page's header is %q", first)
+    }
+
+    fake.messages = nil
+    s.Newer(2)
+    if want := []string{"alice: m4", "alice: m5"}; !reflect.DeepEqual(fake.messages, want) {
+        t.Errorf("paging forward showed %q, want %q", fake.messages, want)
+    }
+
+    // A new message ends the paging.
+    s.PrintMessage("alice", "a1", "", []byte("m8"), true, time.Time{})
+    s.Newer(2)
+    if last := fake.notices[len(fake.notices)-1]; !strings.Contains(last, "no newer messages") {
+        t.Errorf("paging forward after a new message printed %q", last)
+    }
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    searchPageSize = 10  // matches shown per page
+    searchContext  = 1   // messages shown before and after each match
+    searchLineMax  = 200 // runes of a message shown
+)
+
+// historySearch is /search: a search of the history, newest match first,
+// shown a page at a time. A search without a term shows the next page of
+// the last one.
+type historySearch struct {
+    term   string
+    offset int
+}
+
+// Page returns the next page of matches for term, or of the last term if
+// term is empty, ready to show.
+func (s *historySearch) Page(history *History, term string) (string, error) {
+    if term != "" {
+        s.term, s.offset = term, 0
+    } else if s.term == "" {
+        return "", fmt.Errorf("usage: /search <term>")
+    }
+    total, err := history.CountMatches(s.term)
+    if err != nil {
+        return "", err
+    }
+    if total == 0 {
+        return fmt.Sprintf("[search] no messages match %q\n", s.term), nil
+    }
+    if s.offset >= total {
+        return fmt.Sprintf("[search] no more matches for %q\n", s.term), nil
+    }
+    matches, err := history.Search(s.term, s.offset, searchPageSize)
+    if err != nil {
+        return "", err
+    }
+
+    var b strings.Builder
+    fmt.Fprintf(&b, "[search] %d-%d of %d matches for %q\n", s.offset+1, s.offset+len(matches), total, s.term)
+    for _, match := range matches {
+        before, after, err := history.Around(match, searchContext)
+        if err != nil {
+            return "", err
+        }
+        fmt.Fprintf(&b, "\n  with %s, %s\n", conversationLabel(match, append(before, after...)), match.SentAt.Format("2006-01-02"))
+        for _, entry := range before {
+            b.WriteString(formatSearchLine(" ", entry))
+        }
+        b.WriteString(formatSearchLine(">", match))
+        for _, entry := range after {
+            b.WriteString(formatSearchLine(" ", entry))
+        }
+    }
+    s.offset += len(matches)
+    if remaining := total - s.offset; remaining > 0 {
+        fmt.Fprintf(&b, "\n[search] %d more, /search to see them\n", remaining)
+    }
+    return b.String(), nil
+}
+
+func formatSearchLine(marker string, entry HistoryEntry) string {
+    text := fmt.Sprintf("<binary message, %d bytes>", len(entry.Body))
+    if entry.Type == envelopeText && utf8.Valid(entry.Body) {
+        text = strings.Join(strings.Fields(string(entry.Body)), " ")
+        if utf8.RuneCountInString(text) > searchLineMax {
+            text = string([]rune(text)[:searchLineMax]) + "…"
+        }
+    }
+    return fmt.Sprintf("  %s %s %s: %s\n", marker, entry.SentAt.Format("15:04:05"), entry.SenderName, text)
+}
+
+// conversationLabel names the peer of the conversation a match is from:
+// their alias, the name they used, or their ID.
+func conversationLabel(match HistoryEntry, context []HistoryEntry) string {
+    if alias := contacts.Alias(match.PeerID); alias != "" {
+        return alias
+    }
+    for _, entry := range append([]HistoryEntry{match}, context...) {
+        if entry.Direction == directionIn && entry.SenderName != "" {
+            return entry.SenderName
+        }
+    }
+    return match.PeerID
+}
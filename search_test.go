@@ -0,0 +1,52 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestHistorySearch(t *testing.T) {
+    history, err := openHistory(filepath.Join(t.TempDir(), "history.db"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer history.Close()
+    start := time.Date(2026, 10, 17, 9, 0, 0, 0, time.Local)
+    record := func(i int, sender, text string) {
+        entry := HistoryEntry{ID: fmt.Sprint(i), PeerID: "bob-id", SenderID: sender + "-id", SenderName: sender, Direction: directionOut, Type: envelopeText, Body: []byte(text), SentAt: start.Add(time.Duration(i) * time.Minute)}
+        if sender == "bob" {
+            entry.Direction = directionIn
+        }
+        if err := history.Record(entry); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for i := 0; i < 12; i++ {
+        record(2*i, "alice", fmt.Sprintf("lunch %d?", i))
+        record(2*i+1, "bob", "sure")
+    }
+    record(100, "bob", "100% sure")
+
+    var search historySearch
+    page, err := search.Page(history, "LUNCH")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"1-10 of 12 matches", "with bob, 2026-10-17", "> 09:22:00 alice: lunch 11?", "  09:21:00 bob: sure", "2 more"} {
+        if !strings.Contains(page, want) {
+            t.Errorf("page 1 lacks %q:\n%s", want, page)
+        }
+    }
+    page, _ = search.Page(history, "")
+    if !strings.Contains(page, "11-12 of 12") || !strings.Contains(page, "> 09:00:00 alice: lunch 0?") || strings.Contains(page, "more") {
+        t.Errorf("page 2:\n%s", page)
+    }
+
+    // LIKE wildcards in the term are matched literally
+    if n, _ := history.CountMatches("0%"); n != 1 {
+        t.Errorf("%q matched %d messages", "0%", n)
+    }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Envelopes on the chat channel carry a sequence number, counting up from
+// 1 for each session, so the receiver can put them back in order and drop
+// duplicates when the channel is unordered or unreliable. File envelopes
+// aren't numbered; their own channel is always ordered and reliable.
+//
+// A number that never arrives (the channel gave up on it) holds the
+// envelopes after it back for at most reorderTimeout, longer if the peer
+// resends, or until maxReorderPending are waiting, and is then skipped.
+const (
+    reorderTimeout    = 2 * time.Second
+    maxReorderPending = 256
+)
+
+// reorderBuffer delivers numbered envelopes in sequence order, each once.
+// Envelopes without a number, from older peers, are delivered as they come.
+type reorderBuffer struct {
+    deliver func(env *Envelope)
+    lost    func(count uint64)
+    wait    func() time.Duration // how long to wait on a gap
+
+    mu      sync.Mutex
+    next    uint64 // the number expected next
+    pending map[uint64]*Envelope
+    timer   *time.Timer
+}
+
+func newReorderBuffer(deliver func(env *Envelope), lost func(count uint64), wait func() time.Duration) *reorderBuffer {
+    return &reorderBuffer{
+        deliver: deliver,
+        lost:    lost,
+        wait:    wait,
+        next:    1,
+        pending: map[uint64]*Envelope{},
+    }
+}
+
+func (r *reorderBuffer) Receive(env *Envelope) {
+    if env.Seq == 0 {
+        r.deliver(env)
+        return
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if env.Seq < r.next || r.pending[env.Seq] != nil {
+        log.Printf("Duplicate message %d dropped\n", env.Seq)
+        return
+    }
+    r.pending[env.Seq] = env
+    if len(r.pending) > maxReorderPending {
+        r.skipGap()
+    }
+    r.flush()
+}
+
+// flush delivers the envelopes that are next in sequence and keeps the gap
+// timer running while any are left waiting.
+func (r *reorderBuffer) flush() {
+    for {
+        env, ok := r.pending[r.next]
+        if !ok {
+            break
+        }
+        delete(r.pending, r.next)
+        r.next++
+        r.deliver(env)
+    }
+
+    if len(r.pending) == 0 {
+        if r.timer != nil {
+            r.timer.Stop()
+            r.timer = nil
+        }
+        return
+    }
+    if r.timer == nil {
+        r.timer = time.AfterFunc(r.wait(), r.timeout)
+    }
+}
+
+func (r *reorderBuffer) timeout() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.timer = nil
+    if len(r.pending) > 0 {
+        r.skipGap()
+        r.flush()
+    }
+}
+
+// skipGap gives up on the numbers missing before the first waiting envelope.
+func (r *reorderBuffer) skipGap() {
+    waiting := make([]uint64, 0, len(r.pending))
+    for seq := range r.pending {
+        waiting = append(waiting, seq)
+    }
+    sort.Slice(waiting, func(i, j int) bool { return waiting[i] < waiting[j] })
+    if first := waiting[0]; first > r.next {
+        r.lost(first - r.next)
+        r.next = first
+    }
+}
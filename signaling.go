@@ -0,0 +1,269 @@
+package main
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Signaler carries signaling messages between this client and its peers,
+// normally through the WebSocket signaling server.
+type Signaler interface {
+    WriteJSON(v interface{}) error
+    ReadJSON(v interface{}) error
+    Close() error
+}
+
+// SignalingClient wraps the connection to the signaling server, WebSocket
+// or gRPC. Writes are serialized, and a dropped connection is transparently
+// redialed with exponential backoff; OnReconnect runs after each successful
+// redial so the caller can re-register with the server.
+type SignalingClient struct {
+    serverIP string
+    options  SignalingOptions
+
+    OnReconnect func()
+
+    mu   sync.Mutex
+    conn signalingConn
+}
+
+// signalingConn is one connection to the signaling server. Goodbye tells
+// the server we're leaving on purpose, before Close.
+type signalingConn interface {
+    WriteJSON(v interface{}) error
+    ReadJSON(v interface{}) error
+    Goodbye() error
+    Close() error
+}
+
+// wsConn is a signaling connection over WebSocket, with messages as JSON
+// text frames or, if the server accepted msgpackSubprotocol, MessagePack
+// binary frames.
+type wsConn struct {
+    *websocket.Conn
+    msgpack bool
+}
+
+func (c wsConn) WriteJSON(v interface{}) error {
+    if !c.msgpack {
+        return c.Conn.WriteJSON(v)
+    }
+    data, err := jsonToMsgpack(v)
+    if err != nil {
+        return err
+    }
+    return c.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c wsConn) ReadJSON(v interface{}) error {
+    if !c.msgpack {
+        return c.Conn.ReadJSON(v)
+    }
+    _, data, err := c.ReadMessage()
+    if err != nil {
+        return err
+    }
+    return msgpackToJSON(data, v)
+}
+
+// Goodbye sends a close frame.
+func (c wsConn) Goodbye() error {
+    return c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// SignalingOptions configures how the signaling connection is dialed.
+type SignalingOptions struct {
+    TLSConfig *tls.Config
+
+    // AuthToken is sent as "Authorization: Bearer <token>" on the WebSocket
+    // handshake. Servers that require it answer a missing or wrong token
+    // with 401/403 instead of upgrading the connection.
+    AuthToken string
+
+    // Proxy, if set, is an http:// or socks5:// proxy URL used for
+    // the connection. Otherwise HTTP_PROXY/HTTPS_PROXY/NO_PROXY apply.
+    Proxy *url.URL
+
+    // Reconnect is the redial policy used when the connection drops.
+    Reconnect ReconnectConfig
+
+    // Msgpack asks a WebSocket server for MessagePack instead of JSON.
+    // Servers that don't offer it keep using JSON.
+    Msgpack bool
+}
+
+var errAuthRejected = errors.New("signaling server rejected the auth token")
+
+func connectToSignalingServer(serverIP string, options SignalingOptions) *SignalingClient {
+    c := &SignalingClient{
+        serverIP: serverIP,
+        options:  options,
+    }
+    conn, err := c.dial()
+    if errors.Is(err, errAuthRejected) {
+        exitWith(exitAuthRejected, "シグナリングサーバー接続エラー: %v", err)
+    }
+    if err != nil {
+        exitWith(exitSignalingUnreachable, "シグナリングサーバー接続エラー: %v", err)
+    }
+    log.Println("シグナリングサーバーに接続しました")
+    c.conn = conn
+    return c
+}
+
+func (c *SignalingClient) dial() (signalingConn, error) {
+    if isGRPCURL(c.serverIP) {
+        conn, err := dialGRPC(c.serverIP, c.options)
+        if err != nil {
+            return nil, err
+        }
+        return conn, nil
+    }
+
+    dialer := *websocket.DefaultDialer
+    dialer.TLSClientConfig = c.options.TLSConfig
+    if c.options.Proxy != nil {
+        dialer.Proxy = http.ProxyURL(c.options.Proxy)
+    }
+
+    if c.options.Msgpack {
+        dialer.Subprotocols = []string{msgpackSubprotocol}
+    }
+
+    header := http.Header{}
+    if c.options.AuthToken != "" {
+        header.Set("Authorization", "Bearer "+c.options.AuthToken)
+    }
+
+    conn, resp, err := dialer.Dial(c.serverIP, header)
+    if err != nil && resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+        return nil, fmt.Errorf("%w (%s)", errAuthRejected, resp.Status)
+    }
+    if err != nil {
+        return nil, err
+    }
+    msgpack := conn.Subprotocol() == msgpackSubprotocol
+    if msgpack {
+        log.Println("Signaling over MessagePack")
+    }
+    return wsConn{Conn: conn, msgpack: msgpack}, nil
+}
+
+func (c *SignalingClient) WriteJSON(v interface{}) error {
+    c.mu.Lock()
+    conn := c.conn
+    err := conn.WriteJSON(v)
+    c.mu.Unlock()
+    if err == nil || shuttingDown.Load() {
+        return err
+    }
+
+    log.Println("シグナリング送信エラー、再接続します: ", err)
+    c.reconnect(conn)
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.conn.WriteJSON(v)
+}
+
+// ReadJSON reads the next message, reconnecting as many times as needed
+// until a message arrives or shutdown begins.
+func (c *SignalingClient) ReadJSON(v interface{}) error {
+    for {
+        c.mu.Lock()
+        conn := c.conn
+        c.mu.Unlock()
+
+        err := conn.ReadJSON(v)
+        if err == nil || shuttingDown.Load() {
+            return err
+        }
+        if isDecodeError(err) {
+            // Malformed payload; the connection itself is still usable
+            return err
+        }
+        if errors.Is(err, errAuthRejected) {
+            // gRPC servers can refuse the token on the stream itself
+            exitWith(exitAuthRejected, "シグナリング認証エラー: %v", err)
+        }
+
+        log.Println("シグナリング受信エラー、再接続します: ", err)
+        c.reconnect(conn)
+    }
+}
+
+// Close says goodbye before dropping the connection.
+func (c *SignalingClient) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err := c.conn.Goodbye(); err != nil {
+        log.Println("signaling close error: ", err)
+    }
+    return c.conn.Close()
+}
+
+// reconnect replaces failed with a freshly dialed connection. If another
+// goroutine has already replaced it, reconnect returns immediately.
+func (c *SignalingClient) reconnect(failed signalingConn) {
+    c.mu.Lock()
+    if c.conn != failed {
+        c.mu.Unlock()
+        return
+    }
+    failed.Close()
+
+    policy := c.options.Reconnect
+    if !policy.IsEnabled() {
+        exitWith(exitSignalingUnreachable, "シグナリングサーバーとの接続が切断されました (reconnect disabled)")
+    }
+
+    delay := time.Duration(policy.InitialDelay)
+    for attempt := 1; !shuttingDown.Load(); attempt++ {
+        if policy.MaxAttempts > 0 && attempt > policy.MaxAttempts {
+            exitWith(exitSignalingUnreachable, "シグナリング再接続エラー: gave up after %d attempts", policy.MaxAttempts)
+        }
+        // Full jitter keeps a crowd of clients from redialing in lockstep
+        wait := time.Duration(rand.Int63n(int64(delay)))
+        log.Printf("Reconnecting to signaling server in %s (attempt %d)\n", wait, attempt)
+        time.Sleep(wait)
+
+        conn, err := c.dial()
+        if errors.Is(err, errAuthRejected) {
+            // Retrying won't make the token valid
+            exitWith(exitAuthRejected, "シグナリング再接続エラー: %v", err)
+        }
+        if err != nil {
+            log.Println("シグナリング再接続エラー: ", err)
+            delay *= 2
+            if delay > time.Duration(policy.MaxDelay) {
+                delay = time.Duration(policy.MaxDelay)
+            }
+            continue
+        }
+
+        c.conn = conn
+        c.mu.Unlock()
+        log.Println("シグナリングサーバーに再接続しました")
+        if c.OnReconnect != nil {
+            c.OnReconnect()
+        }
+        return
+    }
+    c.mu.Unlock()
+}
+
+func isDecodeError(err error) bool {
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, errMalformedSignaling)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "text/tabwriter"
+
+    "github.com/pion/webrtc/v3"
+)
+
+// formatStats renders the parts of a pion stats report that matter when a
+// connection is slow: which candidate pair won, whether it is relayed, RTT
+// and traffic, plus per data channel counters.
+func formatStats(peerConnection *webrtc.PeerConnection) string {
+    report := peerConnection.GetStats()
+
+    var b strings.Builder
+    w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+
+    fmt.Fprintf(w, "connection state\t%s\n", peerConnection.ConnectionState())
+    fmt.Fprintf(w, "ice state\t%s\n", peerConnection.ICEConnectionState())
+
+    pair, ok := selectedCandidatePair(report)
+    if !ok {
+        fmt.Fprintf(w, "selected pair\t(none)\n")
+    } else {
+        local, _ := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+        remote, _ := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+        relayed := local.CandidateType == webrtc.ICECandidateTypeRelay || remote.CandidateType == webrtc.ICECandidateTypeRelay
+
+        fmt.Fprintf(w, "local candidate\t%s\n", formatCandidate(local))
+        fmt.Fprintf(w, "remote candidate\t%s\n", formatCandidate(remote))
+        fmt.Fprintf(w, "relayed\t%t\n", relayed)
+
+        rtt, sent, received := pairTraffic(report, pair)
+        fmt.Fprintf(w, "rtt\t%.1f ms\n", rtt*1000)
+        fmt.Fprintf(w, "bytes sent\t%d\n", sent)
+        fmt.Fprintf(w, "bytes received\t%d\n", received)
+    }
+    w.Flush()
+
+    channels := []webrtc.DataChannelStats{}
+    for _, s := range report {
+        if dc, ok := s.(webrtc.DataChannelStats); ok {
+            channels = append(channels, dc)
+        }
+    }
+    sort.Slice(channels, func(i, j int) bool {
+        return channels[i].DataChannelIdentifier < channels[j].DataChannelIdentifier
+    })
+
+    b.WriteString("\n")
+    w = tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "channel\tid\tstate\tmsgs sent\tbytes sent\tmsgs recv\tbytes recv")
+    for _, dc := range channels {
+        fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%d\n",
+            dc.Label, dc.DataChannelIdentifier, dc.State,
+            dc.MessagesSent, dc.BytesSent, dc.MessagesReceived, dc.BytesReceived)
+    }
+    w.Flush()
+
+    return b.String()
+}
+
+// selectedCandidatePair finds the nominated, succeeded pair ICE is using.
+func selectedCandidatePair(report webrtc.StatsReport) (webrtc.ICECandidatePairStats, bool) {
+    for _, s := range report {
+        pair, ok := s.(webrtc.ICECandidatePairStats)
+        if ok && pair.Nominated && pair.State == webrtc.StatsICECandidatePairStateSucceeded {
+            return pair, true
+        }
+    }
+    return webrtc.ICECandidatePairStats{}, false
+}
+
+// pairTraffic returns the selected pair's RTT in seconds and its byte
+// counters. pion doesn't always fill in the pair's counters; the ICE and
+// SCTP transports track the same traffic.
+func pairTraffic(report webrtc.StatsReport, pair webrtc.ICECandidatePairStats) (rtt float64, sent, received uint64) {
+    rtt = pair.CurrentRoundTripTime
+    if sctp, ok := report["sctpTransport"].(webrtc.SCTPTransportStats); ok && rtt == 0 {
+        rtt = sctp.SmoothedRoundTripTime
+    }
+    sent, received = pair.BytesSent, pair.BytesReceived
+    if transport, ok := report["iceTransport"].(webrtc.TransportStats); ok && sent == 0 && received == 0 {
+        sent, received = transport.BytesSent, transport.BytesReceived
+    }
+    return rtt, sent, received
+}
+
+func formatCandidate(c webrtc.ICECandidateStats) string {
+    if c.ID == "" {
+        return "(unknown)"
+    }
+    return fmt.Sprintf("%s %s:%d/%s", c.CandidateType, c.IP, c.Port, c.Protocol)
+}
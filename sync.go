@@ -0,0 +1,113 @@
+package main
+
+import (
+    "log"
+    "time"
+)
+
+// Messages sent while the connection was down, or in flight when it went,
+// can be missing on the other side. So when the peers reconnect, and
+// whenever the peer joins, each side sends a sync naming the last message
+// it saw from the other:
+//
+//	{"type":"sync","from":<id>,"ts":<unix ms>,"ref":<message id>}
+//
+// and the other resends from its history whatever it sent after that
+// message, with the original IDs and times. Messages already seen are
+// dropped by ID on arrival. Only peers that list featureSync take part, and
+// a side without history has nothing to resend from.
+const (
+    featureSync   = "sync"
+    maxSyncResend = 100 // messages resent for one sync at most
+)
+
+// SyncHistory asks the peer to resend what we missed.
+func (c *Chat) SyncHistory() {
+    if !c.peerSupports(featureSync) {
+        return
+    }
+    ref := c.lastSeen()
+    if ref == "" {
+        // Nothing to go by; they can't know what we have
+        return
+    }
+    m := newControlMessage(controlSync, c.clientID)
+    m.Ref = ref
+    if err := c.sendControl(m); err != nil {
+        log.Println("同期要求送信エラー: ", err)
+    }
+}
+
+// lastSeen returns the ID of the peer's latest message, from this session
+// or an earlier one.
+func (c *Chat) lastSeen() string {
+    if last, ok := c.recent.lastReceived(); ok {
+        return last.ID
+    }
+    if c.history == nil {
+        return ""
+    }
+    id, err := c.history.LastReceived(c.PeerID())
+    if err != nil {
+        log.Println("履歴読み込みエラー: ", err)
+    }
+    return id
+}
+
+// handleSync resends the messages the peer says it missed. The history
+// is looked up by the ID the peer joined with: a sync claiming to come from
+// anyone else is ignored, so it can't pull out what was sent to them.
+func (c *Chat) handleSync(m *ControlMessage) {
+    if c.history == nil {
+        return
+    }
+    peerID := c.PeerID()
+    if m.From != peerID {
+        log.Printf("Ignoring sync from %q, the peer is %q\n", m.From, peerID)
+        return
+    }
+    // After the outbox, and not before the chat channel is open
+    select {
+    case <-c.ready:
+    case <-time.After(outboxJoinWait):
+        log.Println("Chat channel not open, not resending history")
+        return
+    }
+    entries, err := c.history.SentAfter(peerID, m.Ref, maxSyncResend)
+    if err != nil {
+        log.Println("履歴読み込みエラー: ", err)
+        return
+    }
+    for _, entry := range entries {
+        env := &Envelope{
+            ID:        entry.ID,
+            Type:      entry.Type,
+            Sender:    c.clientID,
+            Timestamp: entry.SentAt.UnixMilli(),
+            Payload:   entry.Body,
+        }
+        if err := c.sendEnvelope(env); err != nil {
+            log.Println("再送エラー: ", err)
+            return
+        }
+    }
+    if len(entries) > 0 {
+        c.display.Printf("[sync] resent %d message(s) %s missed\n", len(entries), displayName(c.PeerName()))
+    }
+}
+
+// alreadySeen reports whether the message with id has arrived before, as a
+// message resent by a sync may have.
+func (c *Chat) alreadySeen(id string) bool {
+    if c.recent.has(id) {
+        return true
+    }
+    if c.history == nil {
+        return false
+    }
+    seen, err := c.history.Has(id)
+    if err != nil {
+        log.Println("履歴読み込みエラー: ", err)
+    }
+    return seen
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSyncHistoryResendsMissedMessages(t *testing.T) {
+    shown := useFakeDisplay(t)
+    alice, bob := newChatPair(t)
+    for _, side := range []*testChat{alice, bob} {
+        history, err := openHistory(filepath.Join(t.TempDir(), "history.db"), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { history.Close() })
+        side.history = history
+    }
+    open(t, shown, alice, bob)
+
+    send := func(text string) {
+        if err := alice.Send([]byte(text)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    send("one\n")
+    eventually(t, "the first message", func() bool { return len(shown.Messages()) == 1 })
+    first := bob.lastSeen()
+    // The link goes down without either side noticing at first
+    alice.data.setDrop(true)
+    send("two\n")
+    send("three\n")
+    alice.data.setDrop(false)
+
+    bob.SyncHistory()
+    eventually(t, "the missed messages", func() bool { return len(shown.Messages()) == 3 })
+    want := []string{"alice: one\n", "alice: two\n", "alice: three\n"}
+    if got := shown.Messages(); !reflect.DeepEqual(got, want) {
+        t.Errorf("bob saw %q, want %q", got, want)
+    }
+    eventually(t, "the resend notice", func() bool { return shown.HasNotice("[sync] resent 2 message(s) bob missed") })
+
+    // A sync claiming to be from someone else gets nothing of theirs
+    for i, body := range []string{"hi carol\n", "for carol only\n"} {
+        entry := HistoryEntry{
+            ID:        fmt.Sprintf("carol-%d", i),
+            PeerID:    "carol-id",
+            SenderID:  "alice-id",
+            Direction: directionOut,
+            Type:      envelopeText,
+            Body:      []byte(body),
+            SentAt:    time.Now(),
+        }
+        if err := alice.history.Record(entry); err != nil {
+            t.Fatal(err)
+        }
+    }
+    alice.handleSync(&ControlMessage{Type: controlSync, From: "carol-id", Ref: "carol-0"})
+    if n := shown.NoticeCount("[sync] resent"); n != 1 {
+        t.Errorf("%d resend notices after a sync from carol, want 1", n)
+    }
+
+    // Resent again, they aren't shown twice
+    alice.handleSync(&ControlMessage{Type: controlSync, From: "bob-id", Ref: first})
+    send("four\n")
+    eventually(t, "the last message", func() bool { return len(shown.Messages()) >= 4 })
+    if got := shown.Messages(); len(got) != 4 || !strings.HasSuffix(got[3], "four\n") {
+        t.Errorf("bob saw %q", got)
+    }
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+)
+
+// watchTerminalSize calls resized whenever the terminal window changes
+// size.
+func watchTerminalSize(resized func()) {
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, syscall.SIGWINCH)
+    for range sigCh {
+        resized()
+    }
+}
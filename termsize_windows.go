@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+// watchTerminalSize does nothing: the console reports resizing as an input
+// event rather than a signal, so the line editor checks the size before
+// each line instead.
+func watchTerminalSize(resized func()) {}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+// In the terminal, the window title names the peer and counts the
+// messages that arrived since anything was last typed, so a chat left in a
+// background tab or window shows there is something new:
+//
+//	(3) alice - webrtc-chat
+//
+// The title is set with an OSC 2 sequence. The one it replaces is pushed
+// on the terminal's title stack first and popped again on exit, where the
+// terminal keeps one. -no-title leaves the title alone.
+const (
+    titleApp      = "webrtc-chat"
+    maxTitlePeer  = 40 // runes of the peer's name kept
+    titlePush     = "\x1b[22;2t"
+    titlePop      = "\x1b[23;2t"
+    titleSetStart = "\x1b]2;"
+    titleSetEnd   = "\a"
+)
+
+// titleDisplay wraps a Display and keeps the window title up to date.
+type titleDisplay struct {
+    Display
+
+    mu        sync.Mutex
+    peerName  string // the name the peer announced
+    peerLabel string // the contact label or ID, until they announce one
+    unread    int
+    shown     string // the title set last, "" before the first
+    closed    bool
+}
+
+func newTitleDisplay(d Display) *titleDisplay {
+    return &titleDisplay{Display: d}
+}
+
+func (t *titleDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    t.Display.PrintMessage(sender, senderID, id, data, isString, sentAt)
+    t.mu.Lock()
+    t.unread++
+    t.update()
+}
+
+func (t *titleDisplay) SetStatus(key, value string) {
+    t.Display.SetStatus(key, value)
+    switch key {
+    case "peer name":
+        t.mu.Lock()
+        t.peerName = value
+        t.update()
+    case "peer":
+        t.mu.Lock()
+        t.peerLabel = value
+        t.update()
+    }
+}
+
+// Seen clears the unread count, for when the user is typing again.
+func (t *titleDisplay) Seen() {
+    t.mu.Lock()
+    if t.unread == 0 {
+        t.mu.Unlock()
+        return
+    }
+    t.unread = 0
+    t.update()
+}
+
+// Close gives the window back the title it had.
+func (t *titleDisplay) Close() {
+    t.mu.Lock()
+    restore := !t.closed && t.shown != ""
+    t.closed = true
+    t.mu.Unlock()
+    if restore {
+        writeTerminalControl(titlePop)
+    }
+    t.Display.Close()
+}
+
+// update sets the title if it changed. It is called with mu held and
+// releases it.
+func (t *titleDisplay) update() {
+    title := formatTitle(t.peerName, t.peerLabel, t.unread)
+    first := t.shown == ""
+    if t.closed || title == t.shown {
+        t.mu.Unlock()
+        return
+    }
+    t.shown = title
+    t.mu.Unlock()
+    if first {
+        writeTerminalControl(titlePush)
+    }
+    writeTerminalControl(titleSetStart + title + titleSetEnd)
+}
+
+// formatTitle makes the window title for a peer known by name or label
+// with unread new messages.
+func formatTitle(name, label string, unread int) string {
+    peer := titleText(name)
+    if peer == "" {
+        peer = titleText(label)
+    }
+    title := titleApp
+    if peer != "" {
+        title = peer + " - " + title
+    }
+    if unread > 0 {
+        title = fmt.Sprintf("(%d) %s", unread, title)
+    }
+    return title
+}
+
+// titleText makes a peer's name safe to put in the title: unlike a message,
+// a title can't show an escaped control character as text, so every one is
+// dropped, and an overlong name is cut short.
+func titleText(s string) string {
+    var b strings.Builder
+    for _, r := range s {
+        switch {
+        case r == '\n' || r == '\t':
+            b.WriteByte(' ')
+        case isUnsafeRune(r), r == utf8.RuneError:
+        default:
+            b.WriteRune(r)
+        }
+    }
+    text := strings.TrimSpace(b.String())
+    if utf8.RuneCountInString(text) > maxTitlePeer {
+        text = string([]rune(text)[:maxTitlePeer-1]) + "…"
+    }
+    return text
+}
+
+// writeTerminalControl writes an escape sequence that doesn't move the
+// cursor, past the line editor's wait for a whole line.
+func writeTerminalControl(seq string) {
+    if editor != nil {
+        editor.WriteControl(seq)
+        return
+    }
+    io.WriteString(terminalErr, seq)
+}
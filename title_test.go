@@ -0,0 +1,42 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTitleCountsUnreadUntilSeen(t *testing.T) {
+    var out bytes.Buffer
+    previous := terminalErr
+    terminalErr = &out
+    defer func() { terminalErr = previous }()
+
+    title := newTitleDisplay(&fakeDisplay{status: map[string]string{}})
+    title.SetStatus("peer", "a1b2c3")
+    title.SetStatus("peer name", "alice\x1b]2;owned\a")
+    title.PrintMessage("alice", "a1", "", []byte("hi"), true, time.Time{})
+    title.PrintMessage("alice", "a1", "", []byte("there"), true, time.Time{})
+    title.Seen()
+    title.Seen()
+    title.Close()
+
+    want := titlePush +
+        "\x1b]2;a1b2c3 - webrtc-chat\a" +
+        "\x1b]2;alice]2;owned - webrtc-chat\a" +
+        "\x1b]2;(1) alice]2;owned - webrtc-chat\a" +
+        "\x1b]2;(2) alice]2;owned - webrtc-chat\a" +
+        "\x1b]2;alice]2;owned - webrtc-chat\a" +
+        titlePop
+    if got := out.String(); got != want {
+        t.Errorf("the title was set with\n%q\nwant\n%q", got, want)
+    }
+}
+
+func TestTitleTextCutsLongNames(t *testing.T) {
+    got := titleText(strings.Repeat("あ", 50))
+    if want := strings.Repeat("あ", maxTitlePeer-1) + "…"; got != want {
+        t.Errorf("titleText cut a long name to %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gdamore/tcell/v2"
+    "github.com/rivo/tview"
+)
+
+const tuiSidebarWidth = 32
+
+var tuiMarkdown = markdownStyle{
+    bold:   [2]string{"[::b]", "[::B]"},
+    italic: [2]string{"[::i]", "[::I]"},
+    code:   [2]string{"[teal]", "[-]"},
+    link:   [2]string{"[::u]", "[::U]"},
+    escape: tview.Escape,
+}
+
+var tuiMention = [2]string{"[black:yellow]", "[-:-]"}
+
+// tuiDisplay is the full-screen interface enabled with --tui: a scrollable
+// message pane, an input box and a status sidebar.
+type tuiDisplay struct {
+    app      *tview.Application
+    messages *tview.TextView
+    sidebar  *tview.TextView
+    input    *tview.InputField
+
+    mu       sync.Mutex
+    screen   tcell.Screen // set once the application has drawn
+    status   map[string]string
+    progress map[string]string
+    closed   bool
+}
+
+// newTUIDisplay builds the interface. onInput receives each line the user
+// submits, with a trailing newline like lines read from stdin.
+func newTUIDisplay(onInput func(line []byte)) *tuiDisplay {
+    t := &tuiDisplay{
+        app:      tview.NewApplication(),
+        status:   map[string]string{},
+        progress: map[string]string{},
+    }
+
+    t.messages = tview.NewTextView().
+        SetDynamicColors(true).
+        SetScrollable(true).
+        SetWrap(true)
+    t.messages.SetBorder(true).SetTitle(" webrtc-chat ")
+
+    t.sidebar = tview.NewTextView().SetWrap(true)
+    t.sidebar.SetBorder(true).SetTitle(" Status ")
+
+    t.input = tview.NewInputField().SetLabel("> ")
+    t.input.SetDoneFunc(func(key tcell.Key) {
+        if key != tcell.KeyEnter {
+            return
+        }
+        line := t.input.GetText()
+        if line == "" {
+            return
+        }
+        t.input.SetText("")
+        onInput([]byte(line + "\n"))
+    })
+
+    // PageUp/PageDown scroll the message pane without leaving the input box
+    t.input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+        switch event.Key() {
+        case tcell.KeyPgUp, tcell.KeyPgDn:
+            t.messages.InputHandler()(event, nil)
+            return nil
+        }
+        return event
+    })
+
+    main := tview.NewFlex().SetDirection(tview.FlexRow).
+        AddItem(t.messages, 0, 1, false).
+        AddItem(t.input, 1, 0, true)
+    root := tview.NewFlex().
+        AddItem(main, 0, 1, true).
+        AddItem(t.sidebar, tuiSidebarWidth, 0, false)
+    t.app.SetRoot(root, true).SetFocus(t.input)
+    t.app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
+        t.mu.Lock()
+        t.screen = screen
+        t.mu.Unlock()
+        return false
+    })
+    return t
+}
+
+// Run blocks until the user quits with Ctrl-C or Close is called.
+func (t *tuiDisplay) Run() error {
+    return t.app.Run()
+}
+
+// Write lets the TUI act as the log output so -log doesn't scribble over
+// the screen.
+func (t *tuiDisplay) Write(p []byte) (int, error) {
+    t.appendText("[gray]" + tview.Escape(sanitizeText(string(p))) + "[-]")
+    return len(p), nil
+}
+
+func (t *tuiDisplay) PrintMessage(sender, senderID, id string, data []byte, isString bool, sentAt time.Time) {
+    prefix := "[gray]" + tview.Escape(messagePrefix(id, sentAt)) + "[-]"
+    if sender != "" {
+        prefix += tuiPeerName(senderID, tview.Escape(sanitizeText(sender))) + ": "
+    }
+    if !isString {
+        t.appendText(fmt.Sprintf("%s[yellow]<binary message, %d bytes>[-]\n", prefix, len(data)))
+        return
+    }
+    t.appendText(prefix + styleMessage(ensureNewline(sanitizeText(string(data))), tuiMarkdown, tuiMention))
+}
+
+func (t *tuiDisplay) PrintSent(id string, data []byte, sentAt time.Time) {
+    t.appendText("[gray]" + tview.Escape(messagePrefix(id, sentAt)) + "[-][green]> " + tview.Escape(ensureNewline(string(data))) + "[-]")
+}
+
+func (t *tuiDisplay) Printf(format string, args ...interface{}) {
+    t.appendText("[aqua]" + tview.Escape(ensureNewline(fmt.Sprintf(format, sanitizeArgs(args)...))) + "[-]")
+}
+
+func (t *tuiDisplay) Error(text string) {
+    t.appendText("[red]" + tview.Escape(ensureNewline(sanitizeText(text))) + "[-]")
+}
+
+func (t *tuiDisplay) Progress(key, line string, done bool) {
+    t.mu.Lock()
+    if done {
+        delete(t.progress, key)
+    } else {
+        t.progress[key] = sanitizeText(line)
+    }
+    t.mu.Unlock()
+    t.redrawSidebar()
+    if done {
+        t.Printf("%s\n", line)
+    }
+}
+
+func (t *tuiDisplay) SetStatus(key, value string) {
+    t.mu.Lock()
+    t.status[key] = sanitizeText(value)
+    t.mu.Unlock()
+    t.redrawSidebar()
+}
+
+// Alert beeps, or with visual flashes the message pane's border.
+func (t *tuiDisplay) Alert(visual bool) {
+    if !visual {
+        t.mu.Lock()
+        screen := t.screen
+        t.mu.Unlock()
+        if screen != nil {
+            screen.Beep()
+        }
+        return
+    }
+    t.app.QueueUpdateDraw(func() {
+        t.messages.SetBorderColor(tcell.ColorYellow)
+    })
+    time.AfterFunc(300*time.Millisecond, func() {
+        t.app.QueueUpdateDraw(func() {
+            t.messages.SetBorderColor(tview.Styles.BorderColor)
+        })
+    })
+}
+
+func (t *tuiDisplay) Close() {
+    t.mu.Lock()
+    closed := t.closed
+    t.closed = true
+    t.mu.Unlock()
+    if !closed {
+        t.app.Stop()
+    }
+}
+
+func (t *tuiDisplay) appendText(text string) {
+    t.app.QueueUpdateDraw(func() {
+        fmt.Fprint(t.messages, text)
+        t.messages.ScrollToEnd()
+    })
+}
+
+func (t *tuiDisplay) redrawSidebar() {
+    t.mu.Lock()
+    var b strings.Builder
+    for _, key := range sortedKeys(t.status) {
+        fmt.Fprintf(&b, "%s:\n  %s\n", key, t.status[key])
+    }
+    if len(t.progress) > 0 {
+        b.WriteString("\ntransfers:\n")
+        for _, key := range sortedKeys(t.progress) {
+            fmt.Fprintf(&b, "  %s\n", t.progress[key])
+        }
+    }
+    text := b.String()
+    t.mu.Unlock()
+
+    t.app.QueueUpdateDraw(func() {
+        t.sidebar.SetText(text)
+    })
+}
+
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func ensureNewline(s string) string {
+    if strings.HasSuffix(s, "\n") {
+        return s
+    }
+    return s + "\n"
+}
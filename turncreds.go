@@ -0,0 +1,241 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+)
+
+const (
+    turnCredentialsTimeout = 10 * time.Second
+    // Credentials are fetched again when this much of their lifetime is
+    // left, and never more often than turnCredentialsMinRefresh.
+    turnCredentialsRefreshMargin = 0.25
+    turnCredentialsMinRefresh    = 30 * time.Second
+)
+
+// TURNCredentialsConfig says where short-lived TURN credentials come from,
+// either URL or Command.
+//
+// URL is an HTTP endpoint such as a TURN REST API service for coturn's
+// use-auth-secret or Twilio's Network Traversal Service. AuthToken is sent
+// as a bearer token; basic auth credentials can go in the URL instead.
+// Method is GET, the default, or POST.
+//
+// Command is run instead, for credentials that take more than a request to
+// get (a single sign-on helper, a cloud CLI). It prints the same JSON an
+// endpoint would answer with on stdout.
+type TURNCredentialsConfig struct {
+    URL       string   `json:"url,omitempty"`
+    Method    string   `json:"method,omitempty"`
+    AuthToken string   `json:"auth_token,omitempty"`
+    Command   []string `json:"command,omitempty"`
+}
+
+// turnCredentialProvider hands out TURN servers with fresh credentials and
+// how long those last, zero if unknown.
+type turnCredentialProvider interface {
+    Fetch() ([]ICEServer, time.Duration, error)
+}
+
+// newTURNCredentialProvider returns the provider config describes, or nil
+// if there is none.
+func newTURNCredentialProvider(config TURNCredentialsConfig, options SignalingOptions) turnCredentialProvider {
+    switch {
+    case config.URL != "":
+        return httpCredentialProvider{config: config, options: options}
+    case len(config.Command) > 0:
+        return commandCredentialProvider{command: config.Command}
+    }
+    return nil
+}
+
+type httpCredentialProvider struct {
+    config  TURNCredentialsConfig
+    options SignalingOptions
+}
+
+func (p httpCredentialProvider) Fetch() ([]ICEServer, time.Duration, error) {
+    return fetchTURNCredentials(p.config, p.options)
+}
+
+type commandCredentialProvider struct {
+    command []string
+}
+
+func (p commandCredentialProvider) Fetch() ([]ICEServer, time.Duration, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), turnCredentialsTimeout)
+    defer cancel()
+    var stdout bytes.Buffer
+    cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+    cmd.Stdout = &stdout
+    // Helpers may need to ask the user something, such as to log in
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return nil, 0, fmt.Errorf("%s: %w", p.command[0], err)
+    }
+    return parseTURNCredentials(stdout.Bytes())
+}
+
+// turnCredentialsResponse accepts both common answers: the TURN REST API's
+// username, password and uris, or a list of ICE servers (Twilio's
+// ice_servers, or iceServers). ttl is in seconds, a number or a string.
+// A server's credential is a password, or with credentialType "oauth" an
+// RTCOAuthCredential object ({"macKey": ..., "accessToken": ...}).
+type turnCredentialsResponse struct {
+    Username   string                 `json:"username"`
+    Password   string                 `json:"password"`
+    URIs       []string               `json:"uris"`
+    ICEServers []turnCredentialServer `json:"ice_servers"`
+    // Browser-style responses
+    ICEServersCamel []turnCredentialServer `json:"iceServers"`
+    TTL             json.Number            `json:"ttl"`
+}
+
+type turnCredentialServer struct {
+    URLs           stringList      `json:"urls"`
+    URL            string          `json:"url"` // older Twilio responses
+    Username       string          `json:"username"`
+    Credential     json.RawMessage `json:"credential"`
+    CredentialType string          `json:"credentialType"`
+}
+
+// iceServer converts the response's description of a server.
+func (s turnCredentialServer) iceServer() (ICEServer, error) {
+    server := ICEServer{URLs: s.URLs, Username: s.Username, CredentialType: s.CredentialType}
+    if len(server.URLs) == 0 && s.URL != "" {
+        server.URLs = stringList{s.URL}
+    }
+    if len(s.Credential) == 0 {
+        return server, nil
+    }
+    if s.CredentialType == "oauth" {
+        var oauth struct {
+            MACKey      string `json:"macKey"`
+            AccessToken string `json:"accessToken"`
+        }
+        if err := json.Unmarshal(s.Credential, &oauth); err != nil {
+            return server, fmt.Errorf("invalid OAuth credential: %w", err)
+        }
+        server.MACKey, server.AccessToken = oauth.MACKey, oauth.AccessToken
+        return server, nil
+    }
+    if err := json.Unmarshal(s.Credential, &server.Credential); err != nil {
+        return server, fmt.Errorf("invalid credential: %w", err)
+    }
+    return server, nil
+}
+
+// fetchTURNCredentials asks the endpoint for credentials and returns the
+// servers they are for and how long they last, zero if the endpoint didn't
+// say.
+func fetchTURNCredentials(config TURNCredentialsConfig, options SignalingOptions) ([]ICEServer, time.Duration, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = options.TLSConfig
+    if options.Proxy != nil {
+        transport.Proxy = http.ProxyURL(options.Proxy)
+    }
+    client := &http.Client{Transport: transport, Timeout: turnCredentialsTimeout}
+
+    method := config.Method
+    if method == "" {
+        method = http.MethodGet
+    }
+    req, err := http.NewRequest(method, config.URL, nil)
+    if err != nil {
+        return nil, 0, err
+    }
+    if config.AuthToken != "" {
+        req.Header.Set("Authorization", "Bearer "+config.AuthToken)
+    }
+    req.Header.Set("Accept", "application/json")
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return nil, 0, err
+    }
+    if resp.StatusCode/100 != 2 {
+        return nil, 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    return parseTURNCredentials(body)
+}
+
+func parseTURNCredentials(body []byte) ([]ICEServer, time.Duration, error) {
+    var response turnCredentialsResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, 0, fmt.Errorf("invalid response: %w", err)
+    }
+
+    var servers []ICEServer
+    if len(response.URIs) > 0 {
+        servers = append(servers, ICEServer{URLs: response.URIs, Username: response.Username, Credential: response.Password})
+    }
+    for _, s := range append(response.ICEServers, response.ICEServersCamel...) {
+        server, err := s.iceServer()
+        if err != nil {
+            return nil, 0, err
+        }
+        if len(server.URLs) > 0 {
+            servers = append(servers, server)
+        }
+    }
+    if len(servers) == 0 {
+        return nil, 0, errors.New("the response lists no servers")
+    }
+
+    var ttl time.Duration
+    if response.TTL != "" {
+        seconds, err := response.TTL.Int64()
+        if err != nil {
+            return nil, 0, fmt.Errorf("invalid ttl %q", response.TTL)
+        }
+        ttl = time.Duration(seconds) * time.Second
+    }
+    return servers, ttl, nil
+}
+
+// refreshTURNCredentials fetches new credentials before the old ones run
+// out and puts them in the peer connection's configuration. pion hands the
+// server list to the ICE agent when the connection is created, so an agent
+// already running keeps the relays it has allocated; the fresh credentials
+// are what any later agent for this connection starts with.
+func refreshTURNCredentials(peerConnection *webrtc.PeerConnection, config Config, provider turnCredentialProvider, ttl time.Duration) {
+    for ttl > 0 && !shuttingDown.Load() {
+        wait := time.Duration(float64(ttl) * (1 - turnCredentialsRefreshMargin))
+        if wait < turnCredentialsMinRefresh {
+            wait = turnCredentialsMinRefresh
+        }
+        time.Sleep(wait)
+
+        servers, next, err := provider.Fetch()
+        if err != nil {
+            log.Println("TURN認証情報更新エラー: ", err)
+            // Try again well before the old ones expire, if there is time
+            ttl = max(ttl-wait, turnCredentialsMinRefresh)
+            continue
+        }
+        configuration := peerConnection.GetConfiguration()
+        configuration.ICEServers = iceServersFor(config, servers)
+        if err := peerConnection.SetConfiguration(configuration); err != nil {
+            log.Println("ICE設定更新エラー: ", err)
+        } else {
+            log.Printf("TURN credentials refreshed, valid for %s\n", next)
+        }
+        ttl = next
+    }
+}
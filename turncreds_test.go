@@ -0,0 +1,91 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os/exec"
+    "testing"
+    "time"
+)
+
+func TestParseTURNCredentials(t *testing.T) {
+    tests := []struct {
+        name     string
+        body     string
+        username string
+        urls     int
+        ttl      time.Duration
+    }{
+        {"TURN REST API", `{"username": "1700000000:alice", "password": "secret", "ttl": 86400, "uris": ["turn:turn.example.com:3478?transport=udp", "turn:turn.example.com:3478?transport=tcp"]}`, "1700000000:alice", 2, 24 * time.Hour},
+        {"Twilio", `{"ttl": "3600", "ice_servers": [{"url": "stun:global.stun.twilio.com:3478"}, {"urls": "turn:global.turn.twilio.com:3478", "username": "u", "credential": "p"}]}`, "", 1, time.Hour},
+        {"iceServers without ttl", `{"iceServers": [{"urls": ["turn:relay.example"], "username": "u", "credential": "p"}]}`, "u", 1, 0},
+    }
+    for _, test := range tests {
+        servers, ttl, err := parseTURNCredentials([]byte(test.body))
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if servers[0].Username != test.username || len(servers[0].URLs) != test.urls || ttl != test.ttl {
+            t.Errorf("%s: got %+v, ttl %s", test.name, servers, ttl)
+        }
+    }
+
+    if _, _, err := parseTURNCredentials([]byte(`{"ttl": 60}`)); err == nil {
+        t.Error("a response without servers was accepted")
+    }
+
+    oauth := `{"iceServers": [{"urls": "turn:relay.example", "username": "kid", "credentialType": "oauth", "credential": {"macKey": "mac", "accessToken": "token"}}]}`
+    servers, _, err := parseTURNCredentials([]byte(oauth))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if servers[0].CredentialType != "oauth" || servers[0].MACKey != "mac" || servers[0].AccessToken != "token" || servers[0].Credential != "" {
+        t.Errorf("OAuth credential: got %+v", servers[0])
+    }
+}
+
+func TestCommandCredentialProvider(t *testing.T) {
+    if _, err := exec.LookPath("sh"); err != nil {
+        t.Skip("no shell")
+    }
+    config := TURNCredentialsConfig{Command: []string{"sh", "-c", `echo '{"username": "u", "password": "p", "ttl": 60, "uris": ["turn:relay.example"]}'`}}
+    provider := newTURNCredentialProvider(config, SignalingOptions{})
+    servers, ttl, err := provider.Fetch()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(servers) != 1 || servers[0].Credential != "p" || ttl != time.Minute {
+        t.Errorf("got %+v, ttl %s", servers, ttl)
+    }
+
+    failing := newTURNCredentialProvider(TURNCredentialsConfig{Command: []string{"sh", "-c", "exit 3"}}, SignalingOptions{})
+    if _, _, err := failing.Fetch(); err == nil {
+        t.Error("a failing command succeeded")
+    }
+    if newTURNCredentialProvider(TURNCredentialsConfig{}, SignalingOptions{}) != nil {
+        t.Error("got a provider without a url or command")
+    }
+}
+
+func TestFetchTURNCredentials(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+            http.Error(w, "nope", http.StatusUnauthorized)
+            return
+        }
+        w.Write([]byte(`{"username": "u", "password": "p", "ttl": 600, "uris": ["turn:relay.example"]}`))
+    }))
+    defer server.Close()
+
+    servers, ttl, err := fetchTURNCredentials(TURNCredentialsConfig{URL: server.URL, Method: "POST", AuthToken: "token"}, SignalingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(servers) != 1 || servers[0].Credential != "p" || ttl != 10*time.Minute {
+        t.Errorf("got %+v, ttl %s", servers, ttl)
+    }
+    if _, _, err := fetchTURNCredentials(TURNCredentialsConfig{URL: server.URL}, SignalingOptions{}); err == nil {
+        t.Error("a refused request succeeded")
+    }
+}
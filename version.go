@@ -0,0 +1,39 @@
+package main
+
+import (
+    "runtime"
+    "runtime/debug"
+)
+
+// version is the release this binary was built as, set with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+//
+// Without it the module version or VCS revision Go recorded is used.
+var version = ""
+
+// clientVersion names this build, as sent to the peer in the join.
+func clientVersion() string {
+    if version != "" {
+        return "webrtc-chat " + version
+    }
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return "webrtc-chat (unknown)"
+    }
+    v := info.Main.Version
+    if v == "" || v == "(devel)" {
+        v = "devel"
+        for _, setting := range info.Settings {
+            if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+                v += " " + setting.Value[:12]
+            }
+        }
+    }
+    return "webrtc-chat " + v
+}
+
+// clientPlatform is the OS and architecture this build runs on.
+func clientPlatform() string {
+    return runtime.GOOS + "/" + runtime.GOARCH
+}
@@ -0,0 +1,35 @@
+package main
+
+// /msg sends a line to one peer without switching to their conversation.
+// It goes as a text envelope with the private flag set, which the receiver
+// shows next to the sender's name. Peers that don't list featurePrivate
+// would show it as an ordinary message, so for them the mark goes in the
+// text instead.
+const (
+    featurePrivate = "private"
+    privateMark    = "[private] "
+)
+
+// SendPrivate sends text to the peer marked as private. Unlike Send it
+// doesn't queue: a whisper to someone not connected fails.
+func (c *Chat) SendPrivate(text []byte) error {
+    if !c.Connected() {
+        return errNotConnected
+    }
+    env := newEnvelope(envelopeText, c.clientID, text)
+    env.Private = true
+    if !c.peerSupports(featurePrivate) {
+        env.Payload = append([]byte(privateMark), text...)
+    }
+    if err := c.sendEnvelope(env); err != nil {
+        return err
+    }
+    c.recent.add(env.ID, true, text)
+    c.record(env, directionOut)
+    return nil
+}
+
+// privateSender is how the sender of a private message is shown.
+func privateSender(name string) string {
+    return displayName(name) + " (private)"
+}
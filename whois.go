@@ -0,0 +1,46 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "text/tabwriter"
+)
+
+// PeerInfo is what the peer said about itself in its join, for /whois.
+type PeerInfo struct {
+    ID       string
+    Name     string
+    Client   string // client name and version, such as "webrtc-chat v1.2.3"
+    Platform string // OS/architecture
+    Version  int    // the peer protocol version agreed on
+    Features []string
+}
+
+// formatPeerInfo renders info for /whois, with the peer's certificate
+// fingerprint when it is known.
+func formatPeerInfo(info PeerInfo, fingerprint string) string {
+    unknown := func(s string) string {
+        if s == "" {
+            return "(unknown)"
+        }
+        return s
+    }
+
+    var b strings.Builder
+    w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(w, "id\t%s\n", info.ID)
+    fmt.Fprintf(w, "code\t%s\n", peerCode(info.ID))
+    fmt.Fprintf(w, "name\t%s\n", unknown(info.Name))
+    if alias := contacts.Alias(info.ID); alias != "" {
+        fmt.Fprintf(w, "alias\t%s\n", alias)
+    }
+    fmt.Fprintf(w, "client\t%s\n", unknown(info.Client))
+    fmt.Fprintf(w, "platform\t%s\n", unknown(info.Platform))
+    fmt.Fprintf(w, "protocol\tv%d\n", info.Version)
+    fmt.Fprintf(w, "features\t%s\n", unknown(strings.Join(info.Features, ", ")))
+    if fingerprint != "" {
+        fmt.Fprintf(w, "fingerprint\t%s\n", fingerprint)
+    }
+    w.Flush()
+    return b.String()
+}